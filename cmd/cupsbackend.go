@@ -0,0 +1,365 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/quantamhd/gu/utils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/term"
+)
+
+// Exit statuses of a CUPS backend, from cups/backend.h.
+const (
+	backendOK           = 0
+	backendFailed       = 1
+	backendAuthRequired = 2
+	backendHold         = 3
+	backendStop         = 4
+	backendCancel       = 5
+	backendRetry        = 6
+)
+
+// backendScheme is the URI scheme of gu queues, and the name of the backend
+// executable CUPS runs for them.
+const backendScheme = "gu"
+
+/*
+Returns the device URI of printer on the current server,
+gu://<server host>/<printer name>.
+*/
+func backendURI(printer utils.PaperCutPrinter) string {
+	return backendScheme + "://" + serverHostPort() + "/" + url.PathEscape(strings.TrimSpace(printer.GetName()))
+}
+
+// serverHostPort is the host and port of the current PaperCut server.
+func serverHostPort() string {
+	u, err := url.Parse(utils.BaseURL)
+	if err != nil || u.Host == "" {
+		return utils.BaseURL
+	}
+	return u.Host
+}
+
+/*
+Writes a status line for CUPS to stderr, such as "STATE: +connecting-to-device"
+or "ERROR: ...".
+*/
+func backendLog(prefix string, message string) {
+	fmt.Fprintln(os.Stderr, prefix+": "+message)
+}
+
+// Reports message as an error and returns status.
+func backendError(status int, message string) int {
+	backendLog("ERROR", message)
+	return status
+}
+
+/*
+Points gu at the server named by the host of a device URI: the current
+server if it matches, otherwise the profile whose URL has that host, and
+otherwise https://<host>.
+*/
+func useBackendServer(host string) {
+	if host == serverHostPort() {
+		return
+	}
+
+	names := []string{}
+	for name := range viper.GetStringMap("profiles") {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		u, err := url.Parse(viper.GetString("profiles." + name + ".url"))
+		if err == nil && u.Host == host {
+			useProfile(name)
+			useAuth()
+			initTransport()
+			return
+		}
+	}
+
+	utils.BaseURL = "https://" + host
+}
+
+/*
+Returns the username and password CUPS passes in AUTH_USERNAME and
+AUTH_PASSWORD for queues with auth-info-required set. The profile username
+is used when AUTH_USERNAME is empty.
+*/
+func backendCredentials() (string, string, bool) {
+	username := os.Getenv("AUTH_USERNAME")
+	if username == "" {
+		username = activeProfile.Username
+	}
+	password := os.Getenv("AUTH_PASSWORD")
+
+	return username, password, username != "" && password != ""
+}
+
+// isTerminal reports whether f is an interactive terminal.
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+/*
+Lists a device line for every PaperCut printer, as CUPS expects from a
+backend run without arguments. Without credentials only the generic gu
+device is listed, unless run from a terminal, where they are asked for.
+*/
+func listBackendDevices() {
+	username, password, ok := backendCredentials()
+	if !ok && isTerminal(os.Stdin) {
+		username, password = askCredentials()
+		ok = true
+	}
+	if !ok {
+		fmt.Println(`network ` + backendScheme + ` "Unknown" "PaperCut web print (gu)"`)
+		return
+	}
+
+	ctx := context.Background()
+	credentials, err := utils.CreatePaperCutCredentials(ctx, username, password)
+	if err != nil || !credentials.IsLoggedIn() {
+		fmt.Println(`network ` + backendScheme + ` "Unknown" "PaperCut web print (gu)"`)
+		return
+	}
+	printers, err := utils.GetPaperCutPrinters(ctx, credentials)
+	if err != nil {
+		os.Exit(backendError(backendFailed, "Could not list printers: "+err.Error()))
+	}
+
+	ids := []int{}
+	for id := range printers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		p := printers[id]
+		name := strings.TrimSpace(p.GetName())
+		fmt.Printf("network %s \"PaperCut Web Print\" %s \"MFG:PaperCut;MDL:Web Print;CMD:PDF;\" %s\n",
+			backendURI(p), strconv.Quote(name+" (gu)"), strconv.Quote(strings.TrimSpace(p.GetLocation())))
+	}
+}
+
+// backendBooleans are the boolean CUPS options that "noname" turns off.
+var backendBooleans = map[string]bool{
+	"collate":     true,
+	"fit-to-page": true,
+	"landscape":   true,
+	"mirror":      true,
+	"prettyprint": true,
+	"wrap":        true,
+}
+
+/*
+Parses the options argument of a CUPS backend, "name=value name2 ...",
+into a map. Options without a value are set to "true", and "noname" to
+"false" when name is a known boolean option.
+*/
+func parseBackendOptions(options string) map[string]string {
+	parsed := map[string]string{}
+	for _, field := range strings.Fields(options) {
+		if i := strings.Index(field, "="); i >= 0 {
+			parsed[field[:i]] = field[i+1:]
+		} else if strings.HasPrefix(field, "no") && backendBooleans[field[2:]] {
+			parsed[field[2:]] = "false"
+		} else {
+			parsed[field] = "true"
+		}
+	}
+	return parsed
+}
+
+/*
+Works out the number of copies of a job from its arguments, job-id user
+title copies options [file]. A document on stdin has been through the
+CUPS filters, which made the copies already, so it is printed once.
+Options PaperCut web print has no setting for are logged and ignored.
+*/
+func backendCopies(args []string) (int, error) {
+	options := parseBackendOptions(args[4])
+	copies, err := strconv.Atoi(args[3])
+	if err != nil || copies < 1 {
+		return 0, errors.New("Invalid number of copies: " + args[3])
+	}
+	if value, ok := options["copies"]; ok {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			copies = n
+		}
+	}
+	if len(args) == 5 {
+		copies = 1
+	}
+
+	names := []string{}
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name != "copies" {
+			backendLog("DEBUG", "Ignoring option "+name+"="+options[name]+", PaperCut web print has no setting for it")
+		}
+	}
+
+	return copies, nil
+}
+
+/*
+Prints one job: job-id user title copies options [file]. The document is
+read from file or stdin and sent to the printer named by DEVICE_URI.
+Returns the exit status for CUPS.
+*/
+func runBackendJob(args []string) int {
+	jobID, user, title := args[0], args[1], args[2]
+	copies, err := backendCopies(args)
+	if err != nil {
+		return backendError(backendCancel, err.Error())
+	}
+
+	device, err := url.Parse(os.Getenv("DEVICE_URI"))
+	if err != nil || device.Scheme != backendScheme || device.Host == "" {
+		return backendError(backendStop, "DEVICE_URI must look like "+backendScheme+"://<server>/<printer>, not \""+os.Getenv("DEVICE_URI")+"\"")
+	}
+	printerName := strings.TrimPrefix(device.Path, "/")
+	useBackendServer(device.Host)
+
+	username, password, ok := backendCredentials()
+	if !ok {
+		fmt.Fprintln(os.Stderr, "ATTR: auth-info-required=username,password")
+		return backendError(backendAuthRequired, "A PaperCut username and password are needed for "+utils.BaseURL)
+	}
+
+	var in io.Reader = os.Stdin
+	if len(args) == 6 {
+		file, err := os.Open(args[5])
+		if err != nil {
+			return backendError(backendCancel, err.Error())
+		}
+		defer file.Close()
+		in = file
+	}
+
+	path, err := utils.SaveDocument(in, title)
+	if err != nil {
+		return backendError(backendFailed, "Could not read the document: "+err.Error())
+	}
+	defer os.RemoveAll(filepath.Dir(path))
+
+	if err := utils.CheckDocument(path); err != nil {
+		return backendError(backendCancel, "Cannot print "+title+": "+err.Error())
+	}
+
+	// CUPS sends SIGTERM when the job is cancelled.
+	ctx, stop := trapInterrupt(context.Background())
+	defer stop()
+
+	backendLog("STATE", "+connecting-to-device")
+	backendLog("INFO", "Logging in to "+utils.BaseURL+" as "+username)
+	credentials, err := utils.CreatePaperCutCredentials(ctx, username, password)
+	if err != nil {
+		return backendError(backendStatus(ctx, err), "Could not connect to "+utils.BaseURL+": "+err.Error())
+	}
+	if !credentials.IsLoggedIn() {
+		fmt.Fprintln(os.Stderr, "ATTR: auth-info-required=username,password")
+		return backendError(backendAuthRequired, "PaperCut did not accept the password of "+username)
+	}
+
+	printers, err := utils.GetPaperCutPrinters(ctx, credentials)
+	if err != nil {
+		return backendError(backendStatus(ctx, err), "Could not list printers: "+err.Error())
+	}
+	id, ok := utils.FindPrinter(printers, printerName)
+	if !ok {
+		return backendError(backendStop, "No printer called "+printerName+" at "+utils.BaseURL)
+	}
+	printer := printers[id]
+	backendLog("STATE", "-connecting-to-device")
+
+	backendLog("INFO", "Sending "+title+" ("+strconv.Itoa(copies)+" copies) to "+printer.GetName())
+	job, err := utils.SubmitPrintJob(ctx, credentials, &printer, copies, path)
+	if err != nil {
+		return backendError(backendStatus(ctx, err), "Could not print "+title+": "+err.Error())
+	}
+
+	backendLog("INFO", "Job "+jobID+" from "+user+" is PaperCut job "+job.GetJobID()+": "+job.GetStatus())
+	return backendOK
+}
+
+/*
+Picks the exit status for a failed job: cancelled jobs stay cancelled,
+transient failures are retried later and anything else fails the job.
+*/
+func backendStatus(ctx context.Context, err error) int {
+	switch {
+	case ctx.Err() != nil:
+		return backendCancel
+	case errors.Is(err, utils.ErrSessionExpired):
+		return backendRetry
+	case utils.IsTemporary(err):
+		return backendRetry
+	}
+	return backendFailed
+}
+
+// cupsBackendCmd represents the cups-backend command
+var cupsBackendCmd = &cobra.Command{
+	Use:   "cups-backend [job-id user title copies options [file]]",
+	Short: "Runs as a CUPS backend that prints to PaperCut web print",
+	Long: `This command follows the CUPS backend contract, so that CUPS queues
+with a gu:// device URI print through PaperCut web print. CUPS runs
+backends by their URI scheme, so install a small wrapper called gu in the
+CUPS backend directory, owned by root and not writable by others:
+
+#!/bin/sh
+exec /usr/local/bin/gu cups-backend -- "$@"
+
+Run without arguments, it lists a "network gu://<server>/<printer>" device
+for every PaperCut printer, for lpinfo -v and printer setup tools. It logs
+in with AUTH_USERNAME and AUTH_PASSWORD, or asks when run from a terminal.
+
+Run by CUPS with job-id user title copies options [file], it reads the
+document from file or stdin and sends it to the printer in DEVICE_URI.
+Set auth-info-required on the queue so that CUPS asks for the PaperCut
+username and password:
+
+lpadmin -p library-bw -E -v gu://paper-app.gonzaga.edu:9192/library-bw \
+  -m lsb/usr/cupsfilters/Generic-PDF_Printer-PDF.ppd \
+  -o auth-info-required=username,password
+
+When CUPS passes a file, the copies argument, or a copies option, sets
+the number of copies; a document on stdin has been through the CUPS
+filters, which made the copies already, and is sent once. Other options
+have no equivalent in web print and are ignored. Status is
+reported on stderr with STATE:, INFO: and ERROR: lines, and the exit
+status tells CUPS whether to retry, hold the queue or cancel the job.
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		switch len(args) {
+		case 0:
+			listBackendDevices()
+		case 5, 6:
+			os.Exit(runBackendJob(args))
+		default:
+			fmt.Fprintln(os.Stderr, "Usage: gu cups-backend job-id user title copies options [file]")
+			os.Exit(backendFailed)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(cupsBackendCmd)
+}
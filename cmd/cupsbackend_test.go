@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBackendOptions(t *testing.T) {
+	tests := []struct {
+		options string
+		want    map[string]string
+	}{
+		{"", map[string]string{}},
+		{"copies=2 media=a4", map[string]string{"copies": "2", "media": "a4"}},
+		{"collate nolandscape", map[string]string{"collate": "true", "landscape": "false"}},
+		{"normal notify-me", map[string]string{"normal": "true", "notify-me": "true"}},
+		{"noprettyprint=x", map[string]string{"noprettyprint": "x"}},
+	}
+
+	for _, test := range tests {
+		if got := parseBackendOptions(test.options); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseBackendOptions(%q) = %v, want %v", test.options, got, test.want)
+		}
+	}
+}
+
+func TestBackendCopies(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"file", []string{"1", "student", "essay", "3", "", "essay.pdf"}, 3},
+		{"copies option", []string{"1", "student", "essay", "1", "copies=2", "essay.pdf"}, 2},
+		{"stdin", []string{"1", "student", "essay", "3", ""}, 1},
+		{"stdin with copies option", []string{"1", "student", "essay", "3", "copies=2"}, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := backendCopies(test.args)
+			if err != nil || got != test.want {
+				t.Errorf("backendCopies = %d, %v; want %d", got, err, test.want)
+			}
+		})
+	}
+
+	for _, copies := range []string{"0", "-1", "two"} {
+		if _, err := backendCopies([]string{"1", "student", "essay", copies, "", "essay.pdf"}); err == nil {
+			t.Errorf("%s copies were accepted", copies)
+		}
+	}
+}
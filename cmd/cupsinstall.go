@@ -0,0 +1,384 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/quantamhd/gu/utils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cupsDryRun     bool
+	cupsBackendDir string
+)
+
+// cupsQueuePrefix starts the name of every queue gu cups-install adds.
+const cupsQueuePrefix = "gu-"
+
+/*
+cupsPPD describes a generic PDF printer. Documents reach the backend as
+PDF, and cupsManualCopies False leaves copies to the backend, which asks
+PaperCut for them instead of repeating the pages.
+*/
+const cupsPPD = `*PPD-Adobe: "4.3"
+*FormatVersion: "4.3"
+*FileVersion: "1.0"
+*LanguageVersion: English
+*LanguageEncoding: ISOLatin1
+*PCFileName: "GUPDF.PPD"
+*Manufacturer: "PaperCut"
+*Product: "(PaperCut Web Print)"
+*ModelName: "PaperCut Web Print (gu)"
+*ShortNickName: "PaperCut Web Print (gu)"
+*NickName: "PaperCut Web Print (gu), PDF"
+*PSVersion: "(3010.000) 0"
+*LanguageLevel: "3"
+*ColorDevice: False
+*DefaultColorSpace: Gray
+*FileSystem: False
+*Throughput: "1"
+*LandscapeOrientation: Plus90
+*TTRasterizer: Type42
+*cupsVersion: 2.2
+*cupsManualCopies: False
+*cupsFilter2: "application/vnd.cups-pdf application/pdf 0 -"
+
+*OpenUI *PageSize/Media Size: PickOne
+*OrderDependency: 10 AnySetup *PageSize
+*DefaultPageSize: Letter
+*PageSize Letter/US Letter: "<</PageSize[612 792]/ImagingBBox null>>setpagedevice"
+*PageSize A4/A4: "<</PageSize[595 842]/ImagingBBox null>>setpagedevice"
+*CloseUI: *PageSize
+
+*OpenUI *PageRegion/Media Size: PickOne
+*OrderDependency: 10 AnySetup *PageRegion
+*DefaultPageRegion: Letter
+*PageRegion Letter/US Letter: "<</PageSize[612 792]/ImagingBBox null>>setpagedevice"
+*PageRegion A4/A4: "<</PageSize[595 842]/ImagingBBox null>>setpagedevice"
+*CloseUI: *PageRegion
+
+*DefaultImageableArea: Letter
+*ImageableArea Letter/US Letter: "0 0 612 792"
+*ImageableArea A4/A4: "0 0 595 842"
+*DefaultPaperDimension: Letter
+*PaperDimension Letter/US Letter: "612 792"
+*PaperDimension A4/A4: "595 842"
+
+*DefaultFont: Courier
+*Font Courier: Standard "(002.004S)" Standard ROM
+`
+
+// cupsStep is one change cups-install or cups-uninstall makes. script
+// shows it as shell commands for --dry-run.
+type cupsStep struct {
+	script string
+	run    func() error
+}
+
+/*
+Finds the directory CUPS runs backends from: the one cups-config reports,
+or the first of the usual locations that exists.
+*/
+func cupsBackendDirectory() string {
+	if cupsBackendDir != "" {
+		return cupsBackendDir
+	}
+
+	if out, err := exec.Command("cups-config", "--serverbin").Output(); err == nil {
+		if dir := strings.TrimSpace(string(out)); dir != "" {
+			return filepath.Join(dir, "backend")
+		}
+	}
+	for _, dir := range []string{"/usr/lib/cups/backend", "/usr/libexec/cups/backend"} {
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			return dir
+		}
+	}
+	return "/usr/lib/cups/backend"
+}
+
+var unsafeQueueChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// Returns the CUPS queue name for printer.
+func cupsQueueName(printer utils.PaperCutPrinter) string {
+	name := strings.Trim(unsafeQueueChars.ReplaceAllString(strings.TrimSpace(printer.GetName()), "-"), "-")
+	if name == "" {
+		name = fmt.Sprint(printer.GetID())
+	}
+	return cupsQueuePrefix + name
+}
+
+var safeShellWord = regexp.MustCompile(`^[A-Za-z0-9_./:=,@%+-]+$`)
+
+// Quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	if safeShellWord.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Returns a step that runs name with args.
+func commandStep(name string, args ...string) cupsStep {
+	words := []string{name}
+	for _, arg := range args {
+		words = append(words, shellQuote(arg))
+	}
+
+	return cupsStep{
+		script: strings.Join(words, " "),
+		run: func() error {
+			out, err := exec.Command(name, args...).CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("%s: %v %s", name, err, strings.TrimSpace(string(out)))
+			}
+			return nil
+		},
+	}
+}
+
+// Returns a step that writes contents to path with mode.
+func writeFileStep(path string, contents string, mode os.FileMode) cupsStep {
+	return cupsStep{
+		script: "cat > " + shellQuote(path) + " <<'EOF'\n" + contents + "EOF\n" +
+			fmt.Sprintf("chmod %o %s", mode, shellQuote(path)),
+		run: func() error {
+			if err := ioutil.WriteFile(path, []byte(contents), mode); err != nil {
+				return err
+			}
+			return os.Chmod(path, mode)
+		},
+	}
+}
+
+// Returns a step that removes path if it exists.
+func removeFileStep(path string) cupsStep {
+	return cupsStep{
+		script: "rm -f " + shellQuote(path),
+		run: func() error {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		},
+	}
+}
+
+/*
+Runs steps, or with --dry-run prints them as a shell script. Exits at the
+first step that fails.
+*/
+func runCupsSteps(title string, steps []cupsStep) {
+	if cupsDryRun {
+		fmt.Println("#!/bin/sh")
+		fmt.Println("# " + title)
+		fmt.Println("set -e")
+		for _, step := range steps {
+			fmt.Println(step.script)
+		}
+		return
+	}
+
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+}
+
+/*
+Picks the printers to install: those named in args, by name or ID, or all
+of them. Exits if a named printer does not exist.
+*/
+func cupsPrinters(printers map[int]utils.PaperCutPrinter, args []string) []utils.PaperCutPrinter {
+	ids := []int{}
+	if len(args) == 0 {
+		for id := range printers {
+			ids = append(ids, id)
+		}
+	}
+	for _, arg := range args {
+		id, ok := utils.FindPrinter(printers, arg)
+		if !ok {
+			fmt.Println("No printer called " + arg + " at " + utils.BaseURL)
+			os.Exit(1)
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	var selected []utils.PaperCutPrinter
+	for _, id := range ids {
+		selected = append(selected, printers[id])
+	}
+	return selected
+}
+
+// Lists the CUPS queues whose device URI uses the gu backend.
+func cupsQueues() []string {
+	cmd := exec.Command("lpstat", "-v")
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+	out, err := cmd.Output()
+	if err != nil && len(out) == 0 {
+		// lpstat fails when there are no queues at all.
+		return nil
+	}
+	return parseCupsQueues(out)
+}
+
+// Picks the queues using the gu backend from the output of lpstat -v.
+func parseCupsQueues(out []byte) []string {
+	var queues []string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// device for gu-library-bw: gu://paper-app.gonzaga.edu:9192/library-bw
+		line := strings.TrimPrefix(scanner.Text(), "device for ")
+		i := strings.Index(line, ": ")
+		if i < 0 {
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line[i+2:]), backendScheme+"://") {
+			queues = append(queues, line[:i])
+		}
+	}
+	return queues
+}
+
+/*
+Plans the installation of a queue for each of printers: the backend
+wrapper in backendDir that runs executable, the PPD at ppd, an lpadmin
+call for each queue and removing the PPD again.
+*/
+func cupsInstallSteps(printers []utils.PaperCutPrinter, executable string, backendDir string, ppd string) []cupsStep {
+	backend := filepath.Join(backendDir, backendScheme)
+	steps := []cupsStep{
+		// Backends that only root can run are run as root, which gu does
+		// not need, so the wrapper stays readable by the lp user.
+		writeFileStep(backend, "#!/bin/sh\nexec "+shellQuote(executable)+" cups-backend -- \"$@\"\n", 0755),
+		writeFileStep(ppd, cupsPPD, 0644),
+	}
+	for _, printer := range printers {
+		steps = append(steps, commandStep("lpadmin",
+			"-p", cupsQueueName(printer),
+			"-E",
+			"-v", backendURI(printer),
+			"-P", ppd,
+			"-D", strings.TrimSpace(printer.GetName())+" (PaperCut web print)",
+			"-L", strings.TrimSpace(printer.GetLocation()),
+			"-o", "auth-info-required=username,password",
+			"-o", "printer-is-shared=false",
+		))
+	}
+
+	return append(steps, removeFileStep(ppd))
+}
+
+// Plans removing queues and the backend wrapper in backendDir.
+func cupsUninstallSteps(queues []string, backendDir string) []cupsStep {
+	var steps []cupsStep
+	for _, queue := range queues {
+		steps = append(steps, commandStep("lpadmin", "-x", queue))
+	}
+	return append(steps, removeFileStep(filepath.Join(backendDir, backendScheme)))
+}
+
+// cupsInstallCmd represents the cups-install command
+var cupsInstallCmd = &cobra.Command{
+	Use:   "cups-install [printer...]",
+	Short: "Adds a CUPS queue for every PaperCut printer",
+	Long: `This command logs in, lists the PaperCut printers and adds a CUPS
+queue for each one, or for the printers named by name or ID. The queues
+use a generic PDF driver and the gu backend (see gu cups-backend), which
+is installed as well, and carry the location PaperCut shows. CUPS asks
+for the PaperCut username and password when printing.
+
+Run it as root, or pass --dry-run to print a shell script of the changes
+instead of making them:
+
+gu cups-install --dry-run
+sudo gu cups-install
+sudo gu cups-install library-bw 3
+
+Queues are named gu-<printer>. gu cups-uninstall removes them again.
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+		credentials := login(ctx)
+		printers, err := utils.GetPaperCutPrinters(ctx, credentials)
+		if err != nil {
+			fmt.Println("Could not list printers: " + err.Error())
+			os.Exit(1)
+		}
+		selected := cupsPrinters(printers, args)
+		if len(selected) == 0 {
+			fmt.Println("No printers at " + utils.BaseURL)
+			os.Exit(1)
+		}
+
+		executable, err := os.Executable()
+		if err != nil {
+			executable = "gu"
+		}
+
+		// lpadmin copies the PPD, so it is only needed while installing.
+		ppd := filepath.Join(os.TempDir(), "gu-pdf.ppd")
+		if !cupsDryRun {
+			ppdDir, err := ioutil.TempDir("", "gu-cups")
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			defer os.RemoveAll(ppdDir)
+			ppd = filepath.Join(ppdDir, "gu-pdf.ppd")
+		}
+
+		steps := cupsInstallSteps(selected, executable, cupsBackendDirectory(), ppd)
+		runCupsSteps("gu cups-install for "+utils.BaseURL, steps)
+		if !cupsDryRun {
+			for _, printer := range selected {
+				fmt.Println("Added " + cupsQueueName(printer) + " for " + strings.TrimSpace(printer.GetName()))
+			}
+		}
+	},
+}
+
+// cupsUninstallCmd represents the cups-uninstall command
+var cupsUninstallCmd = &cobra.Command{
+	Use:   "cups-uninstall",
+	Short: "Removes the CUPS queues added by cups-install",
+	Long: `This command removes every CUPS queue that prints through the gu
+backend, and the backend itself. Run it as root, or pass --dry-run to
+print the commands instead.
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		queues := cupsQueues()
+
+		runCupsSteps("gu cups-uninstall", cupsUninstallSteps(queues, cupsBackendDirectory()))
+		if !cupsDryRun {
+			for _, queue := range queues {
+				fmt.Println("Removed " + queue)
+			}
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(cupsInstallCmd)
+	RootCmd.AddCommand(cupsUninstallCmd)
+
+	for _, cmd := range []*cobra.Command{cupsInstallCmd, cupsUninstallCmd} {
+		cmd.Flags().BoolVar(&cupsDryRun, "dry-run", false, "Print the changes as a shell script instead of making them")
+		cmd.Flags().StringVar(&cupsBackendDir, "backend-dir", "", "CUPS backend directory (default from cups-config)")
+	}
+}
@@ -0,0 +1,189 @@
+package cmd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quantamhd/gu/papercuttest"
+	"github.com/quantamhd/gu/utils"
+)
+
+// cupsTestPrinters lists the printers of a fake PaperCut server that offers
+// printers, sorted by ID.
+func cupsTestPrinters(t *testing.T, printers []papercuttest.Printer) []utils.PaperCutPrinter {
+	t.Helper()
+	srv := papercuttest.NewUnstartedServer()
+	srv.SetPrinters(printers)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	baseURL, retry := utils.BaseURL, utils.Retry
+	utils.BaseURL = srv.URL
+	utils.Retry = utils.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	t.Cleanup(func() { utils.BaseURL, utils.Retry = baseURL, retry })
+
+	session, err := utils.NewSession(context.Background(), "student", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	byID, err := session.Printers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cupsPrinters(byID, nil)
+}
+
+func scripts(steps []cupsStep) []string {
+	var lines []string
+	for _, step := range steps {
+		lines = append(lines, step.script)
+	}
+	return lines
+}
+
+func TestCupsInstallSteps(t *testing.T) {
+	printers := cupsTestPrinters(t, []papercuttest.Printer{
+		{ID: 1, Name: "library-bw", Location: "Foley Library, 1st floor"},
+		{ID: 7, Name: "Lab 2 / Colour's", Location: ""},
+	})
+	host := strings.TrimPrefix(utils.BaseURL, "http://")
+
+	steps := scripts(cupsInstallSteps(printers, "/opt/gu dir/gu", "/usr/lib/cups/backend", "/tmp/gu-pdf.ppd"))
+	if len(steps) != 5 {
+		t.Fatalf("got %d steps, want the backend, the PPD, two queues and removing the PPD:\n%s", len(steps), strings.Join(steps, "\n"))
+	}
+
+	backend := "cat > /usr/lib/cups/backend/gu <<'EOF'\n#!/bin/sh\nexec '/opt/gu dir/gu' cups-backend -- \"$@\"\nEOF\nchmod 755 /usr/lib/cups/backend/gu"
+	if steps[0] != backend {
+		t.Errorf("backend step =\n%s\nwant\n%s", steps[0], backend)
+	}
+	if !strings.HasPrefix(steps[1], "cat > /tmp/gu-pdf.ppd <<'EOF'\n*PPD-Adobe") || !strings.HasSuffix(steps[1], "EOF\nchmod 644 /tmp/gu-pdf.ppd") {
+		t.Errorf("PPD step =\n%s", steps[1])
+	}
+
+	want := []string{
+		"lpadmin -p gu-library-bw -E -v gu://" + host + "/library-bw -P /tmp/gu-pdf.ppd" +
+			" -D 'library-bw (PaperCut web print)' -L 'Foley Library, 1st floor'" +
+			" -o auth-info-required=username,password -o printer-is-shared=false",
+		"lpadmin -p gu-Lab-2-Colour-s -E -v gu://" + host + "/Lab%202%20%2F%20Colour%27s -P /tmp/gu-pdf.ppd" +
+			` -D 'Lab 2 / Colour'\''s (PaperCut web print)' -L ''` +
+			" -o auth-info-required=username,password -o printer-is-shared=false",
+		"rm -f /tmp/gu-pdf.ppd",
+	}
+	if !reflect.DeepEqual(steps[2:], want) {
+		t.Errorf("lpadmin steps =\n%s\nwant\n%s", strings.Join(steps[2:], "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestCupsInstallFileSteps(t *testing.T) {
+	printers := cupsTestPrinters(t, []papercuttest.Printer{{ID: 1, Name: "library-bw"}})
+	dir := t.TempDir()
+	ppd := filepath.Join(dir, "gu-pdf.ppd")
+
+	// The file steps need no root; leave out the lpadmin calls.
+	steps := cupsInstallSteps(printers, "/usr/bin/gu", dir, ppd)
+	for _, step := range []cupsStep{steps[0], steps[1]} {
+		if err := step.run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backend := filepath.Join(dir, backendScheme)
+	fi, err := os.Stat(backend)
+	if err != nil || fi.Mode().Perm() != 0755 {
+		t.Fatalf("backend = %v, %v; want mode 755", fi, err)
+	}
+	script, _ := ioutil.ReadFile(backend)
+	if string(script) != "#!/bin/sh\nexec /usr/bin/gu cups-backend -- \"$@\"\n" {
+		t.Errorf("backend script = %q", script)
+	}
+	if data, _ := ioutil.ReadFile(ppd); string(data) != cupsPPD {
+		t.Error("the PPD was not written")
+	}
+
+	if err := steps[len(steps)-1].run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(ppd); !os.IsNotExist(err) {
+		t.Errorf("the PPD is still there: %v", err)
+	}
+	// Removing what is already gone is fine.
+	if err := steps[len(steps)-1].run(); err != nil {
+		t.Errorf("removing a missing PPD: %v", err)
+	}
+
+	for _, step := range cupsUninstallSteps(nil, dir) {
+		if err := step.run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(backend); !os.IsNotExist(err) {
+		t.Errorf("the backend is still there: %v", err)
+	}
+}
+
+func TestCupsUninstallSteps(t *testing.T) {
+	steps := scripts(cupsUninstallSteps([]string{"gu-library-bw", "gu-Lab-2"}, "/usr/libexec/cups/backend"))
+	want := []string{
+		"lpadmin -x gu-library-bw",
+		"lpadmin -x gu-Lab-2",
+		"rm -f /usr/libexec/cups/backend/gu",
+	}
+	if !reflect.DeepEqual(steps, want) {
+		t.Errorf("uninstall steps = %q, want %q", steps, want)
+	}
+}
+
+func TestParseCupsQueues(t *testing.T) {
+	out := "device for gu-library-bw: gu://paper-app.gonzaga.edu:9192/library-bw\n" +
+		"device for office: ipp://192.168.1.20/ipp/print\n" +
+		"device for gu-Lab-2: gu://paper-app.gonzaga.edu:9192/Lab%202\n" +
+		"device for guest: socket://10.0.0.5\n" +
+		"device for pdf: cups-pdf:/\n" +
+		"garbage\n"
+
+	want := []string{"gu-library-bw", "gu-Lab-2"}
+	if got := parseCupsQueues([]byte(out)); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseCupsQueues = %q, want %q", got, want)
+	}
+	if got := parseCupsQueues(nil); got != nil {
+		t.Errorf("parseCupsQueues of nothing = %q", got)
+	}
+}
+
+func TestCupsQueueName(t *testing.T) {
+	printers := cupsTestPrinters(t, []papercuttest.Printer{
+		{ID: 1, Name: "library-bw"},
+		{ID: 2, Name: "  Room 101 (A4) "},
+		{ID: 3, Name: "***"},
+	})
+
+	want := []string{"gu-library-bw", "gu-Room-101-A4", "gu-3"}
+	for i, printer := range printers {
+		if got := cupsQueueName(printer); got != want[i] {
+			t.Errorf("cupsQueueName(%q) = %q, want %q", printer.GetName(), got, want[i])
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for s, want := range map[string]string{
+		"plain":                    "plain",
+		"/usr/lib/cups/backend/gu": "/usr/lib/cups/backend/gu",
+		"a=b,c@d:e%f+g":            "a=b,c@d:e%f+g",
+		"":                         "''",
+		"two words":                "'two words'",
+		"it's":                     `'it'\''s'`,
+		"$HOME":                    "'$HOME'",
+	} {
+		if got := shellQuote(s); got != want {
+			t.Errorf("shellQuote(%q) = %s, want %s", s, got, want)
+		}
+	}
+}
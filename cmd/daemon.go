@@ -0,0 +1,270 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/quantamhd/gu/hotfolder"
+	"github.com/quantamhd/gu/spool"
+	"github.com/quantamhd/gu/utils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// keepAliveInterval is how often the daemon touches its PaperCut session.
+const keepAliveInterval = 5 * time.Minute
+
+/*
+How often the daemon looks for spooled jobs, and how long it waits at most
+between attempts while the server cannot be reached.
+*/
+const (
+	spoolPollInterval = time.Minute
+	offlineFirstDelay = 15 * time.Second
+	offlineMaxDelay   = 10 * time.Minute
+)
+
+// hotFolderConfig is a folder under hot_folders in $HOME/.gu.yaml.
+type hotFolderConfig struct {
+	Path     string
+	Printer  string
+	Copies   int
+	Patterns []string
+	Settle   time.Duration
+	Convert  *bool
+}
+
+/*
+Expands a leading ~ in path to the home directory.
+*/
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, strings.TrimPrefix(path, "~"))
+}
+
+/*
+Reads hot_folders from $HOME/.gu.yaml and looks up their printers. Exits if
+a folder is missing or names a printer that does not exist.
+*/
+func hotFolders(printers map[int]utils.PaperCutPrinter) []hotfolder.Folder {
+	var configs []hotFolderConfig
+	if err := viper.UnmarshalKey("hot_folders", &configs); err != nil {
+		fmt.Println("Invalid hot_folders in config file: " + err.Error())
+		os.Exit(1)
+	}
+	if len(configs) == 0 {
+		return nil
+	}
+
+	// Exits now rather than on the first document if converters are broken.
+	converterRegistry(".")
+
+	var folders []hotfolder.Folder
+	for _, config := range configs {
+		path := expandHome(config.Path)
+		if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+			fmt.Println("Hot folder " + config.Path + " is not a directory")
+			os.Exit(1)
+		}
+
+		printer := config.Printer
+		if printer == "" {
+			printer = activeProfile.Printer
+		}
+		id, ok := utils.FindPrinter(printers, printer)
+		if !ok {
+			fmt.Println("Hot folder " + config.Path + ": no printer called " + printer + " at " + utils.BaseURL)
+			os.Exit(1)
+		}
+
+		folder := hotfolder.Folder{
+			Path:     path,
+			Printer:  printers[id],
+			Copies:   config.Copies,
+			Patterns: config.Patterns,
+			Settle:   config.Settle,
+		}
+		if config.Convert == nil || *config.Convert {
+			folder.Convert = func(ctx context.Context, path string) (string, error) {
+				return converterRegistry(path).ConvertFile(ctx, path)
+			}
+		}
+		folders = append(folders, folder)
+	}
+
+	return folders
+}
+
+// Returns the delay after delay for a server that is still out of reach.
+func nextOfflineDelay(delay time.Duration) time.Duration {
+	delay *= 2
+	if delay > offlineMaxDelay {
+		delay = offlineMaxDelay
+	}
+	return delay
+}
+
+/*
+Logs in, trying again with a growing delay while the server cannot be
+reached. Exits if the login is refused or ctx is done.
+*/
+func waitForSession(ctx context.Context, username string, password string) *utils.Session {
+	delay := offlineFirstDelay
+	for {
+		session, err := utils.NewSession(ctx, username, password)
+		if err == nil {
+			return session
+		}
+		if !utils.IsTemporary(err) {
+			exitIfInterrupted(err)
+			fmt.Println("Could not log in to " + utils.BaseURL + ": " + err.Error())
+			os.Exit(1)
+		}
+
+		fmt.Printf("Could not reach %s (%v), trying again in %s\n", utils.BaseURL, err, delay)
+		select {
+		case <-ctx.Done():
+			os.Exit(exitInterrupted)
+		case <-time.After(delay):
+		}
+		delay = nextOfflineDelay(delay)
+	}
+}
+
+// Returns how long until the next scheduled job is due, at most limit.
+func untilNextDue(sp *spool.Spool, limit time.Duration) time.Duration {
+	jobs, _ := sp.List()
+	wait := limit
+	for _, job := range jobs {
+		if job.At != nil && !job.Failed && !job.Unconfirmed {
+			if until := time.Until(*job.At); until > 0 && until < wait {
+				wait = until
+			}
+		}
+	}
+	return wait
+}
+
+/*
+Prints the spooled jobs until ctx is done: every spoolPollInterval, or when
+the next scheduled job is due, while the server answers, and with a
+growing delay while it does not.
+*/
+func flushSpoolLoop(ctx context.Context, sp *spool.Spool, session *utils.Session, logger *log.Logger) {
+	delay := time.Duration(0)
+	for {
+		_, err := flushSpool(ctx, sp, session, nil, logger)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			delay = 0
+		} else {
+			if delay == 0 {
+				delay = offlineFirstDelay
+			} else {
+				delay = nextOfflineDelay(delay)
+			}
+			logger.Printf("Could not print the spooled jobs (%v), trying again in %s", err, delay)
+		}
+
+		wait := untilNextDue(sp, spoolPollInterval)
+		if delay > 0 {
+			wait = delay
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// daemonCmd represents the daemon command
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Prints the documents saved into hot folders and the offline spool",
+	Long: `This command logs in once and watches the hot folders configured in
+$HOME/.gu.yaml. Every document saved into one is printed on the folder's
+printer as soon as it has been completely written, and then moved into
+the done or failed subdirectory next to a .log file that says what
+happened to it.
+
+hot_folders:
+  - path: ~/print/library
+    printer: library-bw
+  - path: ~/print/handouts
+    printer: 3
+    copies: 30
+    patterns: ["*.pdf", "*.docx"]
+    settle: 10s
+    convert: false
+
+printer is a name or ID and defaults to the profile's printer. copies
+defaults to 1. patterns limits printing to matching file names. A
+document counts as written once its size has not changed for settle
+(default 2s); raise it for folders filled over a slow network share.
+Documents are converted like with gu print unless convert is false.
+Hidden files, *.tmp, *.part and similar partial downloads are ignored.
+
+Documents already in a folder when the daemon starts are printed too. The
+session is kept alive while the daemon runs and logged in again when
+PaperCut ends it.
+
+The daemon also prints the jobs gu print kept in the offline spool (see
+gu queue --help), checking every minute, and scheduled jobs when they are
+due (see gu scheduler --help). While the server cannot be
+reached, at startup or later, it tries again with a growing delay of up
+to ten minutes. Set GU_PASSWORD to run without a password prompt, for
+example from a systemd unit or launchd agent. Ctrl-C or SIGTERM stops the
+daemon; a document it was printing stays in its folder.
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		sp := openSpool()
+		username, password := askCredentials()
+
+		ctx, stop := trapInterrupt(context.Background())
+		defer stop()
+
+		session := waitForSession(ctx, username, password)
+		printers, err := session.Printers(ctx)
+		if err != nil {
+			fmt.Println("Could not list printers: " + err.Error())
+			os.Exit(1)
+		}
+		folders := hotFolders(printers)
+
+		logger := log.New(os.Stdout, "", log.LstdFlags)
+		go session.KeepAlive(ctx, keepAliveInterval, func(err error) {
+			logger.Printf("Could not keep the session alive: %v", err)
+		})
+		go flushSpoolLoop(ctx, sp, session, logger)
+
+		for _, folder := range folders {
+			fmt.Println("Watching " + folder.Path + " for " + strings.TrimSpace(folder.Printer.GetName()))
+		}
+		fmt.Println("Printing spooled jobs from " + sp.GetDir())
+
+		watcher := hotfolder.NewWatcher(session, folders, logger)
+		if err := watcher.Run(ctx); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("Stopped.")
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(daemonCmd)
+}
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/quantamhd/gu/ipp"
+	"github.com/quantamhd/gu/utils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	ippPort    int
+	ippPrinter string
+	ippName    string
+)
+
+/*
+Picks the PaperCut printer a server forwards to: the one named by the
+--printer flag, then the profile's printer, and otherwise asks.
+Exits if the named printer does not exist.
+*/
+func serverPrinter(printers map[int]utils.PaperCutPrinter, nameOrID string) utils.PaperCutPrinter {
+	if nameOrID != "" {
+		id, ok := utils.FindPrinter(printers, nameOrID)
+		if !ok {
+			fmt.Println("No printer called " + nameOrID + " at " + utils.BaseURL)
+			os.Exit(1)
+		}
+		return printers[id]
+	}
+
+	if id, ok := profilePrinter(printers); ok {
+		return printers[id]
+	}
+
+	printTable(printers)
+	return selectPrinter(printers)
+}
+
+// ippServerCmd represents the ipp-server command
+var ippServerCmd = &cobra.Command{
+	Use:   "ipp-server",
+	Short: "Shares a PaperCut printer as a local IPP printer",
+	Long: `This command logs in once and serves an IPP/2.0 printer on localhost,
+so that any application can print to PaperCut web print. PDF, JPEG and
+PNG documents it receives are sent to the chosen PaperCut printer, and
+the job states clients see follow the PaperCut job list. Cancelling a
+job from the client cancels it at PaperCut if it has not printed yet.
+
+Examples
+
+gu ipp-server --printer library-bw
+gu ipp-server --port 8631 --printer 2
+
+Adding the printer
+
+With CUPS, on Linux and macOS:
+
+lpadmin -p gu -E -v ipp://localhost:8631/ipp/print -m everywhere
+
+On Windows, add a printer by address and enter
+http://localhost:8631/ipp/print.
+
+The server logs in again when PaperCut ends the session, and stops on
+Ctrl-C. Finished jobs are shown to clients for an hour.
+
+The server has no authentication of its own: anyone who can use this
+computer, including other local users, can print on your PaperCut
+account through it.
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+		session := startSession(ctx)
+		printers, err := session.Printers(ctx)
+		if err != nil {
+			fmt.Println("Could not list printers: " + err.Error())
+			os.Exit(1)
+		}
+		printer := serverPrinter(printers, ippPrinter)
+
+		logger := log.New(os.Stdout, "", log.LstdFlags)
+		server := ipp.NewServer(session, printer, ippName, logger)
+
+		addr := "127.0.0.1:" + strconv.Itoa(ippPort)
+		fmt.Println("Printing to " + printer.GetName() + " via ipp://localhost:" + strconv.Itoa(ippPort) + ipp.PrinterPath)
+
+		if err := http.ListenAndServe(addr, server); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(ippServerCmd)
+
+	ippServerCmd.Flags().IntVar(&ippPort, "port", 8631, "Port to listen on")
+	ippServerCmd.Flags().StringVar(&ippPrinter, "printer", "", "Name or ID of the PaperCut printer to print to (default from the profile)")
+	ippServerCmd.Flags().StringVar(&ippName, "name", "gu", "Printer name shown to IPP clients")
+}
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/quantamhd/gu/kiosk"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	kioskListen   string
+	kioskIdle     time.Duration
+	kioskLocation string
+)
+
+// kioskCmd represents the kiosk command
+var kioskCmd = &cobra.Command{
+	Use:   "kiosk",
+	Short: "Serves a web page for printing from a shared computer",
+	Long: `This command serves a small web page for lab computers, so that people
+can print without the command line. They log in with their PaperCut
+username and password, drop a document onto the page, pick a printer,
+narrowed down by location if they like, and the number of copies, and
+follow the status of their jobs, which they can cancel until printed.
+Documents are converted like with gu print.
+
+Every browser session logs in to PaperCut on its own, and nothing is
+shared between them. A session is logged out of PaperCut after --idle
+without activity, or kiosk_idle in $HOME/.gu.yaml, and the page goes
+back to the login form. Stopping the kiosk logs everyone out.
+
+Open the page in a browser in kiosk mode, for example:
+
+gu kiosk --location "Foley Library, 1st floor"
+chromium --kiosk --incognito http://127.0.0.1:8090/
+
+--location preselects the printers of the lab's location. The page only
+listens on localhost unless --listen says otherwise; it has no TLS, so
+only serve it to other computers over a network you trust.
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		idle := kioskIdle
+		if !cmd.Flags().Changed("idle") && viper.IsSet("kiosk_idle") {
+			idle = viper.GetDuration("kiosk_idle")
+		}
+		if idle <= 0 {
+			fmt.Println("--idle must be a positive duration such as 5m")
+			os.Exit(1)
+		}
+
+		ctx, stop := trapInterrupt(context.Background())
+		defer stop()
+
+		convert := func(ctx context.Context, path string) (string, error) {
+			return converterRegistry(path).ConvertFile(ctx, path)
+		}
+		logger := log.New(os.Stdout, "", log.LstdFlags)
+		page := kiosk.NewServer(idle, kioskLocation, convert, logger)
+
+		listener, err := net.Listen("tcp", kioskListen)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if !isLoopback(kioskListen) {
+			fmt.Println("Warning: the kiosk can be reached from other computers, and passwords are sent unencrypted.")
+		}
+		fmt.Println("Serving the kiosk on http://" + listener.Addr().String() + "/")
+
+		expired := make(chan struct{})
+		go func() {
+			page.ExpireIdle(ctx)
+			close(expired)
+		}()
+
+		server := &http.Server{Handler: page}
+		go func() {
+			<-ctx.Done()
+			shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			server.Shutdown(shutdown)
+		}()
+
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		<-expired
+		fmt.Println("Stopped.")
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(kioskCmd)
+
+	kioskCmd.Flags().StringVar(&kioskListen, "listen", "127.0.0.1:8090", "Address to listen on")
+	kioskCmd.Flags().DurationVar(&kioskIdle, "idle", 5*time.Minute, "Log out after this long without activity")
+	kioskCmd.Flags().StringVar(&kioskLocation, "location", "", "Location whose printers are preselected")
+}
@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/quantamhd/gu/lpd"
+	"github.com/quantamhd/gu/utils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	lpdPort    int
+	lpdListen  string
+	lpdPrinter string
+	lpdAliases map[string]string
+)
+
+/*
+Builds the LPD queues: every printer under its name and ID, aliases from
+lpd_queues in $HOME/.gu.yaml and --queue, and "lp" for the default printer
+named with --printer or by the profile. Exits if an alias names a printer
+that does not exist.
+*/
+func lpdQueues(printers map[int]utils.PaperCutPrinter) map[string]utils.PaperCutPrinter {
+	queues := map[string]utils.PaperCutPrinter{}
+	for id, printer := range printers {
+		queues[strconv.Itoa(id)] = printer
+		queues[strings.TrimSpace(printer.GetName())] = printer
+	}
+
+	aliases := viper.GetStringMapString("lpd_queues")
+	for alias, target := range lpdAliases {
+		aliases[alias] = target
+	}
+	for alias, target := range aliases {
+		id, ok := utils.FindPrinter(printers, target)
+		if !ok {
+			fmt.Println("Queue " + alias + ": no printer called " + target + " at " + utils.BaseURL)
+			os.Exit(1)
+		}
+		queues[alias] = printers[id]
+	}
+
+	if lpdPrinter != "" {
+		id, ok := utils.FindPrinter(printers, lpdPrinter)
+		if !ok {
+			fmt.Println("No printer called " + lpdPrinter + " at " + utils.BaseURL)
+			os.Exit(1)
+		}
+		queues["lp"] = printers[id]
+	} else if id, ok := profilePrinter(printers); ok {
+		queues["lp"] = printers[id]
+	}
+
+	return queues
+}
+
+// lpdServerCmd represents the lpd-server command
+var lpdServerCmd = &cobra.Command{
+	Use:   "lpd-server",
+	Short: "Accepts lpr print jobs and sends them to PaperCut web print",
+	Long: `This command logs in once and runs a Line Printer Daemon (RFC 1179),
+so that tools and devices that can only print with lpr can print through
+PaperCut web print. Every PaperCut printer is a queue, by name and by ID,
+and "lp" is the default printer from --printer or the profile. Add
+shorter queue names with --queue or in $HOME/.gu.yaml:
+
+lpd_queues:
+  bw: library-bw
+  color: 3
+
+The job name and user come from the control file, and the number of
+copies from its "#" line or from how often the document is listed. Data
+files must be PDF, JPEG, PNG or another type PaperCut accepts, and a
+connection may send at most 32 files. Documents are sent to PaperCut one
+at a time. Queue state requests (lpq) are answered from your PaperCut job
+list.
+
+Examples
+
+gu lpd-server --printer library-bw
+gu lpd-server --listen 0.0.0.0 --port 515 --queue bw=library-bw
+lpr -H localhost:5515 -P bw homework.pdf
+
+The server has no authentication of its own: anyone who can reach it
+prints on your account. It only listens on localhost unless --listen says
+otherwise. The standard port 515 needs root.
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+		session := startSession(ctx)
+		printers, err := session.Printers(ctx)
+		if err != nil {
+			fmt.Println("Could not list printers: " + err.Error())
+			os.Exit(1)
+		}
+		queues := lpdQueues(printers)
+
+		addr := net.JoinHostPort(lpdListen, strconv.Itoa(lpdPort))
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		names := []string{}
+		for name := range queues {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Println("LPD server listening on " + addr + ", queues: " + strings.Join(names, ", "))
+
+		server := lpd.NewServer(session, queues, log.New(os.Stdout, "", log.LstdFlags))
+		if err := server.Serve(listener); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(lpdServerCmd)
+
+	lpdServerCmd.Flags().IntVar(&lpdPort, "port", 5515, "Port to listen on")
+	lpdServerCmd.Flags().StringVar(&lpdListen, "listen", "127.0.0.1", "Address to listen on")
+	lpdServerCmd.Flags().StringVar(&lpdPrinter, "printer", "", "Name or ID of the printer for the lp queue (default from the profile)")
+	lpdServerCmd.Flags().StringToStringVar(&lpdAliases, "queue", nil, "Extra queue name for a printer, as name=printer, may be repeated")
+}
@@ -0,0 +1,201 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/quantamhd/gu/papercuttest"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// mockFixtures is the layout of fixtures.yaml for gu mock-server.
+type mockFixtures struct {
+	Users     []mockUser
+	Printers  []mockPrinter
+	Lifecycle []mockLifecycleStep
+}
+
+type mockUser struct {
+	Username string
+	Password string
+	Balance  float64
+}
+
+type mockPrinter struct {
+	ID          int
+	Name        string
+	Location    string
+	CostPerPage float64 `mapstructure:"cost_per_page"`
+	Lifecycle   []mockLifecycleStep
+}
+
+type mockLifecycleStep struct {
+	Status string
+	After  time.Duration
+}
+
+var (
+	mockPort        int
+	mockFixturesDir string
+	mockUploads     string
+)
+
+/*
+Reads fixtures.yaml from the fixtures directory into handler.
+Exits if the file cannot be read.
+*/
+func loadMockFixtures(handler *papercuttest.Handler, dir string) {
+	v := viper.New()
+	v.SetConfigFile(filepath.Join(dir, "fixtures.yaml"))
+	if err := v.ReadInConfig(); err != nil {
+		fmt.Println("Could not read fixtures: " + err.Error())
+		os.Exit(1)
+	}
+
+	var fixtures mockFixtures
+	if err := v.Unmarshal(&fixtures); err != nil {
+		fmt.Println("Invalid fixtures: " + err.Error())
+		os.Exit(1)
+	}
+
+	if len(fixtures.Users) > 0 {
+		var users []papercuttest.User
+		for _, u := range fixtures.Users {
+			users = append(users, papercuttest.User{Username: u.Username, Password: u.Password, Balance: u.Balance})
+		}
+		handler.SetUsers(users)
+	}
+
+	if len(fixtures.Printers) > 0 {
+		var printers []papercuttest.Printer
+		for i, p := range fixtures.Printers {
+			id := p.ID
+			if id == 0 {
+				id = i + 1
+			}
+			printers = append(printers, papercuttest.Printer{
+				ID:          id,
+				Name:        p.Name,
+				Location:    p.Location,
+				CostPerPage: p.CostPerPage,
+				Lifecycle:   lifecycleSteps(p.Lifecycle),
+			})
+		}
+		handler.SetPrinters(printers)
+	}
+
+	handler.SetLifecycle(lifecycleSteps(fixtures.Lifecycle))
+}
+
+func lifecycleSteps(steps []mockLifecycleStep) []papercuttest.LifecycleStep {
+	var lifecycle []papercuttest.LifecycleStep
+	for _, step := range steps {
+		lifecycle = append(lifecycle, papercuttest.LifecycleStep{Status: step.Status, After: step.After})
+	}
+	return lifecycle
+}
+
+/*
+Saves every uploaded document into dir as <job id>-<document name>.
+*/
+func recordUploads(handler *papercuttest.Handler, dir string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fmt.Println("Could not create upload directory: " + err.Error())
+		os.Exit(1)
+	}
+
+	handler.OnUpload = func(job papercuttest.Job) {
+		path := filepath.Join(dir, job.ID+"-"+filepath.Base(job.Document))
+		if err := ioutil.WriteFile(path, job.Data, 0644); err != nil {
+			fmt.Println("Could not save upload: " + err.Error())
+			return
+		}
+
+		fmt.Println("Job " + job.ID + ": " + job.Username + " sent " + job.Document + " (" +
+			strconv.Itoa(job.Copies) + " copies) to " + job.Printer + ", saved to " + path)
+	}
+}
+
+// mockServerCmd represents the mock-server command
+var mockServerCmd = &cobra.Command{
+	Use:   "mock-server",
+	Short: "Runs a stand-in PaperCut server for demos and offline testing",
+	Long: `This command serves a fake PaperCut web print site on localhost, so
+that gu and tools built on it can be developed without the real server.
+Point any gu command at it with --server.
+
+Examples
+
+gu mock-server --port 9192 --fixtures testdata/
+gu --server http://localhost:9192 print homework.pdf
+
+Fixtures
+
+The fixtures directory holds a fixtures.yaml describing the accounts,
+printers and how jobs move through their statuses. Uploaded documents
+are saved to the uploads directory inside it unless --uploads is given.
+Without --fixtures the user "student" with password "password" and two
+printers are served.
+
+users:
+  - username: student
+    password: password
+    balance: 10.00
+printers:
+  - id: 1
+    name: library-bw
+    location: Foley Library
+    cost_per_page: 0.05
+  - id: 2
+    name: jammed
+    location: Basement
+    cost_per_page: 0.10
+    lifecycle:
+      - status: Rendering
+      - status: Error
+        after: 3s
+lifecycle:
+  - status: Rendering
+  - status: Held in a queue
+    after: 5s
+  - status: Printed
+    after: 15s
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		handler := papercuttest.NewHandler()
+
+		uploads := mockUploads
+		if mockFixturesDir != "" {
+			loadMockFixtures(handler, mockFixturesDir)
+			if uploads == "" {
+				uploads = filepath.Join(mockFixturesDir, "uploads")
+			}
+		}
+		if uploads == "" {
+			uploads = "uploads"
+		}
+		recordUploads(handler, uploads)
+
+		addr := "127.0.0.1:" + strconv.Itoa(mockPort)
+		fmt.Println("Mock PaperCut server listening on http://" + addr)
+
+		if err := http.ListenAndServe(addr, handler); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(mockServerCmd)
+
+	mockServerCmd.Flags().IntVar(&mockPort, "port", 9192, "Port to listen on")
+	mockServerCmd.Flags().StringVar(&mockFixturesDir, "fixtures", "", "Directory containing fixtures.yaml")
+	mockServerCmd.Flags().StringVar(&mockUploads, "uploads", "", "Directory to save uploaded documents to")
+}
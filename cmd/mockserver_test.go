@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quantamhd/gu/papercuttest"
+	"github.com/quantamhd/gu/utils"
+)
+
+func TestMockServerFixtures(t *testing.T) {
+	handler := papercuttest.NewHandler()
+	loadMockFixtures(handler, filepath.Join("testdata", "mockserver"))
+	uploads := t.TempDir()
+	recordUploads(handler, uploads)
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	baseURL, retry := utils.BaseURL, utils.Retry
+	utils.BaseURL = srv.URL
+	utils.Retry = utils.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	defer func() { utils.BaseURL, utils.Retry = baseURL, retry }()
+	ctx := context.Background()
+
+	// The fixture's users replace the default student.
+	if _, err := utils.NewSession(ctx, "student", "password"); err == nil {
+		t.Error("the default user could log in")
+	}
+	session, err := utils.NewSession(ctx, "jdoe", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance, ok := session.GetCredentials().GetBalance(); !ok || balance != 2.5 {
+		t.Errorf("balance = %v, %t; want 2.50", balance, ok)
+	}
+
+	printers, err := session.Printers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(printers) != 2 || printers[5].GetName() != "library-bw" || printers[2].GetName() != "jammed" {
+		t.Fatalf("printers = %v, want library-bw as 5 and jammed as 2", printers)
+	}
+	if cost, _ := printers[2].GetCostPerPage(); cost != 0.10 {
+		t.Errorf("jammed costs %v a page, want 0.10", cost)
+	}
+
+	// A server with a single printer needs no prompt.
+	if only := selectPrinter(map[int]utils.PaperCutPrinter{5: printers[5]}); only.GetID() != 5 {
+		t.Errorf("selectPrinter picked %q (ID %d) of a single printer, want library-bw", only.GetName(), only.GetID())
+	}
+
+	document := filepath.Join(t.TempDir(), "essay.pdf")
+	ioutil.WriteFile(document, []byte("%PDF-1.4\n1 0 obj << /Type /Page >> endobj\n%%EOF\n"), 0644)
+	for _, id := range []int{5, 2} {
+		printer := printers[id]
+		if _, err := session.Submit(ctx, &printer, 1, document); err != nil {
+			t.Fatalf("printing to %s: %v", printer.GetName(), err)
+		}
+	}
+
+	// Both lifecycles end after a millisecond.
+	time.Sleep(20 * time.Millisecond)
+	jobs, err := session.Jobs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := map[string]string{}
+	for _, job := range jobs {
+		statuses[job.GetPrinterName()] = job.GetStatus()
+	}
+	if statuses["library-bw"] != papercuttest.StatusPrinted || statuses["jammed"] != papercuttest.StatusError {
+		t.Errorf("statuses = %v, want library-bw printed by the default lifecycle and jammed failed by its own", statuses)
+	}
+
+	for _, job := range handler.Jobs() {
+		saved, err := ioutil.ReadFile(filepath.Join(uploads, job.ID+"-essay.pdf"))
+		if err != nil || string(saved) != string(job.Data) {
+			t.Errorf("upload of job %s was not saved: %v", job.ID, err)
+		}
+	}
+}
+
+func TestMockServerMissingFixtures(t *testing.T) {
+	if dir := os.Getenv("GU_TEST_FIXTURES"); dir != "" {
+		loadMockFixtures(papercuttest.NewHandler(), dir)
+		exit(0)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMockServerMissingFixtures$")
+	cmd.Env = append(os.Environ(), "GU_TEST_FIXTURES="+t.TempDir())
+	out, err := cmd.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+		t.Fatalf("exit = %v, want status 1:\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "Could not read fixtures") {
+		t.Errorf("no message about the fixtures:\n%s", out)
+	}
+}
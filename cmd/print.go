@@ -15,15 +15,22 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/bgentry/speakeasy"
 	"github.com/olekukonko/tablewriter"
 	"github.com/quantamhd/gu/utils"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 func printTable(printers map[int]utils.PaperCutPrinter) {
@@ -50,10 +57,10 @@ func selectCopies() int {
 	num, err := strconv.Atoi(copies)
 	if err != nil {
 		fmt.Println("Not a valid number of copies!")
-		os.Exit(1)
+		exit(1)
 	} else if num < 1 {
 		fmt.Println("Not a valid number of copies!")
-		os.Exit(1)
+		exit(1)
 	}
 	return num
 }
@@ -67,57 +74,369 @@ func selectPrinter(printers map[int]utils.PaperCutPrinter) utils.PaperCutPrinter
 
 	// If only one printer, return that printer
 	if len(printers) == 1 {
-		return printers[0]
+		for _, p := range printers {
+			return p
+		}
 	}
 
+	defaultID, hasDefault := profilePrinter(printers)
+
 	var printerID string
-	fmt.Print("Select a printer ID: ")
+	if hasDefault {
+		fmt.Print("Select a printer ID [" + strconv.Itoa(defaultID) + "]: ")
+	} else {
+		fmt.Print("Select a printer ID: ")
+	}
 	fmt.Scanln(&printerID)
 
+	if printerID == "" && hasDefault {
+		return printers[defaultID]
+	}
+
 	// check if printerID is an int and a valid ID
 	id, err := strconv.Atoi(printerID)
 	if err != nil {
 		fmt.Println("Not a valid ID!")
-		os.Exit(1)
+		exit(1)
 	} else if _, ok := printers[id]; !ok {
 		fmt.Println("Not a valid ID!")
-		os.Exit(1)
+		exit(1)
 	}
 
 	return printers[id]
 }
 
+/*
+Finds the default printer of the active profile, given by name or ID.
+*/
+func profilePrinter(printers map[int]utils.PaperCutPrinter) (int, bool) {
+	return utils.FindPrinter(printers, activeProfile.Printer)
+}
+
 /*
 Handles login with user. Exits if failed login.
+The username of the active profile is used without asking.
 Returns credentials object.
 */
-func login() *utils.PaperCutCredentials {
-	var username string
-	fmt.Print("Username for 'https://guprint.gonzaga.edu': ")
-	fmt.Scanln(&username)
-	password, _ := speakeasy.Ask("Password for 'https://guprint.gonzaga.edu': ")
+func login(ctx context.Context) *utils.PaperCutCredentials {
+	username, password := askCredentials()
 
-	credentials := utils.CreatePaperCutCredentials(username, password)
+	return checkLogin(utils.CreatePaperCutCredentials(ctx, username, password))
+}
+
+/*
+Exits unless the login that returned credentials and err succeeded.
+*/
+func checkLogin(credentials *utils.PaperCutCredentials, err error) *utils.PaperCutCredentials {
+	if err != nil {
+		fmt.Println("Could not connect to " + utils.BaseURL + ": " + err.Error())
+		exit(1)
+	}
 
 	if !credentials.IsLoggedIn() {
-		fmt.Println("Could not connect to Gonzaga Print Services")
-		os.Exit(1)
+		fmt.Println("Could not log in to " + utils.BaseURL)
+		exit(1)
 	}
 
 	return credentials
 }
 
+/*
+Asks for the username, unless the active profile has one, and the password,
+unless GU_PASSWORD is set so that gu can run unattended.
+*/
+func askCredentials() (string, string) {
+	username := activeProfile.Username
+	if username == "" {
+		fmt.Print("Username for '" + utils.BaseURL + "': ")
+		fmt.Scanln(&username)
+	}
+	if password := os.Getenv("GU_PASSWORD"); password != "" {
+		return username, password
+	}
+	password, _ := speakeasy.Ask("Password for '" + username + "' at '" + utils.BaseURL + "': ")
+
+	return username, password
+}
+
+/*
+Logs in for a long running command. The session logs in again by itself
+when PaperCut expires it. Exits if login fails.
+*/
+func startSession(ctx context.Context) *utils.Session {
+	username, password := askCredentials()
+
+	session, err := utils.NewSession(ctx, username, password)
+	if err != nil {
+		fmt.Println("Could not log in to " + utils.BaseURL + ": " + err.Error())
+		exit(1)
+	}
+
+	return session
+}
+
+// exitInterrupted is the exit status after SIGINT or SIGTERM, 128 + SIGINT
+// as shells report it.
+const exitInterrupted = 130
+
+/*
+Returns a context that is cancelled on SIGINT or SIGTERM, so that a print
+job in flight can be stopped and cleaned up on the server. Once it has
+been cancelled the signals are released, and a second Ctrl-C exits at once.
+*/
+func trapInterrupt(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(parent, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+/*
+Exits with exitInterrupted if err comes from a cancelled context.
+*/
+func exitIfInterrupted(err error) {
+	if !errors.Is(err, context.Canceled) {
+		return
+	}
+
+	fmt.Println()
+	if err == context.Canceled {
+		fmt.Println("Interrupted, the print job was cancelled.")
+	} else {
+		fmt.Println("Interrupted: " + err.Error())
+	}
+	exit(exitInterrupted)
+}
+
+// tempDirs are removed by exit, which deferred calls do not get to.
+var tempDirs []string
+
+/*
+Removes tempDirs and exits with status. Use it instead of os.Exit once a
+temporary directory has been made.
+*/
+func exit(status int) {
+	for _, dir := range tempDirs {
+		os.RemoveAll(dir)
+	}
+	os.Exit(status)
+}
+
 /*
 Extracts the filePath from command line args. Exits if no file path.
 */
-func getFilePath() string {
+func getFilePath(args []string) string {
 
-	if len(os.Args) < 3 {
+	if len(args) < 1 {
 		fmt.Println("Need to specify a file to print!")
-		os.Exit(1)
+		exit(1)
+	}
+
+	return args[0]
+}
+
+/*
+Counts the pages of the document locally and shows what the job will cost.
+Asks the user to confirm when the estimate is above the confirm_above
+threshold or more than the account balance, unless --yes or --dry-run
+was given.
+Exits if the user declines.
+*/
+func confirmCost(credentials *utils.PaperCutCredentials, printer utils.PaperCutPrinter, copies int, filePath string) {
+	pages, err := utils.CountPages(filePath)
+	if err != nil {
+		fmt.Println("Page count unknown (" + err.Error() + "), PaperCut will charge after rendering.")
+		return
+	}
+
+	sheets := pages * copies
+	costPerPage, ok := printer.GetCostPerPage()
+	if !ok && viper.IsSet("cost_per_page") {
+		costPerPage, ok = viper.GetFloat64("cost_per_page"), true
+	}
+	if !ok {
+		fmt.Printf("%d pages x %d copies = %d pages, cost per page unknown.\n", pages, copies, sheets)
+		return
+	}
+
+	estimate := float64(sheets) * costPerPage
+	fmt.Printf("%d pages x %d copies at $%.2f per page = $%.2f\n", pages, copies, costPerPage, estimate)
+
+	balance, hasBalance := credentials.GetBalance()
+	insufficient := hasBalance && balance < estimate
+	if hasBalance {
+		fmt.Printf("Your balance is $%.2f.\n", balance)
+	}
+	if insufficient {
+		fmt.Println("Your balance is not enough to cover this job!")
+	}
+
+	if assumeYes || dryRun || (!insufficient && estimate <= viper.GetFloat64("confirm_above")) {
+		return
+	}
+
+	var answer string
+	fmt.Print("Continue printing? [y/N]: ")
+	fmt.Scanln(&answer)
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	if answer != "y" && answer != "yes" {
+		fmt.Println("Print job cancelled.")
+		exit(1)
+	}
+}
+
+/*
+Builds the converter registry for filePath: the external converters
+configured in ~/.gu.yaml, followed by the built-in Markdown typesetter,
+which a converter from text/markdown takes the place of.
+*/
+func converterRegistry(filePath string) *utils.ConverterRegistry {
+	registry := utils.NewConverterRegistry()
+
+	var configs []utils.ExternalConverterConfig
+	if err := viper.UnmarshalKey("converters", &configs); err != nil {
+		fmt.Println("Invalid converters in config file: " + err.Error())
+		exit(1)
+	}
+
+	for _, config := range configs {
+		converter, err := utils.NewExternalConverter(config)
+		if err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
+		registry.Register(converter)
+	}
+	registry.Register(utils.MarkdownConverter{BaseDir: filepath.Dir(filePath)})
+
+	return registry
+}
+
+/*
+Converts documents PaperCut does not accept into a type it does.
+Returns the path of the file to upload. Exits if conversion fails.
+*/
+func convertDocument(filePath string) string {
+	uploadPath, err := converterRegistry(filePath).ConvertFile(context.Background(), filePath)
+	if err != nil {
+		fmt.Println("Could not convert " + filePath + ": " + err.Error())
+		exit(1)
+	}
+
+	return uploadPath
+}
+
+/*
+Shows the steps of a print job as it goes through the wizard. On a terminal
+the upload progress is kept to one line that is written over; errors are
+left to the caller.
+*/
+func showProgress(e utils.Event) {
+	line := e.String()
+	line = strings.ToUpper(line[:1]) + line[1:]
+
+	switch e.Type {
+	case utils.EventUploading:
+		if isTerminal(os.Stdout) {
+			fmt.Print("\r" + line)
+		}
+		return
+	case utils.EventUploaded:
+		if isTerminal(os.Stdout) {
+			fmt.Print("\r\033[K")
+		}
+	case utils.EventFailed:
+		if e.Err != nil {
+			if isTerminal(os.Stdout) {
+				fmt.Print("\r\033[K")
+			}
+			return
+		}
+	}
+	fmt.Println(line + ".")
+}
+
+/*
+Reads the hooks from $HOME/.gu.yaml. Exits if a hook command cannot be
+found.
+*/
+func printHooks() utils.HookConfig {
+	var hooks utils.HookConfig
+	if err := viper.UnmarshalKey("hooks", &hooks); err != nil {
+		fmt.Println("Invalid hooks in config file: " + err.Error())
+		exit(1)
+	}
+	if err := hooks.Validate(); err != nil {
+		fmt.Println(err)
+		exit(1)
+	}
+	return hooks
+}
+
+/*
+Follows job until it has printed, failed or was cancelled, and then runs
+the hooks its events called for. Exits unless it printed.
+*/
+func waitForJob(ctx context.Context, credentials *utils.PaperCutCredentials, submitted utils.PaperCutJob, hooks *utils.HookQueue, opts []utils.PrintOption) {
+	job, err := utils.WatchPrintJob(ctx, credentials, submitted, jobWatchInterval, opts...)
+	hooks.Run()
+	if errors.Is(err, context.Canceled) {
+		fmt.Println()
+		fmt.Println("Stopped waiting, job " + submitted.GetJobID() + " was not cancelled.")
+		exit(exitInterrupted)
+	}
+	if err != nil {
+		fmt.Println("Could not follow the job: " + err.Error())
+		exit(1)
+	}
+	if utils.StatusEvent(job).Type != utils.EventPrinted {
+		fmt.Println("Job " + job.GetJobID() + " was not printed.")
+		exit(1)
+	}
+}
+
+var (
+	assumeYes    bool
+	dryRun       bool
+	queueJob     bool
+	printAt      string
+	printPrinter string
+	printCopies  int
+	printWait    bool
+)
+
+/*
+Picks the printer from --printer, or asks after showing the list. Exits if
+the named printer does not exist.
+*/
+func choosePrinter(printers map[int]utils.PaperCutPrinter) utils.PaperCutPrinter {
+	if printPrinter == "" {
+		printTable(printers)
+		return selectPrinter(printers)
 	}
 
-	return os.Args[2]
+	id, ok := utils.FindPrinter(printers, printPrinter)
+	if !ok {
+		fmt.Println("No printer called " + printPrinter + " at " + utils.BaseURL)
+		exit(1)
+	}
+	return printers[id]
+}
+
+/*
+Returns the username to queue a job for without logging in: the profile's,
+or asks for it.
+*/
+func spoolUsername() string {
+	username := activeProfile.Username
+	if username == "" {
+		fmt.Print("Username for '" + utils.BaseURL + "': ")
+		fmt.Scanln(&username)
+	}
+	return username
 }
 
 // printCmd represents the print command
@@ -132,6 +451,7 @@ Examples
 gu print homework.pdf
 gu print concreteReport.docx
 gu print /home/family_photo.jpg
+gu print design.md
 
 Supported Document Types
 
@@ -145,6 +465,9 @@ Supported Document Types
 +-------------------------+-------------------------------------------+
 | Microsoft Word          | doc, docm, docx, dot, dotm, dotx, rtf     |
 +-------------------------+-------------------------------------------+
+| Markdown                | md, markdown, mdown, mkd                  |
+|                         | (typeset to PDF before upload)            |
++-------------------------+-------------------------------------------+
 | PDF                     | pdf                                       |
 +-------------------------+-------------------------------------------+
 | Picture Files           | bmp, dib, gif, jfif, jif, jpe, jpeg, jpg, |
@@ -152,20 +475,190 @@ Supported Document Types
 +-------------------------+-------------------------------------------+
 | XPS                     | xps                                       |
 +-------------------------+-------------------------------------------+
+
+Other document types can be printed by registering external converters
+in $HOME/.gu.yaml. Converters are chained until PaperCut accepts the
+result. {input}, {output} and {outdir} are replaced with temporary paths;
+without them the document is piped through stdin and stdout. A converter
+from text/markdown is used instead of the built-in Markdown typesetter.
+
+converters:
+  - name: pandoc
+    from: [text/x-rst, text/html]
+    to: application/pdf
+    command: pandoc -o {output} {input}
+  - name: libreoffice
+    from: [application/vnd.oasis.opendocument.text]
+    to: application/pdf
+    command: libreoffice --headless --convert-to pdf --outdir {outdir} {input}
+
+Cost Estimates
+
+Before printing, the pages of PDFs and images are counted locally and
+multiplied by the copies and the printer's cost per page. You are asked
+to confirm when the estimate is above confirm_above (default $1.00) or
+more than your balance. Set cost_per_page in $HOME/.gu.yaml for printers
+that do not list a cost, and pass --yes to skip the confirmation.
+
+Dry Run
+
+gu print --dry-run homework.pdf logs in, lets you pick a printer, runs the
+checks above and shows the requests that would log in and go through the
+print wizard, with passwords and cookies redacted. None of them is sent,
+so the document is never uploaded.
+
+Retries
+
+Requests that fail because of a dropped connection, a timeout or a busy
+server are sent again with a growing delay, up to four times. If the
+wizard fails part way it starts again from printer selection. When the
+upload fails without a clear answer, gu checks your job list before
+uploading again, so a document is never printed twice.
+
+Pressing Ctrl-C while the document is being sent stops the upload and
+cancels the job on the server if it already arrived. gu then exits with
+status 130. Press Ctrl-C a second time to exit without cleaning up.
+
+Offline Spool
+
+When the server cannot be reached, the document is kept in the offline
+spool for the printer from --printer or the profile, and printed later
+by gu queue flush or gu daemon. --queue spools it without trying the
+server. See gu queue --help.
+
+Waiting and Hooks
+
+gu print --wait follows the job until it has printed, failed or was
+cancelled, and exits with status 1 unless it printed. Commands set under
+hooks in $HOME/.gu.yaml run when the job is in the job list (on_submit),
+has printed (on_printed), or could not be sent, failed or was cancelled
+(on_failed). Only --wait sees a job print or fail after it was sent.
+Hooks run once gu is done sending or following the job, so that a slow
+hook does not hold it up, and are killed after a minute.
+
+Hooks are run without a shell and get the job as JSON on stdin and in the
+variables GU_HOOK, GU_JOB_ID, GU_FILE, GU_DOCUMENT, GU_PRINTER,
+GU_COPIES, GU_STATUS, GU_ERROR, GU_SERVER and GU_USERNAME.
+
+hooks:
+  on_printed: sh -c 'notify-send "Printed $GU_DOCUMENT"'
+  on_failed: /home/me/bin/requeue-print
+
+Scheduled Printing
+
+gu print --at 07:45 handout.pdf keeps the document in the spool until
+07:45, so that it does not wait on the tray overnight. See gu scheduler
+--help for the times --at understands and how the jobs are printed.
 	`,
 	Run: func(cmd *cobra.Command, args []string) {
 		// TODO: Work your own magic here
 
-		filePath := getFilePath()
-		credentials := login()
-		printers := utils.GetPaperCutPrinters(credentials)
-		printTable(printers)
-		printer := selectPrinter(printers)
-		copies := selectCopies()
-		utils.CreatePrintJob(credentials, &printer, copies, filePath)
+		filePath := getFilePath(args)
+		if printCopies < 0 {
+			fmt.Println("Not a valid number of copies!")
+			exit(1)
+		}
+		if printWait && (queueJob || printAt != "" || dryRun) {
+			fmt.Println("--wait cannot be used with --queue, --at or --dry-run.")
+			exit(1)
+		}
+		hooks := printHooks()
+		scheduledAt = parseAtFlag()
+		uploadPath := convertDocument(filePath)
+		if uploadPath != filePath {
+			tempDirs = append(tempDirs, filepath.Dir(uploadPath))
+			defer os.RemoveAll(filepath.Dir(uploadPath))
+		}
+		if err := utils.CheckDocument(uploadPath); err != nil {
+			fmt.Println("Cannot print " + filePath + ": " + err.Error())
+			exit(1)
+		}
+		if queueJob {
+			printer := spoolPrinter()
+			queueDocument(filePath, uploadPath, printer, spoolCopies(), spoolUsername())
+			return
+		}
+
+		ctx := context.Background()
+		username, password := askCredentials()
+		credentials, err := utils.CreatePaperCutCredentials(ctx, username, password)
+		if err != nil && utils.IsTemporary(err) && viper.GetBool("spool_offline") && !dryRun {
+			fmt.Println("Could not connect to " + utils.BaseURL + ": " + err.Error())
+			queueDocument(filePath, uploadPath, spoolPrinter(), spoolCopies(), username)
+			return
+		}
+		credentials = checkLogin(credentials, err)
+
+		printers, err := utils.GetPaperCutPrinters(ctx, credentials)
+		if err != nil {
+			fmt.Println("Could not list printers: " + err.Error())
+			exit(1)
+		}
+		printer := choosePrinter(printers)
+		copies := printCopies
+		if copies == 0 {
+			copies = selectCopies()
+		}
+		confirmCost(credentials, printer, copies, uploadPath)
+
+		if scheduledAt != nil {
+			cacheSession(username, credentials.GetSessionID())
+			queueDocument(filePath, uploadPath, strings.TrimSpace(printer.GetName()), copies, username)
+			return
+		}
+
+		ctx, stop := trapInterrupt(ctx)
+		defer stop()
+
+		if dryRun {
+			fmt.Println()
+			if err := utils.DryRunPrintJob(ctx, credentials, &printer, copies, uploadPath, os.Stdout); err != nil {
+				exitIfInterrupted(err)
+				fmt.Println("Dry run failed: " + err.Error())
+				exit(1)
+			}
+			fmt.Println("Dry run: " + filePath + " was not uploaded.")
+			return
+		}
+
+		opts := []utils.PrintOption{utils.WithEvents(showProgress)}
+		if hooks.IsEmpty() && !printWait {
+			if err := utils.CreatePrintJob(ctx, credentials, &printer, copies, uploadPath, opts...); err != nil {
+				exitIfInterrupted(err)
+				fmt.Println("Could not print " + filePath + ": " + err.Error())
+				exit(1)
+			}
+
+			fmt.Println("Printing " + strconv.Itoa(copies) + " copies of " +
+				filePath + " to printer " + printer.GetName() + ".")
+			return
+		}
+
+		// Hooks need the job, so it is looked up in the job list.
+		hookQueue := utils.NewHookQueue(hooks, utils.HookJob{
+			File:     filePath,
+			Document: filepath.Base(filePath),
+			Printer:  strings.TrimSpace(printer.GetName()),
+			Copies:   copies,
+			Server:   utils.BaseURL,
+			Username: username,
+		}, func(err error) {
+			fmt.Println(err)
+		})
+		opts = append(opts, hookQueue.Events())
+		job, err := utils.SubmitPrintJob(ctx, credentials, &printer, copies, uploadPath, opts...)
+		hookQueue.Run()
+		if err != nil {
+			exitIfInterrupted(err)
+			fmt.Println("Could not print " + filePath + ": " + err.Error())
+			exit(1)
+		}
 
 		fmt.Println("Printing " + strconv.Itoa(copies) + " copies of " +
-			filePath + " to printer " + printer.GetName() + ".")
+			filePath + " to printer " + printer.GetName() + " as job " + job.GetJobID() + ".")
+		if printWait {
+			waitForJob(ctx, credentials, job, hookQueue, opts)
+		}
 
 	},
 }
@@ -173,6 +666,15 @@ Supported Document Types
 func init() {
 	RootCmd.AddCommand(printCmd)
 
+	printCmd.Flags().BoolVarP(&assumeYes, "yes", "y", false, "Print without asking to confirm the cost")
+	printCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Show the requests of the print wizard without sending them")
+	printCmd.Flags().BoolVar(&queueJob, "queue", false, "Put the document in the offline spool without contacting the server")
+	printCmd.Flags().StringVar(&printPrinter, "printer", "", "Name or ID of the printer, instead of asking")
+	printCmd.Flags().IntVar(&printCopies, "copies", 0, "Number of copies, instead of asking")
+	printCmd.Flags().BoolVar(&printWait, "wait", false, "Wait until the job has printed, failed or was cancelled")
+	printCmd.Flags().StringVar(&printAt, "at", "", "Print later, at a time such as 07:45, tomorrow or \"friday 13:00\"")
+	viper.SetDefault("confirm_above", 1.00)
+
 	// Here you will define your flags and configuration settings.
 
 	// Cobra supports Persistent Flags which will work for this command
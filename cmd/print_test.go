@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestConfiguredConverterBeforeMarkdown(t *testing.T) {
+	viper.Set("converters", []map[string]interface{}{
+		{"name": "cat", "from": []string{"text/markdown"}, "to": "application/pdf", "command": "cat"},
+	})
+	defer viper.Set("converters", nil)
+
+	out, outType, err := converterRegistry(t.TempDir()).ConvertToAccepted(context.Background(), strings.NewReader("%PDF-1.4\n"), "text/markdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	converted, _ := ioutil.ReadAll(out)
+	if outType != "application/pdf" || string(converted) != "%PDF-1.4\n" {
+		t.Errorf("converted to %s %q, want the output of cat", outType, converted)
+	}
+}
+
+func TestExitRemovesTempDirs(t *testing.T) {
+	if dir := os.Getenv("GU_TEST_TEMP_DIR"); dir != "" {
+		tempDirs = append(tempDirs, dir)
+		exit(3)
+	}
+
+	dir := filepath.Join(t.TempDir(), "converted")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestExitRemovesTempDirs$")
+	cmd.Env = append(os.Environ(), "GU_TEST_TEMP_DIR="+dir)
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 3 {
+		t.Fatalf("exit = %v, want status 3", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("%s is still there", dir)
+	}
+}
+
+func TestInterruptExits(t *testing.T) {
+	switch os.Getenv("GU_TEST_INTERRUPT") {
+	case "cancelled":
+		exitIfInterrupted(fmt.Errorf("uploading: %w", context.Canceled))
+		exit(0)
+	case "failed":
+		exitIfInterrupted(errors.New("printer refused the job"))
+		exit(0)
+	case "signal":
+		ctx, stop := trapInterrupt(context.Background())
+		defer stop()
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+		select {
+		case <-ctx.Done():
+			exitIfInterrupted(ctx.Err())
+		case <-time.After(5 * time.Second):
+		}
+		exit(0)
+	}
+
+	for _, test := range []struct {
+		env    string
+		status int
+	}{
+		{"cancelled", exitInterrupted},
+		{"failed", 0},
+		{"signal", exitInterrupted},
+	} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestInterruptExits$")
+		cmd.Env = append(os.Environ(), "GU_TEST_INTERRUPT="+test.env)
+		out, err := cmd.CombinedOutput()
+		status := 0
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			status = exitErr.ExitCode()
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if status != test.status {
+			t.Errorf("%s: exit status %d, want %d:\n%s", test.env, status, test.status, out)
+		}
+		if test.status == exitInterrupted && !strings.Contains(string(out), "Interrupted") {
+			t.Errorf("%s: no message:\n%s", test.env, out)
+		}
+	}
+}
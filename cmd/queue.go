@@ -0,0 +1,338 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/quantamhd/gu/spool"
+	"github.com/quantamhd/gu/utils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var dropAll bool
+
+/*
+Opens the spool in spool_dir from $HOME/.gu.yaml, by default
+$HOME/.gu/spool. Exits if it cannot be created.
+*/
+func openSpool() *spool.Spool {
+	dir := expandHome(viper.GetString("spool_dir"))
+	if dir == "" {
+		dir = filepath.Join(guDir(), "spool")
+	}
+
+	sp, err := spool.Open(dir)
+	if err != nil {
+		fmt.Println("Could not open the spool: " + err.Error())
+		exit(1)
+	}
+	return sp
+}
+
+/*
+Returns the printer to queue a job for, from --printer or the profile.
+Exits if there is none, since the printer list cannot be shown offline.
+*/
+func spoolPrinter() string {
+	printer := printPrinter
+	if printer == "" {
+		printer = activeProfile.Printer
+	}
+	if printer == "" {
+		fmt.Println("Pass --printer, or set a printer in the profile, to queue a job without the printer list.")
+		exit(1)
+	}
+	return printer
+}
+
+// Returns the copies from --copies, or asks.
+func spoolCopies() int {
+	if printCopies > 0 {
+		return printCopies
+	}
+	return selectCopies()
+}
+
+/*
+Stores the document at uploadPath in the spool, to be printed from filePath
+by username on printer, at the time given with --at or as soon as possible.
+*/
+func queueDocument(filePath string, uploadPath string, printer string, copies int, username string) {
+	job, err := openSpool().Add(uploadPath, filePath, spool.Job{
+		Server:   utils.BaseURL,
+		Username: username,
+		Printer:  printer,
+		Copies:   copies,
+		At:       scheduledAt,
+	})
+	if err != nil {
+		fmt.Println("Could not queue " + filePath + ": " + err.Error())
+		exit(1)
+	}
+
+	if job.At != nil {
+		fmt.Println("Scheduled " + filePath + " as job " + strconv.Itoa(job.ID) + " for printer " + printer +
+			" at " + job.At.Format(scheduleFormat) + ".")
+		fmt.Println("It is printed by gu daemon or gu scheduler run, see gu scheduler --help.")
+		return
+	}
+	fmt.Println("Queued " + filePath + " as job " + strconv.Itoa(job.ID) + " for printer " + printer + ".")
+	fmt.Println("It is printed by gu queue flush, or by gu daemon once " + utils.BaseURL + " can be reached.")
+}
+
+// Describes the state of a spooled job.
+func spoolStatus(job spool.Job) string {
+	switch {
+	case job.IsSending():
+		return "sending"
+	case job.Failed:
+		return "failed: " + job.LastError
+	case job.Unconfirmed:
+		return "may have printed, check the PaperCut job list before flushing it by ID: " + job.LastError
+	case !job.IsDue(time.Now()):
+		return "scheduled for " + job.At.Format(scheduleFormat)
+	case job.LastError != "":
+		return "waiting, last try: " + job.LastError
+	}
+	return "waiting"
+}
+
+// Reports whether job is for the current server and username.
+func spoolJobIsFor(job spool.Job, username string) bool {
+	return strings.TrimSuffix(job.Server, "/") == strings.TrimSuffix(utils.BaseURL, "/") &&
+		strings.EqualFold(job.Username, username)
+}
+
+/*
+Sends the spooled jobs of the session's user on the current server. Jobs
+named in ids are sent even if PaperCut refused them before, their last
+upload went unanswered or they are scheduled for later; without ids those
+are skipped. Returns how many jobs were sent, and stops with the error at
+the first failure that means the server is out of reach.
+*/
+func flushSpool(ctx context.Context, sp *spool.Spool, session *utils.Session, ids []int, logger *log.Logger) (int, error) {
+	jobs, err := sp.List()
+	if err != nil {
+		return 0, err
+	}
+
+	wanted := map[int]bool{}
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	now := time.Now()
+	var todo []spool.Job
+	for _, job := range jobs {
+		if len(wanted) > 0 && !wanted[job.ID] {
+			continue
+		}
+		if len(wanted) == 0 && (job.Failed || job.Unconfirmed || !job.IsDue(now)) {
+			continue
+		}
+		if !spoolJobIsFor(job, session.GetUsername()) {
+			continue
+		}
+		todo = append(todo, job)
+	}
+	if len(todo) == 0 {
+		return 0, nil
+	}
+
+	printers, err := session.Printers(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, job := range todo {
+		job, ok, err := sp.Claim(job.ID)
+		if err != nil {
+			return sent, err
+		}
+		if !ok {
+			continue
+		}
+
+		id, found := utils.FindPrinter(printers, job.Printer)
+		if !found {
+			err := errors.New("no printer called " + job.Printer + " at " + utils.BaseURL)
+			logger.Printf("Spooled job %d (%s): %v", job.ID, job.Name, err)
+			sp.Release(job.ID, err, true)
+			continue
+		}
+		printer := printers[id]
+
+		_, err = session.Submit(ctx, &printer, job.Copies, sp.Path(job),
+			utils.LogEvents(logger, fmt.Sprintf("Spooled job %d (%s)", job.ID, job.Name)))
+		if errors.Is(err, utils.ErrUploadOutcomeUnknown) {
+			sp.Unconfirm(job.ID, err)
+			logger.Printf("Spooled job %d (%s): %v; it is kept until flushed by ID", job.ID, job.Name, err)
+			continue
+		}
+		if err != nil {
+			unreachable := ctx.Err() != nil || utils.IsTemporary(err)
+			sp.Release(job.ID, err, !unreachable)
+			if unreachable {
+				return sent, err
+			}
+			logger.Printf("Spooled job %d (%s): %v", job.ID, job.Name, err)
+			continue
+		}
+
+		if err := sp.Remove(job.ID); err != nil {
+			logger.Printf("Spooled job %d (%s): printed, but %v", job.ID, job.Name, err)
+		}
+		sent++
+	}
+
+	return sent, nil
+}
+
+/*
+Parses job IDs given as arguments. Exits if one is not a number.
+*/
+func spoolIDs(args []string) []int {
+	var ids []int
+	for _, arg := range args {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			fmt.Println("Not a valid job ID: " + arg)
+			os.Exit(1)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// queueCmd represents the queue command
+var queueCmd = &cobra.Command{
+	Use:   "queue",
+	Short: "Manages the jobs waiting in the offline spool",
+	Long: `When the PaperCut server cannot be reached, gu print keeps the document
+and its printer and copies in a spool directory, $HOME/.gu/spool unless
+spool_dir is set in $HOME/.gu.yaml. gu print --queue spools a document
+without trying the server at all. Set spool_offline to false to turn the
+automatic fallback off.
+
+Spooled jobs are printed by gu queue flush, or by gu daemon, which tries
+again with a growing delay until the server answers. Jobs scheduled with
+gu print --at wait until they are due, unless flushed by ID. Jobs are only
+sent to the server and as the user they were queued for.
+
+A job whose upload got no answer may have reached PaperCut, so it is not
+sent again until it is flushed by ID; check the PaperCut job list first.
+
+Examples
+
+gu print --queue --printer library-bw --copies 2 essay.pdf
+gu queue list
+gu queue flush
+gu queue drop 3
+	`,
+}
+
+var queueListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the spooled jobs",
+	Run: func(cmd *cobra.Command, args []string) {
+		jobs, err := openSpool().List()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if len(jobs) == 0 {
+			fmt.Println("The spool is empty.")
+			return
+		}
+
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetHeader([]string{"ID", "document", "printer", "copies", "queued", "server", "status"})
+		for _, job := range jobs {
+			table.Append([]string{
+				strconv.Itoa(job.ID),
+				job.Name,
+				job.Printer,
+				strconv.Itoa(job.Copies),
+				job.Queued.Format("2006-01-02 15:04"),
+				job.Username + " at " + job.Server,
+				spoolStatus(job),
+			})
+		}
+		table.Render()
+	},
+}
+
+var queueFlushCmd = &cobra.Command{
+	Use:   "flush [job-id...]",
+	Short: "Prints the spooled jobs now",
+	Long: `This command logs in and sends the spooled jobs for the current server
+and user. Jobs PaperCut refused before are skipped unless named by ID.
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ids := spoolIDs(args)
+		sp := openSpool()
+
+		ctx, stop := trapInterrupt(context.Background())
+		defer stop()
+
+		session := startSession(ctx)
+		sent, err := flushSpool(ctx, sp, session, ids, log.New(os.Stdout, "", 0))
+		if err != nil {
+			exitIfInterrupted(err)
+			fmt.Println("Stopped flushing the spool: " + err.Error())
+			os.Exit(1)
+		}
+		fmt.Println(strconv.Itoa(sent) + " spooled jobs printed.")
+	},
+}
+
+var queueDropCmd = &cobra.Command{
+	Use:   "drop <job-id...>",
+	Short: "Removes jobs from the spool without printing them",
+	Run: func(cmd *cobra.Command, args []string) {
+		sp := openSpool()
+		ids := spoolIDs(args)
+		if dropAll {
+			jobs, err := sp.List()
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			for _, job := range jobs {
+				ids = append(ids, job.ID)
+			}
+		}
+		if len(ids) == 0 {
+			fmt.Println("Name the jobs to drop, or pass --all.")
+			os.Exit(1)
+		}
+
+		for _, id := range ids {
+			if err := sp.Remove(id); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			fmt.Println("Dropped job " + strconv.Itoa(id) + ".")
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(queueCmd)
+	queueCmd.AddCommand(queueListCmd)
+	queueCmd.AddCommand(queueFlushCmd)
+	queueCmd.AddCommand(queueDropCmd)
+
+	queueDropCmd.Flags().BoolVar(&dropAll, "all", false, "Drop every spooled job")
+	viper.SetDefault("spool_offline", true)
+}
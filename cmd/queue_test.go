@@ -0,0 +1,173 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quantamhd/gu/papercuttest"
+	"github.com/quantamhd/gu/spool"
+	"github.com/quantamhd/gu/utils"
+)
+
+// newTestSpool starts a fake PaperCut server for the whole program and
+// returns a session on it and an empty spool.
+func newTestSpool(t *testing.T) (*papercuttest.Server, *utils.Session, *spool.Spool) {
+	t.Helper()
+	srv := papercuttest.NewServer()
+	t.Cleanup(srv.Close)
+
+	baseURL, retry := utils.BaseURL, utils.Retry
+	utils.BaseURL = srv.URL
+	utils.Retry = utils.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	t.Cleanup(func() { utils.BaseURL, utils.Retry = baseURL, retry })
+
+	session, err := utils.NewSession(context.Background(), "student", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp, err := spool.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, session, sp
+}
+
+// spoolDocument spools a one page PDF called name for the fake server's
+// default user.
+func spoolDocument(t *testing.T, sp *spool.Spool, name string, printer string, copies int) spool.Job {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte("%PDF-1.4\n1 0 obj << /Type /Page >> endobj\n%%EOF\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	job, err := sp.Add(path, path, spool.Job{Server: utils.BaseURL, Username: "student", Printer: printer, Copies: copies})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestFlushSpool(t *testing.T) {
+	srv, session, sp := newTestSpool(t)
+	spoolDocument(t, sp, "essay.pdf", "library-bw", 2)
+	other := spoolDocument(t, sp, "other.pdf", "library-bw", 1)
+	other.Username = "someone-else"
+	if _, err := sp.Add(sp.Path(other), "other.pdf", other); err != nil {
+		t.Fatal(err)
+	}
+	sp.Remove(other.ID)
+
+	sent, err := flushSpool(context.Background(), sp, session, nil, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 1 {
+		t.Fatalf("sent %d jobs, want 1", sent)
+	}
+
+	uploads := srv.Jobs()
+	if len(uploads) != 1 || uploads[0].Document != "essay.pdf" || uploads[0].Copies != 2 {
+		t.Fatalf("server jobs = %v, want essay.pdf with 2 copies", uploads)
+	}
+	if jobs, _ := sp.List(); len(jobs) != 1 || jobs[0].Username != "someone-else" {
+		t.Errorf("spool = %v, want only the job of someone-else", jobs)
+	}
+}
+
+func TestFlushSpoolUnknownPrinter(t *testing.T) {
+	srv, session, sp := newTestSpool(t)
+	job := spoolDocument(t, sp, "essay.pdf", "basement", 1)
+
+	sent, err := flushSpool(context.Background(), sp, session, nil, log.New(ioutil.Discard, "", 0))
+	if err != nil || sent != 0 {
+		t.Fatalf("flushSpool = %d, %v; want 0, nil", sent, err)
+	}
+	if len(srv.Jobs()) != 0 {
+		t.Fatal("a job was sent to an unknown printer")
+	}
+
+	jobs, _ := sp.List()
+	if len(jobs) != 1 || jobs[0].ID != job.ID || !jobs[0].Failed {
+		t.Fatalf("spool = %v, want job %d marked failed", jobs, job.ID)
+	}
+}
+
+func TestFlushSpoolUnavailable(t *testing.T) {
+	srv, session, sp := newTestSpool(t)
+	job := spoolDocument(t, sp, "essay.pdf", "library-bw", 1)
+
+	srv.Fail(papercuttest.Unavailable)
+	sent, err := flushSpool(context.Background(), sp, session, nil, log.New(ioutil.Discard, "", 0))
+	if err == nil || !utils.IsTemporary(err) || sent != 0 {
+		t.Fatalf("flushSpool = %d, %v; want 0 and a temporary error", sent, err)
+	}
+
+	jobs, _ := sp.List()
+	if len(jobs) != 1 || jobs[0].ID != job.ID || jobs[0].Failed || jobs[0].IsSending() {
+		t.Fatalf("spool = %+v, want job %d still waiting", jobs, job.ID)
+	}
+
+	srv.Recover()
+	if sent, err := flushSpool(context.Background(), sp, session, nil, log.New(ioutil.Discard, "", 0)); err != nil || sent != 1 {
+		t.Fatalf("flushSpool after recovering = %d, %v; want 1, nil", sent, err)
+	}
+	if len(srv.Jobs()) != 1 {
+		t.Fatalf("server has %d jobs, want 1", len(srv.Jobs()))
+	}
+}
+
+// dropUploads reads every upload and drops the connection without passing
+// it on, so that it is not known whether the document arrived.
+type dropUploads struct {
+	uploads int
+}
+
+func (d *dropUploads) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasPrefix(req.URL.Path, "/upload/") {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+	d.uploads++
+	ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	return nil, &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+}
+
+func TestFlushSpoolUploadOutcomeUnknown(t *testing.T) {
+	_, session, sp := newTestSpool(t)
+	job := spoolDocument(t, sp, "essay.pdf", "library-bw", 1)
+
+	transport := &dropUploads{}
+	defer func(previous http.RoundTripper) { utils.Transport = previous }(utils.Transport)
+	utils.Transport = transport
+
+	for i := 0; i < 2; i++ {
+		sent, err := flushSpool(context.Background(), sp, session, nil, log.New(ioutil.Discard, "", 0))
+		if err != nil || sent != 0 {
+			t.Fatalf("flushSpool = %d, %v; want 0, nil", sent, err)
+		}
+	}
+	if transport.uploads != 1 {
+		t.Fatalf("the document was uploaded %d times, want once", transport.uploads)
+	}
+
+	jobs, _ := sp.List()
+	if len(jobs) != 1 || jobs[0].ID != job.ID || !jobs[0].Unconfirmed || jobs[0].Failed || jobs[0].IsSending() {
+		t.Fatalf("spool = %+v, want job %d unconfirmed", jobs, job.ID)
+	}
+
+	// Flushing it by ID sends it again.
+	if _, err := flushSpool(context.Background(), sp, session, []int{job.ID}, log.New(ioutil.Discard, "", 0)); err != nil {
+		t.Fatal(err)
+	}
+	if transport.uploads != 2 {
+		t.Fatalf("the document was uploaded %d times, want twice", transport.uploads)
+	}
+}
@@ -17,12 +17,49 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"strings"
 
+	"github.com/quantamhd/gu/utils"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
-var cfgFile string
+var (
+	cfgFile      string
+	traceHTTP    bool
+	serverURL    string
+	harFile      string
+	cassetteFile string
+	profileName  string
+	caFiles      []string
+	insecure     bool
+	clientCert   string
+	clientKey    string
+	proxyURL     string
+)
+
+// connection holds the TLS and proxy settings, which can be given at the top
+// of $HOME/.gu.yaml, per profile or with flags.
+type connection struct {
+	CAFile             []string `mapstructure:"ca_file"`
+	InsecureSkipVerify bool     `mapstructure:"insecure_skip_verify"`
+	ClientCert         string   `mapstructure:"client_cert"`
+	ClientKey          string   `mapstructure:"client_key"`
+	Proxy              string
+	NoProxy            string `mapstructure:"no_proxy"`
+}
+
+// profile is a PaperCut server configured under profiles in $HOME/.gu.yaml.
+type profile struct {
+	URL        string
+	Username   string
+	Printer    string
+	Auth       string
+	connection `mapstructure:",squash"`
+}
+
+// activeProfile is the profile chosen with --profile or the profile key.
+var activeProfile profile
 
 // RootCmd represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
@@ -47,13 +84,23 @@ func Execute() {
 }
 
 func init() {
-	cobra.OnInitialize(initConfig)
+	cobra.OnInitialize(initConfig, initServer, initTransport)
 
 	// Here you will define your flags and configuration settings.
 	// Cobra supports Persistent Flags, which, if defined here,
 	// will be global for your application.
 
 	//RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.gu.yaml)")
+	RootCmd.PersistentFlags().StringVar(&serverURL, "server", "", "PaperCut server URL, overriding the profile (default "+utils.BaseURL+")")
+	RootCmd.PersistentFlags().StringVar(&profileName, "profile", "", "server profile from $HOME/.gu.yaml to use")
+	RootCmd.PersistentFlags().BoolVar(&traceHTTP, "trace", false, "log every HTTP request and response to stderr, with credentials redacted")
+	RootCmd.PersistentFlags().StringVar(&harFile, "har", "", "write the HTTP session to this file in HAR 1.2 format, with credentials redacted")
+	RootCmd.PersistentFlags().StringVar(&cassetteFile, "record", "", "record the PaperCut pages of this session to a cassette file, anonymised, for parser tests")
+	RootCmd.PersistentFlags().StringSliceVar(&caFiles, "ca-file", nil, "PEM bundle of extra certificate authorities to trust, may be repeated")
+	RootCmd.PersistentFlags().BoolVar(&insecure, "insecure", false, "do not verify the server's TLS certificate (unsafe)")
+	RootCmd.PersistentFlags().StringVar(&clientCert, "client-cert", "", "PEM client certificate to authenticate with")
+	RootCmd.PersistentFlags().StringVar(&clientKey, "client-key", "", "PEM private key of the client certificate")
+	RootCmd.PersistentFlags().StringVar(&proxyURL, "proxy", "", "http, https or socks5 proxy URL (default from HTTPS_PROXY and NO_PROXY)")
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	//RootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
@@ -71,6 +118,159 @@ func initConfig() {
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
+		// On stderr, so that output other programs read stays clean.
+		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
+	}
+}
+
+/*
+initServer points gu at the server of the active profile, or at the one
+given with --server. The profile is named with --profile or by the profile
+key of the config file:
+
+	profile: gonzaga
+	profiles:
+	  gonzaga:
+	    url: https://paper-app.gonzaga.edu:9192
+	    username: jdoe
+	    printer: library-bw
+	  partner:
+	    url: https://print.partner.edu
+	    auth: cas
+*/
+func initServer() {
+	name := profileName
+	if name == "" {
+		name = viper.GetString("profile")
+	}
+
+	if name != "" {
+		useProfile(name)
+	}
+
+	if serverURL != "" {
+		utils.BaseURL = strings.TrimSuffix(serverURL, "/")
+	}
+
+	useAuth()
+}
+
+/*
+useProfile makes the profile called name the active one and points gu at
+its server. Exits if there is no such profile.
+*/
+func useProfile(name string) {
+	key := "profiles." + name
+	if !viper.IsSet(key) {
+		fmt.Println("No profile named " + name + " in " + configFileName())
+		os.Exit(1)
+	}
+	activeProfile = profile{}
+	if err := viper.UnmarshalKey(key, &activeProfile); err != nil {
+		fmt.Println("Invalid profile " + name + ": " + err.Error())
+		os.Exit(1)
+	}
+	if activeProfile.URL != "" {
+		utils.BaseURL = strings.TrimSuffix(activeProfile.URL, "/")
+	}
+}
+
+// useAuth sets up the login method of the active profile.
+func useAuth() {
+	auth := activeProfile.Auth
+	if auth == "" {
+		auth = viper.GetString("auth")
+	}
+	switch strings.ToLower(auth) {
+	case "", "form":
+		utils.Auth = utils.FormAuthenticator{}
+	case "cas":
+		utils.Auth = utils.CASAuthenticator{}
+	default:
+		fmt.Println("Unknown auth " + auth + ", use form or cas")
+		os.Exit(1)
+	}
+}
+
+// configFileName names the config file in messages.
+func configFileName() string {
+	if viper.ConfigFileUsed() != "" {
+		return viper.ConfigFileUsed()
+	}
+	return "$HOME/.gu.yaml"
+}
+
+/*
+connectionSettings merges the TLS and proxy settings of the config file,
+the active profile and the flags, in increasing order of precedence.
+*/
+func connectionSettings() connection {
+	var conn connection
+	if err := viper.Unmarshal(&conn); err != nil {
+		fmt.Println("Invalid connection settings: " + err.Error())
+		os.Exit(1)
+	}
+
+	p := activeProfile.connection
+	conn.CAFile = append(conn.CAFile, p.CAFile...)
+	conn.InsecureSkipVerify = conn.InsecureSkipVerify || p.InsecureSkipVerify
+	if p.ClientCert != "" {
+		conn.ClientCert, conn.ClientKey = p.ClientCert, p.ClientKey
+	}
+	if p.Proxy != "" {
+		conn.Proxy = p.Proxy
+	}
+	if p.NoProxy != "" {
+		conn.NoProxy = p.NoProxy
+	}
+
+	conn.CAFile = append(conn.CAFile, caFiles...)
+	conn.InsecureSkipVerify = conn.InsecureSkipVerify || insecure
+	if clientCert != "" {
+		conn.ClientCert, conn.ClientKey = clientCert, clientKey
+	}
+	if proxyURL != "" {
+		conn.Proxy = proxyURL
+	}
+
+	return conn
+}
+
+// initTransport sets up TLS and proxies for PaperCut and wraps the
+// transport for --record, --trace and --har.
+func initTransport() {
+	conn := connectionSettings()
+	transport, err := utils.NewTransport(utils.TransportConfig{
+		CAFiles:            conn.CAFile,
+		InsecureSkipVerify: conn.InsecureSkipVerify,
+		ClientCert:         conn.ClientCert,
+		ClientKey:          conn.ClientKey,
+		Proxy:              conn.Proxy,
+		NoProxy:            conn.NoProxy,
+	})
+	if err != nil {
+		fmt.Println("Could not set up the connection: " + err.Error())
+		os.Exit(1)
+	}
+	utils.Transport = transport
+
+	if conn.InsecureSkipVerify {
+		fmt.Fprintln(os.Stderr, "********************************************************************")
+		fmt.Fprintln(os.Stderr, "WARNING: TLS certificate verification is OFF (--insecure).")
+		fmt.Fprintln(os.Stderr, "Anyone between you and "+utils.BaseURL+" can read your")
+		fmt.Fprintln(os.Stderr, "password and documents. Use --ca-file to trust a private CA instead.")
+		fmt.Fprintln(os.Stderr, "********************************************************************")
+	}
+
+	if cassetteFile != "" {
+		utils.Transport = &utils.CassetteRecorder{Next: utils.Transport, Path: cassetteFile}
+	}
+
+	if harFile != "" {
+		utils.Transport = &utils.HARRecorder{Next: utils.Transport, Path: harFile}
+	}
+
+	if traceHTTP {
+		utils.Transport = &utils.TraceTransport{Next: utils.Transport, Out: os.Stderr}
 	}
 }
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/quantamhd/gu/utils"
+	"github.com/spf13/viper"
+)
+
+// useTestProfiles configures the profiles of the example in initServer's
+// comment and puts everything initServer changes back afterwards.
+func useTestProfiles(t *testing.T) {
+	t.Helper()
+	baseURL, auth := utils.BaseURL, utils.Auth
+	t.Cleanup(func() {
+		utils.BaseURL, utils.Auth = baseURL, auth
+		activeProfile, profileName, serverURL = profile{}, "", ""
+		viper.Set("profile", nil)
+		viper.Set("profiles", nil)
+	})
+
+	viper.Set("profiles", map[string]interface{}{
+		"gonzaga": map[string]interface{}{
+			"url":      "https://paper-app.gonzaga.edu:9192/",
+			"username": "jdoe",
+			"printer":  "library-bw",
+		},
+		"partner": map[string]interface{}{
+			"url":      "https://print.partner.edu/papercut",
+			"auth":     "cas",
+			"proxy":    "http://proxy.partner.edu:3128",
+			"no_proxy": "partner.edu",
+		},
+	})
+}
+
+func TestInitServerProfiles(t *testing.T) {
+	useTestProfiles(t)
+
+	viper.Set("profile", "gonzaga")
+	initServer()
+	if utils.BaseURL != "https://paper-app.gonzaga.edu:9192" {
+		t.Errorf("BaseURL = %s, want the gonzaga server without the trailing slash", utils.BaseURL)
+	}
+	if activeProfile.Username != "jdoe" || activeProfile.Printer != "library-bw" {
+		t.Errorf("active profile = %+v, want gonzaga's", activeProfile)
+	}
+	if _, ok := utils.Auth.(utils.FormAuthenticator); !ok {
+		t.Errorf("Auth = %T, want the login form", utils.Auth)
+	}
+
+	// --profile wins over the profile key, and the active profile is
+	// replaced, not merged.
+	profileName = "partner"
+	initServer()
+	if utils.BaseURL != "https://print.partner.edu/papercut" {
+		t.Errorf("BaseURL = %s, want the partner server", utils.BaseURL)
+	}
+	if activeProfile.Username != "" || activeProfile.Proxy != "http://proxy.partner.edu:3128" || activeProfile.NoProxy != "partner.edu" {
+		t.Errorf("active profile = %+v, want partner's", activeProfile)
+	}
+	if _, ok := utils.Auth.(utils.CASAuthenticator); !ok {
+		t.Errorf("Auth = %T, want CAS", utils.Auth)
+	}
+
+	// --server wins over the profile's URL.
+	serverURL = "http://localhost:9191/"
+	initServer()
+	if utils.BaseURL != "http://localhost:9191" {
+		t.Errorf("BaseURL = %s, want the --server URL", utils.BaseURL)
+	}
+}
+
+func TestMissingProfileExits(t *testing.T) {
+	if os.Getenv("GU_TEST_PROFILE") != "" {
+		useTestProfiles(t)
+		profileName = os.Getenv("GU_TEST_PROFILE")
+		initServer()
+		exit(0)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMissingProfileExits$")
+	cmd.Env = append(os.Environ(), "GU_TEST_PROFILE=library")
+	out, err := cmd.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+		t.Fatalf("exit = %v, want status 1:\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "No profile named library") {
+		t.Errorf("no message about the missing profile:\n%s", out)
+	}
+}
@@ -0,0 +1,382 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/quantamhd/gu/spool"
+	"github.com/quantamhd/gu/utils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// scheduledAt is the time from gu print --at, nil to print at once.
+var scheduledAt *time.Time
+
+// scheduleFormat shows when a scheduled job is due.
+const scheduleFormat = "Mon 2 Jan 15:04"
+
+var clockTime = regexp.MustCompile(`^(\d{1,2}):(\d{2})$`)
+
+/*
+Parses a time of day such as 07:45 into hours and minutes.
+*/
+func parseClock(value string) (int, int, bool) {
+	match := clockTime.FindStringSubmatch(value)
+	if match == nil {
+		return 0, 0, false
+	}
+	hour, _ := strconv.Atoi(match[1])
+	minute, _ := strconv.Atoi(match[2])
+	return hour, minute, hour < 24 && minute < 60
+}
+
+/*
+Parses the time given to --at, relative to now:
+
+	07:45              the next time it is 07:45
+	tomorrow [07:45]   tomorrow
+	friday [07:45]     the next Friday, or today if it is Friday and not yet that time
+	2026-10-21 [07:45] that day
+	+90m               after a delay
+
+Days without a time of day mean schedule_time from $HOME/.gu.yaml.
+*/
+func parseAt(value string, now time.Time) (time.Time, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if strings.HasPrefix(value, "+") {
+		delay, err := time.ParseDuration(value[1:])
+		if err != nil || delay <= 0 {
+			return time.Time{}, errors.New("not a valid delay: " + value)
+		}
+		return now.Add(delay), nil
+	}
+
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields) > 2 {
+		return time.Time{}, errors.New("not a valid time: " + value)
+	}
+
+	hour, minute, hasClock := parseClock(fields[len(fields)-1])
+	if hasClock {
+		fields = fields[:len(fields)-1]
+	} else {
+		var ok bool
+		hour, minute, ok = parseClock(viper.GetString("schedule_time"))
+		if !ok {
+			return time.Time{}, errors.New("schedule_time in config file is not a time such as 07:30")
+		}
+	}
+	if len(fields) > 1 {
+		return time.Time{}, errors.New("not a valid time: " + value)
+	}
+	day := ""
+	if len(fields) == 1 {
+		day = fields[0]
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
+	var at time.Time
+	switch day {
+	case "", "today":
+		at = today
+		if day == "" && !at.After(now) {
+			at = at.AddDate(0, 0, 1)
+		}
+	case "tomorrow":
+		at = today.AddDate(0, 0, 1)
+	default:
+		if date, err := time.ParseInLocation("2006-01-02", day, now.Location()); err == nil {
+			at = time.Date(date.Year(), date.Month(), date.Day(), hour, minute, 0, 0, now.Location())
+			break
+		}
+		weekday, ok := parseWeekday(day)
+		if !ok {
+			return time.Time{}, errors.New("not a valid day: " + day)
+		}
+		at = today.AddDate(0, 0, (int(weekday)-int(now.Weekday())+7)%7)
+		if !at.After(now) {
+			at = at.AddDate(0, 0, 7)
+		}
+	}
+
+	if !at.After(now) {
+		return time.Time{}, errors.New(at.Format(scheduleFormat) + " has already passed")
+	}
+	return at, nil
+}
+
+// Parses a weekday name, in full or by its first three letters.
+func parseWeekday(name string) (time.Weekday, bool) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		full := strings.ToLower(day.String())
+		if name == full || name == full[:3] {
+			return day, true
+		}
+	}
+	return 0, false
+}
+
+/*
+Parses the --at flag of gu print. Returns nil without it. Exits if the time
+is not understood.
+*/
+func parseAtFlag() *time.Time {
+	if printAt == "" {
+		return nil
+	}
+	if dryRun {
+		fmt.Println("--at cannot be combined with --dry-run.")
+		os.Exit(1)
+	}
+
+	at, err := parseAt(printAt, time.Now())
+	if err != nil {
+		fmt.Println("Cannot schedule the job: " + err.Error())
+		os.Exit(1)
+	}
+	return &at
+}
+
+/*
+Returns the directory gu keeps its own files in, $HOME/.gu. Exits if there
+is no home directory.
+*/
+func guDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return filepath.Join(home, ".gu")
+}
+
+// Returns the file the PaperCut session IDs are cached in.
+func sessionCachePath() string {
+	return filepath.Join(guDir(), "sessions.json")
+}
+
+// Returns the key of the current server and username in the session cache.
+func sessionCacheKey(username string) string {
+	return strings.ToLower(username) + " at " + strings.TrimSuffix(utils.BaseURL, "/")
+}
+
+// Reads the session cache. A missing or broken cache is empty.
+func readSessionCache() map[string]string {
+	cache := map[string]string{}
+	if data, err := ioutil.ReadFile(sessionCachePath()); err == nil {
+		json.Unmarshal(data, &cache)
+	}
+	return cache
+}
+
+// Returns the cached session ID of username on the current server.
+func cachedSessionID(username string) string {
+	return readSessionCache()[sessionCacheKey(username)]
+}
+
+/*
+Saves the session ID of username on the current server, readable only by
+the user, so that gu scheduler run can print without the password.
+Failures are reported but not fatal.
+*/
+func cacheSession(username string, sessionID string) {
+	cache := readSessionCache()
+	cache[sessionCacheKey(username)] = sessionID
+
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err == nil {
+		if err = os.MkdirAll(guDir(), 0700); err == nil {
+			err = ioutil.WriteFile(sessionCachePath(), data, 0600)
+		}
+	}
+	if err != nil {
+		fmt.Println("Could not save the session for gu scheduler run: " + err.Error())
+	}
+}
+
+/*
+Returns the spooled jobs PaperCut has not refused: those of username on the
+current server, or all of them when username is empty.
+*/
+func pendingSpoolJobs(sp *spool.Spool, username string) []spool.Job {
+	jobs, err := sp.List()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	var pending []spool.Job
+	for _, job := range jobs {
+		if job.Failed || job.Unconfirmed || (username != "" && !spoolJobIsFor(job, username)) {
+			continue
+		}
+		pending = append(pending, job)
+	}
+	return pending
+}
+
+// schedulerCmd represents the scheduler command
+var schedulerCmd = &cobra.Command{
+	Use:   "scheduler",
+	Short: "Prints scheduled jobs when they are due",
+	Long: `gu print --at keeps a document in the spool (see gu queue --help) until
+the time given:
+
+gu print --at 07:45 handout.pdf         the next time it is 07:45
+gu print --at tomorrow handout.pdf      tomorrow at schedule_time
+gu print --at "friday 13:00" quiz.pdf   the next Friday
+gu print --at "2026-11-02 08:00" exam.pdf
+gu print --at +2h notes.pdf             in two hours
+
+schedule_time in $HOME/.gu.yaml is the time of day for days given without
+one, 07:30 unless set. gu print --at logs in and saves the PaperCut
+session, readable only by you, in $HOME/.gu/sessions.json.
+
+Scheduled jobs are printed by gu daemon, or by gu scheduler run, which
+prints the jobs that are due and exits. Running it every few minutes from
+cron keeps the saved session alive in between, so it needs no password:
+
+*/5 * * * * gu scheduler run
+
+If the session has expired after all, gu scheduler run logs in with
+GU_PASSWORD, or asks when run from a terminal. gu schedule list and
+gu schedule cancel manage the scheduled jobs.
+	`,
+}
+
+var schedulerRunCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Prints the scheduled and spooled jobs that are due, then exits",
+	Run: func(cmd *cobra.Command, args []string) {
+		sp := openSpool()
+		username := activeProfile.Username
+		if username == "" {
+			fmt.Println("Set a username in the profile for gu scheduler run.")
+			os.Exit(1)
+		}
+		if len(pendingSpoolJobs(sp, username)) == 0 {
+			return
+		}
+
+		ctx, stop := trapInterrupt(context.Background())
+		defer stop()
+
+		password := os.Getenv("GU_PASSWORD")
+		session, err := utils.ResumeSession(ctx, username, password, cachedSessionID(username))
+		if errors.Is(err, utils.ErrSessionExpired) && isTerminal(os.Stdin) {
+			_, password = askCredentials()
+			session, err = utils.ResumeSession(ctx, username, password, "")
+		}
+		if err != nil {
+			exitIfInterrupted(err)
+			if errors.Is(err, utils.ErrSessionExpired) {
+				fmt.Println("The saved session of " + username + " at " + utils.BaseURL + " has expired; set GU_PASSWORD, or run gu scheduler run from a terminal.")
+			} else {
+				fmt.Println("Could not log in to " + utils.BaseURL + ": " + err.Error())
+			}
+			os.Exit(1)
+		}
+		cacheSession(username, session.GetCredentials().GetSessionID())
+
+		if _, err := flushSpool(ctx, sp, session, nil, log.New(os.Stdout, "", log.LstdFlags)); err != nil {
+			exitIfInterrupted(err)
+			fmt.Println("Stopped printing the due jobs: " + err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+// scheduleCmd represents the schedule command
+var scheduleCmd = &cobra.Command{
+	Use:   "schedule",
+	Short: "Lists and cancels the jobs scheduled with gu print --at",
+}
+
+var scheduleListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the scheduled jobs",
+	Run: func(cmd *cobra.Command, args []string) {
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetHeader([]string{"ID", "document", "printer", "copies", "at", "status"})
+		for _, job := range pendingSpoolJobs(openSpool(), "") {
+			if job.At == nil {
+				continue
+			}
+			status := spoolStatus(job)
+			if !job.IsDue(time.Now()) && !job.IsSending() {
+				status = "scheduled"
+			}
+			table.Append([]string{
+				strconv.Itoa(job.ID),
+				job.Name,
+				job.Printer,
+				strconv.Itoa(job.Copies),
+				job.At.Format(scheduleFormat),
+				status,
+			})
+		}
+
+		if table.NumLines() == 0 {
+			fmt.Println("No jobs are scheduled.")
+			return
+		}
+		table.Render()
+	},
+}
+
+var scheduleCancelCmd = &cobra.Command{
+	Use:   "cancel <job-id...>",
+	Short: "Cancels scheduled jobs before they are printed",
+	Run: func(cmd *cobra.Command, args []string) {
+		ids := spoolIDs(args)
+		if len(ids) == 0 {
+			fmt.Println("Name the jobs to cancel.")
+			os.Exit(1)
+		}
+
+		sp := openSpool()
+		scheduled := map[int]bool{}
+		for _, job := range pendingSpoolJobs(sp, "") {
+			scheduled[job.ID] = job.At != nil && !job.IsSending()
+		}
+
+		for _, id := range ids {
+			waiting, ok := scheduled[id]
+			if !ok {
+				fmt.Println("No scheduled job " + strconv.Itoa(id) + ", see gu schedule list.")
+				os.Exit(1)
+			}
+			if !waiting {
+				fmt.Println("Job " + strconv.Itoa(id) + " is not waiting for its time, see gu queue list.")
+				os.Exit(1)
+			}
+			if err := sp.Remove(id); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			fmt.Println("Cancelled job " + strconv.Itoa(id) + ".")
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(schedulerCmd)
+	schedulerCmd.AddCommand(schedulerRunCmd)
+	RootCmd.AddCommand(scheduleCmd)
+	scheduleCmd.AddCommand(scheduleListCmd)
+	scheduleCmd.AddCommand(scheduleCancelCmd)
+
+	viper.SetDefault("schedule_time", "07:30")
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestParseAt(t *testing.T) {
+	// A Wednesday morning.
+	now := time.Date(2026, 10, 21, 10, 0, 0, 0, time.UTC)
+	day := func(d int, hour int, minute int) time.Time {
+		return time.Date(2026, 10, d, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{value: "+90m", want: now.Add(90 * time.Minute)},
+		{value: " +2h30m ", want: now.Add(150 * time.Minute)},
+		{value: "14:15", want: day(21, 14, 15)},
+		{value: "9:05", want: day(22, 9, 5)},
+		{value: "10:00", want: day(22, 10, 0)},
+		{value: "today 18:00", want: day(21, 18, 0)},
+		{value: "tomorrow", want: day(22, 7, 30)},
+		{value: "Tomorrow 12:00", want: day(22, 12, 0)},
+		{value: "friday", want: day(23, 7, 30)},
+		{value: "fri 16:45", want: day(23, 16, 45)},
+		{value: "wednesday 11:00", want: day(21, 11, 0)},
+		{value: "wednesday 09:00", want: day(28, 9, 0)},
+		{value: "wed", want: day(28, 7, 30)},
+		{value: "2026-10-30", want: day(30, 7, 30)},
+		{value: "2026-10-30 22:10", want: day(30, 22, 10)},
+
+		{value: "", wantErr: true},
+		{value: "+", wantErr: true},
+		{value: "+0s", wantErr: true},
+		{value: "+-5m", wantErr: true},
+		{value: "+soon", wantErr: true},
+		{value: "24:00", wantErr: true},
+		{value: "12:60", wantErr: true},
+		{value: "noon", wantErr: true},
+		{value: "today", wantErr: true},
+		{value: "today 09:00", wantErr: true},
+		{value: "someday 09:00", wantErr: true},
+		{value: "2026-10-20 12:00", wantErr: true},
+		{value: "2026-13-01", wantErr: true},
+		{value: "next friday 09:00", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := parseAt(test.value, now)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseAt(%q) = %v, want an error", test.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseAt(%q): %v", test.value, err)
+		} else if !got.Equal(test.want) {
+			t.Errorf("parseAt(%q) = %v, want %v", test.value, got.Format(scheduleFormat), test.want.Format(scheduleFormat))
+		}
+	}
+}
+
+func TestParseAtScheduleTime(t *testing.T) {
+	now := time.Date(2026, 10, 21, 10, 0, 0, 0, time.UTC)
+	defer viper.Set("schedule_time", "07:30")
+
+	viper.Set("schedule_time", "06:15")
+	if got, err := parseAt("thursday", now); err != nil || !got.Equal(time.Date(2026, 10, 22, 6, 15, 0, 0, time.UTC)) {
+		t.Errorf("parseAt(thursday) = %v, %v; want Thursday at 06:15", got, err)
+	}
+
+	viper.Set("schedule_time", "early")
+	if _, err := parseAt("thursday", now); err == nil {
+		t.Error("parseAt(thursday) succeeded with a broken schedule_time")
+	}
+	if _, err := parseAt("thursday 08:00", now); err != nil {
+		t.Errorf("parseAt(thursday 08:00) needed schedule_time: %v", err)
+	}
+}
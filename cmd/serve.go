@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/quantamhd/gu/rest"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// jobWatchInterval is how often the status of unfinished jobs is checked.
+const jobWatchInterval = 10 * time.Second
+
+var (
+	serveListen  string
+	serveToken   string
+	servePrinter string
+)
+
+/*
+Returns the bearer token for gu serve: --token, GU_SERVE_TOKEN or
+serve_token from $HOME/.gu.yaml, and otherwise a new random one.
+*/
+func apiToken() (string, bool) {
+	for _, token := range []string{serveToken, os.Getenv("GU_SERVE_TOKEN"), viper.GetString("serve_token")} {
+		if token != "" {
+			return token, false
+		}
+	}
+
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		fmt.Println("Could not generate a token: " + err.Error())
+		os.Exit(1)
+	}
+	return hex.EncodeToString(b), true
+}
+
+// isLoopback reports whether addr only listens on this computer.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// serveCmd represents the serve command
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serves a JSON API for printing, jobs and the account",
+	Long: `This command logs in once and serves a JSON API over the session, so that
+scripts and other programs can print without the PaperCut pages:
+
+GET    /printers       printers offered for web print
+GET    /jobs           recent jobs, newest first
+POST   /jobs           print a document (multipart: file, printer, copies)
+GET    /jobs/{id}      one job, with its events if printed through the API
+DELETE /jobs/{id}      cancel a job that has not printed yet
+GET    /balance        the account balance
+GET    /transactions   recent transactions, newest first
+GET    /openapi.json   the OpenAPI document for the API
+
+Requests need the header "Authorization: Bearer <token>". The token is
+--token, GU_SERVE_TOKEN or serve_token from $HOME/.gu.yaml; without one
+a random token is made up and printed at startup. Anyone with the token
+prints as you, so the API only listens on localhost unless --listen says
+otherwise, and then without TLS.
+
+Documents are converted like with gu print. printer may be a name or ID
+and defaults to --printer or the profile's printer. Jobs printed through
+the API list their events, such as "uploaded" and "printed", with the
+time they happened.
+
+Examples
+
+gu serve --listen 127.0.0.1:8080
+curl -H "Authorization: Bearer $TOKEN" http://127.0.0.1:8080/printers
+curl -H "Authorization: Bearer $TOKEN" -F file=@essay.pdf -F printer=library-bw \
+     -F copies=2 http://127.0.0.1:8080/jobs
+
+The session is kept alive while the server runs and logged in again when
+PaperCut ends it. Set GU_PASSWORD to run without a password prompt.
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		token, generated := apiToken()
+
+		ctx := context.Background()
+		session := startSession(ctx)
+
+		printer := servePrinter
+		if printer == "" {
+			printer = activeProfile.Printer
+		}
+
+		logger := log.New(os.Stdout, "", log.LstdFlags)
+		go session.KeepAlive(ctx, keepAliveInterval, func(err error) {
+			logger.Printf("Could not keep the session alive: %v", err)
+		})
+
+		convert := func(ctx context.Context, path string) (string, error) {
+			return converterRegistry(path).ConvertFile(ctx, path)
+		}
+		server := rest.NewServer(session, token, printer, convert, logger)
+		go server.WatchJobs(ctx, jobWatchInterval)
+
+		listener, err := net.Listen("tcp", serveListen)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if !isLoopback(serveListen) {
+			fmt.Println("Warning: the API can be reached from other computers, and the token is sent unencrypted.")
+		}
+		fmt.Println("Serving the API on http://" + listener.Addr().String() + "/, see /openapi.json")
+		if generated {
+			fmt.Println("Token: " + token)
+		}
+
+		if err := http.Serve(listener, server); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(serveCmd)
+
+	serveCmd.Flags().StringVar(&serveListen, "listen", "127.0.0.1:8080", "Address to listen on")
+	serveCmd.Flags().StringVar(&serveToken, "token", "", "Bearer token clients must send (default: GU_SERVE_TOKEN, serve_token or a random one)")
+	serveCmd.Flags().StringVar(&servePrinter, "printer", "", "Name or ID of the printer for jobs that name none (default from the profile)")
+}
@@ -0,0 +1,368 @@
+/*
+Package hotfolder prints the documents dropped into watched directories.
+Each directory is tied to a PaperCut printer; once a document has been
+fully written it is sent to PaperCut and moved into the done or failed
+subdirectory, next to a log of what happened to it.
+*/
+package hotfolder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/quantamhd/gu/utils"
+)
+
+// Subdirectories of a hot folder that handled documents are moved to.
+const (
+	DoneDir   = "done"
+	FailedDir = "failed"
+)
+
+// DefaultSettle is how long a document must stay unchanged before it is
+// printed, when the folder does not say.
+const DefaultSettle = 2 * time.Second
+
+// Folder is a watched directory and how the documents in it are printed.
+type Folder struct {
+	Path    string
+	Printer utils.PaperCutPrinter
+	Copies  int
+
+	// Patterns limits printing to file names matching one of these globs,
+	// such as "*.pdf". All files are printed when it is empty.
+	Patterns []string
+
+	// Settle is how long a document must stay the same size before it
+	// counts as fully written.
+	Settle time.Duration
+
+	// Convert, if set, turns a document into one PaperCut accepts. It
+	// returns the path to upload, which is removed afterwards with its
+	// directory when it differs from path.
+	Convert func(ctx context.Context, path string) (string, error)
+}
+
+// Watcher watches hot folders and prints what arrives in them.
+type Watcher struct {
+	session *utils.Session
+	folders []Folder
+	logger  *log.Logger
+
+	mu      sync.Mutex
+	pending map[string]*pending
+	queued  map[string]bool
+	ready   chan document
+}
+
+// pending is a document that is still being written.
+type pending struct {
+	folder *Folder
+	timer  *time.Timer
+	size   int64
+	mtime  time.Time
+}
+
+// document is a fully written document waiting to be printed.
+type document struct {
+	folder *Folder
+	path   string
+}
+
+// NewWatcher returns a watcher that prints the documents in folders using
+// session. Log lines are written to logger.
+func NewWatcher(session *utils.Session, folders []Folder, logger *log.Logger) *Watcher {
+	return &Watcher{
+		session: session,
+		folders: folders,
+		logger:  logger,
+		pending: map[string]*pending{},
+		queued:  map[string]bool{},
+		ready:   make(chan document, 64),
+	}
+}
+
+/*
+Run watches the folders until ctx is done. Documents already in a folder
+when it starts are printed too. A document being printed when ctx is done
+is left in its folder, to be printed the next time.
+*/
+func (w *Watcher) Run(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	byPath := map[string]*Folder{}
+	for i := range w.folders {
+		folder := &w.folders[i]
+		folder.Path = filepath.Clean(folder.Path)
+		if folder.Settle <= 0 {
+			folder.Settle = DefaultSettle
+		}
+		if folder.Copies < 1 {
+			folder.Copies = 1
+		}
+		for _, dir := range []string{DoneDir, FailedDir} {
+			if err := os.MkdirAll(filepath.Join(folder.Path, dir), 0755); err != nil {
+				return err
+			}
+		}
+		if err := watcher.Add(folder.Path); err != nil {
+			return fmt.Errorf("cannot watch %s: %v", folder.Path, err)
+		}
+		byPath[folder.Path] = folder
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w.work(ctx)
+	}()
+	defer wg.Wait()
+
+	for _, folder := range byPath {
+		files, err := ioutil.ReadDir(folder.Path)
+		if err != nil {
+			return err
+		}
+		for _, fi := range files {
+			w.schedule(ctx, folder, filepath.Join(folder.Path, fi.Name()))
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			w.stopTimers()
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			if folder, ok := byPath[filepath.Dir(event.Name)]; ok {
+				w.schedule(ctx, folder, event.Name)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			w.logger.Printf("Watching: %v", err)
+		}
+	}
+}
+
+/*
+ignored reports whether a file name is left alone: hidden files, the log
+files gu writes and the partial files browsers and editors keep while
+they write.
+*/
+func ignored(name string) bool {
+	if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "~$") || strings.HasSuffix(name, "~") {
+		return true
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".log", ".part", ".partial", ".crdownload", ".download", ".tmp", ".swp":
+		return true
+	}
+	return false
+}
+
+// matches reports whether name is printed from folder.
+func (f *Folder) matches(name string) bool {
+	if ignored(name) {
+		return false
+	}
+	if len(f.Patterns) == 0 {
+		return true
+	}
+	for _, pattern := range f.Patterns {
+		if ok, _ := filepath.Match(strings.ToLower(pattern), strings.ToLower(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+schedule notes that the file at path was created or written to, and prints
+it once its size and modification time have not changed for the folder's
+settle time.
+*/
+func (w *Watcher) schedule(ctx context.Context, folder *Folder, path string) {
+	fi, err := os.Stat(path)
+	if err != nil || !fi.Mode().IsRegular() || !folder.matches(fi.Name()) {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.queued[path] {
+		return
+	}
+	if p, ok := w.pending[path]; ok {
+		p.size, p.mtime = fi.Size(), fi.ModTime()
+		p.timer.Reset(folder.Settle)
+		return
+	}
+
+	p := &pending{folder: folder, size: fi.Size(), mtime: fi.ModTime()}
+	p.timer = time.AfterFunc(folder.Settle, func() { w.settled(ctx, path) })
+	w.pending[path] = p
+}
+
+// settled is called when the file at path has had no events for the settle
+// time. It waits longer if the file still changed in the meantime.
+func (w *Watcher) settled(ctx context.Context, path string) {
+	w.mu.Lock()
+	p, ok := w.pending[path]
+	if !ok {
+		w.mu.Unlock()
+		return
+	}
+
+	fi, err := os.Stat(path)
+	if err == nil && (fi.Size() != p.size || !fi.ModTime().Equal(p.mtime)) {
+		p.size, p.mtime = fi.Size(), fi.ModTime()
+		p.timer.Reset(p.folder.Settle)
+		w.mu.Unlock()
+		return
+	}
+	delete(w.pending, path)
+	if err != nil {
+		// Removed or renamed before it settled.
+		w.mu.Unlock()
+		return
+	}
+	w.queued[path] = true
+	w.mu.Unlock()
+
+	select {
+	case w.ready <- document{folder: p.folder, path: path}:
+	case <-ctx.Done():
+	}
+}
+
+func (w *Watcher) stopTimers() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for path, p := range w.pending {
+		p.timer.Stop()
+		delete(w.pending, path)
+	}
+}
+
+// work prints the documents that are ready, one at a time, until ctx is
+// done.
+func (w *Watcher) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case doc := <-w.ready:
+			w.print(ctx, doc)
+			w.mu.Lock()
+			delete(w.queued, doc.path)
+			w.mu.Unlock()
+		}
+	}
+}
+
+// print sends one document to PaperCut and files it away with its log.
+func (w *Watcher) print(ctx context.Context, doc document) {
+	name := filepath.Base(doc.path)
+	printer := doc.folder.Printer
+	submitted := time.Now()
+
+	job, err := w.submit(ctx, doc)
+	if ctx.Err() != nil {
+		w.logger.Printf("%s: stopped before it was printed, it stays in %s", name, doc.folder.Path)
+		return
+	}
+
+	lines := []string{
+		"file: " + name,
+		"submitted: " + submitted.Format(time.RFC3339),
+		"printer: " + strings.TrimSpace(printer.GetName()),
+		fmt.Sprintf("copies: %d", doc.folder.Copies),
+	}
+	dir := DoneDir
+	if err != nil {
+		dir = FailedDir
+		lines = append(lines, "error: "+err.Error())
+		w.logger.Printf("%s: %v", name, err)
+	} else {
+		lines = append(lines, "job: "+job.GetJobID(), "status: "+job.GetStatus())
+	}
+
+	if err := file(doc.path, filepath.Join(doc.folder.Path, dir), strings.Join(lines, "\n")+"\n"); err != nil {
+		w.logger.Printf("%s: %v", name, err)
+	}
+}
+
+// submit converts and checks the document, then sends it to PaperCut.
+func (w *Watcher) submit(ctx context.Context, doc document) (utils.PaperCutJob, error) {
+	uploadPath := doc.path
+	if doc.folder.Convert != nil {
+		converted, err := doc.folder.Convert(ctx, doc.path)
+		if err != nil {
+			return utils.PaperCutJob{}, fmt.Errorf("could not convert: %v", err)
+		}
+		if converted != doc.path {
+			defer os.RemoveAll(filepath.Dir(converted))
+		}
+		uploadPath = converted
+	}
+
+	if err := utils.CheckDocument(uploadPath); err != nil {
+		return utils.PaperCutJob{}, err
+	}
+
+	printer := doc.folder.Printer
+	return w.session.Submit(ctx, &printer, doc.folder.Copies, uploadPath,
+		utils.LogEvents(w.logger, filepath.Base(doc.path)))
+}
+
+/*
+file moves the document at path into dir and writes report next to it as
+<name>.log. A document of the same name already in dir is kept; the new
+one gets the time appended to its name.
+*/
+func file(path string, dir string, report string) error {
+	name := filepath.Base(path)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	target := filepath.Join(dir, name)
+	for i := 1; exists(target) || exists(target+".log"); i++ {
+		suffix := time.Now().Format("20060102-150405")
+		if i > 1 {
+			suffix += fmt.Sprintf("-%d", i)
+		}
+		target = filepath.Join(dir, base+"-"+suffix+ext)
+	}
+
+	if err := os.Rename(path, target); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(target+".log", []byte(report), 0644)
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
@@ -0,0 +1,302 @@
+package hotfolder
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quantamhd/gu/papercuttest"
+	"github.com/quantamhd/gu/utils"
+)
+
+const testPDF = "%PDF-1.4\n1 0 obj << /Type /Page >> endobj\n%%EOF\n"
+
+func TestIgnored(t *testing.T) {
+	for name, want := range map[string]bool{
+		"essay.pdf":             false,
+		"report.final.docx":     false,
+		".hidden.pdf":           true,
+		"~$essay.docx":          true,
+		"essay.pdf~":            true,
+		"essay.pdf.log":         true,
+		"essay.pdf.part":        true,
+		"essay.pdf.partial":     true,
+		"essay.pdf.crdownload":  true,
+		"essay.pdf.download":    true,
+		"essay.TMP":             true,
+		".essay.pdf.swp":        true,
+		"logbook.pdf":           false,
+		"partial-solutions.pdf": false,
+	} {
+		if got := ignored(name); got != want {
+			t.Errorf("ignored(%q) = %t, want %t", name, got, want)
+		}
+	}
+}
+
+func TestFolderMatches(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		name     string
+		want     bool
+	}{
+		{nil, "essay.pdf", true},
+		{nil, "photo.jpg", true},
+		{nil, "essay.pdf.log", false},
+		{[]string{"*.pdf"}, "essay.pdf", true},
+		{[]string{"*.pdf"}, "ESSAY.PDF", true},
+		{[]string{"*.PDF"}, "essay.pdf", true},
+		{[]string{"*.pdf"}, "photo.jpg", false},
+		{[]string{"*.pdf", "*.jpg"}, "photo.jpg", true},
+		{[]string{"scan-*"}, "scan-001.pdf", true},
+		{[]string{"scan-*"}, "essay.pdf", false},
+		{[]string{"*.pdf"}, ".hidden.pdf", false},
+		{[]string{"[bad"}, "essay.pdf", false},
+	}
+
+	for _, test := range tests {
+		folder := Folder{Patterns: test.patterns}
+		if got := folder.matches(test.name); got != test.want {
+			t.Errorf("%q matches %q = %t, want %t", test.patterns, test.name, got, test.want)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	folder := t.TempDir()
+	done := filepath.Join(folder, DoneDir)
+	os.Mkdir(done, 0755)
+
+	drop := func(contents string) string {
+		path := filepath.Join(folder, "essay.pdf")
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	for i, contents := range []string{"first", "second", "third"} {
+		if err := file(drop(contents), done, "report "+contents+"\n"); err != nil {
+			t.Fatalf("filing document %d: %v", i+1, err)
+		}
+	}
+
+	files, _ := ioutil.ReadDir(done)
+	documents := map[string]string{}
+	for _, fi := range files {
+		if strings.HasSuffix(fi.Name(), ".log") {
+			continue
+		}
+		data, _ := ioutil.ReadFile(filepath.Join(done, fi.Name()))
+		report, err := ioutil.ReadFile(filepath.Join(done, fi.Name()+".log"))
+		if err != nil {
+			t.Errorf("%s has no log: %v", fi.Name(), err)
+		}
+		if string(report) != "report "+string(data)+"\n" {
+			t.Errorf("%s has log %q, which belongs to another document", fi.Name(), report)
+		}
+		if !strings.HasPrefix(fi.Name(), "essay") || filepath.Ext(fi.Name()) != ".pdf" {
+			t.Errorf("%s was renamed beyond recognition", fi.Name())
+		}
+		documents[string(data)] = fi.Name()
+	}
+	if len(documents) != 3 || len(files) != 6 {
+		t.Fatalf("done holds %d documents in %d files, want 3 documents with their logs", len(documents), len(files))
+	}
+	if documents["first"] != "essay.pdf" {
+		t.Errorf("the first document became %s, want essay.pdf", documents["first"])
+	}
+	if exists(filepath.Join(folder, "essay.pdf")) {
+		t.Error("the document is still in the folder")
+	}
+
+	// A stray log alone also counts as taken.
+	os.Remove(filepath.Join(done, "essay.pdf"))
+	if err := file(drop("fourth"), done, "report fourth\n"); err != nil {
+		t.Fatal(err)
+	}
+	if exists(filepath.Join(done, "essay.pdf")) {
+		t.Error("a document was filed next to another document's log")
+	}
+}
+
+// uploads records the documents the fake server receives.
+type uploads struct {
+	mu   sync.Mutex
+	jobs []papercuttest.Job
+	at   []time.Time
+}
+
+func (u *uploads) add(job papercuttest.Job) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.jobs = append(u.jobs, job)
+	u.at = append(u.at, time.Now())
+}
+
+func (u *uploads) get() ([]papercuttest.Job, []time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]papercuttest.Job(nil), u.jobs...), append([]time.Time(nil), u.at...)
+}
+
+/*
+startWatcher runs a watcher on a new folder that prints to library-bw on a
+fake PaperCut server. Documents settle after settle.
+*/
+func startWatcher(t *testing.T, settle time.Duration, patterns []string, setup func(dir string)) (string, *uploads) {
+	t.Helper()
+	srv := papercuttest.NewServer()
+	t.Cleanup(srv.Close)
+	received := &uploads{}
+	srv.OnUpload = received.add
+
+	baseURL, retry := utils.BaseURL, utils.Retry
+	utils.BaseURL = srv.URL
+	utils.Retry = utils.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	t.Cleanup(func() { utils.BaseURL, utils.Retry = baseURL, retry })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	session, err := utils.NewSession(ctx, "student", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	printers, err := session.Printers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, ok := utils.FindPrinter(printers, "library-bw")
+	if !ok {
+		t.Fatal("no library-bw printer")
+	}
+
+	dir := t.TempDir()
+	if setup != nil {
+		setup(dir)
+	}
+	folders := []Folder{{Path: dir, Printer: printers[id], Patterns: patterns, Settle: settle}}
+	watcher := NewWatcher(session, folders, log.New(ioutil.Discard, "", 0))
+
+	done := make(chan error, 1)
+	go func() { done <- watcher.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	})
+
+	// Run creates the subdirectories before it watches the folder.
+	waitFor(t, filepath.Join(dir, FailedDir))
+	return dir, received
+}
+
+// waitFor waits until path exists.
+func waitFor(t *testing.T, path string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !exists(path) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s did not appear", path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatcherPrints(t *testing.T) {
+	dir, received := startWatcher(t, 50*time.Millisecond, nil, func(dir string) {
+		ioutil.WriteFile(filepath.Join(dir, "waiting.pdf"), []byte(testPDF), 0644)
+	})
+
+	ioutil.WriteFile(filepath.Join(dir, "essay.pdf"), []byte(testPDF), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not printable\n"), 0644)
+
+	for _, name := range []string{"waiting.pdf", "essay.pdf"} {
+		waitFor(t, filepath.Join(dir, DoneDir, name+".log"))
+		report, _ := ioutil.ReadFile(filepath.Join(dir, DoneDir, name+".log"))
+		for _, line := range []string{"file: " + name, "printer: library-bw", "copies: 1", "job: "} {
+			if !strings.Contains(string(report), line) {
+				t.Errorf("%s log has no %q:\n%s", name, line, report)
+			}
+		}
+		if exists(filepath.Join(dir, name)) {
+			t.Errorf("%s is still in the folder", name)
+		}
+	}
+
+	waitFor(t, filepath.Join(dir, FailedDir, "notes.txt.log"))
+	report, _ := ioutil.ReadFile(filepath.Join(dir, FailedDir, "notes.txt.log"))
+	if !strings.Contains(string(report), "error: text/plain is not a printable document type") {
+		t.Errorf("notes.txt log does not give the error:\n%s", report)
+	}
+	if !exists(filepath.Join(dir, FailedDir, "notes.txt")) {
+		t.Error("notes.txt was not moved to failed")
+	}
+
+	if jobs, _ := received.get(); len(jobs) != 2 {
+		t.Errorf("server got %d documents, want 2", len(jobs))
+	}
+}
+
+func TestWatcherPatterns(t *testing.T) {
+	dir, received := startWatcher(t, 50*time.Millisecond, []string{"*.pdf"}, nil)
+
+	ioutil.WriteFile(filepath.Join(dir, "photo.jpg"), []byte("\xff\xd8\xff"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "essay.pdf.part"), []byte(testPDF), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "essay.pdf"), []byte(testPDF), 0644)
+	waitFor(t, filepath.Join(dir, DoneDir, "essay.pdf.log"))
+	time.Sleep(200 * time.Millisecond)
+
+	for _, name := range []string{"photo.jpg", "essay.pdf.part"} {
+		if !exists(filepath.Join(dir, name)) {
+			t.Errorf("%s was taken from the folder", name)
+		}
+	}
+	if jobs, _ := received.get(); len(jobs) != 1 || jobs[0].Document != "essay.pdf" {
+		t.Errorf("server got %v, want only essay.pdf", jobs)
+	}
+}
+
+func TestWatcherWaitsForGrowingFile(t *testing.T) {
+	const settle = 300 * time.Millisecond
+	dir, received := startWatcher(t, settle, nil, nil)
+
+	path := filepath.Join(dir, "scan.pdf")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written bytes.Buffer
+	write := func(s string) {
+		f.WriteString(s)
+		written.WriteString(s)
+	}
+
+	write("%PDF-1.4\n")
+	for i := 0; i < 8; i++ {
+		time.Sleep(settle / 3)
+		write("1 0 obj << /Type /Page >> endobj\n")
+	}
+	write("%%EOF\n")
+	f.Close()
+	lastWrite := time.Now()
+
+	waitFor(t, filepath.Join(dir, DoneDir, "scan.pdf.log"))
+	jobs, at := received.get()
+	if len(jobs) != 1 {
+		t.Fatalf("server got %d documents, want 1", len(jobs))
+	}
+	if !bytes.Equal(jobs[0].Data, written.Bytes()) {
+		t.Errorf("server got %d bytes, want all %d: the document was printed while it was written", len(jobs[0].Data), written.Len())
+	}
+	if early := lastWrite.Add(settle * 9 / 10).Sub(at[0]); early > 0 {
+		t.Errorf("the document was sent %v before it had settled", early)
+	}
+}
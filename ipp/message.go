@@ -0,0 +1,359 @@
+/*
+Package ipp implements the parts of the Internet Printing Protocol (IPP/2.0,
+RFC 8010 and RFC 8011) that gu needs to act as a network printer: encoding
+and decoding of IPP messages and a Server that forwards print jobs to
+PaperCut web print.
+*/
+package ipp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Operation IDs.
+const (
+	OpPrintJob             = 0x0002
+	OpValidateJob          = 0x0004
+	OpCancelJob            = 0x0008
+	OpGetJobAttributes     = 0x0009
+	OpGetJobs              = 0x000A
+	OpGetPrinterAttributes = 0x000B
+)
+
+// Status codes.
+const (
+	StatusOK                        = 0x0000
+	StatusOKIgnoredOrSubstituted    = 0x0001
+	StatusBadRequest                = 0x0400
+	StatusForbidden                 = 0x0401
+	StatusNotPossible               = 0x0404
+	StatusNotFound                  = 0x0406
+	StatusRequestEntityTooLarge     = 0x0409
+	StatusDocumentFormatUnsupported = 0x040A
+	StatusInternalError             = 0x0500
+	StatusOperationNotSupported     = 0x0501
+	StatusVersionNotSupported       = 0x0503
+)
+
+// Delimiter tags that start attribute groups.
+const (
+	TagOperation   = 0x01
+	TagJob         = 0x02
+	TagEnd         = 0x03
+	TagPrinter     = 0x04
+	TagUnsupported = 0x05
+)
+
+// Value tags.
+const (
+	TagUnsupportedValue = 0x10
+	TagUnknown          = 0x12
+	TagNoValue          = 0x13
+	TagInteger          = 0x21
+	TagBoolean          = 0x22
+	TagEnum             = 0x23
+	TagOctetString      = 0x30
+	TagDateTime         = 0x31
+	TagResolution       = 0x32
+	TagRange            = 0x33
+	TagBeginCollection  = 0x34
+	TagTextLang         = 0x35
+	TagNameLang         = 0x36
+	TagEndCollection    = 0x37
+	TagText             = 0x41
+	TagName             = 0x42
+	TagKeyword          = 0x44
+	TagURI              = 0x45
+	TagURIScheme        = 0x46
+	TagCharset          = 0x47
+	TagLanguage         = 0x48
+	TagMimeType         = 0x49
+	TagMemberName       = 0x4A
+)
+
+// Job states.
+const (
+	JobPending           = 3
+	JobPendingHeld       = 4
+	JobProcessing        = 5
+	JobProcessingStopped = 6
+	JobCanceled          = 7
+	JobAborted           = 8
+	JobCompleted         = 9
+)
+
+// Printer states.
+const (
+	PrinterIdle       = 3
+	PrinterProcessing = 4
+	PrinterStopped    = 5
+)
+
+// Value is one value of an attribute. Data holds the encoded bytes as they
+// appear on the wire.
+type Value struct {
+	Tag  byte
+	Data []byte
+}
+
+// Attribute is a named attribute with one or more values.
+type Attribute struct {
+	Name   string
+	Values []Value
+}
+
+// Group is an attribute group such as the operation or job attributes.
+type Group struct {
+	Tag        byte
+	Attributes []Attribute
+}
+
+/*
+Message is an IPP request or response. Code is the operation ID of a
+request or the status code of a response.
+*/
+type Message struct {
+	Version   [2]byte
+	Code      uint16
+	RequestID uint32
+	Groups    []Group
+}
+
+// ReadMessage decodes a message from r. The document data of a Print-Job
+// request follows it and is left unread.
+func ReadMessage(r *bufio.Reader) (*Message, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	m := &Message{
+		Version:   [2]byte{header[0], header[1]},
+		Code:      binary.BigEndian.Uint16(header[2:4]),
+		RequestID: binary.BigEndian.Uint32(header[4:8]),
+	}
+
+	var group *Group
+	var last *Attribute
+	for {
+		tag, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("ipp: truncated message: %v", err)
+		}
+
+		if tag == TagEnd {
+			return m, nil
+		}
+		if tag < 0x10 {
+			m.Groups = append(m.Groups, Group{Tag: tag})
+			group = &m.Groups[len(m.Groups)-1]
+			last = nil
+			continue
+		}
+		if group == nil {
+			return nil, errors.New("ipp: attribute outside of a group")
+		}
+
+		name, err := readField(r)
+		if err != nil {
+			return nil, err
+		}
+		data, err := readField(r)
+		if err != nil {
+			return nil, err
+		}
+
+		value := Value{Tag: tag, Data: data}
+		if len(name) == 0 {
+			// An additional value of the previous attribute. Members of
+			// collections end up here too, which is enough for the
+			// attributes gu looks at.
+			if last == nil {
+				return nil, errors.New("ipp: value without an attribute name")
+			}
+			last.Values = append(last.Values, value)
+			continue
+		}
+
+		group.Attributes = append(group.Attributes, Attribute{Name: string(name), Values: []Value{value}})
+		last = &group.Attributes[len(group.Attributes)-1]
+	}
+}
+
+func readField(r *bufio.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, fmt.Errorf("ipp: truncated message: %v", err)
+	}
+	data := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("ipp: truncated message: %v", err)
+	}
+	return data, nil
+}
+
+// WriteTo encodes m to w.
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+
+	var header [8]byte
+	header[0], header[1] = m.Version[0], m.Version[1]
+	binary.BigEndian.PutUint16(header[2:4], m.Code)
+	binary.BigEndian.PutUint32(header[4:8], m.RequestID)
+	bw.Write(header[:])
+
+	for _, group := range m.Groups {
+		bw.WriteByte(group.Tag)
+		for _, attr := range group.Attributes {
+			for i, v := range attr.Values {
+				name := attr.Name
+				if i > 0 {
+					name = ""
+				}
+				bw.WriteByte(v.Tag)
+				writeField(bw, []byte(name))
+				writeField(bw, v.Data)
+			}
+		}
+	}
+	bw.WriteByte(TagEnd)
+
+	n := int64(bw.Buffered())
+	return n, bw.Flush()
+}
+
+func writeField(w *bufio.Writer, data []byte) {
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(data)))
+	w.Write(length[:])
+	w.Write(data)
+}
+
+// Group returns the first group with the given tag, or nil.
+func (m *Message) Group(tag byte) *Group {
+	for i := range m.Groups {
+		if m.Groups[i].Tag == tag {
+			return &m.Groups[i]
+		}
+	}
+	return nil
+}
+
+// Attribute returns the attribute called name, or nil.
+func (g *Group) Attribute(name string) *Attribute {
+	if g == nil {
+		return nil
+	}
+	for i := range g.Attributes {
+		if g.Attributes[i].Name == name {
+			return &g.Attributes[i]
+		}
+	}
+	return nil
+}
+
+// Add appends an attribute with the given values to g.
+func (g *Group) Add(name string, values ...Value) {
+	g.Attributes = append(g.Attributes, Attribute{Name: name, Values: values})
+}
+
+// String returns the first value of a text-like attribute.
+func (a *Attribute) String() string {
+	if a == nil || len(a.Values) == 0 {
+		return ""
+	}
+	return string(a.Values[0].Data)
+}
+
+// Strings returns every value of a text-like attribute.
+func (a *Attribute) Strings() []string {
+	if a == nil {
+		return nil
+	}
+	var values []string
+	for _, v := range a.Values {
+		values = append(values, string(v.Data))
+	}
+	return values
+}
+
+// Int returns the first value of an integer or enum attribute.
+func (a *Attribute) Int() (int, bool) {
+	if a == nil || len(a.Values) == 0 || len(a.Values[0].Data) != 4 {
+		return 0, false
+	}
+	return int(int32(binary.BigEndian.Uint32(a.Values[0].Data))), true
+}
+
+// String returns a value of a text-like type.
+func String(tag byte, s string) Value {
+	return Value{Tag: tag, Data: []byte(s)}
+}
+
+// Integer returns an integer or enum value.
+func Integer(tag byte, n int) Value {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(int32(n)))
+	return Value{Tag: tag, Data: data}
+}
+
+// Boolean returns a boolean value.
+func Boolean(b bool) Value {
+	if b {
+		return Value{Tag: TagBoolean, Data: []byte{1}}
+	}
+	return Value{Tag: TagBoolean, Data: []byte{0}}
+}
+
+// Range returns a rangeOfInteger value.
+func Range(lower, upper int) Value {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data[0:4], uint32(int32(lower)))
+	binary.BigEndian.PutUint32(data[4:8], uint32(int32(upper)))
+	return Value{Tag: TagRange, Data: data}
+}
+
+// Resolution returns a resolution value in dots per inch.
+func Resolution(x, y int) Value {
+	data := make([]byte, 9)
+	binary.BigEndian.PutUint32(data[0:4], uint32(int32(x)))
+	binary.BigEndian.PutUint32(data[4:8], uint32(int32(y)))
+	data[8] = 3 // dots per inch
+	return Value{Tag: TagResolution, Data: data}
+}
+
+// DateTime returns a dateTime value in RFC 2579 format.
+func DateTime(t time.Time) Value {
+	_, offset := t.Zone()
+	sign := byte('+')
+	if offset < 0 {
+		sign = '-'
+		offset = -offset
+	}
+	data := make([]byte, 11)
+	binary.BigEndian.PutUint16(data[0:2], uint16(t.Year()))
+	data[2] = byte(t.Month())
+	data[3] = byte(t.Day())
+	data[4] = byte(t.Hour())
+	data[5] = byte(t.Minute())
+	data[6] = byte(t.Second())
+	data[7] = byte(t.Nanosecond() / 100000000)
+	data[8] = sign
+	data[9] = byte(offset / 3600)
+	data[10] = byte(offset % 3600 / 60)
+	return Value{Tag: TagDateTime, Data: data}
+}
+
+// Strings returns one value of tag for every string.
+func Strings(tag byte, values ...string) []Value {
+	var out []Value
+	for _, s := range values {
+		out = append(out, String(tag, s))
+	}
+	return out
+}
@@ -0,0 +1,82 @@
+package ipp
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	op := Group{Tag: TagOperation}
+	op.Add("attributes-charset", String(TagCharset, "utf-8"))
+	op.Add("attributes-natural-language", String(TagLanguage, "en"))
+	op.Add("requested-attributes", Strings(TagKeyword, "job-id", "job-state", "job-name")...)
+	job := Group{Tag: TagJob}
+	job.Add("copies", Integer(TagInteger, 3))
+	job.Add("job-state", Integer(TagEnum, JobProcessing))
+	job.Add("printer-is-accepting-jobs", Boolean(true))
+	job.Add("copies-supported", Range(1, 999))
+	job.Add("printer-resolution-default", Resolution(600, 600))
+	job.Add("time-at-creation", DateTime(time.Date(2026, 10, 19, 15, 4, 5, 0, time.UTC)))
+	job.Add("job-name", String(TagName, ""))
+
+	sent := &Message{Version: [2]byte{2, 0}, Code: OpPrintJob, RequestID: 42, Groups: []Group{op, job}}
+	var buf bytes.Buffer
+	n, err := sent.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo = %d, wrote %d bytes", n, buf.Len())
+	}
+	buf.WriteString("%PDF-1.4")
+
+	r := bufio.NewReader(&buf)
+	got, err := ReadMessage(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, sent) {
+		t.Errorf("read %+v, want %+v", got, sent)
+	}
+	if rest, _ := r.ReadString(0); rest != "%PDF-1.4" {
+		t.Errorf("the document after the message is %q", rest)
+	}
+
+	if copies, ok := got.Group(TagJob).Attribute("copies").Int(); !ok || copies != 3 {
+		t.Errorf("copies = %d, %v", copies, ok)
+	}
+	if requested := got.Group(TagOperation).Attribute("requested-attributes").Strings(); strings.Join(requested, ",") != "job-id,job-state,job-name" {
+		t.Errorf("requested-attributes = %v", requested)
+	}
+	if got.Group(TagPrinter) != nil || got.Group(TagJob).Attribute("missing") != nil {
+		t.Error("found a group or attribute that was not sent")
+	}
+}
+
+func TestReadMessageErrors(t *testing.T) {
+	header := "\x02\x00\x00\x02\x00\x00\x00\x01"
+	tests := []struct {
+		name    string
+		message string
+	}{
+		{"empty", ""},
+		{"short header", "\x02\x00\x00"},
+		{"no end tag", header + "\x01"},
+		{"attribute outside a group", header + "\x47\x00\x01a\x00\x01b\x03"},
+		{"value without a name", header + "\x01\x47\x00\x00\x00\x01b\x03"},
+		{"truncated name", header + "\x01\x47\x00\x10abc"},
+		{"truncated value", header + "\x01\x47\x00\x01a\x00\x10abc"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if m, err := ReadMessage(bufio.NewReader(strings.NewReader(test.message))); err == nil {
+				t.Errorf("read %+v, want an error", m)
+			}
+		})
+	}
+}
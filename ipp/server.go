@@ -0,0 +1,657 @@
+package ipp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quantamhd/gu/utils"
+)
+
+// PrinterPath is the path under which the printer is served.
+const PrinterPath = "/ipp/print"
+
+// documentFormats are the document formats a Print-Job may carry.
+// application/octet-stream is sniffed.
+var documentFormats = []string{"application/pdf", "image/jpeg", "image/png", "application/octet-stream"}
+
+// refreshInterval is how long PaperCut job statuses are reused before the
+// job list is fetched again.
+var refreshInterval = 5 * time.Second
+
+// jobTTL is how long finished jobs are kept for clients to look up.
+const jobTTL = time.Hour
+
+/*
+Server is an IPP printer that sends the documents it receives to a
+PaperCut web print printer. Job states follow the status PaperCut shows in
+the job list.
+*/
+type Server struct {
+	session *utils.Session
+	printer utils.PaperCutPrinter
+	name    string
+	logger  *log.Logger
+	started time.Time
+
+	// submit sends a document to PaperCut, session.Submit but for tests.
+	submit func(ctx context.Context, printer *utils.PaperCutPrinter, copies int, path string) (utils.PaperCutJob, error)
+
+	mu        sync.Mutex
+	jobs      map[int]*job
+	nextID    int
+	refreshed time.Time
+}
+
+// job is a print job the server accepted.
+type job struct {
+	id         int
+	name       string
+	user       string
+	created    time.Time
+	processing time.Time
+	completed  time.Time
+	state      int
+	reason     string
+	message    string
+	paperCut   utils.PaperCutJob
+	submitted  bool
+	cancel     context.CancelFunc
+}
+
+// NewServer returns a server called name that prints to printer using
+// session. Log lines are written to logger.
+func NewServer(session *utils.Session, printer utils.PaperCutPrinter, name string, logger *log.Logger) *Server {
+	s := &Server{
+		session: session,
+		printer: printer,
+		name:    name,
+		logger:  logger,
+		started: time.Now(),
+		jobs:    map[int]*job{},
+		nextID:  1,
+	}
+	s.submit = func(ctx context.Context, printer *utils.PaperCutPrinter, copies int, path string) (utils.PaperCutJob, error) {
+		return s.session.Submit(ctx, printer, copies, path)
+	}
+	return s
+}
+
+// ServeHTTP answers IPP requests POSTed to PrinterPath.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != PrinterPath && r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "IPP requests must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/ipp") {
+		http.Error(w, "expected an application/ipp request", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body := bufio.NewReader(r.Body)
+	req, err := ReadMessage(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := s.handle(r, req, body)
+
+	w.Header().Set("Content-Type", "application/ipp")
+	resp.WriteTo(w)
+}
+
+// handle answers one IPP request. body holds the document data.
+func (s *Server) handle(r *http.Request, req *Message, body io.Reader) *Message {
+	resp := &Message{Version: [2]byte{2, 0}, Code: StatusOK, RequestID: req.RequestID}
+	op := Group{Tag: TagOperation}
+	op.Add("attributes-charset", String(TagCharset, "utf-8"))
+	op.Add("attributes-natural-language", String(TagLanguage, "en"))
+	resp.Groups = append(resp.Groups, op)
+
+	if req.Version[0] != 1 && req.Version[0] != 2 {
+		resp.Code = StatusVersionNotSupported
+		return resp
+	}
+	if len(req.Groups) == 0 || req.Groups[0].Tag != TagOperation ||
+		req.Group(TagOperation).Attribute("attributes-charset") == nil ||
+		req.Group(TagOperation).Attribute("attributes-natural-language") == nil {
+		return s.fail(resp, StatusBadRequest, "missing attributes-charset or attributes-natural-language")
+	}
+
+	switch req.Code {
+	case OpGetPrinterAttributes:
+		s.getPrinterAttributes(r, req, resp)
+	case OpValidateJob:
+		if format := req.Group(TagOperation).Attribute("document-format").String(); format != "" && !supportedFormat(format) {
+			s.fail(resp, StatusDocumentFormatUnsupported, format+" is not supported")
+		}
+	case OpPrintJob:
+		s.printJob(r, req, resp, body)
+	case OpGetJobs:
+		s.getJobs(r, req, resp)
+	case OpGetJobAttributes:
+		s.getJobAttributes(r, req, resp)
+	case OpCancelJob:
+		s.cancelJob(req, resp)
+	default:
+		s.fail(resp, StatusOperationNotSupported, "")
+	}
+	return resp
+}
+
+// fail sets the status of resp, adding message as the status-message.
+func (s *Server) fail(resp *Message, status uint16, message string) *Message {
+	resp.Code = status
+	if message != "" {
+		resp.Groups[0].Add("status-message", String(TagText, message))
+	}
+	return resp
+}
+
+// printerURI is the URI clients reach the printer at through r.
+func printerURI(r *http.Request) string {
+	return "ipp://" + r.Host + PrinterPath
+}
+
+func (s *Server) getPrinterAttributes(r *http.Request, req *Message, resp *Message) {
+	s.mu.Lock()
+	queued, printing := 0, false
+	for _, j := range s.jobs {
+		if !finished(j.state) {
+			queued++
+			printing = printing || j.state == JobProcessing
+		}
+	}
+	s.mu.Unlock()
+
+	state := PrinterIdle
+	if printing {
+		state = PrinterProcessing
+	}
+
+	g := Group{Tag: TagPrinter}
+	g.Add("printer-uri-supported", String(TagURI, printerURI(r)))
+	g.Add("uri-security-supported", String(TagKeyword, "none"))
+	g.Add("uri-authentication-supported", String(TagKeyword, "requesting-user-name"))
+	g.Add("printer-name", String(TagName, s.name))
+	g.Add("printer-info", String(TagText, s.printer.GetName()))
+	g.Add("printer-location", String(TagText, s.printer.GetLocation()))
+	g.Add("printer-make-and-model", String(TagText, "PaperCut web print via gu"))
+	g.Add("printer-state", Integer(TagEnum, state))
+	g.Add("printer-state-reasons", String(TagKeyword, "none"))
+	g.Add("printer-is-accepting-jobs", Boolean(true))
+	g.Add("printer-up-time", Integer(TagInteger, int(time.Since(s.started).Seconds())+1))
+	g.Add("printer-uuid", String(TagURI, "urn:uuid:"+uuid(s.name+strconv.Itoa(s.printer.GetID()))))
+	g.Add("queued-job-count", Integer(TagInteger, queued))
+	g.Add("ipp-versions-supported", Strings(TagKeyword, "1.1", "2.0")...)
+	g.Add("operations-supported",
+		Integer(TagEnum, OpPrintJob),
+		Integer(TagEnum, OpValidateJob),
+		Integer(TagEnum, OpCancelJob),
+		Integer(TagEnum, OpGetJobAttributes),
+		Integer(TagEnum, OpGetJobs),
+		Integer(TagEnum, OpGetPrinterAttributes))
+	g.Add("charset-configured", String(TagCharset, "utf-8"))
+	g.Add("charset-supported", String(TagCharset, "utf-8"))
+	g.Add("natural-language-configured", String(TagLanguage, "en"))
+	g.Add("generated-natural-language-supported", String(TagLanguage, "en"))
+	g.Add("document-format-default", String(TagMimeType, "application/pdf"))
+	g.Add("document-format-supported", Strings(TagMimeType, documentFormats...)...)
+	g.Add("pdl-override-supported", String(TagKeyword, "not-attempted"))
+	g.Add("compression-supported", String(TagKeyword, "none"))
+	g.Add("multiple-document-jobs-supported", Boolean(false))
+	g.Add("job-creation-attributes-supported", Strings(TagKeyword, "copies")...)
+	g.Add("copies-default", Integer(TagInteger, 1))
+	g.Add("copies-supported", Range(1, 999))
+	g.Add("color-supported", Boolean(false))
+	g.Add("media-default", String(TagKeyword, "iso_a4_210x297mm"))
+	g.Add("media-supported", Strings(TagKeyword, "iso_a4_210x297mm", "na_letter_8.5x11in")...)
+	g.Add("media-ready", Strings(TagKeyword, "iso_a4_210x297mm", "na_letter_8.5x11in")...)
+	g.Add("sides-default", String(TagKeyword, "one-sided"))
+	g.Add("sides-supported", String(TagKeyword, "one-sided"))
+	g.Add("print-color-mode-default", String(TagKeyword, "monochrome"))
+	g.Add("print-color-mode-supported", String(TagKeyword, "monochrome"))
+	g.Add("printer-resolution-default", Resolution(600, 600))
+	g.Add("printer-resolution-supported", Resolution(600, 600))
+	g.Add("which-jobs-supported", Strings(TagKeyword, "completed", "not-completed", "all")...)
+
+	resp.Groups = append(resp.Groups, filter(g, req.Group(TagOperation).Attribute("requested-attributes").Strings()))
+}
+
+func (s *Server) printJob(r *http.Request, req *Message, resp *Message, body io.Reader) {
+	op := req.Group(TagOperation)
+
+	format := op.Attribute("document-format").String()
+	if format == "" {
+		format = "application/octet-stream"
+	}
+	if !supportedFormat(format) {
+		s.fail(resp, StatusDocumentFormatUnsupported, format+" is not supported")
+		return
+	}
+
+	copies := 1
+	if n, ok := req.Group(TagJob).Attribute("copies").Int(); ok {
+		if n < 1 || n > 999 {
+			s.fail(resp, StatusBadRequest, "copies must be between 1 and 999")
+			return
+		}
+		copies = n
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(body, utils.MaxDocumentSize+1))
+	if err != nil {
+		s.fail(resp, StatusBadRequest, err.Error())
+		return
+	}
+	if int64(len(data)) > utils.MaxDocumentSize {
+		s.fail(resp, StatusRequestEntityTooLarge, "the document is larger than PaperCut accepts")
+		return
+	}
+	if len(data) == 0 {
+		s.fail(resp, StatusBadRequest, "the request has no document")
+		return
+	}
+
+	if format == "application/octet-stream" {
+		format = strings.SplitN(http.DetectContentType(data), ";", 2)[0]
+		if !supportedFormat(format) || format == "application/octet-stream" {
+			s.fail(resp, StatusDocumentFormatUnsupported, "the document is not a PDF, JPEG or PNG file")
+			return
+		}
+	}
+
+	name := op.Attribute("job-name").String()
+	if name == "" {
+		name = op.Attribute("document-name").String()
+	}
+	if name == "" {
+		name = "Untitled"
+	}
+
+	j := &job{
+		name:    name,
+		user:    op.Attribute("requesting-user-name").String(),
+		created: time.Now(),
+		state:   JobPending,
+		reason:  "none",
+	}
+
+	path, err := utils.SaveDocument(bytes.NewReader(data), name)
+	if err != nil {
+		s.fail(resp, StatusInternalError, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j.cancel = cancel
+
+	s.mu.Lock()
+	s.prune()
+	j.id = s.nextID
+	s.nextID++
+	s.jobs[j.id] = j
+	s.mu.Unlock()
+
+	s.logger.Printf("job %d: %q from %s, %d bytes, %d copies", j.id, name, j.user, len(data), copies)
+	go s.process(ctx, j, path, copies)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp.Groups = append(resp.Groups, s.jobAttributes(r, j, []string{"job-id", "job-uri", "job-state", "job-state-reasons"}))
+}
+
+// process sends a spooled document to PaperCut and records the outcome.
+func (s *Server) process(ctx context.Context, j *job, path string, copies int) {
+	defer os.RemoveAll(filepath.Dir(path))
+
+	s.mu.Lock()
+	if j.state == JobCanceled {
+		s.mu.Unlock()
+		return
+	}
+	j.state, j.reason, j.processing = JobProcessing, "job-transforming", time.Now()
+	s.mu.Unlock()
+
+	printer := s.printer
+	paperCutJob, err := s.submit(ctx, &printer, copies, path)
+
+	s.mu.Lock()
+	if err == nil && j.state == JobCanceled {
+		// The job was cancelled while the document was being sent, which
+		// got there all the same.
+		j.paperCut, j.submitted = paperCutJob, true
+		s.mu.Unlock()
+		s.cancelSubmitted(j, paperCutJob)
+		return
+	}
+	defer s.mu.Unlock()
+
+	if err != nil {
+		if ctx.Err() != nil {
+			s.logger.Printf("job %d: cancelled", j.id)
+			j.state, j.reason = JobCanceled, "job-canceled-by-user"
+		} else {
+			s.logger.Printf("job %d: %v", j.id, err)
+			j.state, j.reason, j.message = JobAborted, "aborted-by-system", err.Error()
+		}
+		j.completed = time.Now()
+		return
+	}
+
+	s.logger.Printf("job %d: sent to PaperCut as job %s", j.id, paperCutJob.GetJobID())
+	j.submitted = true
+	s.update(j, paperCutJob)
+}
+
+/*
+cancelSubmitted cancels the PaperCut job of j, which was cancelled before
+it was sent. If that fails j takes the state of the PaperCut job.
+*/
+func (s *Server) cancelSubmitted(j *job, paperCutJob utils.PaperCutJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err := s.session.Cancel(ctx, paperCutJob.GetJobID())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.logger.Printf("job %d: could not cancel PaperCut job %s: %v", j.id, paperCutJob.GetJobID(), err)
+		j.completed = time.Time{}
+		s.update(j, paperCutJob)
+		j.message = "could not cancel: " + err.Error()
+		return
+	}
+	s.logger.Printf("job %d: cancelled PaperCut job %s", j.id, paperCutJob.GetJobID())
+}
+
+// update sets the state of j from the status of its PaperCut job.
+func (s *Server) update(j *job, paperCutJob utils.PaperCutJob) {
+	j.paperCut = paperCutJob
+	j.state, j.reason = jobState(paperCutJob.GetStatus())
+	j.message = paperCutJob.GetStatus()
+	if finished(j.state) && j.completed.IsZero() {
+		j.completed = time.Now()
+	}
+}
+
+// jobState maps a PaperCut job status to an IPP job state and reason.
+func jobState(status string) (int, string) {
+	status = strings.ToLower(status)
+	switch {
+	case strings.HasPrefix(status, strings.ToLower(utils.JobStatusPrinted)):
+		return JobCompleted, "job-completed-successfully"
+	case strings.HasPrefix(status, strings.ToLower(utils.JobStatusCancelled)):
+		return JobCanceled, "job-canceled-by-user"
+	case strings.HasPrefix(status, strings.ToLower(utils.JobStatusError)):
+		return JobAborted, "aborted-by-system"
+	case strings.HasPrefix(status, strings.ToLower(utils.JobStatusHeld)):
+		return JobPendingHeld, "job-hold-until-specified"
+	default:
+		return JobProcessing, "job-printing"
+	}
+}
+
+func finished(state int) bool {
+	return state == JobCompleted || state == JobCanceled || state == JobAborted
+}
+
+// prune forgets the jobs that finished more than jobTTL ago. s.mu must be
+// held.
+func (s *Server) prune() {
+	for id, j := range s.jobs {
+		if finished(j.state) && time.Since(j.completed) > jobTTL {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+/*
+refresh updates jobs that are still at PaperCut from the job list, at most
+once every refreshInterval. Failures are logged and the old states kept.
+*/
+func (s *Server) refresh(ctx context.Context) {
+	s.mu.Lock()
+	pending := false
+	for _, j := range s.jobs {
+		pending = pending || (j.submitted && !finished(j.state))
+	}
+	if !pending || time.Since(s.refreshed) < refreshInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.refreshed = time.Now()
+	s.mu.Unlock()
+
+	paperCutJobs, err := s.session.Jobs(ctx)
+	if err != nil {
+		s.logger.Printf("could not fetch the PaperCut job list: %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		if !j.submitted || finished(j.state) {
+			continue
+		}
+		for _, paperCutJob := range paperCutJobs {
+			if paperCutJob.GetJobID() == j.paperCut.GetJobID() {
+				s.update(j, paperCutJob)
+			}
+		}
+	}
+}
+
+func (s *Server) getJobs(r *http.Request, req *Message, resp *Message) {
+	op := req.Group(TagOperation)
+	s.refresh(r.Context())
+
+	which := op.Attribute("which-jobs").String()
+	if which == "" {
+		which = "not-completed"
+	}
+	if which != "not-completed" && which != "completed" && which != "all" {
+		s.fail(resp, StatusBadRequest, "which-jobs "+which+" is not supported")
+		return
+	}
+
+	limit, _ := op.Attribute("limit").Int()
+	user := ""
+	if myJobs := op.Attribute("my-jobs"); myJobs != nil && len(myJobs.Values) > 0 && len(myJobs.Values[0].Data) == 1 && myJobs.Values[0].Data[0] == 1 {
+		user = op.Attribute("requesting-user-name").String()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+
+	requested := op.Attribute("requested-attributes").Strings()
+	if len(requested) == 0 {
+		requested = []string{"job-id", "job-uri"}
+	}
+
+	// Newest first, like lpstat.
+	for id := s.nextID - 1; id > 0; id-- {
+		j, ok := s.jobs[id]
+		if !ok || (user != "" && j.user != user) {
+			continue
+		}
+		if (which == "completed" && !finished(j.state)) || (which == "not-completed" && finished(j.state)) {
+			continue
+		}
+		resp.Groups = append(resp.Groups, s.jobAttributes(r, j, requested))
+		if limit > 0 && len(resp.Groups)-1 >= limit {
+			break
+		}
+	}
+}
+
+func (s *Server) getJobAttributes(r *http.Request, req *Message, resp *Message) {
+	s.refresh(r.Context())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j := s.findJob(req)
+	if j == nil {
+		s.fail(resp, StatusNotFound, "no such job")
+		return
+	}
+	resp.Groups = append(resp.Groups, s.jobAttributes(r, j, req.Group(TagOperation).Attribute("requested-attributes").Strings()))
+}
+
+func (s *Server) cancelJob(req *Message, resp *Message) {
+	s.mu.Lock()
+	j := s.findJob(req)
+	if j == nil {
+		s.mu.Unlock()
+		s.fail(resp, StatusNotFound, "no such job")
+		return
+	}
+	if finished(j.state) {
+		s.mu.Unlock()
+		s.fail(resp, StatusNotPossible, "the job has already finished")
+		return
+	}
+
+	if !j.submitted {
+		// Stopping the upload also cancels the job at PaperCut if the
+		// document got there.
+		j.state, j.reason, j.completed = JobCanceled, "job-canceled-by-user", time.Now()
+		j.cancel()
+		s.mu.Unlock()
+		return
+	}
+	jobID := j.paperCut.GetJobID()
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := s.session.Cancel(ctx, jobID); err != nil {
+		s.fail(resp, StatusNotPossible, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logger.Printf("job %d: cancelled PaperCut job %s", j.id, jobID)
+	j.state, j.reason, j.completed = JobCanceled, "job-canceled-by-user", time.Now()
+}
+
+// findJob returns the job named by the job-id or job-uri of req. s.mu must
+// be held.
+func (s *Server) findJob(req *Message) *job {
+	op := req.Group(TagOperation)
+	id, ok := op.Attribute("job-id").Int()
+	if !ok {
+		uri := op.Attribute("job-uri").String()
+		n, err := strconv.Atoi(uri[strings.LastIndex(uri, "/")+1:])
+		if err != nil {
+			return nil
+		}
+		id = n
+	}
+	return s.jobs[id]
+}
+
+// jobAttributes describes j, keeping only the requested attributes. s.mu
+// must be held.
+func (s *Server) jobAttributes(r *http.Request, j *job, requested []string) Group {
+	g := Group{Tag: TagJob}
+	g.Add("job-id", Integer(TagInteger, j.id))
+	g.Add("job-uri", String(TagURI, printerURI(r)+"/"+strconv.Itoa(j.id)))
+	g.Add("job-printer-uri", String(TagURI, printerURI(r)))
+	g.Add("job-name", String(TagName, j.name))
+	g.Add("job-originating-user-name", String(TagName, j.user))
+	g.Add("job-state", Integer(TagEnum, j.state))
+	g.Add("job-state-reasons", String(TagKeyword, j.reason))
+	if j.message != "" {
+		g.Add("job-state-message", String(TagText, j.message))
+	}
+	g.Add("job-printer-up-time", Integer(TagInteger, int(time.Since(s.started).Seconds())+1))
+	g.Add("time-at-creation", Integer(TagInteger, int(j.created.Sub(s.started).Seconds())+1))
+	g.Add("date-time-at-creation", DateTime(j.created))
+	g.Add("time-at-processing", timeAt(s.started, j.processing))
+	g.Add("time-at-completed", timeAt(s.started, j.completed))
+	if j.submitted && j.paperCut.GetPages() > 0 {
+		g.Add("job-impressions", Integer(TagInteger, j.paperCut.GetPages()))
+		if j.state == JobCompleted {
+			g.Add("job-impressions-completed", Integer(TagInteger, j.paperCut.GetPages()))
+		}
+	}
+
+	return filter(g, requested)
+}
+
+// timeAt is a time-at-* attribute value, the printer up time at t.
+func timeAt(started time.Time, t time.Time) Value {
+	if t.IsZero() {
+		return Value{Tag: TagNoValue}
+	}
+	return Integer(TagInteger, int(t.Sub(started).Seconds())+1)
+}
+
+/*
+filter keeps the attributes of g named in requested. Group names such as
+"all" or "printer-description", or an empty list, keep everything.
+*/
+func filter(g Group, requested []string) Group {
+	if len(requested) == 0 {
+		return g
+	}
+
+	want := map[string]bool{}
+	for _, name := range requested {
+		switch name {
+		case "all", "printer-description", "job-template", "job-description", "job-status":
+			return g
+		}
+		want[name] = true
+	}
+
+	filtered := Group{Tag: g.Tag}
+	for _, attr := range g.Attributes {
+		if want[attr.Name] {
+			filtered.Attributes = append(filtered.Attributes, attr)
+		}
+	}
+	return filtered
+}
+
+func supportedFormat(format string) bool {
+	format = strings.ToLower(strings.TrimSpace(strings.SplitN(format, ";", 2)[0]))
+	for _, f := range documentFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// uuid derives a stable version 3 UUID from name, so that clients
+// recognise the printer across restarts.
+func uuid(name string) string {
+	sum := md5.Sum([]byte(name))
+	sum[6] = sum[6]&0x0f | 0x30
+	sum[8] = sum[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
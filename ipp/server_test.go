@@ -0,0 +1,274 @@
+package ipp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quantamhd/gu/papercuttest"
+	"github.com/quantamhd/gu/utils"
+)
+
+const testPDF = "%PDF-1.4\n1 0 obj << /Type /Page >> endobj\n%%EOF\n"
+
+// newTestPrinter starts an IPP printer that prints to library-bw on a fake
+// PaperCut server, and returns both and the printer's URL.
+func newTestPrinter(t *testing.T) (*papercuttest.Server, *Server, string) {
+	t.Helper()
+	srv := papercuttest.NewServer()
+	t.Cleanup(srv.Close)
+
+	baseURL, retry, interval := utils.BaseURL, utils.Retry, refreshInterval
+	utils.BaseURL = srv.URL
+	utils.Retry = utils.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	refreshInterval = 0
+	t.Cleanup(func() { utils.BaseURL, utils.Retry, refreshInterval = baseURL, retry, interval })
+
+	ctx := context.Background()
+	session, err := utils.NewSession(ctx, "student", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	printers, err := session.Printers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, ok := utils.FindPrinter(printers, "library-bw")
+	if !ok {
+		t.Fatal("no library-bw printer")
+	}
+
+	server := NewServer(session, printers[id], "gu", log.New(ioutil.Discard, "", 0))
+	printer := httptest.NewServer(server)
+	t.Cleanup(printer.Close)
+	return srv, server, printer.URL + PrinterPath
+}
+
+// call sends an IPP request with the operation attributes in op, the job
+// attributes in job, if any, and document after it.
+func call(t *testing.T, printerURL string, code uint16, op []Attribute, job []Attribute, document string) *Message {
+	t.Helper()
+	ops := Group{Tag: TagOperation}
+	ops.Add("attributes-charset", String(TagCharset, "utf-8"))
+	ops.Add("attributes-natural-language", String(TagLanguage, "en"))
+	ops.Add("printer-uri", String(TagURI, printerURL))
+	ops.Attributes = append(ops.Attributes, op...)
+	req := &Message{Version: [2]byte{2, 0}, Code: code, RequestID: 1, Groups: []Group{ops}}
+	if job != nil {
+		req.Groups = append(req.Groups, Group{Tag: TagJob, Attributes: job})
+	}
+
+	var body bytes.Buffer
+	req.WriteTo(&body)
+	body.WriteString(document)
+
+	resp, err := http.Post(printerURL, "application/ipp", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	m, err := ReadMessage(bufio.NewReader(resp.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func attr(name string, values ...Value) Attribute {
+	return Attribute{Name: name, Values: values}
+}
+
+// printTestJob prints testPDF as name and returns the IPP job ID.
+func printTestJob(t *testing.T, printerURL string, name string) int {
+	t.Helper()
+	resp := call(t, printerURL, OpPrintJob,
+		[]Attribute{attr("requesting-user-name", String(TagName, "alice")), attr("job-name", String(TagName, name)),
+			attr("document-format", String(TagMimeType, "application/pdf"))},
+		[]Attribute{attr("copies", Integer(TagInteger, 2))}, testPDF)
+	if resp.Code != StatusOK {
+		t.Fatalf("Print-Job = %#x: %s", resp.Code, resp.Group(TagOperation).Attribute("status-message").String())
+	}
+	id, ok := resp.Group(TagJob).Attribute("job-id").Int()
+	if !ok {
+		t.Fatal("Print-Job answered without a job-id")
+	}
+	return id
+}
+
+// waitForState waits until job id is in state for reason, and returns the
+// answer of Get-Job-Attributes.
+func waitForState(t *testing.T, printerURL string, id int, state int, reason string) *Message {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp := call(t, printerURL, OpGetJobAttributes, []Attribute{attr("job-id", Integer(TagInteger, id))}, nil, "")
+		job := resp.Group(TagJob)
+		got, _ := job.Attribute("job-state").Int()
+		if got == state && job.Attribute("job-state-reasons").String() == reason {
+			return resp
+		} else if time.Now().After(deadline) {
+			t.Fatalf("job %d is in state %d for %s, want %d for %s", id, got, job.Attribute("job-state-reasons").String(), state, reason)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPrintJob(t *testing.T) {
+	srv, _, printerURL := newTestPrinter(t)
+
+	id := printTestJob(t, printerURL, "essay.pdf")
+	resp := waitForState(t, printerURL, id, JobProcessing, "job-printing")
+	if name := resp.Group(TagJob).Attribute("job-name").String(); name != "essay.pdf" {
+		t.Errorf("job-name = %q", name)
+	}
+
+	jobs := srv.Jobs()
+	if len(jobs) != 1 || jobs[0].Document != "essay.pdf" || jobs[0].Copies != 2 || string(jobs[0].Data) != testPDF {
+		t.Fatalf("server jobs = %+v, want essay.pdf with 2 copies", jobs)
+	}
+
+	srv.SetJobStatus(jobs[0].ID, papercuttest.StatusPrinted)
+	waitForState(t, printerURL, id, JobCompleted, "job-completed-successfully")
+}
+
+func TestPrintJobRefused(t *testing.T) {
+	srv, _, printerURL := newTestPrinter(t)
+
+	tests := []struct {
+		name     string
+		format   string
+		copies   int
+		document string
+		status   uint16
+	}{
+		{"unsupported format", "text/plain", 1, "hello", StatusDocumentFormatUnsupported},
+		{"sniffed text", "application/octet-stream", 1, "hello", StatusDocumentFormatUnsupported},
+		{"no document", "application/pdf", 1, "", StatusBadRequest},
+		{"no copies", "application/pdf", 0, testPDF, StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := call(t, printerURL, OpPrintJob, []Attribute{attr("document-format", String(TagMimeType, test.format))},
+				[]Attribute{attr("copies", Integer(TagInteger, test.copies))}, test.document)
+			if resp.Code != test.status {
+				t.Errorf("Print-Job = %#x, want %#x", resp.Code, test.status)
+			}
+		})
+	}
+	if len(srv.Jobs()) != 0 {
+		t.Errorf("the server has %d jobs, want none", len(srv.Jobs()))
+	}
+}
+
+func TestGetJobs(t *testing.T) {
+	srv, _, printerURL := newTestPrinter(t)
+
+	first := printTestJob(t, printerURL, "essay.pdf")
+	waitForState(t, printerURL, first, JobProcessing, "job-printing")
+	second := printTestJob(t, printerURL, "notes.pdf")
+	waitForState(t, printerURL, second, JobProcessing, "job-printing")
+	for _, job := range srv.Jobs() {
+		if job.Document == "essay.pdf" {
+			srv.SetJobStatus(job.ID, papercuttest.StatusPrinted)
+		}
+	}
+	waitForState(t, printerURL, first, JobCompleted, "job-completed-successfully")
+
+	ids := func(which string) []int {
+		resp := call(t, printerURL, OpGetJobs, []Attribute{attr("which-jobs", String(TagKeyword, which))}, nil, "")
+		var ids []int
+		for _, g := range resp.Groups {
+			if g.Tag == TagJob {
+				id, _ := g.Attribute("job-id").Int()
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+	if got := ids("not-completed"); len(got) != 1 || got[0] != second {
+		t.Errorf("not completed jobs = %v, want [%d]", got, second)
+	}
+	if got := ids("completed"); len(got) != 1 || got[0] != first {
+		t.Errorf("completed jobs = %v, want [%d]", got, first)
+	}
+	if got := ids("all"); len(got) != 2 || got[0] != second || got[1] != first {
+		t.Errorf("all jobs = %v, want [%d %d]", got, second, first)
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	srv, _, printerURL := newTestPrinter(t)
+
+	id := printTestJob(t, printerURL, "essay.pdf")
+	waitForState(t, printerURL, id, JobProcessing, "job-printing")
+
+	resp := call(t, printerURL, OpCancelJob, []Attribute{attr("job-id", Integer(TagInteger, id))}, nil, "")
+	if resp.Code != StatusOK {
+		t.Fatalf("Cancel-Job = %#x", resp.Code)
+	}
+	waitForState(t, printerURL, id, JobCanceled, "job-canceled-by-user")
+	if jobs := srv.Jobs(); len(jobs) != 1 || jobs[0].Status != papercuttest.StatusCancelled {
+		t.Errorf("server jobs = %+v, want one cancelled job", jobs)
+	}
+
+	if resp := call(t, printerURL, OpCancelJob, []Attribute{attr("job-id", Integer(TagInteger, id))}, nil, ""); resp.Code != StatusNotPossible {
+		t.Errorf("cancelling again = %#x, want not possible", resp.Code)
+	}
+	if resp := call(t, printerURL, OpCancelJob, []Attribute{attr("job-id", Integer(TagInteger, 99))}, nil, ""); resp.Code != StatusNotFound {
+		t.Errorf("cancelling an unknown job = %#x, want not found", resp.Code)
+	}
+}
+
+func TestCancelJobWhileSending(t *testing.T) {
+	srv, server, printerURL := newTestPrinter(t)
+
+	// Cancel-Job comes in after the document reached PaperCut, before the
+	// job was found in the job list.
+	submit := server.submit
+	server.submit = func(ctx context.Context, printer *utils.PaperCutPrinter, copies int, path string) (utils.PaperCutJob, error) {
+		job, err := submit(ctx, printer, copies, path)
+		if resp := call(t, printerURL, OpCancelJob, []Attribute{attr("job-id", Integer(TagInteger, 1))}, nil, ""); resp.Code != StatusOK {
+			t.Errorf("Cancel-Job = %#x", resp.Code)
+		}
+		return job, err
+	}
+
+	id := printTestJob(t, printerURL, "essay.pdf")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if jobs := srv.Jobs(); len(jobs) == 1 && jobs[0].Status == papercuttest.StatusCancelled {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server jobs = %+v, want one cancelled job", srv.Jobs())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitForState(t, printerURL, id, JobCanceled, "job-canceled-by-user")
+}
+
+func TestPrune(t *testing.T) {
+	s := NewServer(nil, utils.PaperCutPrinter{}, "gu", log.New(ioutil.Discard, "", 0))
+	old := time.Now().Add(-2 * jobTTL)
+	s.jobs = map[int]*job{
+		1: {id: 1, state: JobCompleted, completed: old},
+		2: {id: 2, state: JobAborted, completed: old},
+		3: {id: 3, state: JobCompleted, completed: time.Now()},
+		4: {id: 4, state: JobProcessing, created: old},
+		5: {id: 5, state: JobPendingHeld, created: old},
+	}
+
+	s.prune()
+
+	for id, kept := range map[int]bool{1: false, 2: false, 3: true, 4: true, 5: true} {
+		if _, ok := s.jobs[id]; ok != kept {
+			t.Errorf("job %d kept = %v, want %v", id, ok, kept)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package kiosk
+
+import (
+	"html/template"
+	"net/http"
+)
+
+// pageData fills the page template.
+type pageData struct {
+	CSRF        string
+	IdleMinutes int
+	Notice      string
+	Failed      bool
+
+	// Username is empty until the visitor logs in.
+	Username  string
+	Balance   string
+	Location  string
+	Locations []string
+	Printers  []printerOption
+	Jobs      []jobRow
+	JobsError string
+}
+
+type printerOption struct {
+	ID       int
+	Name     string
+	Location string
+	Cost     string
+}
+
+type jobRow struct {
+	ID          string
+	Submitted   string
+	Printer     string
+	Document    string
+	Pages       int
+	Cost        string
+	Status      string
+	Cancellable bool
+}
+
+// render writes the template called name.
+func render(w http.ResponseWriter, name string, data pageData) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := pages.ExecuteTemplate(w, name, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+var pages = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Print</title>
+<link rel="stylesheet" href="/kiosk.css">
+<script src="/kiosk.js" defer></script>
+</head>
+<body>
+<header>
+<h1>Print</h1>
+{{if .Username}}
+<form method="post" action="/logout" class="logout">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<span>{{.Username}}{{if .Balance}} &middot; balance {{.Balance}}{{end}}</span>
+<button type="submit">Log out</button>
+</form>
+{{end}}
+</header>
+<main>
+{{if .Notice}}<p class="notice{{if .Failed}} failed{{end}}" role="status">{{.Notice}}</p>{{end}}
+{{if .Username}}
+<form method="post" action="/print" enctype="multipart/form-data" id="print">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<label class="drop" id="drop">
+<input type="file" name="file" id="file" required>
+<span id="drop-label">Drop a document here, or click to choose one</span>
+</label>
+<div class="options">
+<label>Location
+<select id="location">
+<option value="">All locations</option>
+{{range .Locations}}<option value="{{.}}"{{if eq . $.Location}} selected{{end}}>{{.}}</option>
+{{end}}</select>
+</label>
+<label>Printer
+<select name="printer" id="printer" required>
+{{range .Printers}}<option value="{{.ID}}" data-location="{{.Location}}">{{.Name}}{{if .Location}} ({{.Location}}){{end}}{{if .Cost}}, {{.Cost}} a page{{end}}</option>
+{{end}}</select>
+</label>
+<label>Copies
+<input type="number" name="copies" value="1" min="1" max="999" required>
+</label>
+</div>
+<button type="submit" id="send">Print</button>
+</form>
+<section>
+<h2>Your jobs</h2>
+<div id="jobs">{{template "jobs" .}}</div>
+</section>
+<p class="hint">You are logged out after {{.IdleMinutes}} minutes of inactivity. Log out when you are done.</p>
+{{else}}
+<form method="post" action="/login" class="login" autocomplete="off">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<label>Username <input type="text" name="username" autocomplete="off" autocapitalize="none" required autofocus></label>
+<label>Password <input type="password" name="password" autocomplete="off" required></label>
+<button type="submit">Log in</button>
+</form>
+{{end}}
+</main>
+</body>
+</html>
+{{define "jobs"}}{{if .JobsError}}<p class="notice failed">{{.JobsError}}</p>{{else if .Jobs}}
+<table>
+<thead><tr><th>Job</th><th>Submitted</th><th>Printer</th><th>Document</th><th>Pages</th><th>Cost</th><th>Status</th><th></th></tr></thead>
+<tbody>
+{{range .Jobs}}<tr>
+<td>{{.ID}}</td><td>{{.Submitted}}</td><td>{{.Printer}}</td><td>{{.Document}}</td><td>{{.Pages}}</td><td>{{.Cost}}</td><td>{{.Status}}</td>
+<td>{{if .Cancellable}}<form method="post" action="/cancel"><input type="hidden" name="csrf" value="{{$.CSRF}}"><input type="hidden" name="job" value="{{.ID}}"><button type="submit">Cancel</button></form>{{end}}</td>
+</tr>
+{{end}}</tbody>
+</table>
+{{else}}<p>No jobs yet.</p>{{end}}{{end}}
+`))
+
+/*
+script makes the drop zone accept dropped files, narrows the printers down
+to a location and refreshes the job status. When the session has expired,
+the status poll fails and the page goes back to the login form, so that the
+next person does not see the jobs of the last one.
+*/
+const script = `"use strict";
+document.addEventListener("DOMContentLoaded", function () {
+  var drop = document.getElementById("drop");
+  var file = document.getElementById("file");
+  var label = document.getElementById("drop-label");
+  if (drop && file) {
+    var show = function () {
+      if (file.files.length > 0) {
+        label.textContent = file.files[0].name;
+      }
+    };
+    file.addEventListener("change", show);
+    drop.addEventListener("dragover", function (e) {
+      e.preventDefault();
+      drop.classList.add("over");
+    });
+    drop.addEventListener("dragleave", function () {
+      drop.classList.remove("over");
+    });
+    drop.addEventListener("drop", function (e) {
+      e.preventDefault();
+      drop.classList.remove("over");
+      if (e.dataTransfer.files.length > 0) {
+        file.files = e.dataTransfer.files;
+        show();
+      }
+    });
+  }
+
+  var place = document.getElementById("location");
+  var printer = document.getElementById("printer");
+  if (place && printer) {
+    var filter = function () {
+      var first = null;
+      Array.prototype.forEach.call(printer.options, function (option) {
+        option.hidden = place.value !== "" && option.dataset.location !== place.value;
+        if (!option.hidden && first === null) {
+          first = option;
+        }
+      });
+      if (printer.selectedOptions.length === 0 || printer.selectedOptions[0].hidden) {
+        if (first !== null) {
+          first.selected = true;
+        }
+      }
+    };
+    place.addEventListener("change", filter);
+    filter();
+  }
+
+  var form = document.getElementById("print");
+  if (form) {
+    form.addEventListener("submit", function () {
+      var send = document.getElementById("send");
+      send.disabled = true;
+      send.textContent = "Sending…";
+    });
+  }
+
+  var jobs = document.getElementById("jobs");
+  if (jobs) {
+    setInterval(function () {
+      fetch("/status", {credentials: "same-origin", cache: "no-store"}).then(function (resp) {
+        if (resp.status === 401) {
+          location.replace("/");
+          return;
+        }
+        if (resp.ok) {
+          resp.text().then(function (html) { jobs.innerHTML = html; });
+        }
+      });
+    }, 5000);
+  }
+});
+`
+
+const style = `body { font-family: system-ui, sans-serif; margin: 0; color: #222; }
+header { display: flex; align-items: center; justify-content: space-between; padding: 0.5em 1.5em; background: #2c3e50; color: #fff; }
+header h1 { margin: 0; font-size: 1.4em; }
+header .logout span { margin-right: 1em; }
+main { max-width: 60em; margin: 1.5em auto; padding: 0 1.5em; }
+label { display: block; margin: 0.5em 0; }
+input, select, button { font: inherit; padding: 0.4em; }
+button { cursor: pointer; }
+.login { max-width: 20em; margin: 3em auto; }
+.login input { width: 100%; box-sizing: border-box; }
+.drop { border: 3px dashed #999; border-radius: 8px; padding: 3em 1em; text-align: center; cursor: pointer; }
+.drop.over { border-color: #2c3e50; background: #eef3f8; }
+.drop input { display: block; margin: 0 auto 1em; }
+.options { display: flex; flex-wrap: wrap; gap: 1em; margin: 1em 0; }
+#send { font-size: 1.2em; padding: 0.5em 2em; }
+.notice { padding: 0.75em 1em; background: #e8f5e9; border-left: 4px solid #2e7d32; }
+.notice.failed { background: #fdecea; border-left-color: #c62828; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 0.4em; border-bottom: 1px solid #ddd; }
+td form { margin: 0; }
+.hint { color: #666; font-size: 0.9em; }
+`
@@ -0,0 +1,518 @@
+/*
+Package kiosk serves a small web page for printing from a shared computer:
+a login form, then a drop zone for the document, a printer picker that can
+be narrowed down by location, the number of copies and the user's recent
+jobs with their status.
+
+Every browser session logs in to PaperCut on its own. Nothing is shared
+between visitors: the cookie that ties a browser to its PaperCut session is
+replaced at login, pages are never cached, and a visitor idle for longer
+than the idle time is logged out of PaperCut and forgotten, so the next
+person at the computer starts at the login form.
+*/
+package kiosk
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quantamhd/gu/utils"
+)
+
+// cookieName is the cookie that identifies a visitor.
+const cookieName = "gu_kiosk"
+
+// maxMemory is how much of an upload is kept in memory; the rest goes to a
+// temporary file.
+const maxMemory = 32 << 20
+
+// shownJobs is how many of the recent jobs the status view lists.
+const shownJobs = 10
+
+// expireInterval is how often idle visitors are looked for.
+var expireInterval = 5 * time.Second
+
+// logoutTimeout bounds logging a visitor out of PaperCut.
+const logoutTimeout = 30 * time.Second
+
+/*
+Server is the kiosk page. Documents are converted with convert, if set,
+before they are checked and uploaded.
+*/
+type Server struct {
+	idle     time.Duration
+	location string
+	convert  func(ctx context.Context, path string) (string, error)
+	logger   *log.Logger
+
+	mu       sync.Mutex
+	visitors map[string]*visitor
+}
+
+// visitor is a browser session, logged in to PaperCut once session is set.
+type visitor struct {
+	id       string
+	csrf     string
+	session  *utils.Session
+	printers map[int]utils.PaperCutPrinter
+	lastSeen time.Time
+
+	// notice is shown once on the next page, as an error if failed.
+	notice string
+	failed bool
+}
+
+/*
+NewServer returns a kiosk that logs visitors out after idle without a
+request. location preselects the printers of a location and may be empty.
+Log lines are written to logger; they name users but never documents.
+*/
+func NewServer(idle time.Duration, location string, convert func(ctx context.Context, path string) (string, error), logger *log.Logger) *Server {
+	return &Server{
+		idle:     idle,
+		location: location,
+		convert:  convert,
+		logger:   logger,
+		visitors: map[string]*visitor{},
+	}
+}
+
+// ServeHTTP answers the kiosk's pages and forms.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	header := w.Header()
+	header.Set("Cache-Control", "no-store")
+	header.Set("X-Frame-Options", "DENY")
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Referrer-Policy", "no-referrer")
+	header.Set("Content-Security-Policy", "default-src 'none'; script-src 'self'; style-src 'self'; "+
+		"connect-src 'self'; form-action 'self'; frame-ancestors 'none'; base-uri 'none'")
+
+	if r.Method == "POST" && !sameOrigin(r) {
+		http.Error(w, "forms must be sent from the kiosk page", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/" && r.Method == "GET":
+		s.servePage(w, r)
+	case r.URL.Path == "/status" && r.Method == "GET":
+		s.serveStatus(w, r)
+	case r.URL.Path == "/kiosk.js" && r.Method == "GET":
+		header.Set("Content-Type", "text/javascript; charset=utf-8")
+		fmt.Fprint(w, script)
+	case r.URL.Path == "/kiosk.css" && r.Method == "GET":
+		header.Set("Content-Type", "text/css; charset=utf-8")
+		fmt.Fprint(w, style)
+	case r.URL.Path == "/login" && r.Method == "POST":
+		s.login(w, r)
+	case r.URL.Path == "/print" && r.Method == "POST":
+		s.print(w, r)
+	case r.URL.Path == "/cancel" && r.Method == "POST":
+		s.cancel(w, r)
+	case r.URL.Path == "/logout" && r.Method == "POST":
+		s.logout(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+/*
+ExpireIdle logs out the visitors that have been idle for too long until ctx
+is done, and then everyone still logged in.
+*/
+func (s *Server) ExpireIdle(ctx context.Context) {
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			var all []*visitor
+			for id, v := range s.visitors {
+				all = append(all, v)
+				delete(s.visitors, id)
+			}
+			s.mu.Unlock()
+			for _, v := range all {
+				s.end(v, "the kiosk stopped")
+			}
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			var idle []*visitor
+			for id, v := range s.visitors {
+				if time.Since(v.lastSeen) > s.idle {
+					idle = append(idle, v)
+					delete(s.visitors, id)
+				}
+			}
+			s.mu.Unlock()
+			for _, v := range idle {
+				s.end(v, "idle")
+			}
+		}
+	}
+}
+
+// end logs a forgotten visitor out of PaperCut.
+func (s *Server) end(v *visitor, reason string) {
+	if v.session == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), logoutTimeout)
+	defer cancel()
+	if err := v.session.Logout(ctx); err != nil {
+		s.logger.Printf("%s: could not log out of PaperCut: %v", v.session.GetUsername(), err)
+		return
+	}
+	s.logger.Printf("%s: logged out (%s)", v.session.GetUsername(), reason)
+}
+
+/*
+visitor returns the visitor of r's cookie, or nil if it has none or it was
+idle for too long. touch counts the request as activity.
+*/
+func (s *Server) visitor(r *http.Request, touch bool) *visitor {
+	cookie, err := r.Cookie(cookieName)
+	if err != nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.visitors[cookie.Value]
+	if !ok || time.Since(v.lastSeen) > s.idle {
+		return nil
+	}
+	if touch {
+		v.lastSeen = time.Now()
+	}
+	return v
+}
+
+/*
+newVisitor starts a browser session and sets its cookie. session and
+printers are nil until the visitor logs in.
+*/
+func (s *Server) newVisitor(w http.ResponseWriter, session *utils.Session, printers map[int]utils.PaperCutPrinter) *visitor {
+	v := &visitor{
+		id:       randomToken(),
+		csrf:     randomToken(),
+		session:  session,
+		printers: printers,
+		lastSeen: time.Now(),
+	}
+
+	s.mu.Lock()
+	s.visitors[v.id] = v
+	s.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieName,
+		Value:    v.id,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return v
+}
+
+// forget drops a visitor, if it is still known.
+func (s *Server) forget(v *visitor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.visitors[v.id] == v {
+		delete(s.visitors, v.id)
+	}
+}
+
+// formVisitor returns the visitor that sent a form, or nil if the form does
+// not carry its CSRF token.
+func (s *Server) formVisitor(r *http.Request) *visitor {
+	v := s.visitor(r, true)
+	if v == nil || subtle.ConstantTimeCompare([]byte(r.FormValue("csrf")), []byte(v.csrf)) != 1 {
+		return nil
+	}
+	return v
+}
+
+// notify sets the notice v sees on its next page.
+func (s *Server) notify(v *visitor, failed bool, format string, args ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v.notice = fmt.Sprintf(format, args...)
+	v.failed = failed
+}
+
+// takeNotice returns v's notice and clears it.
+func (s *Server) takeNotice(v *visitor) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	notice, failed := v.notice, v.failed
+	v.notice, v.failed = "", false
+	return notice, failed
+}
+
+func (s *Server) servePage(w http.ResponseWriter, r *http.Request) {
+	v := s.visitor(r, true)
+	if v == nil {
+		v = s.newVisitor(w, nil, nil)
+	}
+
+	data := pageData{CSRF: v.csrf, IdleMinutes: int((s.idle + time.Minute - 1) / time.Minute)}
+	data.Notice, data.Failed = s.takeNotice(v)
+	if v.session != nil {
+		data.Username = v.session.GetUsername()
+		data.Location = s.location
+		data.Locations, data.Printers = printerOptions(v.printers)
+		data.Jobs, data.JobsError = s.jobRows(r.Context(), v)
+		if balance, err := v.session.Balance(r.Context()); err == nil {
+			data.Balance = money(balance)
+		}
+	}
+
+	render(w, "page", data)
+}
+
+/*
+serveStatus answers the status view's polls with the job table. Polls do
+not count as activity, so an abandoned page still expires; once it has,
+they are answered with 401 Unauthorized and the page goes back to the
+login form.
+*/
+func (s *Server) serveStatus(w http.ResponseWriter, r *http.Request) {
+	v := s.visitor(r, false)
+	if v == nil || v.session == nil {
+		http.Error(w, "logged out", http.StatusUnauthorized)
+		return
+	}
+
+	data := pageData{CSRF: v.csrf}
+	data.Jobs, data.JobsError = s.jobRows(r.Context(), v)
+	render(w, "jobs", data)
+}
+
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	old := s.formVisitor(r)
+	if old == nil {
+		v := s.newVisitor(w, nil, nil)
+		s.notify(v, true, "The page had expired, please log in again.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	username := strings.TrimSpace(r.FormValue("username"))
+	password := r.FormValue("password")
+	if username == "" || password == "" {
+		s.notify(old, true, "Enter your username and password.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	session, err := utils.NewSession(r.Context(), username, password)
+	if err != nil {
+		s.logger.Printf("%s: could not log in: %v", username, err)
+		s.notify(old, true, "Could not log in: %v", err)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	printers, err := session.Printers(r.Context())
+	if err != nil {
+		session.Logout(r.Context())
+		s.notify(old, true, "Could not list the printers: %v", err)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	// A new cookie at login, so that one set before cannot be used to ride
+	// along on the session.
+	s.forget(old)
+	s.newVisitor(w, session, printers)
+	s.logger.Printf("%s: logged in", username)
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (s *Server) print(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, utils.MaxDocumentSize+maxMemory)
+	if err := r.ParseMultipartForm(maxMemory); err != nil {
+		http.Error(w, "the document is too large or the form is broken", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	if v := s.formVisitor(r); v != nil && v.session != nil {
+		s.printDocument(r, v)
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// printDocument prints the document of a print form and tells v how it went.
+func (s *Server) printDocument(r *http.Request, v *visitor) {
+	id, _ := strconv.Atoi(r.FormValue("printer"))
+	printer, ok := v.printers[id]
+	if !ok {
+		s.notify(v, true, "Choose a printer.")
+		return
+	}
+	copies, err := strconv.Atoi(r.FormValue("copies"))
+	if err != nil || copies < 1 {
+		s.notify(v, true, "The number of copies must be at least 1.")
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		s.notify(v, true, "Choose a document to print.")
+		return
+	}
+	defer file.Close()
+
+	path, err := utils.SaveDocument(file, header.Filename)
+	if err != nil {
+		s.notify(v, true, "Could not read %s: %v", header.Filename, err)
+		return
+	}
+	defer os.RemoveAll(filepath.Dir(path))
+
+	uploadPath := path
+	if s.convert != nil {
+		converted, err := s.convert(r.Context(), path)
+		if err != nil {
+			s.notify(v, true, "Could not convert %s: %v", header.Filename, err)
+			return
+		}
+		if converted != path {
+			defer os.RemoveAll(filepath.Dir(converted))
+		}
+		uploadPath = converted
+	}
+	if err := utils.CheckDocument(uploadPath); err != nil {
+		s.notify(v, true, "Cannot print %s: %v", header.Filename, err)
+		return
+	}
+
+	job, err := v.session.Submit(r.Context(), &printer, copies, uploadPath)
+	if err != nil {
+		s.logger.Printf("%s: could not print: %v", v.session.GetUsername(), err)
+		s.notify(v, true, "Could not print %s: %v", header.Filename, err)
+		return
+	}
+	s.logger.Printf("%s: job %s sent to %s", v.session.GetUsername(), job.GetJobID(), strings.TrimSpace(printer.GetName()))
+	s.notify(v, false, "%s was sent to %s as job %s.", header.Filename, strings.TrimSpace(printer.GetName()), job.GetJobID())
+}
+
+func (s *Server) cancel(w http.ResponseWriter, r *http.Request) {
+	v := s.formVisitor(r)
+	if v == nil || v.session == nil {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	id := r.FormValue("job")
+	if err := v.session.Cancel(r.Context(), id); err != nil {
+		s.notify(v, true, "Could not cancel job %s: %v", id, err)
+	} else {
+		s.notify(v, false, "Job %s was cancelled.", id)
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (s *Server) logout(w http.ResponseWriter, r *http.Request) {
+	if v := s.formVisitor(r); v != nil {
+		s.forget(v)
+		s.end(v, "logged out by the user")
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: cookieName, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteStrictMode})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// jobRows lists v's recent jobs for the status view.
+func (s *Server) jobRows(ctx context.Context, v *visitor) ([]jobRow, string) {
+	jobs, err := v.session.Jobs(ctx)
+	if err != nil {
+		return nil, "Could not fetch your jobs: " + err.Error()
+	}
+	if len(jobs) > shownJobs {
+		jobs = jobs[:shownJobs]
+	}
+
+	var rows []jobRow
+	for _, job := range jobs {
+		rows = append(rows, jobRow{
+			ID:          job.GetJobID(),
+			Submitted:   job.GetSubmitted(),
+			Printer:     job.GetPrinterName(),
+			Document:    job.GetDocumentName(),
+			Pages:       job.GetPages(),
+			Cost:        money(job.GetCost()),
+			Status:      job.GetStatus(),
+			Cancellable: !job.IsFinished(),
+		})
+	}
+	return rows, ""
+}
+
+// printerOptions lists the printers by name, and their locations.
+func printerOptions(printers map[int]utils.PaperCutPrinter) ([]string, []printerOption) {
+	var options []printerOption
+	seen := map[string]bool{}
+	var locations []string
+	for id, p := range printers {
+		location := strings.TrimSpace(p.GetLocation())
+		option := printerOption{ID: id, Name: strings.TrimSpace(p.GetName()), Location: location}
+		if cost, ok := p.GetCostPerPage(); ok {
+			option.Cost = money(cost)
+		}
+		options = append(options, option)
+		if location != "" && !seen[location] {
+			seen[location] = true
+			locations = append(locations, location)
+		}
+	}
+
+	sort.Slice(options, func(a, b int) bool { return strings.ToLower(options[a].Name) < strings.ToLower(options[b].Name) })
+	sort.Strings(locations)
+	return locations, options
+}
+
+/*
+sameOrigin reports whether a form was sent from a page of the kiosk itself,
+judged by the Origin header browsers send with POST requests.
+*/
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || origin == "null" {
+		return origin == ""
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(origin, "http://"), "https://") == r.Host
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func money(amount float64) string {
+	if amount < 0 {
+		return fmt.Sprintf("-$%.2f", -amount)
+	}
+	return fmt.Sprintf("$%.2f", amount)
+}
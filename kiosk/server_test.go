@@ -0,0 +1,356 @@
+package kiosk
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quantamhd/gu/papercuttest"
+	"github.com/quantamhd/gu/utils"
+)
+
+const testPDF = "%PDF-1.4\n1 0 obj << /Type /Page >> endobj\n%%EOF\n"
+
+var (
+	csrfRe    = regexp.MustCompile(`name="csrf" value="([0-9a-f]+)"`)
+	printerRe = regexp.MustCompile(`<option value="(\d+)" data-location="[^"]*">library-bw`)
+	jobRe     = regexp.MustCompile(`name="job" value="([^"]+)"`)
+)
+
+// syncBuffer is a log destination that the expiry goroutine can write to
+// while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// newTestKiosk starts a kiosk in front of a fake PaperCut server that also
+// knows the user "other".
+func newTestKiosk(t *testing.T, idle time.Duration) (*papercuttest.Server, *Server, string, *syncBuffer) {
+	t.Helper()
+	srv := papercuttest.NewServer()
+	t.Cleanup(srv.Close)
+	srv.AddUser(papercuttest.User{Username: "other", Password: "secret", Balance: 10})
+
+	baseURL, retry := utils.BaseURL, utils.Retry
+	utils.BaseURL = srv.URL
+	utils.Retry = utils.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	t.Cleanup(func() { utils.BaseURL, utils.Retry = baseURL, retry })
+
+	logs := &syncBuffer{}
+	server := NewServer(idle, "", nil, log.New(logs, "", 0))
+	kiosk := httptest.NewServer(server)
+	t.Cleanup(kiosk.Close)
+	return srv, server, kiosk.URL, logs
+}
+
+// browser is a visitor's browser, with its own cookies.
+type browser struct {
+	t      *testing.T
+	url    string
+	client *http.Client
+	page   string
+}
+
+func newBrowser(t *testing.T, kioskURL string) *browser {
+	t.Helper()
+	jar, _ := cookiejar.New(nil)
+	b := &browser{t: t, url: kioskURL, client: &http.Client{Jar: jar}}
+	b.get()
+	return b
+}
+
+// get loads the page.
+func (b *browser) get() string {
+	b.t.Helper()
+	resp, err := b.client.Get(b.url + "/")
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	b.page = readBody(b.t, resp)
+	return b.page
+}
+
+// post sends a form from the page the browser last loaded.
+func (b *browser) post(path string, form url.Values) string {
+	b.t.Helper()
+	resp, err := b.client.PostForm(b.url+path, form)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	b.page = readBody(b.t, resp)
+	return b.page
+}
+
+// csrf returns the CSRF token of the page the browser last loaded.
+func (b *browser) csrf() string {
+	b.t.Helper()
+	m := csrfRe.FindStringSubmatch(b.page)
+	if m == nil {
+		b.t.Fatalf("no CSRF token in page:\n%s", b.page)
+	}
+	return m[1]
+}
+
+// cookie returns the value of the kiosk cookie.
+func (b *browser) cookie() string {
+	u, _ := url.Parse(b.url)
+	for _, c := range b.client.Jar.Cookies(u) {
+		if c.Name == cookieName {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+func (b *browser) logIn(username string, password string) {
+	b.t.Helper()
+	page := b.post("/login", url.Values{"csrf": {b.csrf()}, "username": {username}, "password": {password}})
+	if !strings.Contains(page, "Your jobs") {
+		b.t.Fatalf("not logged in as %s:\n%s", username, page)
+	}
+}
+
+// print sends a document to library-bw and returns the ID of the job.
+func (b *browser) print(name string) string {
+	b.t.Helper()
+	printer := printerRe.FindStringSubmatch(b.page)
+	if printer == nil {
+		b.t.Fatalf("library-bw is not offered:\n%s", b.page)
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	w.WriteField("csrf", b.csrf())
+	w.WriteField("printer", printer[1])
+	w.WriteField("copies", "1")
+	file, _ := w.CreateFormFile("file", name)
+	file.Write([]byte(testPDF))
+	w.Close()
+
+	resp, err := b.client.Post(b.url+"/print", w.FormDataContentType(), &body)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	b.page = readBody(b.t, resp)
+	if !strings.Contains(b.page, name+" was sent to library-bw") {
+		b.t.Fatalf("%s was not printed:\n%s", name, b.page)
+	}
+	return jobRe.FindStringSubmatch(b.page)[1]
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestLoginReplacesCookie(t *testing.T) {
+	_, _, kioskURL, _ := newTestKiosk(t, time.Hour)
+	b := newBrowser(t, kioskURL)
+
+	before, csrf := b.cookie(), b.csrf()
+	if before == "" {
+		t.Fatal("no cookie before logging in")
+	}
+	b.logIn("student", "password")
+	if after := b.cookie(); after == "" || after == before {
+		t.Errorf("cookie %q was kept at login", before)
+	}
+	if b.csrf() == csrf {
+		t.Error("CSRF token was kept at login")
+	}
+
+	// Someone who planted the old cookie does not ride along.
+	planted := newBrowser(t, kioskURL)
+	u, _ := url.Parse(kioskURL)
+	planted.client.Jar.SetCookies(u, []*http.Cookie{{Name: cookieName, Value: before, Path: "/"}})
+	if page := planted.get(); strings.Contains(page, "Your jobs") {
+		t.Error("the cookie from before the login is logged in")
+	}
+}
+
+func TestBadLogin(t *testing.T) {
+	_, _, kioskURL, _ := newTestKiosk(t, time.Hour)
+	b := newBrowser(t, kioskURL)
+
+	page := b.post("/login", url.Values{"csrf": {b.csrf()}, "username": {"student"}, "password": {"wrong"}})
+	if !strings.Contains(page, "Could not log in") || strings.Contains(page, "Your jobs") {
+		t.Errorf("bad password was not refused:\n%s", page)
+	}
+
+	page = b.post("/login", url.Values{"csrf": {"0000"}, "username": {"student"}, "password": {"password"}})
+	if !strings.Contains(page, "The page had expired") || strings.Contains(page, "Your jobs") {
+		t.Errorf("login without the page's CSRF token was accepted:\n%s", page)
+	}
+}
+
+func TestIdleVisitorIsLoggedOut(t *testing.T) {
+	interval := expireInterval
+	expireInterval = 10 * time.Millisecond
+	t.Cleanup(func() { expireInterval = interval })
+
+	_, server, kioskURL, logs := newTestKiosk(t, 50*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.ExpireIdle(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	b := newBrowser(t, kioskURL)
+	b.logIn("student", "password")
+	server.mu.Lock()
+	credentials := server.visitors[b.cookie()].session.GetCredentials()
+	server.mu.Unlock()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(logs.String(), "student: logged out (idle)") {
+		if time.Now().After(deadline) {
+			t.Fatalf("idle visitor was not logged out; log:\n%s", logs.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	server.mu.Lock()
+	visitors := len(server.visitors)
+	server.mu.Unlock()
+	if visitors != 0 {
+		t.Errorf("%d visitors are still known", visitors)
+	}
+	if _, err := utils.GetPaperCutPrintJobs(context.Background(), credentials); err == nil {
+		t.Error("the PaperCut session still works after the visitor expired")
+	}
+	if page := b.get(); !strings.Contains(page, `action="/login"`) {
+		t.Errorf("expired visitor does not get the login form:\n%s", page)
+	}
+
+	resp, err := b.client.Get(kioskURL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status after expiry = %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestVisitorsAreSeparate(t *testing.T) {
+	srv, _, kioskURL, _ := newTestKiosk(t, time.Hour)
+	alice := newBrowser(t, kioskURL)
+	alice.logIn("student", "password")
+	job := alice.print("essay.pdf")
+	aliceCSRF := alice.csrf()
+
+	bob := newBrowser(t, kioskURL)
+	bob.logIn("other", "secret")
+	if page := bob.get(); strings.Contains(page, "essay.pdf") || strings.Contains(page, job) {
+		t.Errorf("another visitor sees the job:\n%s", page)
+	}
+
+	// Neither another visitor's CSRF token nor their own lets bob cancel it.
+	bob.post("/cancel", url.Values{"csrf": {aliceCSRF}, "job": {job}})
+	bob.post("/cancel", url.Values{"csrf": {bob.csrf()}, "job": {job}})
+	for _, j := range srv.Jobs() {
+		if j.Status == papercuttest.StatusCancelled {
+			t.Fatalf("job %s was cancelled by another visitor", j.ID)
+		}
+	}
+
+	// Nor does a request carrying only the token, without the cookie.
+	stranger := &http.Client{}
+	resp, err := stranger.PostForm(kioskURL+"/cancel", url.Values{"csrf": {aliceCSRF}, "job": {job}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	for _, j := range srv.Jobs() {
+		if j.Status == papercuttest.StatusCancelled {
+			t.Fatalf("job %s was cancelled without the visitor's cookie", j.ID)
+		}
+	}
+
+	page := alice.post("/cancel", url.Values{"csrf": {alice.csrf()}, "job": {job}})
+	if !strings.Contains(page, "Job "+job+" was cancelled") {
+		t.Errorf("the visitor could not cancel their own job:\n%s", page)
+	}
+}
+
+func TestCrossOriginPostIsRejected(t *testing.T) {
+	_, _, kioskURL, _ := newTestKiosk(t, time.Hour)
+	b := newBrowser(t, kioskURL)
+
+	for _, origin := range []string{"http://evil.example", "null"} {
+		form := url.Values{"csrf": {b.csrf()}, "username": {"student"}, "password": {"password"}}
+		req, _ := http.NewRequest("POST", kioskURL+"/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Origin", origin)
+		resp, err := b.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("POST from origin %s = %d, want 403", origin, resp.StatusCode)
+		}
+	}
+	if page := b.get(); strings.Contains(page, "Your jobs") {
+		t.Error("a cross-origin login went through")
+	}
+
+	// The kiosk's own origin is fine.
+	form := url.Values{"csrf": {b.csrf()}, "username": {"student"}, "password": {"password"}}
+	req, _ := http.NewRequest("POST", kioskURL+"/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", kioskURL)
+	resp, err := b.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page := readBody(t, resp); !strings.Contains(page, "Your jobs") {
+		t.Errorf("same-origin login failed:\n%s", page)
+	}
+}
+
+func TestPagesAreNotCached(t *testing.T) {
+	_, _, kioskURL, _ := newTestKiosk(t, time.Hour)
+	resp, err := http.Get(kioskURL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", got)
+	}
+}
@@ -0,0 +1,523 @@
+/*
+Package lpd implements the receiving side of the Line Printer Daemon
+protocol (RFC 1179), so that tools which can only print with lpr can print
+to PaperCut web print.
+*/
+package lpd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quantamhd/gu/utils"
+)
+
+// Daemon commands, the first byte of a connection.
+const (
+	cmdPrintWaiting = 1
+	cmdReceiveJob   = 2
+	cmdShortQueue   = 3
+	cmdLongQueue    = 4
+	cmdRemoveJobs   = 5
+)
+
+// Receive job subcommands.
+const (
+	subAbort   = 1
+	subControl = 2
+	subData    = 3
+)
+
+// timeout bounds how long a client may stay silent.
+const timeout = 2 * time.Minute
+
+// maxFiles bounds the control and data files one connection may send.
+const maxFiles = 32
+
+// maxControlSize bounds the size of a control file.
+const maxControlSize = 64 << 10
+
+// queueLength bounds the documents waiting to be sent to PaperCut.
+// Connections with more to queue wait for room.
+const queueLength = 8
+
+/*
+Server accepts LPD jobs and sends them to PaperCut. Queue names are looked
+up in the queues map, case-insensitively.
+*/
+type Server struct {
+	session   *utils.Session
+	queues    map[string]utils.PaperCutPrinter
+	logger    *log.Logger
+	documents chan document
+}
+
+// document is a data file waiting to be sent to PaperCut.
+type document struct {
+	job     controlFile
+	printer utils.PaperCutPrinter
+	path    string
+}
+
+// NewServer returns a server that prints to the printers in queues, keyed
+// by queue name, using session. Log lines are written to logger.
+func NewServer(session *utils.Session, queues map[string]utils.PaperCutPrinter, logger *log.Logger) *Server {
+	lower := map[string]utils.PaperCutPrinter{}
+	for name, printer := range queues {
+		lower[strings.ToLower(name)] = printer
+	}
+	return &Server{session: session, queues: lower, logger: logger, documents: make(chan document, queueLength)}
+}
+
+/*
+Serve accepts connections on l until it is closed. Documents are sent to
+PaperCut one at a time while it runs; those still waiting when it returns
+are dropped.
+*/
+func (s *Server) Serve(l net.Listener) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	sent := make(chan struct{})
+	go func() {
+		s.send(ctx)
+		close(sent)
+	}()
+	defer func() {
+		cancel()
+		<-sent
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		go s.serveConn(ctx, conn)
+	}
+}
+
+// serveConn handles the daemon command of one connection.
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	r := bufio.NewReader(conn)
+	line, err := readLine(r)
+	if err != nil || len(line) == 0 {
+		return
+	}
+
+	command, operands := line[0], strings.Fields(line[1:])
+	if len(operands) == 0 {
+		return
+	}
+	queue := operands[0]
+
+	switch command {
+	case cmdPrintWaiting:
+		// Jobs are sent on as soon as they arrive, so there is nothing to
+		// start.
+	case cmdReceiveJob:
+		s.receiveJob(ctx, conn, r, queue)
+	case cmdShortQueue, cmdLongQueue:
+		s.queueState(conn, queue, operands[1:], command == cmdLongQueue)
+	case cmdRemoveJobs:
+		s.logger.Printf("%s: ignoring a request to remove jobs, cancel them in PaperCut", conn.RemoteAddr())
+	default:
+		s.logger.Printf("%s: unknown LPD command %d", conn.RemoteAddr(), command)
+	}
+}
+
+// readLine reads one LF terminated line without the LF.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+/*
+receiveJob reads the control and data files of one or more jobs and
+queues them for PaperCut once the client is done. Data files are kept in
+a temporary directory until then.
+*/
+func (s *Server) receiveJob(ctx context.Context, conn net.Conn, r *bufio.Reader, queue string) {
+	printer, ok := s.queues[strings.ToLower(queue)]
+	if !ok {
+		s.logger.Printf("%s: no queue called %s", conn.RemoteAddr(), queue)
+		conn.Write([]byte{1})
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "gu-lpd")
+	if err != nil {
+		s.logger.Printf("%s: %v", conn.RemoteAddr(), err)
+		conn.Write([]byte{1})
+		return
+	}
+	defer os.RemoveAll(dir)
+	conn.Write([]byte{0})
+
+	controls := map[string]string{}
+	data := map[string]string{}
+	files := 0
+
+	for {
+		conn.SetDeadline(time.Now().Add(timeout))
+		line, err := readLine(r)
+		if err != nil {
+			break
+		}
+		if len(line) == 0 {
+			continue
+		}
+
+		if line[0] == subAbort {
+			for _, path := range data {
+				os.Remove(path)
+			}
+			controls, data = map[string]string{}, map[string]string{}
+			conn.Write([]byte{0})
+			continue
+		}
+
+		fields := strings.Fields(line[1:])
+		if (line[0] != subControl && line[0] != subData) || len(fields) != 2 {
+			s.logger.Printf("%s: bad receive job subcommand %q", conn.RemoteAddr(), line)
+			conn.Write([]byte{1})
+			return
+		}
+		files++
+		if files > maxFiles {
+			s.logger.Printf("%s: more than %d files", conn.RemoteAddr(), maxFiles)
+			conn.Write([]byte{1})
+			return
+		}
+		limit := int64(utils.MaxDocumentSize)
+		if line[0] == subControl {
+			limit = maxControlSize
+		}
+		count, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || count < 0 || count > limit {
+			s.logger.Printf("%s: bad file size %q", conn.RemoteAddr(), fields[0])
+			conn.Write([]byte{1})
+			return
+		}
+
+		if line[0] == subControl {
+			conn.Write([]byte{0})
+			control := new(bytes.Buffer)
+			if err := readFile(r, count, limit, control); err != nil {
+				s.logger.Printf("%s: %v", conn.RemoteAddr(), err)
+				return
+			}
+			controls[fields[1]] = control.String()
+		} else {
+			// The name comes from the client, so it is not used on disk.
+			f, err := ioutil.TempFile(dir, "df")
+			if err != nil {
+				s.logger.Printf("%s: %v", conn.RemoteAddr(), err)
+				conn.Write([]byte{1})
+				return
+			}
+			conn.Write([]byte{0})
+			err = readFile(r, count, limit, f)
+			f.Close()
+			if err != nil {
+				s.logger.Printf("%s: %v", conn.RemoteAddr(), err)
+				return
+			}
+			if previous, ok := data[fields[1]]; ok {
+				os.Remove(previous)
+			}
+			data[fields[1]] = f.Name()
+		}
+		conn.Write([]byte{0})
+
+		if count == 0 {
+			// The file ran to the end of the connection.
+			break
+		}
+	}
+
+	for name, control := range controls {
+		job := parseControlFile(control)
+		for _, file := range job.files {
+			path, ok := data[file]
+			if !ok {
+				s.logger.Printf("%s: control file %s names the missing data file %s", conn.RemoteAddr(), name, file)
+				continue
+			}
+			s.queue(ctx, printer, job, path)
+		}
+	}
+}
+
+/*
+readFile copies a file of count bytes, followed by the NUL the client
+sends when it is done, to w. A count of zero, which some clients use when
+they do not know the size, means the file runs to the end of the
+connection, and it may be at most limit bytes long.
+*/
+func readFile(r *bufio.Reader, count int64, limit int64, w io.Writer) error {
+	if count == 0 {
+		n, err := io.Copy(w, io.LimitReader(r, limit+1))
+		if n > limit {
+			return errors.New("the file is larger than gu accepts")
+		}
+		return err
+	}
+
+	if _, err := io.CopyN(w, r, count); err != nil {
+		return fmt.Errorf("truncated file: %v", err)
+	}
+	if end, err := r.ReadByte(); err != nil || end != 0 {
+		return errors.New("file not followed by a NUL byte")
+	}
+	return nil
+}
+
+// controlFile is what gu uses of an LPD control file.
+type controlFile struct {
+	host   string
+	user   string
+	name   string
+	copies int
+	files  []string
+}
+
+/*
+parseControlFile reads the host (H), user (P), job name (J, or N for the
+source file) and number of copies from an LPD control file. Copies come
+from a "#" line when there is one, and otherwise from how often a data file
+is listed for printing, which is how BSD lpr asks for copies.
+*/
+func parseControlFile(control string) controlFile {
+	job := controlFile{}
+	times := map[string]int{}
+	sourceName := ""
+
+	for _, line := range strings.Split(control, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if len(line) < 2 {
+			continue
+		}
+		value := line[1:]
+
+		switch line[0] {
+		case 'H':
+			job.host = value
+		case 'P':
+			job.user = value
+		case 'J':
+			job.name = value
+		case 'N':
+			sourceName = value
+		case '#':
+			if n, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && n > 0 {
+				job.copies = n
+			}
+		case 'f', 'l', 'o', 'p', 'r', 't', 'n', 'd', 'g', 'c', 'v':
+			if times[value] == 0 {
+				job.files = append(job.files, value)
+			}
+			times[value]++
+		}
+	}
+
+	if job.name == "" {
+		job.name = sourceName
+	}
+	if job.copies == 0 {
+		job.copies = 1
+		for _, n := range times {
+			if n > job.copies {
+				job.copies = n
+			}
+		}
+	}
+	return job
+}
+
+// documentName is the name the job is printed under.
+func (job controlFile) documentName() string {
+	if job.name == "" {
+		return "lpr job"
+	}
+	return job.name
+}
+
+/*
+queue copies a received data file for printing and waits for room in the
+queue, or until ctx is done, when the copy is dropped.
+*/
+func (s *Server) queue(ctx context.Context, printer utils.PaperCutPrinter, job controlFile, dataPath string) {
+	name := job.documentName()
+
+	f, err := os.Open(dataPath)
+	if err != nil {
+		s.logger.Printf("%s from %s@%s: %v", name, job.user, job.host, err)
+		return
+	}
+	path, err := utils.SaveDocument(f, name)
+	f.Close()
+	if err != nil {
+		s.logger.Printf("%s from %s@%s: %v", name, job.user, job.host, err)
+		return
+	}
+
+	select {
+	case s.documents <- document{job: job, printer: printer, path: path}:
+	case <-ctx.Done():
+		os.RemoveAll(filepath.Dir(path))
+	}
+}
+
+// send prints queued documents one at a time until ctx is done, and then
+// drops those still waiting.
+func (s *Server) send(ctx context.Context) {
+	for {
+		select {
+		case doc := <-s.documents:
+			s.print(ctx, doc)
+		case <-ctx.Done():
+			for {
+				select {
+				case doc := <-s.documents:
+					os.RemoveAll(filepath.Dir(doc.path))
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// print sends one document to PaperCut.
+func (s *Server) print(ctx context.Context, doc document) {
+	defer os.RemoveAll(filepath.Dir(doc.path))
+	job, printer, name := doc.job, doc.printer, doc.job.documentName()
+
+	if err := utils.CheckDocument(doc.path); err != nil {
+		s.logger.Printf("%s from %s@%s: %v", name, job.user, job.host, err)
+		return
+	}
+
+	paperCutJob, err := s.session.Submit(ctx, &printer, job.copies, doc.path)
+	if err != nil {
+		s.logger.Printf("%s from %s@%s: %v", name, job.user, job.host, err)
+		return
+	}
+	s.logger.Printf("%s from %s@%s: %d copies sent to %s as job %s", name, job.user, job.host,
+		job.copies, printer.GetName(), paperCutJob.GetJobID())
+}
+
+/*
+queueState answers the LPD queue state commands from the PaperCut job list,
+showing the jobs for the queue's printer that have not finished. operands
+may name the job IDs to show, as the queue state shows them, or the user.
+*/
+func (s *Server) queueState(w io.Writer, queue string, operands []string, long bool) {
+	printer, ok := s.queues[strings.ToLower(queue)]
+	if !ok {
+		fmt.Fprintf(w, "%s: unknown printer\n", queue)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	jobs, err := s.session.Jobs(ctx)
+	if err != nil {
+		fmt.Fprintf(w, "%s: could not fetch the PaperCut job list: %v\n", queue, err)
+		return
+	}
+
+	// Operands are job IDs as shown, or user names. Every job in the list
+	// is the session user's.
+	owner := s.session.GetUsername()
+	wanted := map[string]bool{}
+	for _, operand := range operands {
+		if operand == owner {
+			wanted = map[string]bool{}
+			break
+		}
+		wanted[strings.ToLower(operand)] = true
+	}
+
+	var active []utils.PaperCutJob
+	for _, job := range jobs {
+		if job.IsFinished() || !samePrinter(job.GetPrinterName(), printer.GetName()) {
+			continue
+		}
+		if len(wanted) > 0 && !wanted[strings.ToLower(job.GetJobID())] {
+			continue
+		}
+		active = append(active, job)
+	}
+
+	fmt.Fprintf(w, "%s: %s via PaperCut web print\n", queue, strings.TrimSpace(printer.GetName()))
+	if len(active) == 0 {
+		fmt.Fprintln(w, "no entries")
+		return
+	}
+
+	// The job list is newest first, the queue is shown oldest first.
+	if !long {
+		fmt.Fprintf(w, "%-7s%-11s%-10s%-36s%s\n", "Rank", "Owner", "Job", "File(s)", "Status")
+	}
+	for i := len(active) - 1; i >= 0; i-- {
+		job := active[i]
+		rank := ordinal(len(active) - i)
+		if long {
+			fmt.Fprintf(w, "\n%s: %-33s[job %s]\n", owner, rank, job.GetJobID())
+			fmt.Fprintf(w, "        %-33s%d pages, %s\n", truncate(job.GetDocumentName(), 32), job.GetPages(), job.GetStatus())
+			continue
+		}
+		fmt.Fprintf(w, "%-7s%-11s%-10s%-36s%s\n", rank, truncate(owner, 10), job.GetJobID(),
+			truncate(job.GetDocumentName(), 35), job.GetStatus())
+	}
+}
+
+// samePrinter reports whether a printer in the job list, which may carry a
+// server prefix such as "papercut\", is the printer called name.
+func samePrinter(listed string, name string) bool {
+	listed, name = strings.TrimSpace(listed), strings.TrimSpace(name)
+	return strings.EqualFold(listed, name) || strings.HasSuffix(strings.ToLower(listed), `\`+strings.ToLower(name))
+}
+
+func ordinal(n int) string {
+	suffix := "th"
+	switch {
+	case n%100 >= 11 && n%100 <= 13:
+	case n%10 == 1:
+		suffix = "st"
+	case n%10 == 2:
+		suffix = "nd"
+	case n%10 == 3:
+		suffix = "rd"
+	}
+	return strconv.Itoa(n) + suffix
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
@@ -0,0 +1,257 @@
+package lpd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quantamhd/gu/papercuttest"
+	"github.com/quantamhd/gu/utils"
+)
+
+const testPDF = "%PDF-1.4\n1 0 obj << /Type /Page >> endobj\n%%EOF\n"
+
+// newTestServer starts an LPD server with a bw queue that prints to the
+// fake PaperCut server, and returns both and the LPD address.
+func newTestServer(t *testing.T) (*papercuttest.Server, string) {
+	t.Helper()
+	srv := papercuttest.NewServer()
+	t.Cleanup(srv.Close)
+
+	baseURL, retry := utils.BaseURL, utils.Retry
+	utils.BaseURL = srv.URL
+	utils.Retry = utils.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	t.Cleanup(func() { utils.BaseURL, utils.Retry = baseURL, retry })
+
+	ctx := context.Background()
+	session, err := utils.NewSession(ctx, "student", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	printers, err := session.Printers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, ok := utils.FindPrinter(printers, "library-bw")
+	if !ok {
+		t.Fatal("no library-bw printer")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(session, map[string]utils.PaperCutPrinter{"bw": printers[id]}, log.New(ioutil.Discard, "", 0))
+	served := make(chan struct{})
+	go func() {
+		server.Serve(l)
+		close(served)
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-served
+	})
+	return srv, l.Addr().String()
+}
+
+// lpdClient speaks the receive job command to addr.
+type lpdClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialQueue(t *testing.T, addr string, queue string) *lpdClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &lpdClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	fmt.Fprintf(conn, "\x02%s\n", queue)
+	if !c.acked() {
+		t.Fatalf("queue %s was refused", queue)
+	}
+	return c
+}
+
+// acked reads the reply to the last command.
+func (c *lpdClient) acked() bool {
+	b, err := c.r.ReadByte()
+	return err == nil && b == 0
+}
+
+// send sends a control (2) or data (3) file and reports whether both the
+// subcommand and the file were acknowledged.
+func (c *lpdClient) send(kind byte, name string, contents string) bool {
+	fmt.Fprintf(c.conn, "%c%d %s\n", kind, len(contents), name)
+	if !c.acked() {
+		return false
+	}
+	c.conn.Write(append([]byte(contents), 0))
+	return c.acked()
+}
+
+// waitForJobs waits until the fake server has n jobs.
+func waitForJobs(t *testing.T, srv *papercuttest.Server, n int) []papercuttest.Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if jobs := srv.Jobs(); len(jobs) >= n {
+			return jobs
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("the server has %d jobs, want %d", len(srv.Jobs()), n)
+	return nil
+}
+
+func TestReceiveJob(t *testing.T) {
+	srv, addr := newTestServer(t)
+
+	c := dialQueue(t, addr, "bw")
+	if !c.send(subData, "dfA001host", testPDF) {
+		t.Fatal("the data file was refused")
+	}
+	if !c.send(subControl, "cfA001host", "Hhost\nPstudent\nJessay.pdf\nldfA001host\nldfA001host\n") {
+		t.Fatal("the control file was refused")
+	}
+	c.conn.Close()
+
+	jobs := waitForJobs(t, srv, 1)
+	if jobs[0].Document != "essay.pdf" || jobs[0].Copies != 2 || string(jobs[0].Data) != testPDF {
+		t.Errorf("job = %s with %d copies, want essay.pdf with 2", jobs[0].Document, jobs[0].Copies)
+	}
+}
+
+func TestReceiveJobUnknownQueue(t *testing.T) {
+	_, addr := newTestServer(t)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "\x02basement\n")
+	if b, err := bufio.NewReader(conn).ReadByte(); err != nil || b == 0 {
+		t.Fatalf("reply = %d, %v; want a refusal", b, err)
+	}
+}
+
+func TestReceiveJobTooManyFiles(t *testing.T) {
+	srv, addr := newTestServer(t)
+
+	c := dialQueue(t, addr, "bw")
+	for i := 0; i < maxFiles; i++ {
+		if !c.send(subData, fmt.Sprintf("dfA%03dhost", i), testPDF) {
+			t.Fatalf("data file %d was refused", i)
+		}
+	}
+	if c.send(subControl, "cfA001host", "Pstudent\nldfA000host\n") {
+		t.Fatalf("file %d was accepted", maxFiles+1)
+	}
+	c.conn.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	if jobs := srv.Jobs(); len(jobs) != 0 {
+		t.Errorf("the server has %d jobs, want none", len(jobs))
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		count int64
+		want  string
+		ok    bool
+	}{
+		{"sized", "abc\x00", 3, "abc", true},
+		{"no NUL", "abcd", 3, "", false},
+		{"truncated", "ab", 3, "", false},
+		{"to the end", "abcdef", 0, "abcdef", true},
+		{"to the end, too long", "abcdefghijk", 0, "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := new(bytes.Buffer)
+			err := readFile(bufio.NewReader(strings.NewReader(test.input)), test.count, 10, got)
+			if (err == nil) != test.ok {
+				t.Fatalf("err = %v, want ok %v", err, test.ok)
+			}
+			if test.ok && got.String() != test.want {
+				t.Errorf("read %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// printDocument sends name to the bw queue and waits until the fake server
+// has n jobs.
+func printDocument(t *testing.T, srv *papercuttest.Server, addr string, name string, n int) {
+	t.Helper()
+	c := dialQueue(t, addr, "bw")
+	if !c.send(subData, "dfA001host", testPDF) || !c.send(subControl, "cfA001host", "Hhost\nPstudent\nJ"+name+"\nldfA001host\n") {
+		t.Fatalf("%s was refused", name)
+	}
+	c.conn.Close()
+	waitForJobs(t, srv, n)
+}
+
+// queueState sends a queue state command for bw and returns the answer.
+func queueState(t *testing.T, addr string, command byte, operands ...string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "%cbw %s\n", command, strings.Join(operands, " "))
+	answer, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(answer)
+}
+
+func TestQueueState(t *testing.T) {
+	srv, addr := newTestServer(t)
+	printDocument(t, srv, addr, "essay.pdf", 1)
+	printDocument(t, srv, addr, "notes.pdf", 2)
+
+	all := queueState(t, addr, cmdShortQueue)
+	var essayID string
+	for _, line := range strings.Split(all, "\n") {
+		if fields := strings.Fields(line); len(fields) == 5 && fields[3] == "essay.pdf" {
+			essayID = fields[2]
+		}
+	}
+	if essayID == "" || !strings.Contains(all, "notes.pdf") {
+		t.Fatalf("queue state does not show both jobs:\n%s", all)
+	}
+
+	for _, operand := range []string{essayID, strings.ToUpper(essayID)} {
+		one := queueState(t, addr, cmdShortQueue, operand)
+		if !strings.Contains(one, "essay.pdf") || strings.Contains(one, "notes.pdf") {
+			t.Errorf("queue state for job %s:\n%s", operand, one)
+		}
+	}
+	if long := queueState(t, addr, cmdLongQueue, essayID); !strings.Contains(long, "[job "+essayID+"]") || strings.Contains(long, "notes.pdf") {
+		t.Errorf("long queue state for job %s:\n%s", essayID, long)
+	}
+	if mine := queueState(t, addr, cmdShortQueue, "student"); !strings.Contains(mine, "essay.pdf") || !strings.Contains(mine, "notes.pdf") {
+		t.Errorf("queue state for student:\n%s", mine)
+	}
+	if none := queueState(t, addr, cmdShortQueue, "0"); !strings.Contains(none, "no entries") {
+		t.Errorf("queue state for an unknown job:\n%s", none)
+	}
+}
@@ -0,0 +1,319 @@
+package papercut
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quantamhd/gu/utils"
+)
+
+// Option configures a WebClient.
+type Option func(*options)
+
+type options struct {
+	server    utils.Server
+	keepAlive time.Duration
+	onError   func(error)
+}
+
+// WithServer sets the address of the PaperCut server, such as
+// "https://print.example.edu:9192".
+func WithServer(url string) Option {
+	return func(o *options) {
+		o.server.URL = url
+	}
+}
+
+// WithTransport sets the transport requests to PaperCut are made with, for
+// custom certificates, proxies or tracing.
+func WithTransport(transport http.RoundTripper) Option {
+	return func(o *options) {
+		o.server.Transport = transport
+	}
+}
+
+// WithCAS logs in through the CAS single sign-on page the server sends
+// users to, instead of PaperCut's own login form.
+func WithCAS() Option {
+	return func(o *options) {
+		o.server.Auth = utils.CASAuthenticator{}
+	}
+}
+
+/*
+WithKeepAlive touches the session every interval until Close, so that
+PaperCut does not end it while the client is idle. Failures are passed to
+onError, which may be nil.
+*/
+func WithKeepAlive(interval time.Duration, onError func(error)) Option {
+	return func(o *options) {
+		o.keepAlive = interval
+		o.onError = onError
+	}
+}
+
+/*
+WebClient is a Client logged in to a PaperCut server. It logs in again on
+its own when PaperCut ends the session.
+*/
+type WebClient struct {
+	server  utils.Server
+	session *utils.Session
+
+	mu     sync.Mutex
+	closed bool
+	stop   context.CancelFunc
+}
+
+var _ Client = (*WebClient)(nil)
+
+/*
+Login logs in to PaperCut as username. Without WithServer it uses the
+server of the utils package, Gonzaga's unless changed.
+*/
+func Login(ctx context.Context, username string, password string, opts ...Option) (*WebClient, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	c := &WebClient{server: o.server, stop: func() {}}
+	session, err := utils.NewSession(c.context(ctx), username, password)
+	if err != nil {
+		return nil, err
+	}
+	c.session = session
+
+	if o.keepAlive > 0 {
+		keepAlive, stop := context.WithCancel(context.Background())
+		c.stop = stop
+		go session.KeepAlive(c.context(keepAlive), o.keepAlive, func(err error) {
+			if o.onError != nil {
+				o.onError(err)
+			}
+		})
+	}
+
+	return c, nil
+}
+
+// context sends the calls made with ctx to the client's server.
+func (c *WebClient) context(ctx context.Context) context.Context {
+	return utils.WithServer(ctx, c.server)
+}
+
+// check returns ErrClosed after Close.
+func (c *WebClient) check() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Printers returns the printers offered for web print, sorted by ID.
+func (c *WebClient) Printers(ctx context.Context) ([]Printer, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	printers, err := c.session.Printers(c.context(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	var list []Printer
+	for _, p := range printers {
+		cost, known := p.GetCostPerPage()
+		list = append(list, Printer{
+			ID:          p.GetID(),
+			Name:        strings.TrimSpace(p.GetName()),
+			Location:    strings.TrimSpace(p.GetLocation()),
+			CostPerPage: cost,
+			CostKnown:   known,
+		})
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].ID < list[b].ID })
+	return list, nil
+}
+
+/*
+Submit prints req.Document and returns the job PaperCut created, once it
+shows up in the job list.
+*/
+func (c *WebClient) Submit(ctx context.Context, req PrintRequest) (Job, error) {
+	if req.OnEvent == nil {
+		return c.submit(ctx, req)
+	}
+
+	failed := false
+	onEvent := req.OnEvent
+	req.OnEvent = func(e Event) {
+		failed = failed || e.Type == EventFailed
+		onEvent(e)
+	}
+	job, err := c.submit(ctx, req)
+	if err != nil && !failed {
+		onEvent(Event{Type: EventFailed, Time: time.Now(), Printer: req.Printer, Document: req.Name, Copies: req.Copies, Err: err})
+	}
+	return job, err
+}
+
+// submit prints req; only the errors of the wizard are sent as events.
+func (c *WebClient) submit(ctx context.Context, req PrintRequest) (Job, error) {
+	if err := c.check(); err != nil {
+		return Job{}, err
+	}
+	if req.Document == nil {
+		return Job{}, errors.New("the print request has no document")
+	}
+	copies := req.Copies
+	if copies == 0 {
+		copies = 1
+	}
+	if copies < 0 {
+		return Job{}, fmt.Errorf("cannot print %d copies", copies)
+	}
+	name := req.Name
+	if name == "" {
+		name = "document"
+	}
+
+	ctx = c.context(ctx)
+	printers, err := c.session.Printers(ctx)
+	if err != nil {
+		return Job{}, err
+	}
+	id, ok := utils.FindPrinter(printers, req.Printer)
+	if !ok {
+		return Job{}, fmt.Errorf("%w: %q", ErrPrinterNotFound, req.Printer)
+	}
+	printer := printers[id]
+
+	path, err := utils.SaveDocument(req.Document, name)
+	if err != nil {
+		return Job{}, err
+	}
+	defer os.RemoveAll(filepath.Dir(path))
+	if err := utils.CheckDocument(path); err != nil {
+		return Job{}, err
+	}
+
+	var opts []utils.PrintOption
+	if req.OnEvent != nil {
+		opts = append(opts, utils.WithEvents(req.OnEvent))
+	}
+	job, err := c.session.Submit(ctx, &printer, copies, path, opts...)
+	if err != nil {
+		return Job{}, err
+	}
+	return jobFrom(job), nil
+}
+
+// Jobs returns the recent web print jobs, newest first.
+func (c *WebClient) Jobs(ctx context.Context) ([]Job, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	jobs, err := c.session.Jobs(c.context(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	var list []Job
+	for _, job := range jobs {
+		list = append(list, jobFrom(job))
+	}
+	return list, nil
+}
+
+// Job returns the job called id, or ErrJobNotFound.
+func (c *WebClient) Job(ctx context.Context, id string) (Job, error) {
+	jobs, err := c.Jobs(ctx)
+	if err != nil {
+		return Job{}, err
+	}
+	for _, job := range jobs {
+		if job.ID == id {
+			return job, nil
+		}
+	}
+	return Job{}, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+}
+
+// Cancel cancels job id. It returns ErrJobFinished if it is too late.
+func (c *WebClient) Cancel(ctx context.Context, id string) error {
+	job, err := c.Job(ctx, id)
+	if err != nil {
+		return err
+	}
+	if job.Finished() {
+		return fmt.Errorf("%w: job %s is %s", ErrJobFinished, id, job.Status)
+	}
+	return c.session.Cancel(c.context(ctx), id)
+}
+
+// Balance returns the account balance.
+func (c *WebClient) Balance(ctx context.Context) (float64, error) {
+	if err := c.check(); err != nil {
+		return 0, err
+	}
+	return c.session.Balance(c.context(ctx))
+}
+
+// Transactions returns the recent account transactions, newest first.
+func (c *WebClient) Transactions(ctx context.Context) ([]Transaction, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	transactions, err := c.session.Transactions(c.context(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	var list []Transaction
+	for _, t := range transactions {
+		list = append(list, Transaction{
+			Date:    t.GetDate(),
+			Amount:  t.GetAmount(),
+			Balance: t.GetBalance(),
+			Type:    t.GetType(),
+			Comment: t.GetComment(),
+		})
+	}
+	return list, nil
+}
+
+// Close stops keeping the session alive and logs out of PaperCut.
+func (c *WebClient) Close(ctx context.Context) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	c.stop()
+	return c.session.Logout(c.context(ctx))
+}
+
+func jobFrom(job utils.PaperCutJob) Job {
+	return Job{
+		ID:        job.GetJobID(),
+		Submitted: job.GetSubmitted(),
+		Printer:   job.GetPrinterName(),
+		Document:  job.GetDocumentName(),
+		Pages:     job.GetPages(),
+		Cost:      job.GetCost(),
+		Status:    job.GetStatus(),
+	}
+}
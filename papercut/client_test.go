@@ -0,0 +1,157 @@
+package papercut_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/quantamhd/gu/papercut"
+	"github.com/quantamhd/gu/papercutmock"
+	"github.com/quantamhd/gu/papercuttest"
+)
+
+const testPDF = "%PDF-1.4\n1 0 obj << /Type /Page >> endobj\n%%EOF\n"
+
+/*
+testClient runs a print, a cancel and a refused cancel through client,
+which starts with papercuttest's account. finish marks the job of a
+document printed.
+*/
+func testClient(t *testing.T, client papercut.Client, finish func(document string)) {
+	ctx := context.Background()
+
+	printers, err := client.Printers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(printers) != 2 || printers[0].Name != "library-bw" || printers[1].Name != "library-color" {
+		t.Fatalf("Printers = %+v, want library-bw and library-color", printers)
+	}
+	if !printers[0].CostKnown || printers[0].CostPerPage != 0.05 {
+		t.Errorf("library-bw = %+v, want a known cost of 0.05 a page", printers[0])
+	}
+
+	var events []papercut.EventType
+	job, err := client.Submit(ctx, papercut.PrintRequest{
+		Printer:  "library-bw",
+		Document: strings.NewReader(testPDF),
+		Name:     "essay.pdf",
+		Copies:   2,
+		OnEvent:  func(e papercut.Event) { events = append(events, e.Type) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Document != "essay.pdf" || job.Printer != "library-bw" || job.Pages != 2 || job.Status != papercut.StatusRendering || job.Finished() {
+		t.Errorf("Submit = %+v, want 2 pages of essay.pdf rendering on library-bw", job)
+	}
+	if len(events) < 2 || events[0] != papercut.EventLoggedIn || events[len(events)-1] != papercut.EventRendering {
+		t.Errorf("events = %v, want logging in to rendering", events)
+	}
+	if balance, err := client.Balance(ctx); err != nil || !near(balance, 9.90) {
+		t.Errorf("Balance = %v, %v; want 9.90 after printing", balance, err)
+	}
+
+	jobs, err := client.Jobs(ctx)
+	if err != nil || len(jobs) != 1 || jobs[0].ID != job.ID {
+		t.Fatalf("Jobs = %+v, %v; want the job", jobs, err)
+	}
+	if _, err := client.Job(ctx, "no-such-job"); !errors.Is(err, papercut.ErrJobNotFound) {
+		t.Errorf("Job of an unknown ID: %v, want ErrJobNotFound", err)
+	}
+
+	events = nil
+	_, err = client.Submit(ctx, papercut.PrintRequest{
+		Printer:  "basement",
+		Document: strings.NewReader(testPDF),
+		Name:     "essay.pdf",
+		OnEvent:  func(e papercut.Event) { events = append(events, e.Type) },
+	})
+	if !errors.Is(err, papercut.ErrPrinterNotFound) {
+		t.Errorf("Submit to an unknown printer: %v, want ErrPrinterNotFound", err)
+	}
+	if len(events) != 1 || events[0] != papercut.EventFailed {
+		t.Errorf("events of the refused job = %v, want failed", events)
+	}
+
+	if err := client.Cancel(ctx, job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := client.Job(ctx, job.ID); err != nil || got.Status != papercut.StatusCancelled || !got.Finished() {
+		t.Errorf("Job after Cancel = %+v, %v; want it cancelled", got, err)
+	}
+	if err := client.Cancel(ctx, job.ID); !errors.Is(err, papercut.ErrJobFinished) {
+		t.Errorf("second Cancel: %v, want ErrJobFinished", err)
+	}
+	if balance, _ := client.Balance(ctx); !near(balance, 10) {
+		t.Errorf("Balance = %v, want 10 after the refund", balance)
+	}
+	transactions, err := client.Transactions(ctx)
+	if err != nil || len(transactions) < 2 || !near(transactions[0].Amount, 0.10) || !near(transactions[1].Amount, -0.10) {
+		t.Errorf("Transactions = %+v, %v; want the refund and then the charge", transactions, err)
+	}
+
+	printed, err := client.Submit(ctx, papercut.PrintRequest{Printer: "2", Document: strings.NewReader(testPDF), Name: "notes.pdf"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if printed.Printer != "library-color" || printed.Pages != 1 {
+		t.Errorf("Submit to printer 2 = %+v, want one page on library-color", printed)
+	}
+	finish("notes.pdf")
+	if err := client.Cancel(ctx, printed.ID); !errors.Is(err, papercut.ErrJobFinished) {
+		t.Errorf("Cancel of a printed job: %v, want ErrJobFinished", err)
+	}
+
+	if err := client.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Balance(ctx); !errors.Is(err, papercut.ErrClosed) {
+		t.Errorf("Balance after Close: %v, want ErrClosed", err)
+	}
+}
+
+func near(a float64, b float64) bool {
+	return a-b < 0.001 && b-a < 0.001
+}
+
+func TestWebClient(t *testing.T) {
+	srv := papercuttest.NewServer()
+	defer srv.Close()
+
+	client, err := papercut.Login(context.Background(), "student", "password", papercut.WithServer(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testClient(t, client, func(document string) {
+		for _, job := range srv.Jobs() {
+			if job.Document == document {
+				srv.SetJobStatus(job.ID, papercuttest.StatusPrinted)
+			}
+		}
+	})
+}
+
+func TestWebClientBadLogin(t *testing.T) {
+	srv := papercuttest.NewServer()
+	defer srv.Close()
+
+	if _, err := papercut.Login(context.Background(), "student", "wrong", papercut.WithServer(srv.URL)); err == nil {
+		t.Fatal("Login succeeded with a wrong password")
+	}
+}
+
+// TestMock checks that papercutmock behaves like the web client does
+// against papercuttest.
+func TestMock(t *testing.T) {
+	client := papercutmock.New()
+	testClient(t, client, func(document string) {
+		jobs, _ := client.Jobs(context.Background())
+		for _, job := range jobs {
+			if job.Document == document {
+				client.SetJobStatus(job.ID, papercut.StatusPrinted)
+			}
+		}
+	})
+}
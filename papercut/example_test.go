@@ -0,0 +1,45 @@
+package papercut_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/quantamhd/gu/papercut"
+	"github.com/quantamhd/gu/papercuttest"
+)
+
+func Example() {
+	// A fake server stands in for https://print.example.edu:9192.
+	srv := papercuttest.NewServer()
+	defer srv.Close()
+
+	ctx := context.Background()
+	client, err := papercut.Login(ctx, "student", "password", papercut.WithServer(srv.URL))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close(ctx)
+
+	job, err := client.Submit(ctx, papercut.PrintRequest{
+		Printer:  "library-bw",
+		Document: strings.NewReader("%PDF-1.4\n1 0 obj << /Type /Page >> endobj\n%%EOF\n"),
+		Name:     "essay.pdf",
+		Copies:   2,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s: %d pages on %s for $%.2f, %s\n", job.Document, job.Pages, job.Printer, job.Cost, job.Status)
+
+	balance, err := client.Balance(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("balance: $%.2f\n", balance)
+
+	// Output:
+	// essay.pdf: 2 pages on library-bw for $0.10, Rendering
+	// balance: $9.90
+}
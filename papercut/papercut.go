@@ -0,0 +1,162 @@
+/*
+Package papercut prints through PaperCut MF and NG web print, for Go
+programs that embed printing. It drives the same web pages a browser does,
+so it needs no administrator access or API key, only a user's account.
+
+	client, err := papercut.Login(ctx, "jdoe", password,
+		papercut.WithServer("https://print.example.edu:9192"))
+	if err != nil {
+		return err
+	}
+	defer client.Close(ctx)
+
+	job, err := client.Submit(ctx, papercut.PrintRequest{
+		Printer:  "library-bw",
+		Document: file,
+		Name:     "essay.pdf",
+		Copies:   2,
+	})
+
+Code that prints should depend on the Client interface, so that it can be
+tested against papercutmock instead of a server.
+*/
+package papercut
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/quantamhd/gu/utils"
+)
+
+// Job statuses as PaperCut shows them in the web print job list.
+const (
+	StatusRendering = utils.JobStatusRendering
+	StatusHeld      = utils.JobStatusHeld
+	StatusPrinted   = utils.JobStatusPrinted
+	StatusCancelled = utils.JobStatusCancelled
+	StatusError     = utils.JobStatusError
+)
+
+// Event is a step of a print job, passed to PrintRequest.OnEvent.
+type Event = utils.Event
+
+// EventType says what happened to a print job.
+type EventType = utils.EventType
+
+// The steps of a print job, in the order they happen.
+const (
+	EventLoggedIn         = utils.EventLoggedIn
+	EventPrinterSelected  = utils.EventPrinterSelected
+	EventOptionsSubmitted = utils.EventOptionsSubmitted
+	EventUploading        = utils.EventUploading
+	EventUploaded         = utils.EventUploaded
+	EventRendering        = utils.EventRendering
+	EventHeld             = utils.EventHeld
+	EventPrinted          = utils.EventPrinted
+	EventCancelled        = utils.EventCancelled
+	EventStatus           = utils.EventStatus
+	EventFailed           = utils.EventFailed
+)
+
+var (
+	// ErrPrinterNotFound is returned for a printer that is not offered
+	// for web print.
+	ErrPrinterNotFound = errors.New("no such printer")
+	// ErrJobNotFound is returned for a job that is not in the job list.
+	ErrJobNotFound = errors.New("no such job")
+	// ErrJobFinished is returned when cancelling a job that has already
+	// been printed, cancelled or failed.
+	ErrJobFinished = errors.New("the job has already finished")
+	// ErrClosed is returned by a client after Close.
+	ErrClosed = errors.New("the client is closed")
+)
+
+/*
+Client prints to PaperCut web print as one user. Its methods may be called
+from several goroutines; documents are still sent one at a time.
+*/
+type Client interface {
+	// Printers returns the printers offered for web print.
+	Printers(ctx context.Context) ([]Printer, error)
+	// Submit prints a document and returns the job PaperCut created.
+	Submit(ctx context.Context, req PrintRequest) (Job, error)
+	// Jobs returns the recent web print jobs, newest first.
+	Jobs(ctx context.Context) ([]Job, error)
+	// Job returns one job of the job list.
+	Job(ctx context.Context, id string) (Job, error)
+	// Cancel cancels a job that has not finished yet.
+	Cancel(ctx context.Context, id string) error
+	// Balance returns the account balance.
+	Balance(ctx context.Context) (float64, error)
+	// Transactions returns the recent account transactions, newest first.
+	Transactions(ctx context.Context) ([]Transaction, error)
+	// Close logs out. The client cannot be used afterwards.
+	Close(ctx context.Context) error
+}
+
+// Printer is a printer offered for web print.
+type Printer struct {
+	ID       int
+	Name     string
+	Location string
+
+	// CostPerPage is the price PaperCut lists for a page, if CostKnown.
+	CostPerPage float64
+	CostKnown   bool
+}
+
+// PrintRequest is a document to print.
+type PrintRequest struct {
+	// Printer is the name or ID of the printer.
+	Printer string
+
+	// Document is read to the end and uploaded. PaperCut accepts PDF, XPS,
+	// images and Microsoft Office documents.
+	Document io.Reader
+
+	// Name is the file name shown in the job list, "document" when empty.
+	// Its extension tells PaperCut the document type unless the contents
+	// make it plain.
+	Name string
+
+	// Copies is the number of copies, 1 when zero.
+	Copies int
+
+	// OnEvent, if set, is called with each step of the job as it happens,
+	// up to its first status in the job list, or EventFailed.
+	OnEvent func(Event)
+}
+
+// Job is an entry in the web print job list.
+type Job struct {
+	ID string
+
+	// Submitted is the submission time as PaperCut shows it.
+	Submitted string
+
+	Printer  string
+	Document string
+	Pages    int
+	Cost     float64
+	Status   string
+}
+
+// Finished reports whether the job was printed, cancelled or failed.
+func (j Job) Finished() bool {
+	return utils.IsFinishedStatus(j.Status)
+}
+
+// Transaction is a change to the account balance.
+type Transaction struct {
+	// Date is the time of the transaction as PaperCut shows it.
+	Date string
+
+	// Amount is negative for charges. Balance is the balance afterwards.
+	Amount  float64
+	Balance float64
+
+	Type    string
+	Comment string
+}
@@ -0,0 +1,346 @@
+/*
+Package papercutmock is an in-memory papercut.Client for unit tests of code
+that prints. It keeps the printers, jobs, balance and transactions of one
+account, charges for what is printed and refunds cancelled jobs, and can be
+told to fail any method.
+
+	client := papercutmock.New()
+	err := sendReport(ctx, client) // takes a papercut.Client
+	jobs, _ := client.Jobs(ctx)
+
+Jobs stay Rendering until SetJobStatus moves them on.
+*/
+package papercutmock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quantamhd/gu/papercut"
+)
+
+// Client is a fake papercut.Client. Its methods are safe to call from
+// several goroutines.
+type Client struct {
+	mu           sync.Mutex
+	printers     []papercut.Printer
+	jobs         []*job
+	balance      float64
+	transactions []papercut.Transaction
+	failures     map[string]error
+	nextID       int
+	closed       bool
+}
+
+// job is a printed document.
+type job struct {
+	papercut.Job
+	copies int
+	data   []byte
+}
+
+var _ papercut.Client = (*Client)(nil)
+
+// New returns a client with a balance of 10 and the two printers of
+// papercuttest, library-bw and library-color.
+func New() *Client {
+	return &Client{
+		printers: []papercut.Printer{
+			{ID: 1, Name: "library-bw", Location: "Foley Library, 1st floor", CostPerPage: 0.05, CostKnown: true},
+			{ID: 2, Name: "library-color", Location: "Foley Library, 2nd floor", CostPerPage: 0.25, CostKnown: true},
+		},
+		balance:  10,
+		failures: map[string]error{},
+		nextID:   1,
+	}
+}
+
+// SetPrinters replaces the printer list.
+func (c *Client) SetPrinters(printers []papercut.Printer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.printers = append([]papercut.Printer(nil), printers...)
+}
+
+// SetBalance sets the account balance.
+func (c *Client) SetBalance(balance float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.balance = balance
+}
+
+/*
+Fail makes method, such as "Submit", return err until Fail is called again
+with a nil error.
+*/
+func (c *Client) Fail(method string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		delete(c.failures, method)
+		return
+	}
+	c.failures[method] = err
+}
+
+// SetJobStatus changes the status of job id.
+func (c *Client) SetJobStatus(id string, status string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if j := c.find(id); j != nil {
+		j.Status = status
+		return true
+	}
+	return false
+}
+
+// Document returns the document printed as job id and its copies.
+func (c *Client) Document(id string) ([]byte, int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if j := c.find(id); j != nil {
+		return j.data, j.copies, true
+	}
+	return nil, 0, false
+}
+
+// IsClosed reports whether Close was called.
+func (c *Client) IsClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// check returns the error method should fail with, if any. It must be
+// called with c.mu held.
+func (c *Client) check(method string) error {
+	if c.closed {
+		return papercut.ErrClosed
+	}
+	return c.failures[method]
+}
+
+func (c *Client) find(id string) *job {
+	for _, j := range c.jobs {
+		if j.ID == id {
+			return j
+		}
+	}
+	return nil
+}
+
+// Printers returns the printers, as set with SetPrinters.
+func (c *Client) Printers(ctx context.Context) ([]papercut.Printer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.check("Printers"); err != nil {
+		return nil, err
+	}
+	return append([]papercut.Printer(nil), c.printers...), nil
+}
+
+/*
+Submit reads the document and adds a Rendering job for it. PDFs are
+counted by their pages and anything else as one page; the cost is charged
+to the balance. req.OnEvent gets the events a real job would have, without
+upload progress, once the job is added.
+*/
+func (c *Client) Submit(ctx context.Context, req papercut.PrintRequest) (papercut.Job, error) {
+	job, err := c.submit(req)
+
+	if req.OnEvent != nil {
+		copies := req.Copies
+		if copies == 0 {
+			copies = 1
+		}
+		event := func(t papercut.EventType) papercut.Event {
+			return papercut.Event{Type: t, Time: time.Now(), Printer: job.Printer, Document: job.Document,
+				Copies: copies, JobID: job.ID, Status: job.Status}
+		}
+		if err != nil {
+			e := event(papercut.EventFailed)
+			e.Printer, e.Document, e.Err = req.Printer, req.Name, err
+			req.OnEvent(e)
+		} else {
+			for _, t := range []papercut.EventType{papercut.EventLoggedIn, papercut.EventPrinterSelected,
+				papercut.EventOptionsSubmitted, papercut.EventUploaded, papercut.EventRendering} {
+				req.OnEvent(event(t))
+			}
+		}
+	}
+
+	return job, err
+}
+
+func (c *Client) submit(req papercut.PrintRequest) (papercut.Job, error) {
+	if req.Document == nil {
+		return papercut.Job{}, errors.New("the print request has no document")
+	}
+	data, err := ioutil.ReadAll(req.Document)
+	if err != nil {
+		return papercut.Job{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.check("Submit"); err != nil {
+		return papercut.Job{}, err
+	}
+
+	copies := req.Copies
+	if copies == 0 {
+		copies = 1
+	}
+	if copies < 0 {
+		return papercut.Job{}, fmt.Errorf("cannot print %d copies", copies)
+	}
+
+	var printer *papercut.Printer
+	for i, p := range c.printers {
+		if strings.EqualFold(p.Name, req.Printer) || strconv.Itoa(p.ID) == req.Printer {
+			printer = &c.printers[i]
+		}
+	}
+	if printer == nil {
+		return papercut.Job{}, fmt.Errorf("%w: %q", papercut.ErrPrinterNotFound, req.Printer)
+	}
+
+	name := req.Name
+	if name == "" {
+		name = "document"
+	}
+	pages := countPages(data) * copies
+	j := &job{
+		Job: papercut.Job{
+			ID:        strconv.Itoa(c.nextID),
+			Submitted: time.Now().Format("Jan 2, 2006 3:04:05 PM"),
+			Printer:   printer.Name,
+			Document:  name,
+			Pages:     pages,
+			Cost:      float64(pages) * printer.CostPerPage,
+			Status:    papercut.StatusRendering,
+		},
+		copies: copies,
+		data:   data,
+	}
+	c.nextID++
+	c.jobs = append(c.jobs, j)
+	c.charge(-j.Cost, "Print", "Job "+j.ID+": "+name)
+
+	return j.Job, nil
+}
+
+// Jobs returns the jobs, newest first.
+func (c *Client) Jobs(ctx context.Context) ([]papercut.Job, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.check("Jobs"); err != nil {
+		return nil, err
+	}
+
+	var jobs []papercut.Job
+	for i := len(c.jobs) - 1; i >= 0; i-- {
+		jobs = append(jobs, c.jobs[i].Job)
+	}
+	return jobs, nil
+}
+
+// Job returns job id, or papercut.ErrJobNotFound.
+func (c *Client) Job(ctx context.Context, id string) (papercut.Job, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.check("Job"); err != nil {
+		return papercut.Job{}, err
+	}
+
+	if j := c.find(id); j != nil {
+		return j.Job, nil
+	}
+	return papercut.Job{}, fmt.Errorf("%w: %s", papercut.ErrJobNotFound, id)
+}
+
+// Cancel cancels job id and refunds its cost unless it has finished.
+func (c *Client) Cancel(ctx context.Context, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.check("Cancel"); err != nil {
+		return err
+	}
+
+	j := c.find(id)
+	if j == nil {
+		return fmt.Errorf("%w: %s", papercut.ErrJobNotFound, id)
+	}
+	if j.Finished() {
+		return fmt.Errorf("%w: job %s is %s", papercut.ErrJobFinished, id, j.Status)
+	}
+	j.Status = papercut.StatusCancelled
+	c.charge(j.Cost, "Refund", "Job "+id+" cancelled")
+	return nil
+}
+
+// Balance returns the balance.
+func (c *Client) Balance(ctx context.Context) (float64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.check("Balance"); err != nil {
+		return 0, err
+	}
+	return c.balance, nil
+}
+
+// Transactions returns the charges and refunds so far, newest first.
+func (c *Client) Transactions(ctx context.Context) ([]papercut.Transaction, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.check("Transactions"); err != nil {
+		return nil, err
+	}
+
+	var transactions []papercut.Transaction
+	for i := len(c.transactions) - 1; i >= 0; i-- {
+		transactions = append(transactions, c.transactions[i])
+	}
+	return transactions, nil
+}
+
+// Close marks the client closed; later calls return papercut.ErrClosed.
+func (c *Client) Close(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.failures["Close"]; err != nil {
+		return err
+	}
+	c.closed = true
+	return nil
+}
+
+// charge adds amount to the balance and records it as a transaction. It
+// must be called with c.mu held.
+func (c *Client) charge(amount float64, kind string, comment string) {
+	c.balance += amount
+	c.transactions = append(c.transactions, papercut.Transaction{
+		Date:    time.Now().Format("Jan 2, 2006 3:04:05 PM"),
+		Amount:  amount,
+		Balance: c.balance,
+		Type:    kind,
+		Comment: comment,
+	})
+}
+
+var pageRe = regexp.MustCompile(`/Type\s*/Page\b`)
+
+// countPages gives a rough page count for PDFs; anything else is one page.
+func countPages(data []byte) int {
+	if n := len(pageRe.FindAll(data, -1)); n > 0 {
+		return n
+	}
+	return 1
+}
@@ -0,0 +1,39 @@
+package papercutmock_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/quantamhd/gu/papercut"
+	"github.com/quantamhd/gu/papercutmock"
+)
+
+// printReport is code under test that prints through any papercut.Client.
+func printReport(ctx context.Context, client papercut.Client) error {
+	_, err := client.Submit(ctx, papercut.PrintRequest{
+		Printer:  "library-color",
+		Document: strings.NewReader("%PDF-1.4\n1 0 obj << /Type /Page >> endobj\n%%EOF\n"),
+		Name:     "report.pdf",
+	})
+	return err
+}
+
+func Example() {
+	ctx := context.Background()
+	client := papercutmock.New()
+
+	if err := printReport(ctx, client); err != nil {
+		fmt.Println(err)
+	}
+	jobs, _ := client.Jobs(ctx)
+	fmt.Println(jobs[0].Document, jobs[0].Printer, jobs[0].Status)
+
+	client.Fail("Submit", errors.New("PaperCut is down"))
+	fmt.Println(printReport(ctx, client))
+
+	// Output:
+	// report.pdf library-color Rendering
+	// PaperCut is down
+}
@@ -0,0 +1,171 @@
+package papercuttest
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+/*
+CASServer is a fake CAS identity provider. Point a Handler at it with
+UseCAS and PaperCut logins are redirected to its /cas/login form, which
+sends the browser back with a service ticket that the Handler checks at
+/cas/serviceValidate, like a CAS 2.0 client.
+
+	cas := papercuttest.NewCASServer()
+	defer cas.Close()
+	srv.UseCAS(cas.URL + "/cas")
+*/
+type CASServer struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	users      map[string]string
+	tickets    map[string]casTicket
+	executions map[string]bool
+	next       int
+}
+
+type casTicket struct {
+	username string
+	service  string
+}
+
+// NewCASServer starts a fake CAS server with the user "student" whose
+// password is "password".
+func NewCASServer() *CASServer {
+	c := &CASServer{
+		users:      map[string]string{"student": "password"},
+		tickets:    map[string]casTicket{},
+		executions: map[string]bool{},
+	}
+	c.Server = httptest.NewServer(c)
+	return c
+}
+
+// AddUser adds or replaces a CAS account.
+func (c *CASServer) AddUser(username string, password string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.users[username] = password
+}
+
+// ServeHTTP serves /cas/login and /cas/serviceValidate.
+func (c *CASServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/cas/login":
+		c.serveLogin(w, r)
+	case "/cas/serviceValidate":
+		c.serveValidate(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (c *CASServer) serveLogin(w http.ResponseWriter, r *http.Request) {
+	service := r.FormValue("service")
+
+	if r.Method == "POST" {
+		execution := r.PostForm.Get("execution")
+		username := r.PostForm.Get("username")
+		password, ok := c.users[username]
+
+		if c.executions[execution] && ok && password == r.PostForm.Get("password") {
+			delete(c.executions, execution)
+			c.next++
+			ticket := "ST-" + strconv.Itoa(c.next) + "-cas"
+			c.tickets[ticket] = casTicket{username: username, service: service}
+
+			target, err := url.Parse(service)
+			if err != nil || service == "" {
+				fmt.Fprintf(w, "Logged in as %s", html.EscapeString(username))
+				return
+			}
+			query := target.Query()
+			query.Set("ticket", ticket)
+			target.RawQuery = query.Encode()
+			http.Redirect(w, r, target.String(), http.StatusFound)
+			return
+		}
+		delete(c.executions, execution)
+	}
+
+	c.next++
+	execution := "e" + strconv.Itoa(c.next) + "s1"
+	c.executions[execution] = true
+
+	message := ""
+	if r.Method == "POST" {
+		message = `<div id="msg" class="errors">Invalid credentials.</div>`
+	}
+
+	w.Header().Set("Content-Type", "text/html;charset=UTF-8")
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html><head><title>CAS - Central Authentication Service</title></head>
+<body>%s<form id="fm1" method="post" action="login?service=%s">
+<input id="username" name="username" type="text" value=""/>
+<input id="password" name="password" type="password" value=""/>
+<input type="hidden" name="execution" value="%s"/>
+<input type="hidden" name="_eventId" value="submit"/>
+<input class="btn-submit" name="submit" type="submit" value="LOGIN"/>
+</form></body></html>
+`, message, html.EscapeString(url.QueryEscape(service)), execution)
+}
+
+func (c *CASServer) serveValidate(w http.ResponseWriter, r *http.Request) {
+	ticket := r.URL.Query().Get("ticket")
+	t, ok := c.tickets[ticket]
+	// Service tickets are good for a single validation.
+	delete(c.tickets, ticket)
+
+	w.Header().Set("Content-Type", "application/xml;charset=UTF-8")
+	if !ok || t.service != r.URL.Query().Get("service") {
+		fmt.Fprintf(w, `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+<cas:authenticationFailure code="INVALID_TICKET">Ticket %s not recognized</cas:authenticationFailure>
+</cas:serviceResponse>`, html.EscapeString(ticket))
+		return
+	}
+
+	fmt.Fprintf(w, `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+<cas:authenticationSuccess><cas:user>%s</cas:user></cas:authenticationSuccess>
+</cas:serviceResponse>`, html.EscapeString(t.username))
+}
+
+// casResponse is the part of a CAS 2.0 serviceValidate answer the Handler
+// needs.
+type casResponse struct {
+	User string `xml:"authenticationSuccess>user"`
+}
+
+// validateCASTicket asks the CAS server at casURL who ticket was issued to.
+func validateCASTicket(casURL string, ticket string, service string) (string, error) {
+	query := url.Values{"ticket": {ticket}, "service": {service}}
+	resp, err := http.Get(casURL + "/serviceValidate?" + query.Encode())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var answer casResponse
+	if err := xml.Unmarshal(data, &answer); err != nil {
+		return "", err
+	}
+	if answer.User == "" {
+		return "", fmt.Errorf("ticket %s was not accepted", ticket)
+	}
+	return answer.User, nil
+}
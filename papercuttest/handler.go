@@ -0,0 +1,737 @@
+package papercuttest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Failure is a fault the server can be told to simulate.
+type Failure int
+
+const (
+	// BadLogin rejects every login as if the password was wrong.
+	BadLogin Failure = iota
+	// ExpiredSession answers every logged in page with the login form.
+	ExpiredSession
+	// RejectUpload answers document uploads with a server error.
+	RejectUpload
+	// Unavailable answers every request with 503 Service Unavailable and a
+	// Retry-After of one second.
+	Unavailable
+	// LostUploadResponse accepts uploads but answers them with 502 Bad
+	// Gateway, as if the response was lost on the way back.
+	LostUploadResponse
+)
+
+// always marks a failure that stays on until Recover.
+const always = -1
+
+// Job statuses as PaperCut shows them in the web print job list.
+const (
+	StatusRendering = "Rendering"
+	StatusHeld      = "Held in a queue"
+	StatusPrinted   = "Printed"
+	StatusCancelled = "Cancelled"
+	StatusError     = "Error"
+)
+
+// Printer is a printer offered in the web print printer list. Jobs sent to
+// it follow Lifecycle, or the handler's lifecycle when it is empty.
+type Printer struct {
+	ID          int
+	Name        string
+	Location    string
+	CostPerPage float64
+	Lifecycle   []LifecycleStep
+}
+
+// LifecycleStep moves a job to Status once After has passed since it was
+// uploaded.
+type LifecycleStep struct {
+	Status string
+	After  time.Duration
+}
+
+// User is an account that can log in to the server.
+type User struct {
+	Username string
+	Password string
+	Balance  float64
+}
+
+// Job is a document uploaded through web print.
+type Job struct {
+	ID        string
+	Username  string
+	PrinterID int
+	Printer   string
+	Document  string
+	Copies    int
+	Pages     int
+	Cost      float64
+	Status    string
+	Submitted time.Time
+	Data      []byte
+
+	lifecycle []LifecycleStep
+	pinned    bool
+}
+
+// Transaction is a change to a user's balance, shown in the transaction
+// history.
+type Transaction struct {
+	Username string
+	Time     time.Time
+	Amount   float64
+	Balance  float64
+	Type     string
+	Comment  string
+}
+
+// session tracks how far through the web print wizard a browser got.
+type session struct {
+	username string
+	printer  int
+	copies   int
+	uploadID int
+}
+
+// Handler implements the fake PaperCut pages. Its methods are safe to call
+// while requests are being served.
+type Handler struct {
+	mu           sync.Mutex
+	users        map[string]*User
+	printers     []Printer
+	lifecycle    []LifecycleStep
+	jobs         []*Job
+	transactions []Transaction
+	sessions     map[string]*session
+	failures     map[Failure]int
+	nextUploadID int
+	nextJobID    int
+	casURL       string
+
+	// OnUpload, if set, is called with every accepted upload. It runs while
+	// the handler is locked and must not call back into the Handler.
+	OnUpload func(job Job)
+}
+
+// NewHandler returns a handler with a single user "student" whose password
+// is "password" and two printers.
+func NewHandler() *Handler {
+	h := &Handler{
+		users:        map[string]*User{},
+		sessions:     map[string]*session{},
+		failures:     map[Failure]int{},
+		nextUploadID: 1000,
+		nextJobID:    1,
+	}
+
+	h.AddUser(User{Username: "student", Password: "password", Balance: 10})
+	h.printers = []Printer{
+		{ID: 1, Name: "library-bw", Location: "Foley Library, 1st floor", CostPerPage: 0.05},
+		{ID: 2, Name: "library-color", Location: "Foley Library, 2nd floor", CostPerPage: 0.25},
+	}
+
+	return h
+}
+
+// AddUser adds or replaces an account.
+func (h *Handler) AddUser(u User) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	user := u
+	h.users[u.Username] = &user
+}
+
+// SetUsers replaces every account.
+func (h *Handler) SetUsers(users []User) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.users = map[string]*User{}
+	for _, u := range users {
+		user := u
+		h.users[u.Username] = &user
+	}
+}
+
+/*
+SetLifecycle sets the statuses new jobs move through, for example
+Rendering, then Held in a queue after five seconds and Printed after
+fifteen. Without a lifecycle jobs stay Rendering until SetJobStatus.
+*/
+func (h *Handler) SetLifecycle(steps []LifecycleStep) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lifecycle = append([]LifecycleStep(nil), steps...)
+}
+
+// SetPrinters replaces the printer list.
+func (h *Handler) SetPrinters(printers []Printer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.printers = append([]Printer(nil), printers...)
+}
+
+// Balance returns the current balance of username.
+func (h *Handler) Balance(username string) float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if u, ok := h.users[username]; ok {
+		return u.Balance
+	}
+	return 0
+}
+
+// Fail turns on the given failures.
+func (h *Handler) Fail(failures ...Failure) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, f := range failures {
+		h.failures[f] = always
+	}
+}
+
+// FailNext turns on failure for the next n requests it applies to only.
+func (h *Handler) FailNext(failure Failure, n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures[failure] = n
+}
+
+// failing reports whether failure should be simulated now and uses up one
+// of its remaining occurrences.
+func (h *Handler) failing(failure Failure) bool {
+	switch n := h.failures[failure]; {
+	case n == always:
+		return true
+	case n > 0:
+		h.failures[failure] = n - 1
+		return true
+	}
+	return false
+}
+
+// Recover turns off all injected failures.
+func (h *Handler) Recover() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures = map[Failure]int{}
+}
+
+// Jobs returns a copy of every job uploaded so far, oldest first.
+func (h *Handler) Jobs() []Job {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	jobs := make([]Job, len(h.jobs))
+	for i, j := range h.jobs {
+		h.advance(j)
+		jobs[i] = *j
+	}
+	return jobs
+}
+
+// Transactions returns username's transactions so far, oldest first.
+func (h *Handler) Transactions(username string) []Transaction {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var transactions []Transaction
+	for _, t := range h.transactions {
+		if t.Username == username {
+			transactions = append(transactions, t)
+		}
+	}
+	return transactions
+}
+
+// charge adds amount to username's balance and records it as a transaction.
+func (h *Handler) charge(username string, amount float64, kind string, comment string) {
+	user, ok := h.users[username]
+	if !ok {
+		return
+	}
+	user.Balance += amount
+	h.transactions = append(h.transactions, Transaction{
+		Username: username,
+		Time:     time.Now(),
+		Amount:   amount,
+		Balance:  user.Balance,
+		Type:     kind,
+		Comment:  comment,
+	})
+}
+
+// SetJobStatus changes the status of the job with the given ID. The job no
+// longer follows its lifecycle afterwards.
+func (h *Handler) SetJobStatus(id string, status string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, j := range h.jobs {
+		if j.ID == id {
+			j.Status = status
+			j.pinned = true
+			return true
+		}
+	}
+	return false
+}
+
+// advance moves j along its lifecycle to the latest step that is due.
+func (h *Handler) advance(j *Job) {
+	if j.pinned {
+		return
+	}
+	elapsed := time.Since(j.Submitted)
+	for _, step := range j.lifecycle {
+		if elapsed >= step.After {
+			j.Status = step.Status
+		}
+	}
+}
+
+// ServeHTTP dispatches requests the way PaperCut's Tapestry app does.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.failing(Unavailable) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/user":
+		h.serveUser(w, r)
+	case r.URL.Path == "/app" && r.Method == "GET":
+		h.serveAppPage(w, r)
+	case r.URL.Path == "/app" && r.Method == "POST":
+		h.serveAppForm(w, r)
+	case strings.HasPrefix(r.URL.Path, "/upload/") && r.Method == "POST":
+		h.serveUpload(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// UseCAS sends logins to the CAS server at casURL, such as a CASServer's
+// URL followed by "/cas", instead of showing the login form.
+func (h *Handler) UseCAS(casURL string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.casURL = casURL
+}
+
+func (h *Handler) serveUser(w http.ResponseWriter, r *http.Request) {
+	id := newSessionID()
+	h.sessions[id] = &session{}
+	http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: id, Path: "/"})
+
+	if h.casURL != "" {
+		http.Redirect(w, r, h.casURL+"/login?service="+url.QueryEscape(casService(r)), http.StatusFound)
+		return
+	}
+
+	writePage(w, "Login", loginBody)
+}
+
+// casService is the URL CAS sends the browser back to with a ticket.
+func casService(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/app?service=page/UserSummary"
+}
+
+// serveCASTicket logs in the session of r with the CAS ticket it carries.
+func (h *Handler) serveCASTicket(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie("JSESSIONID")
+	if err != nil || h.sessions[cookie.Value] == nil {
+		writePage(w, "Login", loginBody)
+		return
+	}
+
+	username, err := validateCASTicket(h.casURL, r.URL.Query().Get("ticket"), casService(r))
+	if err != nil {
+		writePage(w, "Login", `<div class="errorMessage">`+html.EscapeString(err.Error())+`</div>`+loginBody)
+		return
+	}
+
+	h.sessions[cookie.Value].username = username
+	http.Redirect(w, r, "/app?service=page/UserSummary", http.StatusFound)
+}
+
+// currentSession returns the logged in session for r, or nil if there is
+// none or sessions are being expired.
+func (h *Handler) currentSession(r *http.Request) *session {
+	if h.failing(ExpiredSession) {
+		return nil
+	}
+	cookie, err := r.Cookie("JSESSIONID")
+	if err != nil {
+		return nil
+	}
+	sess, ok := h.sessions[cookie.Value]
+	if !ok || sess.username == "" {
+		return nil
+	}
+	return sess
+}
+
+func (h *Handler) serveAppPage(w http.ResponseWriter, r *http.Request) {
+	if h.casURL != "" && r.URL.Query().Get("ticket") != "" {
+		h.serveCASTicket(w, r)
+		return
+	}
+
+	sess := h.currentSession(r)
+	if sess == nil {
+		writePage(w, "Login", loginBody)
+		return
+	}
+
+	switch r.URL.Query().Get("service") {
+	case "action/1/UserWebPrint/0/$ActionLink":
+		writePage(w, "Web Print", h.printerListBody())
+	case "page/UserWebPrint":
+		writePage(w, "Web Print", h.jobListBody(sess.username))
+	case logoutService:
+		cookie, _ := r.Cookie("JSESSIONID")
+		delete(h.sessions, cookie.Value)
+		writePage(w, "Login", loginBody)
+	case "page/UserTransactions":
+		writePage(w, "Transaction History", h.transactionListBody(sess.username))
+	case cancelService:
+		h.cancelJob(sess.username, strings.TrimPrefix(r.URL.Query().Get("sp"), "S"))
+		writePage(w, "Web Print", h.jobListBody(sess.username))
+	default:
+		writePage(w, "Summary", h.summaryBody(sess.username))
+	}
+}
+
+func (h *Handler) serveAppForm(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.PostForm.Get("service") == "direct/1/Home/$Form$0" {
+		h.serveLogin(w, r)
+		return
+	}
+
+	sess := h.currentSession(r)
+	if sess == nil {
+		writePage(w, "Login", loginBody)
+		return
+	}
+
+	switch r.PostForm.Get("service") {
+	case "direct/1/UserWebPrintSelectPrinter/$Form":
+		id, _ := strconv.Atoi(r.PostForm.Get("$RadioGroup"))
+		if _, ok := h.printer(id); !ok {
+			writePage(w, "Web Print", `<div class="errorMessage">Please select a printer.</div>`+h.printerListBody())
+			return
+		}
+		sess.printer = id
+		writePage(w, "Web Print", optionsBody)
+
+	case "direct/1/UserWebPrintOptionsAndAccountSelection/$Form":
+		copies, err := strconv.Atoi(r.PostForm.Get("copies"))
+		if err != nil || copies < 1 || sess.printer == 0 {
+			writePage(w, "Web Print", `<div class="errorMessage">Invalid number of copies.</div>`+optionsBody)
+			return
+		}
+		sess.copies = copies
+		sess.uploadID = h.nextUploadID
+		h.nextUploadID++
+		writePage(w, "Web Print", fmt.Sprintf(uploadBody, sess.uploadID))
+
+	default:
+		writePage(w, "Summary", h.summaryBody(sess.username))
+	}
+}
+
+func (h *Handler) serveLogin(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie("JSESSIONID")
+	if err != nil {
+		writePage(w, "Login", loginBody)
+		return
+	}
+	sess, ok := h.sessions[cookie.Value]
+	if !ok {
+		writePage(w, "Login", loginBody)
+		return
+	}
+
+	user, ok := h.users[r.PostForm.Get("inputUsername")]
+	if !ok || user.Password != r.PostForm.Get("inputPassword") || h.failing(BadLogin) {
+		writePage(w, "Login", `<div class="errorMessage">Login failed.</div>`+loginBody)
+		return
+	}
+
+	sess.username = user.Username
+	writePage(w, "Summary", h.summaryBody(user.Username))
+}
+
+var uploadPathRe = regexp.MustCompile(`^/upload/([0-9]+)$`)
+
+func (h *Handler) serveUpload(w http.ResponseWriter, r *http.Request) {
+	sess := h.currentSession(r)
+	if sess == nil {
+		http.Error(w, `{"error":"session expired"}`, http.StatusUnauthorized)
+		return
+	}
+
+	m := uploadPathRe.FindStringSubmatch(r.URL.Path)
+	if m == nil || m[1] != strconv.Itoa(sess.uploadID) || sess.uploadID == 0 {
+		http.Error(w, `{"error":"unknown upload"}`, http.StatusNotFound)
+		return
+	}
+
+	if h.failing(RejectUpload) {
+		http.Error(w, `{"error":"upload rejected"}`, http.StatusInternalServerError)
+		return
+	}
+
+	file, header, err := r.FormFile("file[]")
+	if err != nil {
+		http.Error(w, `{"error":"no file"}`, http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		http.Error(w, `{"error":"read failed"}`, http.StatusBadRequest)
+		return
+	}
+
+	printer, _ := h.printer(sess.printer)
+	pages := countPages(data)
+	job := &Job{
+		ID:        strconv.Itoa(h.nextJobID),
+		Username:  sess.username,
+		PrinterID: printer.ID,
+		Printer:   printer.Name,
+		Document:  header.Filename,
+		Copies:    sess.copies,
+		Pages:     pages * sess.copies,
+		Cost:      float64(pages*sess.copies) * printer.CostPerPage,
+		Status:    StatusRendering,
+		Submitted: time.Now(),
+		Data:      data,
+		lifecycle: printer.Lifecycle,
+	}
+	if len(job.lifecycle) == 0 {
+		job.lifecycle = h.lifecycle
+	}
+	h.advance(job)
+	h.nextJobID++
+	h.jobs = append(h.jobs, job)
+
+	h.charge(sess.username, -job.Cost, "Print", "Job "+job.ID+": "+job.Document)
+
+	// Each upload ID is good for a single document.
+	sess.uploadID = 0
+
+	if h.OnUpload != nil {
+		h.OnUpload(*job)
+	}
+
+	if h.failing(LostUploadResponse) {
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"success":true,"jobId":%q}`, job.ID)
+}
+
+func (h *Handler) printer(id int) (Printer, bool) {
+	for _, p := range h.printers {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return Printer{}, false
+}
+
+func (h *Handler) summaryBody(username string) string {
+	balance := 0.0
+	if u, ok := h.users[username]; ok {
+		balance = u.Balance
+	}
+	return fmt.Sprintf(`<div id="main"><h1>Summary</h1>
+<div class="widget stat-bal"><span class="val">%s</span></div>
+<p>Logged in as %s</p></div>`, money(balance), html.EscapeString(username))
+}
+
+func (h *Handler) printerListBody() string {
+	var b strings.Builder
+	b.WriteString(`<form method="post" action="/app"><table class="results"><tbody>`)
+	for i, p := range h.printers {
+		class := "odd"
+		if i%2 == 1 {
+			class = "even"
+		}
+		fmt.Fprintf(&b, `<tr class="%s"><td class="printerNameColumnValue"><input type="radio" name="$RadioGroup" value="%d" id="printer%d"/>
+<label for="printer%d">%s</label></td>
+<td class="locationColumnValue">%s</td>
+<td class="costColumnValue">%s</td></tr>
+`, class, p.ID, p.ID, p.ID, html.EscapeString(p.Name), html.EscapeString(p.Location), money(p.CostPerPage))
+	}
+	b.WriteString(`</tbody></table></form>`)
+	return b.String()
+}
+
+func (h *Handler) jobListBody(username string) string {
+	var jobs []*Job
+	for _, j := range h.jobs {
+		if j.Username == username {
+			h.advance(j)
+			jobs = append(jobs, j)
+		}
+	}
+	sort.SliceStable(jobs, func(a, b int) bool { return jobs[a].Submitted.After(jobs[b].Submitted) })
+
+	var b strings.Builder
+	b.WriteString(`<table class="results"><thead><tr><th>Submission Time</th><th>Printer</th><th>Document Name</th><th>Pages</th><th>Cost</th><th>Status</th><th></th></tr></thead><tbody>`)
+	for i, j := range jobs {
+		class := "odd"
+		if i%2 == 1 {
+			class = "even"
+		}
+		action := ""
+		if !finished(j.Status) {
+			action = fmt.Sprintf(`<a class="cancel" href="/app?service=%s&amp;sp=S%s">Cancel</a>`, cancelService, j.ID)
+		}
+		fmt.Fprintf(&b, `<tr class="%s">
+<td class="dateColumnValue">%s</td>
+<td class="printerColumnValue">%s</td>
+<td class="documentNameColumnValue">%s</td>
+<td class="pagesColumnValue">%d</td>
+<td class="costColumnValue">%s</td>
+<td class="statusColumnValue">%s</td>
+<td class="actionColumnValue">%s</td></tr>
+`, class, j.Submitted.Format("Jan 2, 2006 3:04:05 PM"), html.EscapeString(j.Printer),
+			html.EscapeString(j.Document), j.Pages, money(j.Cost), html.EscapeString(j.Status), action)
+	}
+	b.WriteString(`</tbody></table>`)
+	return b.String()
+}
+
+func (h *Handler) transactionListBody(username string) string {
+	var b strings.Builder
+	b.WriteString(`<table class="results"><thead><tr><th>Transaction Date</th><th>Amount</th><th>Balance</th><th>Transaction Type</th><th>Comment</th></tr></thead><tbody>`)
+	row := 0
+	for i := len(h.transactions) - 1; i >= 0; i-- {
+		t := h.transactions[i]
+		if t.Username != username {
+			continue
+		}
+		class := "odd"
+		if row%2 == 1 {
+			class = "even"
+		}
+		row++
+		fmt.Fprintf(&b, `<tr class="%s">
+<td class="transactionDateColumnValue">%s</td>
+<td class="amountColumnValue">%s</td>
+<td class="balanceColumnValue">%s</td>
+<td class="transactionTypeColumnValue">%s</td>
+<td class="commentColumnValue">%s</td></tr>
+`, class, t.Time.Format("Jan 2, 2006 3:04:05 PM"), money(t.Amount), money(t.Balance),
+			html.EscapeString(t.Type), html.EscapeString(t.Comment))
+	}
+	b.WriteString(`</tbody></table>`)
+	return b.String()
+}
+
+// logoutService is the service of the log out link.
+const logoutService = "direct/1/UserSummary/$UserBorder.logoutLink"
+
+// cancelService is the service of the cancel links in the job list.
+const cancelService = "direct/1/UserWebPrint/$DirectLink"
+
+// cancelJob cancels one of username's jobs unless it already finished. The
+// cost of a cancelled job is refunded.
+func (h *Handler) cancelJob(username string, id string) {
+	for _, j := range h.jobs {
+		if j.ID != id || j.Username != username {
+			continue
+		}
+		h.advance(j)
+		if finished(j.Status) {
+			return
+		}
+		j.Status = StatusCancelled
+		j.pinned = true
+		h.charge(username, j.Cost, "Refund", "Job "+j.ID+" cancelled")
+	}
+}
+
+func finished(status string) bool {
+	return status == StatusPrinted || status == StatusCancelled || status == StatusError
+}
+
+func writePage(w http.ResponseWriter, title string, body string) {
+	w.Header().Set("Content-Type", "text/html;charset=UTF-8")
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html><head><title>PaperCut MF  : %s</title></head>
+<body>%s</body></html>
+`, title, body)
+}
+
+const loginBody = `<form method="post" action="/app" name="Form0">
+<input type="hidden" name="service" value="direct/1/Home/$Form$0"/>
+<input type="text" name="inputUsername"/>
+<input type="password" name="inputPassword"/>
+<input type="submit" name="$Submit$0" value="Log in"/>
+</form>`
+
+const optionsBody = `<form method="post" action="/app">
+<input type="hidden" name="service" value="direct/1/UserWebPrintOptionsAndAccountSelection/$Form"/>
+<input type="text" name="copies" value="1"/>
+<input type="submit" name="$Submit" value="3. Upload Documents &raquo;"/>
+</form>`
+
+const uploadBody = `<div id="upload"></div>
+<script type="text/javascript">
+var uploadUID = '%d';
+</script>`
+
+var pageRe = regexp.MustCompile(`/Type\s*/Page\b`)
+
+// countPages gives a rough page count for PDFs; anything else is one page.
+func countPages(data []byte) int {
+	if n := len(pageRe.FindAll(data, -1)); n > 0 {
+		return n
+	}
+	return 1
+}
+
+func money(amount float64) string {
+	if amount < 0 {
+		return fmt.Sprintf("-$%.2f", -amount)
+	}
+	return fmt.Sprintf("$%.2f", amount)
+}
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return strings.ToUpper(hex.EncodeToString(b))
+}
@@ -0,0 +1,39 @@
+/*
+Package papercuttest provides an in-process fake PaperCut server for tests.
+
+The server mimics the pages the utils package drives during web print: the
+/user page that hands out a JSESSIONID cookie, the /app login form, the
+UserWebPrint printer list, the print options page carrying the upload ID,
+/upload/<id>, the job list with its cancel links, the transaction history
+and the log out link. Failures such as a bad login, an expired session or a
+rejected upload can be injected with Fail, or with FailNext to fail only a
+few requests and then recover. With UseCAS logins go through a CASServer
+instead of the login form.
+
+	srv := papercuttest.NewServer()
+	defer srv.Close()
+	utils.BaseURL = srv.URL
+*/
+package papercuttest
+
+import "net/http/httptest"
+
+// Server is a fake PaperCut server running on a local httptest listener.
+type Server struct {
+	*httptest.Server
+	*Handler
+}
+
+// NewServer starts a fake server with the default fixtures of NewHandler.
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a fake server that has not started listening,
+// so its fixtures can be replaced before the first request.
+func NewUnstartedServer() *Server {
+	h := NewHandler()
+	return &Server{httptest.NewUnstartedServer(h), h}
+}
@@ -0,0 +1,203 @@
+package rest
+
+// openAPI describes the API, served at /openapi.json.
+const openAPI = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "gu web print API",
+    "description": "Prints to PaperCut web print through the session of gu serve.",
+    "version": "1.0.0"
+  },
+  "security": [{"bearerAuth": []}],
+  "paths": {
+    "/printers": {
+      "get": {
+        "summary": "Lists the printers offered for web print",
+        "operationId": "listPrinters",
+        "responses": {
+          "200": {
+            "description": "The printers, by ID",
+            "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Printer"}}}}
+          },
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "502": {"$ref": "#/components/responses/BadGateway"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      }
+    },
+    "/jobs": {
+      "get": {
+        "summary": "Lists the recent web print jobs, newest first",
+        "operationId": "listJobs",
+        "responses": {
+          "200": {
+            "description": "The jobs",
+            "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Job"}}}}
+          },
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "502": {"$ref": "#/components/responses/BadGateway"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      },
+      "post": {
+        "summary": "Prints a document",
+        "description": "Documents PaperCut does not accept are converted like with gu print. The response is sent once PaperCut lists the job.",
+        "operationId": "createJob",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "multipart/form-data": {
+              "schema": {
+                "type": "object",
+                "required": ["file"],
+                "properties": {
+                  "file": {"type": "string", "format": "binary", "description": "The document"},
+                  "printer": {"type": "string", "description": "Name or ID of the printer, required unless gu serve has a default printer"},
+                  "copies": {"type": "integer", "minimum": 1, "default": 1}
+                }
+              }
+            }
+          }
+        },
+        "responses": {
+          "201": {
+            "description": "The job PaperCut created",
+            "headers": {"Location": {"description": "The job's URL", "schema": {"type": "string"}}},
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}
+          },
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "415": {"description": "The document cannot be printed", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+          "502": {"$ref": "#/components/responses/BadGateway"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      }
+    },
+    "/jobs/{id}": {
+      "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}],
+      "get": {
+        "summary": "Shows a job",
+        "operationId": "getJob",
+        "responses": {
+          "200": {"description": "The job", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "502": {"$ref": "#/components/responses/BadGateway"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      },
+      "delete": {
+        "summary": "Cancels a job that has not printed yet",
+        "operationId": "cancelJob",
+        "responses": {
+          "200": {"description": "The cancelled job", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}},
+          "204": {"description": "The job was cancelled and is no longer listed"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "409": {"description": "The job has already finished", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+          "502": {"$ref": "#/components/responses/BadGateway"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      }
+    },
+    "/balance": {
+      "get": {
+        "summary": "Shows the account balance",
+        "operationId": "getBalance",
+        "responses": {
+          "200": {
+            "description": "The balance",
+            "content": {"application/json": {"schema": {"type": "object", "properties": {"balance": {"type": "number"}}}}}
+          },
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "502": {"$ref": "#/components/responses/BadGateway"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      }
+    },
+    "/transactions": {
+      "get": {
+        "summary": "Lists the recent transactions, newest first",
+        "operationId": "listTransactions",
+        "responses": {
+          "200": {
+            "description": "The transactions",
+            "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Transaction"}}}}
+          },
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "502": {"$ref": "#/components/responses/BadGateway"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      }
+    },
+    "/openapi.json": {
+      "get": {
+        "summary": "This document",
+        "operationId": "getOpenAPI",
+        "security": [],
+        "responses": {"200": {"description": "The OpenAPI document", "content": {"application/json": {}}}}
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearerAuth": {"type": "http", "scheme": "bearer", "description": "The token gu serve was started with"}
+    },
+    "schemas": {
+      "Printer": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer"},
+          "name": {"type": "string"},
+          "location": {"type": "string"},
+          "cost_per_page": {"type": "number", "description": "Missing if PaperCut does not show it"}
+        }
+      },
+      "Job": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "submitted": {"type": "string", "description": "As PaperCut shows it"},
+          "printer": {"type": "string"},
+          "document": {"type": "string"},
+          "pages": {"type": "integer"},
+          "cost": {"type": "number"},
+          "status": {"type": "string", "example": "Held in a queue"},
+          "finished": {"type": "boolean", "description": "Whether the job was printed, cancelled or failed"},
+          "events": {"type": "array", "description": "What happened to a job printed through this server, oldest first", "items": {"$ref": "#/components/schemas/Event"}}
+        }
+      },
+      "Event": {
+        "type": "object",
+        "properties": {
+          "type": {"type": "string", "enum": ["logged-in", "printer-selected", "options-submitted", "uploaded", "rendering", "held", "printed", "cancelled", "status", "failed"]},
+          "time": {"type": "string", "format": "date-time"},
+          "status": {"type": "string", "description": "The job status, for status events"},
+          "message": {"type": "string", "example": "selected printer library-bw"}
+        }
+      },
+      "Transaction": {
+        "type": "object",
+        "properties": {
+          "date": {"type": "string", "description": "As PaperCut shows it"},
+          "amount": {"type": "number", "description": "Negative for charges"},
+          "balance": {"type": "number", "description": "The balance afterwards"},
+          "type": {"type": "string", "example": "Print"},
+          "comment": {"type": "string"}
+        }
+      },
+      "Error": {
+        "type": "object",
+        "properties": {"error": {"type": "string"}}
+      }
+    },
+    "responses": {
+      "BadRequest": {"description": "The request is invalid", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "Unauthorized": {"description": "The bearer token is missing or wrong", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "NotFound": {"description": "The job is not in the job list", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "BadGateway": {"description": "PaperCut refused the request", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "Unavailable": {"description": "PaperCut cannot be reached right now", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+    }
+  }
+}
+`
@@ -0,0 +1,558 @@
+/*
+Package rest serves a JSON API for web print over a PaperCut session, so
+that scripts and other programs can print without driving the PaperCut
+pages themselves:
+
+	GET    /printers       printers offered for web print
+	GET    /jobs           recent jobs, newest first
+	POST   /jobs           print a document sent as multipart/form-data
+	GET    /jobs/{id}      one job, with its events if printed through the server
+	DELETE /jobs/{id}      cancel a job that has not printed yet
+	GET    /balance        the account balance
+	GET    /transactions   recent transactions, newest first
+	GET    /openapi.json   the OpenAPI document describing all of this
+
+Every request but the one for /openapi.json needs the server's token as
+"Authorization: Bearer <token>".
+
+Jobs printed through the server carry the events of their print job, from
+logging in to the upload, and the statuses seen in the job list since. Run
+WatchJobs to keep following them between requests.
+*/
+package rest
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quantamhd/gu/utils"
+)
+
+// maxMemory is how much of an upload is kept in memory; the rest goes to a
+// temporary file.
+const maxMemory = 32 << 20
+
+// maxHistory is how many jobs the server keeps the events of.
+const maxHistory = 100
+
+/*
+Server answers API requests with a PaperCut session. Documents are
+converted with convert, if set, before they are checked and uploaded.
+*/
+type Server struct {
+	session *utils.Session
+	token   string
+	printer string
+	convert func(ctx context.Context, path string) (string, error)
+	logger  *log.Logger
+
+	mu sync.Mutex
+	// history has the events of the jobs printed through the server, by
+	// job ID, and order their IDs, oldest first.
+	history map[string]*jobHistory
+	order   []string
+}
+
+type jobHistory struct {
+	events   []utils.Event
+	status   string
+	finished bool
+}
+
+type printerJSON struct {
+	ID          int      `json:"id"`
+	Name        string   `json:"name"`
+	Location    string   `json:"location"`
+	CostPerPage *float64 `json:"cost_per_page,omitempty"`
+}
+
+type jobJSON struct {
+	ID        string      `json:"id"`
+	Submitted string      `json:"submitted"`
+	Printer   string      `json:"printer"`
+	Document  string      `json:"document"`
+	Pages     int         `json:"pages"`
+	Cost      float64     `json:"cost"`
+	Status    string      `json:"status"`
+	Finished  bool        `json:"finished"`
+	Events    []eventJSON `json:"events,omitempty"`
+}
+
+type eventJSON struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Status  string    `json:"status,omitempty"`
+	Message string    `json:"message"`
+}
+
+type transactionJSON struct {
+	Date    string  `json:"date"`
+	Amount  float64 `json:"amount"`
+	Balance float64 `json:"balance"`
+	Type    string  `json:"type"`
+	Comment string  `json:"comment"`
+}
+
+/*
+NewServer returns a server that uses session and accepts requests carrying
+token. printer, a name or ID, is used for jobs that do not name one and may
+be empty. Log lines are written to logger.
+*/
+func NewServer(session *utils.Session, token string, printer string, convert func(ctx context.Context, path string) (string, error), logger *log.Logger) *Server {
+	return &Server{
+		session: session,
+		token:   token,
+		printer: printer,
+		convert: convert,
+		logger:  logger,
+		history: map[string]*jobHistory{},
+	}
+}
+
+/*
+WatchJobs fetches the job list every interval until ctx is done, while
+jobs printed through the server have not finished, and adds their new
+statuses to their events.
+*/
+func (s *Server) WatchJobs(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !s.watching() {
+				continue
+			}
+			jobs, err := s.session.Jobs(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					s.logger.Printf("Could not follow the jobs: %v", err)
+				}
+				continue
+			}
+			s.observe(jobs)
+		}
+	}
+}
+
+// watching reports whether a job printed through the server has not
+// finished yet.
+func (s *Server) watching() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, h := range s.history {
+		if !h.finished {
+			return true
+		}
+	}
+	return false
+}
+
+// record keeps the events of a job printed through the server.
+func (s *Server) record(job utils.PaperCutJob, events []utils.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.history[job.GetJobID()] = &jobHistory{events: events, status: job.GetStatus(), finished: job.IsFinished()}
+	s.order = append(s.order, job.GetJobID())
+	if len(s.order) > maxHistory {
+		delete(s.history, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+// observe adds an event for each job printed through the server whose
+// status changed since it was last seen.
+func (s *Server) observe(jobs []utils.PaperCutJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, job := range jobs {
+		h, ok := s.history[job.GetJobID()]
+		if !ok || h.status == job.GetStatus() {
+			continue
+		}
+		h.events = append(h.events, utils.StatusEvent(job))
+		h.status = job.GetStatus()
+		h.finished = job.IsFinished()
+	}
+}
+
+// jobJSON returns job with its events, if it was printed through the server.
+func (s *Server) jobJSON(job utils.PaperCutJob) jobJSON {
+	j := jobToJSON(job)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h, ok := s.history[job.GetJobID()]; ok {
+		for _, e := range h.events {
+			j.Events = append(j.Events, eventJSON{
+				Type:    string(e.Type),
+				Time:    e.Time,
+				Status:  e.Status,
+				Message: e.String(),
+			})
+		}
+	}
+	return j
+}
+
+// ServeHTTP routes API requests.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+
+	if path == "/openapi.json" {
+		if !allow(w, r, "GET") {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, openAPI)
+		return
+	}
+
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gu"`)
+		writeError(w, http.StatusUnauthorized, "missing or wrong bearer token")
+		return
+	}
+
+	switch {
+	case path == "/printers":
+		if allow(w, r, "GET") {
+			s.listPrinters(w, r)
+		}
+	case path == "/jobs":
+		if allow(w, r, "GET", "POST") {
+			if r.Method == "POST" {
+				s.createJob(w, r)
+			} else {
+				s.listJobs(w, r)
+			}
+		}
+	case strings.HasPrefix(path, "/jobs/") && !strings.Contains(path[len("/jobs/"):], "/"):
+		id := path[len("/jobs/"):]
+		if allow(w, r, "GET", "DELETE") {
+			if r.Method == "DELETE" {
+				s.cancelJob(w, r, id)
+			} else {
+				s.getJob(w, r, id)
+			}
+		}
+	case path == "/balance":
+		if allow(w, r, "GET") {
+			s.getBalance(w, r)
+		}
+	case path == "/transactions":
+		if allow(w, r, "GET") {
+			s.listTransactions(w, r)
+		}
+	default:
+		writeError(w, http.StatusNotFound, "no such endpoint, see /openapi.json")
+	}
+}
+
+// authorized reports whether r carries the server's bearer token.
+func (s *Server) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	const prefix = "bearer "
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return false
+	}
+	token := strings.TrimSpace(auth[len(prefix):])
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+// allow answers 405 Method Not Allowed unless r uses one of methods.
+func allow(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, r.Method+" is not allowed here")
+	return false
+}
+
+func (s *Server) listPrinters(w http.ResponseWriter, r *http.Request) {
+	printers, err := s.session.Printers(r.Context())
+	if err != nil {
+		s.fail(w, "listing printers", err)
+		return
+	}
+
+	ids := make([]int, 0, len(printers))
+	for id := range printers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	list := []printerJSON{}
+	for _, id := range ids {
+		list = append(list, printerToJSON(printers[id]))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) listJobs(w http.ResponseWriter, r *http.Request) {
+	jobs, err := s.session.Jobs(r.Context())
+	if err != nil {
+		s.fail(w, "listing jobs", err)
+		return
+	}
+
+	s.observe(jobs)
+
+	list := []jobJSON{}
+	for _, job := range jobs {
+		list = append(list, s.jobJSON(job))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) getJob(w http.ResponseWriter, r *http.Request, id string) {
+	job, ok, err := s.findJob(r.Context(), id)
+	if err != nil {
+		s.fail(w, "fetching job "+id, err)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "job "+id+" is not in the job list")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.jobJSON(job))
+}
+
+func (s *Server) cancelJob(w http.ResponseWriter, r *http.Request, id string) {
+	job, ok, err := s.findJob(r.Context(), id)
+	if err != nil {
+		s.fail(w, "cancelling job "+id, err)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "job "+id+" is not in the job list")
+		return
+	}
+	if job.IsFinished() {
+		writeError(w, http.StatusConflict, "job "+id+" is "+job.GetStatus()+" and can no longer be cancelled")
+		return
+	}
+
+	if err := s.session.Cancel(r.Context(), id); err != nil {
+		s.fail(w, "cancelling job "+id, err)
+		return
+	}
+	s.logger.Printf("Job %s (%s) cancelled", id, job.GetDocumentName())
+
+	if job, ok, err := s.findJob(r.Context(), id); err == nil && ok {
+		writeJSON(w, http.StatusOK, s.jobJSON(job))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// findJob looks up a job in the PaperCut job list.
+func (s *Server) findJob(ctx context.Context, id string) (utils.PaperCutJob, bool, error) {
+	jobs, err := s.session.Jobs(ctx)
+	if err != nil {
+		return utils.PaperCutJob{}, false, err
+	}
+	s.observe(jobs)
+	for _, job := range jobs {
+		if job.GetJobID() == id {
+			return job, true, nil
+		}
+	}
+	return utils.PaperCutJob{}, false, nil
+}
+
+/*
+createJob prints the document in the file field of a multipart form on the
+printer named by the printer field, or the server's printer, with the
+copies given by the copies field, 1 unless set.
+*/
+func (s *Server) createJob(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, utils.MaxDocumentSize+maxMemory)
+	if err := r.ParseMultipartForm(maxMemory); err != nil {
+		writeError(w, http.StatusBadRequest, "expected a multipart/form-data upload: "+err.Error())
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	nameOrID := strings.TrimSpace(r.FormValue("printer"))
+	if nameOrID == "" {
+		nameOrID = s.printer
+	}
+	if nameOrID == "" {
+		writeError(w, http.StatusBadRequest, "printer is required")
+		return
+	}
+
+	copies := 1
+	if value := strings.TrimSpace(r.FormValue("copies")); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "copies must be a positive number")
+			return
+		}
+		copies = n
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "file is required")
+		return
+	}
+	defer file.Close()
+
+	printers, err := s.session.Printers(r.Context())
+	if err != nil {
+		s.fail(w, "listing printers", err)
+		return
+	}
+	id, ok := utils.FindPrinter(printers, nameOrID)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "no printer called "+nameOrID)
+		return
+	}
+	printer := printers[id]
+
+	path, err := utils.SaveDocument(file, header.Filename)
+	if err != nil {
+		s.fail(w, "saving "+header.Filename, err)
+		return
+	}
+	defer os.RemoveAll(filepath.Dir(path))
+
+	uploadPath := path
+	if s.convert != nil {
+		converted, err := s.convert(r.Context(), path)
+		if err != nil {
+			writeError(w, http.StatusUnsupportedMediaType, "could not convert "+header.Filename+": "+err.Error())
+			return
+		}
+		if converted != path {
+			defer os.RemoveAll(filepath.Dir(converted))
+		}
+		uploadPath = converted
+	}
+	if err := utils.CheckDocument(uploadPath); err != nil {
+		writeError(w, http.StatusUnsupportedMediaType, err.Error())
+		return
+	}
+
+	var events []utils.Event
+	job, err := s.session.Submit(r.Context(), &printer, copies, uploadPath, utils.WithEvents(func(e utils.Event) {
+		if e.Type != utils.EventUploading {
+			events = append(events, e)
+		}
+	}))
+	if err != nil {
+		s.fail(w, "printing "+header.Filename, err)
+		return
+	}
+	s.logger.Printf("%s: %d copies sent to %s as job %s", header.Filename, copies,
+		strings.TrimSpace(printer.GetName()), job.GetJobID())
+	s.record(job, events)
+
+	w.Header().Set("Location", "/jobs/"+job.GetJobID())
+	writeJSON(w, http.StatusCreated, s.jobJSON(job))
+}
+
+func (s *Server) getBalance(w http.ResponseWriter, r *http.Request) {
+	balance, err := s.session.Balance(r.Context())
+	if err != nil {
+		s.fail(w, "fetching the balance", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]float64{"balance": balance})
+}
+
+func (s *Server) listTransactions(w http.ResponseWriter, r *http.Request) {
+	transactions, err := s.session.Transactions(r.Context())
+	if err != nil {
+		s.fail(w, "fetching the transactions", err)
+		return
+	}
+
+	list := []transactionJSON{}
+	for _, t := range transactions {
+		list = append(list, transactionJSON{
+			Date:    t.GetDate(),
+			Amount:  t.GetAmount(),
+			Balance: t.GetBalance(),
+			Type:    t.GetType(),
+			Comment: t.GetComment(),
+		})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+/*
+fail answers a request PaperCut could not serve: 503 Service Unavailable
+while the server is out of reach and 502 Bad Gateway otherwise.
+*/
+func (s *Server) fail(w http.ResponseWriter, doing string, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	s.logger.Printf("Error %s: %v", doing, err)
+
+	status := http.StatusBadGateway
+	if utils.IsTemporary(err) {
+		status = http.StatusServiceUnavailable
+	}
+	writeError(w, status, err.Error())
+}
+
+func printerToJSON(p utils.PaperCutPrinter) printerJSON {
+	printer := printerJSON{
+		ID:       p.GetID(),
+		Name:     strings.TrimSpace(p.GetName()),
+		Location: strings.TrimSpace(p.GetLocation()),
+	}
+	if cost, ok := p.GetCostPerPage(); ok {
+		printer.CostPerPage = &cost
+	}
+	return printer
+}
+
+func jobToJSON(j utils.PaperCutJob) jobJSON {
+	return jobJSON{
+		ID:        j.GetJobID(),
+		Submitted: j.GetSubmitted(),
+		Printer:   j.GetPrinterName(),
+		Document:  j.GetDocumentName(),
+		Pages:     j.GetPages(),
+		Cost:      j.GetCost(),
+		Status:    j.GetStatus(),
+		Finished:  j.IsFinished(),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
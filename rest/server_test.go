@@ -0,0 +1,350 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quantamhd/gu/papercuttest"
+	"github.com/quantamhd/gu/utils"
+)
+
+const (
+	testPDF   = "%PDF-1.4\n1 0 obj << /Type /Page >> endobj\n%%EOF\n"
+	testToken = "s3cret-token"
+)
+
+// newTestAPI starts the API over a session on a fake PaperCut server.
+// printer is the default printer and may be empty.
+func newTestAPI(t *testing.T, printer string) (*papercuttest.Server, *Server, string) {
+	t.Helper()
+	srv := papercuttest.NewServer()
+	t.Cleanup(srv.Close)
+
+	baseURL, retry := utils.BaseURL, utils.Retry
+	utils.BaseURL = srv.URL
+	utils.Retry = utils.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	t.Cleanup(func() { utils.BaseURL, utils.Retry = baseURL, retry })
+
+	session, err := utils.NewSession(context.Background(), "student", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(session, testToken, printer, nil, log.New(ioutil.Discard, "", 0))
+	api := httptest.NewServer(server)
+	t.Cleanup(api.Close)
+	return srv, server, api.URL
+}
+
+// request sends an authorized request and decodes the JSON answer into v,
+// if it is not nil.
+func request(t *testing.T, method string, url string, contentType string, body io.Reader, v interface{}) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, _ := ioutil.ReadAll(resp.Body)
+	if v != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Fatalf("%s %s answered %s, which is not JSON: %v", method, url, data, err)
+		}
+	}
+	return resp
+}
+
+// printForm is a multipart form for POST /jobs. Empty fields are left out.
+func printForm(printer string, copies string, name string, document string) (string, io.Reader) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	if printer != "" {
+		w.WriteField("printer", printer)
+	}
+	if copies != "" {
+		w.WriteField("copies", copies)
+	}
+	if name != "" {
+		file, _ := w.CreateFormFile("file", name)
+		file.Write([]byte(document))
+	}
+	w.Close()
+	return w.FormDataContentType(), &body
+}
+
+// printJob prints a document through the API and returns the created job.
+func printJob(t *testing.T, apiURL string, printer string, copies string) jobJSON {
+	t.Helper()
+	contentType, body := printForm(printer, copies, "essay.pdf", testPDF)
+	var job jobJSON
+	resp := request(t, "POST", apiURL+"/jobs", contentType, body, &job)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /jobs = %d, want 201", resp.StatusCode)
+	}
+	if resp.Header.Get("Location") != "/jobs/"+job.ID {
+		t.Errorf("Location = %q, want /jobs/%s", resp.Header.Get("Location"), job.ID)
+	}
+	return job
+}
+
+func TestAuthorization(t *testing.T) {
+	_, _, apiURL := newTestAPI(t, "")
+
+	for _, auth := range []string{"", "Bearer", "Bearer wrong", "Basic " + testToken, testToken} {
+		req, _ := http.NewRequest("GET", apiURL+"/balance", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var answer map[string]string
+		json.NewDecoder(resp.Body).Decode(&answer)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized || answer["error"] == "" {
+			t.Errorf("Authorization %q: %d %v, want 401 with an error", auth, resp.StatusCode, answer)
+		}
+		if resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("Authorization %q: no WWW-Authenticate header", auth)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", apiURL+"/balance", nil)
+	req.Header.Set("Authorization", "bearer  "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("lower case scheme = %d, want 200", resp.StatusCode)
+	}
+
+	// The OpenAPI document is open to all.
+	resp, err = http.Get(apiURL + "/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var doc map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /openapi.json = %d, %v; want a JSON document", resp.StatusCode, err)
+	}
+}
+
+func TestPrintersAndBalance(t *testing.T) {
+	_, _, apiURL := newTestAPI(t, "")
+
+	var printers []printerJSON
+	if resp := request(t, "GET", apiURL+"/printers", "", nil, &printers); resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /printers = %d", resp.StatusCode)
+	}
+	if len(printers) != 2 || printers[0].Name != "library-bw" || printers[1].Name != "library-color" {
+		t.Fatalf("printers = %+v, want library-bw and library-color", printers)
+	}
+	if printers[0].CostPerPage == nil || *printers[0].CostPerPage != 0.05 {
+		t.Errorf("library-bw costs %v a page, want 0.05", printers[0].CostPerPage)
+	}
+
+	var balance map[string]float64
+	request(t, "GET", apiURL+"/balance", "", nil, &balance)
+	if balance["balance"] != 10 {
+		t.Errorf("balance = %v, want 10", balance)
+	}
+}
+
+func TestCreateJob(t *testing.T) {
+	srv, _, apiURL := newTestAPI(t, "")
+
+	job := printJob(t, apiURL, "library-bw", "2")
+	if job.Document != "essay.pdf" || job.ID == "" {
+		t.Errorf("created job = %+v", job)
+	}
+	var types []string
+	for _, e := range job.Events {
+		types = append(types, e.Type)
+	}
+	if len(types) == 0 || types[0] != string(utils.EventLoggedIn) {
+		t.Errorf("job events = %v, want them to start at logging in", types)
+	}
+	for _, eventType := range types {
+		if eventType == string(utils.EventUploading) {
+			t.Error("upload progress was kept in the job's events")
+		}
+	}
+
+	jobs := srv.Jobs()
+	if len(jobs) != 1 || jobs[0].Copies != 2 || string(jobs[0].Data) != testPDF {
+		t.Fatalf("server jobs = %+v, want the document in 2 copies", jobs)
+	}
+
+	var got jobJSON
+	if resp := request(t, "GET", apiURL+"/jobs/"+job.ID, "", nil, &got); resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /jobs/%s = %d", job.ID, resp.StatusCode)
+	}
+	if got.ID != job.ID || len(got.Events) != len(job.Events) {
+		t.Errorf("GET /jobs/%s = %+v, want the job with its events", job.ID, got)
+	}
+
+	var list []jobJSON
+	request(t, "GET", apiURL+"/jobs", "", nil, &list)
+	if len(list) != 1 || list[0].ID != job.ID {
+		t.Errorf("GET /jobs = %+v, want the job", list)
+	}
+}
+
+func TestCreateJobDefaultPrinter(t *testing.T) {
+	srv, _, apiURL := newTestAPI(t, "library-color")
+
+	printJob(t, apiURL, "", "")
+	if jobs := srv.Jobs(); len(jobs) != 1 || jobs[0].Printer != "library-color" || jobs[0].Copies != 1 {
+		t.Fatalf("server jobs = %+v, want one copy on library-color", jobs)
+	}
+}
+
+func TestCreateJobErrors(t *testing.T) {
+	srv, _, apiURL := newTestAPI(t, "")
+
+	tests := []struct {
+		name     string
+		printer  string
+		copies   string
+		file     string
+		document string
+		status   int
+	}{
+		{"no printer", "", "", "essay.pdf", testPDF, http.StatusBadRequest},
+		{"unknown printer", "basement", "", "essay.pdf", testPDF, http.StatusBadRequest},
+		{"no copies", "library-bw", "0", "essay.pdf", testPDF, http.StatusBadRequest},
+		{"copies not a number", "library-bw", "two", "essay.pdf", testPDF, http.StatusBadRequest},
+		{"no file", "library-bw", "", "", "", http.StatusBadRequest},
+		{"not printable", "library-bw", "", "notes.txt", "plain text\n", http.StatusUnsupportedMediaType},
+	}
+	for _, test := range tests {
+		contentType, body := printForm(test.printer, test.copies, test.file, test.document)
+		var answer map[string]string
+		if resp := request(t, "POST", apiURL+"/jobs", contentType, body, &answer); resp.StatusCode != test.status || answer["error"] == "" {
+			t.Errorf("%s: POST /jobs = %d %v, want %d with an error", test.name, resp.StatusCode, answer, test.status)
+		}
+	}
+
+	var answer map[string]string
+	if resp := request(t, "POST", apiURL+"/jobs", "application/json", strings.NewReader("{}"), &answer); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("POST /jobs with JSON = %d, want 400", resp.StatusCode)
+	}
+
+	srv.Fail(papercuttest.RejectUpload)
+	contentType, body := printForm("library-bw", "", "essay.pdf", testPDF)
+	if resp := request(t, "POST", apiURL+"/jobs", contentType, body, &answer); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("POST /jobs with the upload rejected = %d %v, want 502", resp.StatusCode, answer)
+	}
+
+	if jobs := srv.Jobs(); len(jobs) != 0 {
+		t.Errorf("server has %d jobs, want none", len(jobs))
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	srv, _, apiURL := newTestAPI(t, "library-bw")
+	job := printJob(t, apiURL, "", "")
+
+	var cancelled jobJSON
+	if resp := request(t, "DELETE", apiURL+"/jobs/"+job.ID, "", nil, &cancelled); resp.StatusCode != http.StatusOK {
+		t.Fatalf("DELETE /jobs/%s = %d", job.ID, resp.StatusCode)
+	}
+	if !cancelled.Finished || cancelled.Status != papercuttest.StatusCancelled {
+		t.Errorf("cancelled job = %+v", cancelled)
+	}
+	if jobs := srv.Jobs(); jobs[0].Status != papercuttest.StatusCancelled {
+		t.Errorf("server job is %s, want cancelled", jobs[0].Status)
+	}
+
+	var answer map[string]string
+	if resp := request(t, "DELETE", apiURL+"/jobs/"+job.ID, "", nil, &answer); resp.StatusCode != http.StatusConflict {
+		t.Errorf("second DELETE = %d %v, want 409", resp.StatusCode, answer)
+	}
+	if resp := request(t, "DELETE", apiURL+"/jobs/ffffffff", "", nil, &answer); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("DELETE of an unknown job = %d %v, want 404", resp.StatusCode, answer)
+	}
+	if resp := request(t, "GET", apiURL+"/jobs/ffffffff", "", nil, &answer); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET of an unknown job = %d %v, want 404", resp.StatusCode, answer)
+	}
+}
+
+func TestRoutingErrors(t *testing.T) {
+	_, _, apiURL := newTestAPI(t, "")
+
+	var answer map[string]string
+	resp := request(t, "PUT", apiURL+"/jobs", "", nil, &answer)
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "GET, POST" {
+		t.Errorf("PUT /jobs = %d, Allow %q; want 405 with GET, POST", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+	for _, path := range []string{"/nothing", "/jobs/1/2"} {
+		if resp := request(t, "GET", apiURL+path, "", nil, &answer); resp.StatusCode != http.StatusNotFound || answer["error"] == "" {
+			t.Errorf("GET %s = %d %v, want 404 with an error", path, resp.StatusCode, answer)
+		}
+	}
+}
+
+func TestPaperCutUnavailable(t *testing.T) {
+	srv, _, apiURL := newTestAPI(t, "")
+	srv.Fail(papercuttest.Unavailable)
+
+	for _, path := range []string{"/printers", "/jobs", "/balance", "/transactions"} {
+		var answer map[string]string
+		if resp := request(t, "GET", apiURL+path, "", nil, &answer); resp.StatusCode != http.StatusServiceUnavailable || answer["error"] == "" {
+			t.Errorf("GET %s = %d %v, want 503 with an error", path, resp.StatusCode, answer)
+		}
+	}
+}
+
+func TestWatchJobs(t *testing.T) {
+	srv, server, apiURL := newTestAPI(t, "library-bw")
+	job := printJob(t, apiURL, "", "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.WatchJobs(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	srv.SetJobStatus(srv.Jobs()[0].ID, papercuttest.StatusPrinted)
+	deadline := time.Now().Add(2 * time.Second)
+	for server.watching() {
+		if time.Now().After(deadline) {
+			t.Fatal("WatchJobs did not see the job finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var got jobJSON
+	request(t, "GET", apiURL+"/jobs/"+job.ID, "", nil, &got)
+	last := got.Events[len(got.Events)-1]
+	if last.Type != string(utils.EventPrinted) || last.Status != papercuttest.StatusPrinted {
+		t.Errorf("last event = %+v, want the job printed", last)
+	}
+}
@@ -0,0 +1,314 @@
+/*
+Package spool keeps print jobs that could not be sent because the PaperCut
+server was out of reach, and jobs scheduled for later. Each job is a copy
+of the document in the spool directory and an entry in its manifest,
+manifest.json, so that jobs survive until they are sent or dropped.
+*/
+package spool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const manifestFile = "manifest.json"
+
+// claimTimeout is how long a job stays claimed by a gu that is sending it.
+// A claim older than this was left behind by a gu that died.
+const claimTimeout = 15 * time.Minute
+
+// A lock file older than lockStale was left behind and is taken over.
+const (
+	lockWait  = 10 * time.Second
+	lockStale = 30 * time.Second
+)
+
+// Job is a print job waiting in the spool.
+type Job struct {
+	ID int `json:"id"`
+
+	// File is the path of the spooled copy of the document within the
+	// spool directory, Name the path the document was printed from.
+	File string `json:"file"`
+	Name string `json:"name"`
+
+	Server   string `json:"server"`
+	Username string `json:"username"`
+	Printer  string `json:"printer"`
+	Copies   int    `json:"copies"`
+
+	Queued time.Time `json:"queued"`
+
+	// At is when a scheduled job is due. Jobs without it are due at once.
+	At *time.Time `json:"at,omitempty"`
+
+	// Sending is set while a gu is sending the job.
+	Sending *time.Time `json:"sending,omitempty"`
+
+	Attempts  int    `json:"attempts,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+
+	// Failed jobs were refused by PaperCut and are only sent again when
+	// asked for by ID.
+	Failed bool `json:"failed,omitempty"`
+
+	// Unconfirmed jobs may have reached PaperCut on the last attempt,
+	// which got no answer. Like failed jobs they are only sent again when
+	// asked for by ID, once the job list shows they did not print.
+	Unconfirmed bool `json:"unconfirmed,omitempty"`
+}
+
+// IsSending reports whether a gu is sending the job right now.
+func (j Job) IsSending() bool {
+	return j.Sending != nil && time.Since(*j.Sending) < claimTimeout
+}
+
+// IsDue reports whether the job should be printed by now.
+func (j Job) IsDue(now time.Time) bool {
+	return j.At == nil || !j.At.After(now)
+}
+
+type manifest struct {
+	NextID int   `json:"next_id"`
+	Jobs   []Job `json:"jobs"`
+}
+
+// Spool is a spool directory.
+type Spool struct {
+	dir string
+}
+
+// Open returns the spool in dir, creating the directory if needed.
+func Open(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Spool{dir: dir}, nil
+}
+
+// GetDir returns the spool directory.
+func (s *Spool) GetDir() string {
+	return s.dir
+}
+
+// Path returns the path of the spooled copy of job's document.
+func (s *Spool) Path(job Job) string {
+	return filepath.Join(s.dir, job.File)
+}
+
+/*
+Add copies the document at path into the spool and records job for it,
+filling in its ID, File and Queued time. The document is listed as name.
+*/
+func (s *Spool) Add(path string, name string, job Job) (Job, error) {
+	err := s.update(func(m *manifest) error {
+		m.NextID++
+		job.ID = m.NextID
+		job.File = filepath.Join(strconv.Itoa(job.ID), filepath.Base(path))
+		job.Name = name
+		job.Queued = time.Now()
+
+		// Each document has a directory of its own so that it keeps its
+		// name, which PaperCut shows in the job list.
+		if err := os.MkdirAll(filepath.Dir(s.Path(job)), 0700); err != nil {
+			return err
+		}
+		if err := copyFile(path, s.Path(job)); err != nil {
+			os.RemoveAll(filepath.Dir(s.Path(job)))
+			return err
+		}
+		m.Jobs = append(m.Jobs, job)
+		return nil
+	})
+	return job, err
+}
+
+// List returns the spooled jobs, oldest first.
+func (s *Spool) List() ([]Job, error) {
+	var jobs []Job
+	err := s.update(func(m *manifest) error {
+		jobs = m.Jobs
+		return errUnchanged
+	})
+	return jobs, err
+}
+
+/*
+Claim marks job id as being sent, so that no other gu sends it at the same
+time. It returns false if the job is gone or already claimed.
+*/
+func (s *Spool) Claim(id int) (Job, bool, error) {
+	var job Job
+	claimed := false
+	err := s.update(func(m *manifest) error {
+		i := m.find(id)
+		if i < 0 {
+			return errUnchanged
+		}
+		if m.Jobs[i].IsSending() {
+			return errUnchanged
+		}
+		now := time.Now()
+		m.Jobs[i].Sending = &now
+		job, claimed = m.Jobs[i], true
+		return nil
+	})
+	return job, claimed, err
+}
+
+/*
+Release records a failed attempt to send a claimed job and makes it
+available again. failed marks a job PaperCut refused.
+*/
+func (s *Spool) Release(id int, cause error, failed bool) error {
+	return s.update(func(m *manifest) error {
+		i := m.find(id)
+		if i < 0 {
+			return errUnchanged
+		}
+		m.Jobs[i].Sending = nil
+		m.Jobs[i].Attempts++
+		m.Jobs[i].LastError = cause.Error()
+		m.Jobs[i].Failed = failed
+		m.Jobs[i].Unconfirmed = false
+		return nil
+	})
+}
+
+/*
+Unconfirm records an attempt to send a claimed job that may have reached
+PaperCut without an answer coming back, and makes it available again
+only when asked for by ID.
+*/
+func (s *Spool) Unconfirm(id int, cause error) error {
+	return s.update(func(m *manifest) error {
+		i := m.find(id)
+		if i < 0 {
+			return errUnchanged
+		}
+		m.Jobs[i].Sending = nil
+		m.Jobs[i].Attempts++
+		m.Jobs[i].LastError = cause.Error()
+		m.Jobs[i].Failed = false
+		m.Jobs[i].Unconfirmed = true
+		return nil
+	})
+}
+
+// Remove drops job id and its document from the spool.
+func (s *Spool) Remove(id int) error {
+	return s.update(func(m *manifest) error {
+		i := m.find(id)
+		if i < 0 {
+			return fmt.Errorf("no job %d in the spool", id)
+		}
+		if err := os.RemoveAll(filepath.Dir(s.Path(m.Jobs[i]))); err != nil {
+			return err
+		}
+		m.Jobs = append(m.Jobs[:i], m.Jobs[i+1:]...)
+		return nil
+	})
+}
+
+func (m *manifest) find(id int) int {
+	for i, job := range m.Jobs {
+		if job.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// errUnchanged ends an update without writing the manifest.
+var errUnchanged = errors.New("unchanged")
+
+/*
+update reads the manifest, passes it to change and writes it back, holding
+the spool lock throughout so that several gu processes can share the spool.
+*/
+func (s *Spool) update(change func(*manifest) error) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	m := &manifest{}
+	path := filepath.Join(s.dir, manifestFile)
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, m); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := change(m); err != nil {
+		if err == errUnchanged {
+			return nil
+		}
+		return err
+	}
+
+	data, err = json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// lock takes the spool lock and returns the function that releases it.
+func (s *Spool) lock() (func(), error) {
+	path := filepath.Join(s.dir, "manifest.lock")
+	start := time.Now()
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			file.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) > lockStale {
+			os.Remove(path)
+			continue
+		}
+		if time.Since(start) > lockWait {
+			return nil, errors.New("the spool is locked, remove " + path + " if no other gu is running")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func copyFile(from string, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(to, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(to)
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,255 @@
+package spool
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestSpool opens a spool in a new directory and writes a document to
+// spool into another.
+func newTestSpool(t *testing.T) (*Spool, string) {
+	t.Helper()
+	s, err := Open(filepath.Join(t.TempDir(), "spool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	document := filepath.Join(t.TempDir(), "essay.pdf")
+	if err := ioutil.WriteFile(document, []byte("%PDF-1.4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return s, document
+}
+
+func TestAddListRemove(t *testing.T) {
+	s, document := newTestSpool(t)
+
+	first, err := s.Add(document, "essay.pdf", Job{Printer: "library-bw", Copies: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.Add(document, "copy of essay.pdf", Job{Printer: "library-color", Copies: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID == second.ID || first.File == second.File {
+		t.Fatalf("jobs %+v and %+v share an ID or file", first, second)
+	}
+	if filepath.Base(first.File) != "essay.pdf" || first.Queued.IsZero() {
+		t.Errorf("job %+v does not keep the document's name or queued time", first)
+	}
+	data, err := ioutil.ReadFile(s.Path(first))
+	if err != nil || string(data) != "%PDF-1.4\n" {
+		t.Errorf("spooled copy = %q, %v", data, err)
+	}
+
+	// A second Spool on the same directory sees the same jobs.
+	reopened, err := Open(s.GetDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := reopened.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[0].ID != first.ID || jobs[1].ID != second.ID {
+		t.Fatalf("List = %+v, want both jobs oldest first", jobs)
+	}
+	if jobs[0].Printer != "library-bw" || jobs[0].Copies != 2 || jobs[1].Name != "copy of essay.pdf" {
+		t.Errorf("List = %+v, want the jobs as added", jobs)
+	}
+
+	if err := s.Remove(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Dir(s.Path(first))); !os.IsNotExist(err) {
+		t.Errorf("the removed job's document is still there: %v", err)
+	}
+	if err := s.Remove(first.ID); err == nil {
+		t.Error("removing a job twice succeeded")
+	}
+	if jobs, _ := s.List(); len(jobs) != 1 || jobs[0].ID != second.ID {
+		t.Fatalf("List after Remove = %+v, want only job %d", jobs, second.ID)
+	}
+
+	// IDs are not reused.
+	third, err := s.Add(document, "essay.pdf", Job{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.ID <= second.ID {
+		t.Errorf("new job got ID %d after %d", third.ID, second.ID)
+	}
+}
+
+func TestAddMissingDocument(t *testing.T) {
+	s, _ := newTestSpool(t)
+	if _, err := s.Add(filepath.Join(t.TempDir(), "missing.pdf"), "missing.pdf", Job{}); err == nil {
+		t.Fatal("Add succeeded without a document")
+	}
+	if jobs, _ := s.List(); len(jobs) != 0 {
+		t.Errorf("List = %+v, want no jobs", jobs)
+	}
+	if files, _ := ioutil.ReadDir(s.GetDir()); len(files) != 0 {
+		t.Errorf("the failed Add left %s behind", files[0].Name())
+	}
+}
+
+func TestClaim(t *testing.T) {
+	s, document := newTestSpool(t)
+	job, _ := s.Add(document, "essay.pdf", Job{})
+
+	claimed, ok, err := s.Claim(job.ID)
+	if err != nil || !ok || !claimed.IsSending() {
+		t.Fatalf("Claim = %+v, %t, %v; want the job claimed", claimed, ok, err)
+	}
+	if _, ok, _ := s.Claim(job.ID); ok {
+		t.Error("a claimed job was claimed again")
+	}
+	if _, ok, _ := s.Claim(job.ID + 1); ok {
+		t.Error("a job that is not in the spool was claimed")
+	}
+
+	// A claim left behind by a gu that died runs out.
+	setSending(t, s, job.ID, time.Now().Add(-2*claimTimeout))
+	if _, ok, _ := s.Claim(job.ID); !ok {
+		t.Error("a stale claim was not taken over")
+	}
+}
+
+// setSending changes when the job was claimed, as a gu that died would
+// have left it.
+func setSending(t *testing.T, s *Spool, id int, at time.Time) {
+	t.Helper()
+	err := s.update(func(m *manifest) error {
+		m.Jobs[m.find(id)].Sending = &at
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReleaseAndUnconfirm(t *testing.T) {
+	s, document := newTestSpool(t)
+	job, _ := s.Add(document, "essay.pdf", Job{})
+
+	check := func(step string, failed bool, unconfirmed bool, attempts int, lastError string) {
+		t.Helper()
+		jobs, err := s.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := jobs[0]
+		if got.IsSending() || got.Failed != failed || got.Unconfirmed != unconfirmed || got.Attempts != attempts || got.LastError != lastError {
+			t.Errorf("after %s: job = %+v, want failed %t, unconfirmed %t, %d attempts, error %q",
+				step, got, failed, unconfirmed, attempts, lastError)
+		}
+	}
+
+	s.Claim(job.ID)
+	s.Release(job.ID, errors.New("server unavailable"), false)
+	check("a temporary failure", false, false, 1, "server unavailable")
+
+	s.Claim(job.ID)
+	s.Unconfirm(job.ID, errors.New("no answer to the upload"))
+	check("an unanswered upload", false, true, 2, "no answer to the upload")
+
+	s.Claim(job.ID)
+	s.Release(job.ID, errors.New("printer refused the job"), true)
+	check("a refusal", true, false, 3, "printer refused the job")
+
+	s.Claim(job.ID)
+	s.Unconfirm(job.ID, errors.New("no answer again"))
+	check("another unanswered upload", false, true, 4, "no answer again")
+
+	// Releasing or unconfirming a job that was removed meanwhile is fine.
+	s.Remove(job.ID)
+	if err := s.Release(job.ID, errors.New("gone"), false); err != nil {
+		t.Errorf("Release of a removed job: %v", err)
+	}
+	if err := s.Unconfirm(job.ID, errors.New("gone")); err != nil {
+		t.Errorf("Unconfirm of a removed job: %v", err)
+	}
+}
+
+func TestIsDue(t *testing.T) {
+	now := time.Now()
+	later, earlier := now.Add(time.Hour), now.Add(-time.Hour)
+	for _, test := range []struct {
+		at   *time.Time
+		want bool
+	}{
+		{nil, true},
+		{&earlier, true},
+		{&now, true},
+		{&later, false},
+	} {
+		if got := (Job{At: test.at}).IsDue(now); got != test.want {
+			t.Errorf("IsDue with At %v = %t, want %t", test.at, got, test.want)
+		}
+	}
+}
+
+func TestConcurrentAdds(t *testing.T) {
+	s, document := newTestSpool(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Add(document, "essay.pdf", Job{}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	jobs, _ := s.List()
+	ids := map[int]bool{}
+	for _, job := range jobs {
+		ids[job.ID] = true
+	}
+	if len(jobs) != 10 || len(ids) != 10 {
+		t.Errorf("spool has %d jobs with %d IDs, want 10 of each", len(jobs), len(ids))
+	}
+}
+
+func TestStaleLock(t *testing.T) {
+	s, document := newTestSpool(t)
+	lock := filepath.Join(s.GetDir(), "manifest.lock")
+	if err := ioutil.WriteFile(lock, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * lockStale)
+	os.Chtimes(lock, old, old)
+
+	if _, err := s.Add(document, "essay.pdf", Job{}); err != nil {
+		t.Fatalf("Add with a stale lock: %v", err)
+	}
+	if _, err := os.Stat(lock); !os.IsNotExist(err) {
+		t.Errorf("the lock was not released: %v", err)
+	}
+}
+
+func TestBrokenManifest(t *testing.T) {
+	s, _ := newTestSpool(t)
+	if err := ioutil.WriteFile(filepath.Join(s.GetDir(), manifestFile), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.List(); err == nil {
+		t.Error("List succeeded with a broken manifest")
+	}
+
+	data, _ := json.Marshal(manifest{NextID: 7})
+	ioutil.WriteFile(filepath.Join(s.GetDir(), manifestFile), data, 0600)
+	if jobs, err := s.List(); err != nil || len(jobs) != 0 {
+		t.Errorf("List = %+v, %v; want no jobs", jobs, err)
+	}
+}
@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// PaperCutTransaction is an entry in the account's transaction history.
+type PaperCutTransaction struct {
+	date    string
+	amount  float64
+	balance float64
+	kind    string
+	comment string
+}
+
+func (t PaperCutTransaction) GetDate() string {
+	return t.date
+}
+
+// GetAmount returns the change to the balance, negative for charges.
+func (t PaperCutTransaction) GetAmount() float64 {
+	return t.amount
+}
+
+// GetBalance returns the balance after the transaction.
+func (t PaperCutTransaction) GetBalance() float64 {
+	return t.balance
+}
+
+// GetType returns the kind of transaction, such as "Print" or "Refund".
+func (t PaperCutTransaction) GetType() string {
+	return t.kind
+}
+
+func (t PaperCutTransaction) GetComment() string {
+	return t.comment
+}
+
+/*
+GetPaperCutBalance fetches the current account balance from the summary
+page, unlike the balance in the credentials, which is read once at login.
+*/
+func GetPaperCutBalance(ctx context.Context, credentials *PaperCutCredentials) (float64, error) {
+	doc, err := getAppPage(ctx, credentials, "page/UserSummary", "fetching the balance")
+	if err != nil {
+		return 0, err
+	}
+
+	balance, ok := parseBalance(doc)
+	if !ok {
+		return 0, errors.New("the summary page shows no balance")
+	}
+	return balance, nil
+}
+
+// GetPaperCutTransactions fetches the account's recent transactions, newest first.
+func GetPaperCutTransactions(ctx context.Context, credentials *PaperCutCredentials) ([]PaperCutTransaction, error) {
+	doc, err := getAppPage(ctx, credentials, "page/UserTransactions", "fetching the transactions")
+	if err != nil {
+		return nil, err
+	}
+
+	return getTransactionList(doc), nil
+}
+
+/*
+Logout ends the PaperCut session of credentials by following the log out
+link of the user pages, so that the session ID is of no further use.
+*/
+func Logout(ctx context.Context, credentials *PaperCutCredentials) error {
+	logoutURL := baseURL(ctx) + "/app?service=direct/1/UserSummary/$UserBorder.logoutLink"
+
+	resp, err := Retry.do(ctx, "logging out", func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", logoutURL, nil)
+		if err == nil {
+			addGetHeaders(req, credentials.sessionID)
+		}
+		return req, err
+	})
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	return nil
+}
+
+/*
+getAppPage fetches the PaperCut page of service. Returns ErrSessionExpired
+if PaperCut answers with the login page instead.
+*/
+func getAppPage(ctx context.Context, credentials *PaperCutCredentials, service string, step string) (*goquery.Document, error) {
+	pageURL := baseURL(ctx) + "/app?service=" + service
+
+	resp, err := Retry.do(ctx, step, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", pageURL, nil)
+		if err == nil {
+			addGetHeaders(req, credentials.sessionID)
+		}
+		return req, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	doc, err := goquery.NewDocumentFromResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	if isLoginPage(doc) {
+		return nil, ErrSessionExpired
+	}
+
+	return doc, nil
+}
+
+func getTransactionList(doc *goquery.Document) []PaperCutTransaction {
+	var transactions []PaperCutTransaction
+
+	doc.Find("table.results .odd, table.results .even").Each(func(i int, s *goquery.Selection) {
+		cell := func(classes ...string) string {
+			for _, class := range classes {
+				if td := s.Find("td." + class); td.Length() > 0 {
+					return strings.TrimSpace(strings.Replace(td.Text(), "\n", "", -1))
+				}
+			}
+			return ""
+		}
+
+		amount, _ := parseMoney(cell("amountColumnValue"))
+		balance, _ := parseMoney(cell("balanceColumnValue"))
+
+		transactions = append(transactions, PaperCutTransaction{
+			date:    cell("transactionDateColumnValue", "dateColumnValue"),
+			amount:  amount,
+			balance: balance,
+			kind:    cell("transactionTypeColumnValue", "typeColumnValue"),
+			comment: cell("commentColumnValue"),
+		})
+	})
+
+	return transactions
+}
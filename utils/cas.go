@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+/*
+CASAuthenticator logs in to a PaperCut server that sends users to a CAS
+identity provider. It opens LoginPath on the PaperCut server, follows the
+redirects to the CAS login form, submits it and follows the redirects back
+with the service ticket until PaperCut has set up the session.
+*/
+type CASAuthenticator struct {
+	// LoginPath is the PaperCut page that redirects to CAS, "/user" when
+	// empty.
+	LoginPath string
+	// UsernameField and PasswordField name the inputs of the CAS login
+	// form. When empty, a field called "username" or the first text input
+	// and the first password input are used.
+	UsernameField string
+	PasswordField string
+}
+
+// Authenticate runs the CAS login flow.
+func (c CASAuthenticator) Authenticate(ctx context.Context, username string, password string) (string, *goquery.Document, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return "", nil, err
+	}
+	netClient := newClient(ctx)
+	netClient.Jar = jar
+
+	loginPath := c.LoginPath
+	if loginPath == "" {
+		loginPath = "/user"
+	}
+
+	resp, err := Retry.doWith(ctx, netClient, "opening the single sign-on page", func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", baseURL(ctx)+loginPath, nil)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	loginPage, err := goquery.NewDocumentFromResponse(resp)
+	resp.Body.Close()
+	if err != nil {
+		return "", nil, err
+	}
+
+	loginURL := resp.Request.URL
+	form, action, err := c.loginForm(loginPage, loginURL, username, password)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// CAS login forms carry a one-time execution token, so the form is
+	// never sent twice.
+	resp, err = sendOnce.doWith(ctx, netClient, "logging in with single sign-on", func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", action, bytes.NewBufferString(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("Referer", loginURL.String())
+		}
+		return req, err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	defer resp.Body.Close()
+
+	doc, err := goquery.NewDocumentFromResponse(resp)
+	if err != nil {
+		return "", nil, err
+	}
+
+	base, err := url.Parse(baseURL(ctx) + "/")
+	if err != nil {
+		return "", nil, err
+	}
+
+	return getCookieByName(jar.Cookies(base), "JSESSIONID"), doc, nil
+}
+
+/*
+loginForm fills in the CAS login form on page, keeping its hidden fields,
+and returns it with the absolute URL it is posted to.
+*/
+func (c CASAuthenticator) loginForm(page *goquery.Document, pageURL *url.URL, username string, password string) (url.Values, string, error) {
+	formSel := page.Find("form").FilterFunction(func(i int, s *goquery.Selection) bool {
+		return s.Find("input[type=password]").Length() > 0
+	}).First()
+	if formSel.Length() == 0 {
+		return nil, "", errors.New("no login form found at " + redactURL(pageURL))
+	}
+
+	form := url.Values{}
+	usernameField, passwordField := c.UsernameField, c.PasswordField
+
+	formSel.Find("input").Each(func(i int, s *goquery.Selection) {
+		name, ok := s.Attr("name")
+		if !ok || name == "" {
+			return
+		}
+		inputType := strings.ToLower(s.AttrOr("type", "text"))
+
+		switch inputType {
+		case "password":
+			if passwordField == "" {
+				passwordField = name
+			}
+		case "text", "email":
+			if usernameField == "" && (name == "username" || formSel.Find("input[name=username]").Length() == 0) {
+				usernameField = name
+			}
+		case "checkbox", "radio":
+			if _, checked := s.Attr("checked"); !checked {
+				return
+			}
+			form.Add(name, s.AttrOr("value", "on"))
+			return
+		case "submit", "button", "image", "reset":
+			return
+		}
+		form.Set(name, s.AttrOr("value", ""))
+	})
+
+	if usernameField == "" || passwordField == "" {
+		return nil, "", errors.New("the login form at " + redactURL(pageURL) + " has no username or password field")
+	}
+	form.Set(usernameField, username)
+	form.Set(passwordField, password)
+
+	// Some CAS servers need the name of the pressed submit button.
+	formSel.Find("input[type=submit], button[type=submit]").First().Each(func(i int, s *goquery.Selection) {
+		if name, ok := s.Attr("name"); ok && name != "" && form.Get(name) == "" {
+			form.Set(name, s.AttrOr("value", ""))
+		}
+	})
+
+	action, err := pageURL.Parse(formSel.AttrOr("action", ""))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return form, action.String(), nil
+}
@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/quantamhd/gu/papercuttest"
+)
+
+// newCASTestServer starts a fake PaperCut server that sends logins to a
+// fake CAS server, and returns a context that logs in through CAS. cas
+// serves CAS requests, so that tests can change its pages; nil serves the
+// fake CAS server as it is. Every request is added to requests.
+func newCASTestServer(t *testing.T, cas func(c *papercuttest.CASServer) http.Handler) (context.Context, *[]*http.Request) {
+	t.Helper()
+	srv, _ := newTestServer(t)
+	casServer := papercuttest.NewCASServer()
+	t.Cleanup(casServer.Close)
+
+	casURL := casServer.URL
+	if cas != nil {
+		wrapped := httptest.NewServer(cas(casServer))
+		t.Cleanup(wrapped.Close)
+		casURL = wrapped.URL
+	}
+	srv.UseCAS(casURL + "/cas")
+
+	var mu sync.Mutex
+	requests := []*http.Request{}
+	transport := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+		return http.DefaultTransport.RoundTrip(req)
+	})
+
+	return WithServer(context.Background(), Server{URL: srv.URL, Transport: transport, Auth: CASAuthenticator{}}), &requests
+}
+
+func TestCASLogin(t *testing.T) {
+	ctx, requests := newCASTestServer(t, nil)
+
+	credentials, err := CreatePaperCutCredentials(ctx, "student", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !credentials.IsLoggedIn() || credentials.GetSessionID() == "" {
+		t.Fatalf("not logged in, session %q", credentials.GetSessionID())
+	}
+
+	ticket := false
+	for _, req := range *requests {
+		if req.URL.Path == "/app" && strings.HasPrefix(req.URL.Query().Get("ticket"), "ST-") {
+			ticket = true
+		}
+	}
+	if !ticket {
+		t.Error("PaperCut was never shown a service ticket")
+	}
+
+	// The session works for the rest of the wizard.
+	printer := testPrinter(t, ctx, credentials, "library-bw")
+	if _, err := SubmitPrintJob(ctx, credentials, printer, 1, writeDocument(t, "essay.pdf")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCASBadPassword(t *testing.T) {
+	ctx, requests := newCASTestServer(t, nil)
+
+	credentials, err := CreatePaperCutCredentials(ctx, "student", "wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credentials.IsLoggedIn() {
+		t.Fatal("logged in with the wrong password")
+	}
+
+	posts := 0
+	for _, req := range *requests {
+		if req.Method == "POST" {
+			posts++
+		}
+	}
+	if posts != 1 {
+		t.Errorf("the CAS form was posted %d times, want once", posts)
+	}
+}
+
+// stripExecution serves c with the execution field left out of its login
+// form.
+func stripExecution(c *papercuttest.CASServer) http.Handler {
+	execution := regexp.MustCompile(`<input type="hidden" name="execution"[^>]*>`)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, r)
+		for name, values := range rec.Header() {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(execution.ReplaceAll(rec.Body.Bytes(), nil))
+	})
+}
+
+func TestCASMissingExecution(t *testing.T) {
+	ctx, _ := newCASTestServer(t, stripExecution)
+
+	credentials, err := CreatePaperCutCredentials(ctx, "student", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credentials.IsLoggedIn() {
+		t.Fatal("logged in without the execution token")
+	}
+}
+
+func TestCASNoLoginForm(t *testing.T) {
+	ctx, _ := newCASTestServer(t, func(c *papercuttest.CASServer) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`<html><body>Down for maintenance</body></html>`))
+		})
+	})
+
+	_, err := CreatePaperCutCredentials(ctx, "student", "password")
+	if err == nil || !strings.Contains(err.Error(), "no login form") {
+		t.Fatalf("err = %v, want no login form", err)
+	}
+}
@@ -0,0 +1,318 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// anonymousUser replaces the recorded account name in cassettes.
+const anonymousUser = "student"
+
+// usernameFields are the login form fields of PaperCut and of CAS that carry
+// the account name.
+var usernameFields = map[string]bool{
+	"inputUsername": true,
+	"username":      true,
+}
+
+/*
+Cassette is a recorded PaperCut session. Interactions keep only the path and
+query of each URL, so a cassette replays against any BaseURL.
+*/
+type Cassette struct {
+	Recorded     time.Time     `json:"recorded"`
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Interaction is one recorded request and its response.
+type Interaction struct {
+	Request  CassetteRequest  `json:"request"`
+	Response CassetteResponse `json:"response"`
+}
+
+// CassetteRequest is the sanitised part of a request needed to match it.
+type CassetteRequest struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Service string            `json:"service,omitempty"`
+	Form    map[string]string `json:"form,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+// CassetteResponse is a sanitised response.
+type CassetteResponse struct {
+	Status  int         `json:"status"`
+	Headers http.Header `json:"headers"`
+	Body    string      `json:"body"`
+}
+
+/*
+CassetteRecorder saves every exchange with PaperCut to Path as a cassette.
+Passwords, cookies and session IDs are redacted, the account name and email
+addresses are anonymised and uploaded documents are replaced by a summary.
+The file is rewritten after each exchange.
+*/
+type CassetteRecorder struct {
+	Next http.RoundTripper
+	Path string
+
+	mu       sync.Mutex
+	cassette Cassette
+	names    []string
+}
+
+/*
+CassetteReplayer serves recorded responses in place of a PaperCut server.
+Each request is answered by the first interaction not yet used with the same
+method, path and Tapestry service.
+*/
+type CassetteReplayer struct {
+	cassette Cassette
+
+	mu   sync.Mutex
+	used []bool
+}
+
+var emailRe = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+
+// LoadCassette reads a cassette written by CassetteRecorder.
+func LoadCassette(path string) (*Cassette, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cassette Cassette
+	if err := json.Unmarshal(data, &cassette); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return &cassette, nil
+}
+
+// NewCassetteReplayer returns a transport replaying cassette.
+func NewCassetteReplayer(cassette *Cassette) *CassetteReplayer {
+	return &CassetteReplayer{
+		cassette: *cassette,
+		used:     make([]bool, len(cassette.Interactions)),
+	}
+}
+
+// RoundTrip answers req from the cassette.
+func (c *CassetteReplayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	recorded := sanitiseRequest(req, nil)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, interaction := range c.cassette.Interactions {
+		if c.used[i] || !interaction.Request.matches(recorded) {
+			continue
+		}
+		c.used[i] = true
+
+		body := interaction.Response.Body
+		resp := &http.Response{
+			Status:        fmt.Sprintf("%d %s", interaction.Response.Status, http.StatusText(interaction.Response.Status)),
+			StatusCode:    interaction.Response.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{},
+			Body:          ioutil.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}
+		for name, values := range interaction.Response.Headers {
+			resp.Header[name] = append([]string(nil), values...)
+		}
+		return resp, nil
+	}
+
+	return nil, errors.New("cassette has no recorded response for " + recorded.Method + " " + recorded.URL + " " + recorded.Service)
+}
+
+// Unused returns the interactions that were never replayed.
+func (c *CassetteReplayer) Unused() []Interaction {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var unused []Interaction
+	for i, interaction := range c.cassette.Interactions {
+		if !c.used[i] {
+			unused = append(unused, interaction)
+		}
+	}
+	return unused
+}
+
+func (r CassetteRequest) matches(other CassetteRequest) bool {
+	return r.Method == other.Method && r.URL == other.URL && r.Service == other.Service
+}
+
+// RoundTrip forwards req and records the sanitised exchange.
+func (c *CassetteRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.learnNames(req)
+
+	resp, err := c.Next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	body, readErr := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cassette.Interactions = append(c.cassette.Interactions, Interaction{
+		Request:  sanitiseRequest(req, c.names),
+		Response: c.sanitiseResponse(resp, body),
+	})
+	if err := c.save(); err != nil {
+		fmt.Printf("Could not write cassette %s: %v\n", c.Path, err)
+	}
+
+	return resp, readErr
+}
+
+// learnNames remembers the account name from a login form so that it can
+// be scrubbed from every page recorded afterwards.
+func (c *CassetteRecorder) learnNames(req *http.Request) {
+	form := requestForm(req)
+	if form == nil {
+		return
+	}
+
+	var username string
+	for field := range usernameFields {
+		if v := form.Get(field); v != "" {
+			username = v
+		}
+	}
+	if username == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, name := range c.names {
+		if name == username {
+			return
+		}
+	}
+	c.names = append(c.names, username)
+}
+
+func (c *CassetteRecorder) save() error {
+	if c.cassette.Recorded.IsZero() {
+		c.cassette.Recorded = time.Now().UTC().Truncate(time.Second)
+	}
+
+	data := new(bytes.Buffer)
+	encoder := json.NewEncoder(data)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(c.cassette); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(c.Path, data.Bytes(), 0600)
+}
+
+func (c *CassetteRecorder) sanitiseResponse(resp *http.Response, body []byte) CassetteResponse {
+	headers := http.Header{}
+	for _, name := range []string{"Content-Type", "Location", "Set-Cookie"} {
+		for _, v := range resp.Header[name] {
+			v = sessionInBodyRe.ReplaceAllString(redactHeader(name, v), "${1}"+redacted)
+			headers.Add(name, anonymise(v, c.names))
+		}
+	}
+
+	text := fmt.Sprintf("[%d bytes of %s]", len(body), resp.Header.Get("Content-Type"))
+	if isTextual(resp.Header.Get("Content-Type")) {
+		text = anonymise(sessionInBodyRe.ReplaceAllString(string(body), "${1}"+redacted), c.names)
+	}
+
+	return CassetteResponse{Status: resp.StatusCode, Headers: headers, Body: text}
+}
+
+// sanitiseRequest reduces req to what is needed to match it on replay.
+// Form fields are kept with passwords redacted and names anonymised.
+func sanitiseRequest(req *http.Request, names []string) CassetteRequest {
+	u := *req.URL
+	u.Scheme, u.Host, u.User = "", "", nil
+
+	recorded := CassetteRequest{
+		Method:  req.Method,
+		URL:     anonymise(redactURL(&u), names),
+		Service: req.URL.Query().Get("service"),
+	}
+
+	if form := requestForm(req); form != nil {
+		if service := form.Get("service"); service != "" {
+			recorded.Service = service
+		}
+		recorded.Form = map[string]string{}
+		for name, values := range redactForm(form) {
+			value := strings.Join(values, ",")
+			if usernameFields[name] {
+				value = anonymousUser
+			}
+			recorded.Form[name] = anonymise(value, names)
+		}
+	} else if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			recorded.Body = formatBody(req.Header.Get("Content-Type"), body)
+			body.Close()
+		}
+	}
+
+	return recorded
+}
+
+// requestForm decodes a url-encoded request body without consuming it.
+func requestForm(req *http.Request) url.Values {
+	if req.GetBody == nil || !strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return nil
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return nil
+	}
+	defer body.Close()
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil
+	}
+
+	form, err := url.ParseQuery(string(data))
+	if err != nil {
+		return nil
+	}
+	return form
+}
+
+// anonymise replaces the given account names and any email address.
+func anonymise(text string, names []string) string {
+	for _, name := range names {
+		if len(name) < 2 {
+			continue
+		}
+		re := regexp.MustCompile(`(?i)\b` + regexp.QuoteMeta(name) + `\b`)
+		text = re.ReplaceAllString(text, anonymousUser)
+	}
+	return emailRe.ReplaceAllString(text, anonymousUser+"@example.edu")
+}
@@ -0,0 +1,285 @@
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+/*
+testdata/web-print.json was recorded with --record from gu print --wait
+against gu mock-server, printing handout.pdf on library-color while an
+earlier essay.pdf had already printed.
+*/
+const webPrintCassette = "testdata/web-print.json"
+
+// cassettePage returns the body of the nth response to service in the
+// cassette.
+func cassettePage(t *testing.T, cassette *Cassette, service string, n int) string {
+	t.Helper()
+	for _, interaction := range cassette.Interactions {
+		if interaction.Request.Service != service {
+			continue
+		}
+		if n == 0 {
+			return interaction.Response.Body
+		}
+		n--
+	}
+	t.Fatalf("the cassette has no such response to %s", service)
+	return ""
+}
+
+func loadWebPrintCassette(t *testing.T) *Cassette {
+	t.Helper()
+	cassette, err := LoadCassette(webPrintCassette)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cassette
+}
+
+func parsePage(t *testing.T, html string) *goquery.Document {
+	t.Helper()
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestReplayCassette(t *testing.T) {
+	replayer := NewCassetteReplayer(loadWebPrintCassette(t))
+	ctx := WithServer(context.Background(), Server{URL: "https://papercut.invalid:9192", Transport: replayer})
+
+	credentials, err := CreatePaperCutCredentials(ctx, "student", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !credentials.IsLoggedIn() {
+		t.Fatal("not logged in")
+	}
+	printer := testPrinter(t, ctx, credentials, "library-color")
+
+	job, err := SubmitPrintJob(ctx, credentials, printer, 2, writeDocument(t, "handout.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err = WatchPrintJob(ctx, credentials, job, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.GetDocumentName() != "handout.pdf" || job.GetStatus() != JobStatusPrinted {
+		t.Errorf("job = %v, want handout.pdf printed", job.ToListStrings())
+	}
+
+	for _, interaction := range replayer.Unused() {
+		t.Errorf("not replayed: %s %s", interaction.Request.Method, interaction.Request.URL)
+	}
+}
+
+func TestCassetteIsAnonymised(t *testing.T) {
+	data, err := ioutil.ReadFile(webPrintCassette)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"jdoe", "password\"", "JSESSIONID=node"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("the cassette contains %q", secret)
+		}
+	}
+}
+
+func TestGetPrinterList(t *testing.T) {
+	cassette := loadWebPrintCassette(t)
+
+	tests := []struct {
+		name    string
+		page    string
+		want    []PaperCutPrinter
+		wantErr error
+	}{
+		{
+			name: "recorded",
+			page: cassettePage(t, cassette, "action/1/UserWebPrint/0/$ActionLink", 0),
+			want: []PaperCutPrinter{
+				{1, "library-bw", "Foley Library, 1st floor", 0.05, true},
+				{2, "library-color", "Foley Library, 2nd floor", 0.25, true},
+			},
+		},
+		{
+			name: "without costs",
+			page: `<table class="results"><tr class="odd"><td class="printerNameColumnValue">` +
+				`<input type="radio" name="$RadioGroup" value="7"/><label>lab-3</label></td>` +
+				`<td class="locationColumnValue">Herak 3rd floor</td></tr></table>`,
+			want: []PaperCutPrinter{{7, "lab-3", "Herak 3rd floor", 0, false}},
+		},
+		{
+			name: "no printers",
+			page: `<table class="results"><tbody></tbody></table>`,
+		},
+		{
+			name:    "logged out",
+			page:    cassettePage(t, cassette, "", 0),
+			wantErr: ErrSessionExpired,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			printers, err := getPrinterList(&http.Response{
+				Body:    ioutil.NopCloser(strings.NewReader(test.page)),
+				Request: httptest.NewRequest("GET", "/app", nil),
+			})
+			if err != test.wantErr {
+				t.Fatalf("err = %v, want %v", err, test.wantErr)
+			}
+			if len(printers) != len(test.want) {
+				t.Fatalf("got %d printers, want %d: %v", len(printers), len(test.want), printers)
+			}
+			for _, want := range test.want {
+				if got := printers[want.GetID()]; got != want {
+					t.Errorf("printer %d = %+v, want %+v", want.GetID(), got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGetJobList(t *testing.T) {
+	cassette := loadWebPrintCassette(t)
+	row := func(submitted string, document string, status string) string {
+		return `<tr class="odd"><td class="dateColumnValue">` + submitted + `</td>` +
+			`<td class="printerColumnValue">library-bw</td>` +
+			`<td class="documentNameColumnValue">` + document + `</td>` +
+			`<td class="pagesColumnValue">3</td><td class="costColumnValue">$0.15</td>` +
+			`<td class="statusColumnValue">` + status + `</td></tr>`
+	}
+
+	tests := []struct {
+		name string
+		page string
+		want [][]string
+	}{
+		{
+			name: "recorded while rendering",
+			page: cassettePage(t, cassette, "page/UserWebPrint", 1),
+			want: [][]string{
+				{"Oct 19, 2026 3:34:58 PM", "library-color", "handout.pdf", "2", "Rendering"},
+				{"Oct 19, 2026 3:34:54 PM", "library-bw", "essay.pdf", "1", "Printed"},
+			},
+		},
+		{
+			name: "recorded once printed",
+			page: cassettePage(t, cassette, "page/UserWebPrint", 3),
+			want: [][]string{
+				{"Oct 19, 2026 3:34:58 PM", "library-color", "handout.pdf", "2", "Printed"},
+				{"Oct 19, 2026 3:34:54 PM", "library-bw", "essay.pdf", "1", "Printed"},
+			},
+		},
+		{
+			name: "empty",
+			page: `<table class="results"><tbody></tbody></table>`,
+		},
+		{
+			name: "same document twice in a second",
+			page: `<table class="results">` + row("Oct 1, 2026 9:00:00 AM", "a.pdf", "Held in a queue") +
+				row("Oct 1, 2026 9:00:00 AM", "a.pdf", "Printed") + `</table>`,
+			want: [][]string{
+				{"Oct 1, 2026 9:00:00 AM", "library-bw", "a.pdf", "3", "Held in a queue"},
+				{"Oct 1, 2026 9:00:00 AM", "library-bw", "a.pdf", "3", "Printed"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			jobs := getJobList(parsePage(t, test.page))
+			if len(jobs) != len(test.want) {
+				t.Fatalf("got %d jobs, want %d", len(jobs), len(test.want))
+			}
+			ids := map[string]bool{}
+			for i, want := range test.want {
+				got := jobs[i].ToListStrings()
+				if strings.Join(got[1:], "|") != strings.Join(want, "|") {
+					t.Errorf("job %d = %v, want %v", i, got[1:], want)
+				}
+				if got[0] == "" || ids[got[0]] {
+					t.Errorf("job %d has ID %q, which is empty or taken", i, got[0])
+				}
+				ids[got[0]] = true
+			}
+		})
+	}
+}
+
+func TestJobIDsFollowJobs(t *testing.T) {
+	cassette := loadWebPrintCassette(t)
+
+	// essay.pdf is the only job in the first list, and the second of two
+	// in the last; handout.pdf loses its cancel link as it prints.
+	first := getJobList(parsePage(t, cassettePage(t, cassette, "page/UserWebPrint", 0)))
+	rendering := getJobList(parsePage(t, cassettePage(t, cassette, "page/UserWebPrint", 1)))
+	printed := getJobList(parsePage(t, cassettePage(t, cassette, "page/UserWebPrint", 3)))
+
+	if first[0].GetJobID() != printed[1].GetJobID() {
+		t.Errorf("essay.pdf was job %s, then %s", first[0].GetJobID(), printed[1].GetJobID())
+	}
+	if rendering[0].GetJobID() != printed[0].GetJobID() {
+		t.Errorf("handout.pdf was job %s, then %s", rendering[0].GetJobID(), printed[0].GetJobID())
+	}
+}
+
+func TestIsLoggedIn(t *testing.T) {
+	cassette := loadWebPrintCassette(t)
+
+	tests := []struct {
+		name string
+		page string
+		want bool
+	}{
+		{"summary", cassettePage(t, cassette, "direct/1/Home/$Form$0", 0), true},
+		{"login form", cassettePage(t, cassette, "", 0), false},
+		{"web print", cassettePage(t, cassette, "page/UserWebPrint", 0), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isLoggedIn(parsePage(t, test.page)); got != test.want {
+				t.Errorf("isLoggedIn = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUploadUIDRe(t *testing.T) {
+	cassette := loadWebPrintCassette(t)
+
+	tests := []struct {
+		name string
+		page string
+		want string
+	}{
+		{"recorded", cassettePage(t, cassette, "direct/1/UserWebPrintOptionsAndAccountSelection/$Form", 0), "1001"},
+		{"first of several", "var uploadUID = '12';\nvar uploadUID = '13';", "12"},
+		{"double quotes", `var uploadUID = "12";`, ""},
+		{"missing", `<div class="errorMessage">Invalid number of copies.</div>`, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := ""
+			if m := uploadUIDRe.FindStringSubmatch(test.page); m != nil {
+				got = m[1]
+			}
+			if got != test.want {
+				t.Errorf("upload ID = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,553 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// maxConversionSteps bounds how many converters may be chained for a single
+// document, so that a misconfigured pair of converters cannot loop forever.
+const maxConversionSteps = 5
+
+// Converter turns a document of one MIME type into another. CanConvert
+// reports whether the converter accepts documents of the given type and
+// Convert returns the converted document along with its new MIME type.
+type Converter interface {
+	CanConvert(mimeType string) bool
+	Convert(ctx context.Context, in io.Reader) (io.Reader, string, error)
+}
+
+// ConverterRegistry holds the converters consulted, in registration order,
+// when a document is not natively accepted by PaperCut.
+type ConverterRegistry struct {
+	converters []Converter
+}
+
+// ExternalConverterConfig describes a converter backed by an external
+// command, as read from the "converters" list in ~/.gu.yaml.
+//
+// The command may reference {input}, {output} and {outdir}. Without {input}
+// the document is written to the command's stdin; without {output} or
+// {outdir} the converted document is read from its stdout.
+type ExternalConverterConfig struct {
+	Name     string   `mapstructure:"name"`
+	From     []string `mapstructure:"from"`
+	To       string   `mapstructure:"to"`
+	Command  string   `mapstructure:"command"`
+	InputExt string   `mapstructure:"input_ext"`
+}
+
+// ExternalConverter runs an external program such as pandoc or
+// libreoffice --headless to convert documents.
+type ExternalConverter struct {
+	config ExternalConverterConfig
+}
+
+// MarkdownConverter typesets Markdown into PDF. Relative image paths are
+// resolved against BaseDir.
+type MarkdownConverter struct {
+	BaseDir string
+}
+
+// acceptedTypes maps the file extensions PaperCut web print accepts to their
+// MIME types.
+var acceptedTypes = map[string]string{
+	".pdf": "application/pdf",
+	".xps": "application/vnd.ms-xpsdocument",
+
+	".bmp":  "image/bmp",
+	".dib":  "image/bmp",
+	".gif":  "image/gif",
+	".jfif": "image/jpeg",
+	".jif":  "image/jpeg",
+	".jpe":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".jpg":  "image/jpeg",
+	".png":  "image/png",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+
+	".doc":  "application/msword",
+	".dot":  "application/msword",
+	".docm": "application/vnd.ms-word.document.macroenabled.12",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".dotm": "application/vnd.ms-word.template.macroenabled.12",
+	".dotx": "application/vnd.openxmlformats-officedocument.wordprocessingml.template",
+	".rtf":  "application/rtf",
+
+	".xls":  "application/vnd.ms-excel",
+	".xlam": "application/vnd.ms-excel.addin.macroenabled.12",
+	".xlsb": "application/vnd.ms-excel.sheet.binary.macroenabled.12",
+	".xlsm": "application/vnd.ms-excel.sheet.macroenabled.12",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".xltm": "application/vnd.ms-excel.template.macroenabled.12",
+	".xltx": "application/vnd.openxmlformats-officedocument.spreadsheetml.template",
+
+	".ppt":  "application/vnd.ms-powerpoint",
+	".pot":  "application/vnd.ms-powerpoint",
+	".pps":  "application/vnd.ms-powerpoint",
+	".potm": "application/vnd.ms-powerpoint.template.macroenabled.12",
+	".potx": "application/vnd.openxmlformats-officedocument.presentationml.template",
+	".ppam": "application/vnd.ms-powerpoint.addin.macroenabled.12",
+	".ppsm": "application/vnd.ms-powerpoint.slideshow.macroenabled.12",
+	".ppsx": "application/vnd.openxmlformats-officedocument.presentationml.slideshow",
+	".pptm": "application/vnd.ms-powerpoint.presentation.macroenabled.12",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+}
+
+// extraTypes covers common document types that mime.TypeByExtension does
+// not know on every platform.
+var extraTypes = map[string]string{
+	".md":       "text/markdown",
+	".markdown": "text/markdown",
+	".mdown":    "text/markdown",
+	".mkd":      "text/markdown",
+	".rst":      "text/x-rst",
+	".odt":      "application/vnd.oasis.opendocument.text",
+	".ods":      "application/vnd.oasis.opendocument.spreadsheet",
+	".odp":      "application/vnd.oasis.opendocument.presentation",
+	".html":     "text/html",
+	".htm":      "text/html",
+	".txt":      "text/plain",
+}
+
+// IsAcceptedType reports whether PaperCut web print accepts documents of the
+// given MIME type without conversion.
+func IsAcceptedType(mimeType string) bool {
+	mimeType = baseMIMEType(mimeType)
+	for _, t := range acceptedTypes {
+		if t == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+DetectType returns the MIME type of the file at path, judged first by its
+extension and then by sniffing its contents.
+*/
+func DetectType(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if t, ok := acceptedTypes[ext]; ok {
+		return t
+	}
+	if t, ok := extraTypes[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return baseMIMEType(t)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	return baseMIMEType(http.DetectContentType(head[:n]))
+}
+
+/*
+typeExtensions gives the extension of documents of each MIME type in
+acceptedTypes and extraTypes, in a fixed order so that a type always gets
+the same one.
+*/
+var typeExtensions = []struct {
+	mimeType string
+	ext      string
+}{
+	{"application/pdf", ".pdf"},
+	{"application/vnd.ms-xpsdocument", ".xps"},
+
+	{"image/bmp", ".bmp"},
+	{"image/gif", ".gif"},
+	{"image/jpeg", ".jpg"},
+	{"image/png", ".png"},
+	{"image/tiff", ".tiff"},
+
+	{"application/msword", ".doc"},
+	{"application/vnd.ms-word.document.macroenabled.12", ".docm"},
+	{"application/vnd.openxmlformats-officedocument.wordprocessingml.document", ".docx"},
+	{"application/vnd.ms-word.template.macroenabled.12", ".dotm"},
+	{"application/vnd.openxmlformats-officedocument.wordprocessingml.template", ".dotx"},
+	{"application/rtf", ".rtf"},
+
+	{"application/vnd.ms-excel", ".xls"},
+	{"application/vnd.ms-excel.addin.macroenabled.12", ".xlam"},
+	{"application/vnd.ms-excel.sheet.binary.macroenabled.12", ".xlsb"},
+	{"application/vnd.ms-excel.sheet.macroenabled.12", ".xlsm"},
+	{"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", ".xlsx"},
+	{"application/vnd.ms-excel.template.macroenabled.12", ".xltm"},
+	{"application/vnd.openxmlformats-officedocument.spreadsheetml.template", ".xltx"},
+
+	{"application/vnd.ms-powerpoint", ".ppt"},
+	{"application/vnd.ms-powerpoint.template.macroenabled.12", ".potm"},
+	{"application/vnd.openxmlformats-officedocument.presentationml.template", ".potx"},
+	{"application/vnd.ms-powerpoint.addin.macroenabled.12", ".ppam"},
+	{"application/vnd.ms-powerpoint.slideshow.macroenabled.12", ".ppsm"},
+	{"application/vnd.openxmlformats-officedocument.presentationml.slideshow", ".ppsx"},
+	{"application/vnd.ms-powerpoint.presentation.macroenabled.12", ".pptm"},
+	{"application/vnd.openxmlformats-officedocument.presentationml.presentation", ".pptx"},
+
+	{"text/markdown", ".md"},
+	{"text/x-rst", ".rst"},
+	{"application/vnd.oasis.opendocument.text", ".odt"},
+	{"application/vnd.oasis.opendocument.spreadsheet", ".ods"},
+	{"application/vnd.oasis.opendocument.presentation", ".odp"},
+	{"text/html", ".html"},
+	{"text/plain", ".txt"},
+}
+
+// extensionForType picks a file extension for documents of mimeType.
+func extensionForType(mimeType string) string {
+	mimeType = baseMIMEType(mimeType)
+	for _, t := range typeExtensions {
+		if t.mimeType == mimeType {
+			return t.ext
+		}
+	}
+	if exts, _ := mime.ExtensionsByType(mimeType); len(exts) > 0 {
+		return exts[0]
+	}
+	return ".bin"
+}
+
+/*
+SaveDocument copies a document handed over by another program, such as a
+print server, into a new temporary directory and returns its path. The file
+is named after name so that it can be told apart in the PaperCut job list,
+with an extension matching its contents so that PaperCut accepts it.
+*/
+func SaveDocument(r io.Reader, name string) (string, error) {
+	in := bufio.NewReader(r)
+	head, _ := in.Peek(512)
+	sniffed := baseMIMEType(http.DetectContentType(head))
+
+	base := filepath.Base(name)
+	ext := strings.ToLower(filepath.Ext(base))
+	_, accepted := acceptedTypes[ext]
+	_, extra := extraTypes[ext]
+	if accepted || extra {
+		base = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	if IsAcceptedType(sniffed) || (!accepted && !extra) {
+		// Print systems often keep the original title after converting the
+		// document to PDF, so the contents win over the name. Types gu can
+		// convert keep their extension, which sniffing cannot tell apart
+		// from plain text.
+		ext = extensionForType(sniffed)
+	}
+
+	base = strings.TrimSpace(unsafeFileChars.ReplaceAllString(base, "_"))
+	if len(base) > 100 {
+		base = base[:100]
+	}
+	if base == "" || base == "." {
+		base = "document"
+	}
+
+	dir, err := ioutil.TempDir("", "gu-document")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, base+ext)
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, in); err != nil {
+		return "", err
+	}
+
+	return path, file.Close()
+}
+
+// unsafeFileChars are left out of the names of saved documents.
+var unsafeFileChars = regexp.MustCompile(`[^\w .,()+-]+`)
+
+func baseMIMEType(mimeType string) string {
+	if i := strings.Index(mimeType, ";"); i >= 0 {
+		mimeType = mimeType[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(mimeType))
+}
+
+// NewConverterRegistry returns an empty registry.
+func NewConverterRegistry() *ConverterRegistry {
+	return &ConverterRegistry{}
+}
+
+// Register adds c to the registry. Earlier registrations take precedence.
+func (r *ConverterRegistry) Register(c Converter) {
+	r.converters = append(r.converters, c)
+}
+
+/*
+ConvertToAccepted chains converters until the document is of a type PaperCut
+accepts. Returns the converted document and its MIME type.
+*/
+func (r *ConverterRegistry) ConvertToAccepted(ctx context.Context, in io.Reader, mimeType string) (io.Reader, string, error) {
+	used := make([]bool, len(r.converters))
+
+	for step := 0; !IsAcceptedType(mimeType); step++ {
+		if step == maxConversionSteps {
+			return nil, "", fmt.Errorf("no conversion to a printable type after %d steps", step)
+		}
+
+		i := r.find(mimeType, used)
+		if i < 0 {
+			return nil, "", fmt.Errorf("no converter registered for %s", mimeType)
+		}
+		used[i] = true
+
+		out, outType, err := r.converters[i].Convert(ctx, in)
+		if err != nil {
+			return nil, "", err
+		}
+		in, mimeType = out, baseMIMEType(outType)
+	}
+
+	return in, mimeType, nil
+}
+
+// find returns the index of the first unused converter for mimeType, or -1.
+func (r *ConverterRegistry) find(mimeType string, used []bool) int {
+	for i, c := range r.converters {
+		if !used[i] && c.CanConvert(mimeType) {
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+ConvertFile makes sure the document at path is printable. Accepted documents
+are returned untouched; anything else is converted into a file with the same
+base name inside a new temporary directory, whose path is returned.
+*/
+func (r *ConverterRegistry) ConvertFile(ctx context.Context, path string) (string, error) {
+	mimeType := DetectType(path)
+	if IsAcceptedType(mimeType) {
+		return path, nil
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	out, outType, err := r.ConvertToAccepted(ctx, in, mimeType)
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := ioutil.TempDir("", "gu-convert")
+	if err != nil {
+		return "", err
+	}
+
+	base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	outPath := filepath.Join(dir, base+extensionForType(outType))
+
+	file, err := os.Create(outPath)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	_, err = io.Copy(file, out)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	return outPath, nil
+}
+
+// CanConvert accepts Markdown documents.
+func (m MarkdownConverter) CanConvert(mimeType string) bool {
+	switch baseMIMEType(mimeType) {
+	case "text/markdown", "text/x-markdown":
+		return true
+	}
+	return false
+}
+
+// Convert typesets the Markdown document into a PDF.
+func (m MarkdownConverter) Convert(ctx context.Context, in io.Reader) (io.Reader, string, error) {
+	source, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, "", err
+	}
+
+	out := new(bytes.Buffer)
+	if err := MarkdownToPDF(source, m.BaseDir, out); err != nil {
+		return nil, "", err
+	}
+
+	return out, "application/pdf", nil
+}
+
+// NewExternalConverter validates config and returns a converter for it.
+func NewExternalConverter(config ExternalConverterConfig) (*ExternalConverter, error) {
+	if len(config.From) == 0 || config.To == "" || config.Command == "" {
+		return nil, errors.New("converter " + config.Name + " needs from, to and command")
+	}
+	if len(splitCommandLine(config.Command)) == 0 {
+		return nil, errors.New("converter " + config.Name + " has an empty command")
+	}
+	return &ExternalConverter{config}, nil
+}
+
+// CanConvert reports whether mimeType is one of the configured source types.
+func (c *ExternalConverter) CanConvert(mimeType string) bool {
+	mimeType = baseMIMEType(mimeType)
+	for _, from := range c.config.From {
+		if baseMIMEType(from) == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
+// Convert runs the configured command on the document.
+func (c *ExternalConverter) Convert(ctx context.Context, in io.Reader) (io.Reader, string, error) {
+	dir, err := ioutil.TempDir("", "gu-converter")
+	if err != nil {
+		return nil, "", err
+	}
+	defer os.RemoveAll(dir)
+
+	inputExt := c.config.InputExt
+	if inputExt == "" {
+		inputExt = extensionForType(c.config.From[0])
+	}
+
+	inputPath := filepath.Join(dir, "input"+inputExt)
+	outDir := filepath.Join(dir, "out")
+	outputPath := filepath.Join(outDir, "output"+extensionForType(c.config.To))
+	if err := os.Mkdir(outDir, 0700); err != nil {
+		return nil, "", err
+	}
+
+	usesInput, usesOutput := false, false
+	args := splitCommandLine(c.config.Command)
+	for i, arg := range args {
+		if strings.Contains(arg, "{input}") {
+			usesInput = true
+		}
+		if strings.Contains(arg, "{output}") || strings.Contains(arg, "{outdir}") {
+			usesOutput = true
+		}
+		arg = strings.Replace(arg, "{input}", inputPath, -1)
+		arg = strings.Replace(arg, "{output}", outputPath, -1)
+		args[i] = strings.Replace(arg, "{outdir}", outDir, -1)
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	if usesInput {
+		contents, err := ioutil.ReadAll(in)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := ioutil.WriteFile(inputPath, contents, 0600); err != nil {
+			return nil, "", err
+		}
+	} else {
+		cmd.Stdin = in
+	}
+
+	if err := cmd.Run(); err != nil {
+		return nil, "", fmt.Errorf("converter %s: %v: %s", c.name(), err, strings.TrimSpace(stderr.String()))
+	}
+
+	if !usesOutput {
+		return stdout, c.config.To, nil
+	}
+
+	// Tools such as libreoffice choose their own output name inside
+	// {outdir}, so take whatever single file was produced.
+	files, err := ioutil.ReadDir(outDir)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(files) != 1 {
+		return nil, "", fmt.Errorf("converter %s produced %d files, expected 1", c.name(), len(files))
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(outDir, files[0].Name()))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return bytes.NewReader(contents), c.config.To, nil
+}
+
+func (c *ExternalConverter) name() string {
+	if c.config.Name != "" {
+		return c.config.Name
+	}
+	return splitCommandLine(c.config.Command)[0]
+}
+
+// splitCommandLine splits a command into arguments on whitespace, keeping
+// single or double quoted sections together.
+func splitCommandLine(command string) []string {
+	var args []string
+	var current strings.Builder
+	var quote rune
+	inArg := false
+
+	for _, ch := range command {
+		switch {
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			} else {
+				current.WriteRune(ch)
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+			inArg = true
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(ch)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+
+	return args
+}
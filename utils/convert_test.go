@@ -0,0 +1,308 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExtensionForType(t *testing.T) {
+	tests := []struct {
+		mimeType string
+		want     string
+	}{
+		{"application/pdf", ".pdf"},
+		{"application/pdf; charset=binary", ".pdf"},
+		{"image/jpeg", ".jpg"},
+		{"image/tiff", ".tiff"},
+		{"application/msword", ".doc"},
+		{"application/vnd.ms-powerpoint", ".ppt"},
+		{"text/markdown", ".md"},
+		{"text/html", ".html"},
+		{"application/x-gu-unknown", ".bin"},
+	}
+
+	for _, test := range tests {
+		// Run each a few times, an answer that depends on map order
+		// changes between runs.
+		for i := 0; i < 10; i++ {
+			if got := extensionForType(test.mimeType); got != test.want {
+				t.Fatalf("extensionForType(%q) = %q, want %q", test.mimeType, got, test.want)
+			}
+		}
+	}
+}
+
+func TestTypeExtensionsCoverKnownTypes(t *testing.T) {
+	for _, types := range []map[string]string{acceptedTypes, extraTypes} {
+		for ext, mimeType := range types {
+			got := extensionForType(mimeType)
+			if types[got] != mimeType {
+				t.Errorf("%s documents get %s, which is not one of theirs like %s", mimeType, got, ext)
+			}
+		}
+	}
+}
+
+// fakeConverter turns documents of type from into to, appending its name
+// so that the chain can be checked.
+type fakeConverter struct {
+	name, from, to string
+	err            error
+}
+
+func (f *fakeConverter) CanConvert(mimeType string) bool {
+	return mimeType == f.from
+}
+
+func (f *fakeConverter) Convert(ctx context.Context, in io.Reader) (io.Reader, string, error) {
+	if f.err != nil {
+		return nil, "", f.err
+	}
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, "", err
+	}
+	return strings.NewReader(string(data) + " " + f.name), f.to, nil
+}
+
+func TestConvertToAccepted(t *testing.T) {
+	tests := []struct {
+		name       string
+		converters []*fakeConverter
+		mimeType   string
+		want       string
+		wantType   string
+		wantErr    string
+	}{
+		{name: "accepted", mimeType: "application/pdf", want: "doc", wantType: "application/pdf"},
+		{
+			name: "chain",
+			converters: []*fakeConverter{
+				{name: "b", from: "text/x-b", to: "application/pdf; charset=binary"},
+				{name: "a", from: "text/x-a", to: "text/x-b"},
+			},
+			mimeType: "text/x-a",
+			want:     "doc a b",
+			wantType: "application/pdf",
+		},
+		{
+			name: "first registered wins",
+			converters: []*fakeConverter{
+				{name: "first", from: "text/x-a", to: "application/pdf"},
+				{name: "second", from: "text/x-a", to: "image/png"},
+			},
+			mimeType: "text/x-a",
+			want:     "doc first",
+			wantType: "application/pdf",
+		},
+		{name: "no converter", mimeType: "text/x-a", wantErr: "no converter registered for text/x-a"},
+		{
+			name: "cycle",
+			converters: []*fakeConverter{
+				{name: "a", from: "text/x-a", to: "text/x-b"},
+				{name: "b", from: "text/x-b", to: "text/x-a"},
+			},
+			mimeType: "text/x-a",
+			wantErr:  "no converter registered for text/x-a",
+		},
+		{
+			name: "too many steps",
+			converters: []*fakeConverter{
+				{name: "0", from: "text/x-0", to: "text/x-1"},
+				{name: "1", from: "text/x-1", to: "text/x-2"},
+				{name: "2", from: "text/x-2", to: "text/x-3"},
+				{name: "3", from: "text/x-3", to: "text/x-4"},
+				{name: "4", from: "text/x-4", to: "text/x-5"},
+				{name: "5", from: "text/x-5", to: "application/pdf"},
+			},
+			mimeType: "text/x-0",
+			wantErr:  fmt.Sprintf("after %d steps", maxConversionSteps),
+		},
+		{
+			name:       "converter fails",
+			converters: []*fakeConverter{{name: "a", from: "text/x-a", to: "application/pdf", err: errors.New("broken")}},
+			mimeType:   "text/x-a",
+			wantErr:    "broken",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry := NewConverterRegistry()
+			for _, c := range test.converters {
+				registry.Register(c)
+			}
+
+			out, outType, err := registry.ConvertToAccepted(context.Background(), strings.NewReader("doc"), test.mimeType)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("err = %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := ioutil.ReadAll(out)
+			if string(data) != test.want || outType != test.wantType {
+				t.Errorf("got %q as %s, want %q as %s", data, outType, test.want, test.wantType)
+			}
+		})
+	}
+}
+
+// failingReader returns an error after the first read.
+type failingReader struct {
+	read bool
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.read {
+		return 0, errors.New("disk on fire")
+	}
+	f.read = true
+	return copy(p, "%PDF-1.4\n"), nil
+}
+
+type readerConverter struct {
+	out io.Reader
+}
+
+func (r readerConverter) CanConvert(mimeType string) bool { return true }
+
+func (r readerConverter) Convert(ctx context.Context, in io.Reader) (io.Reader, string, error) {
+	return r.out, "application/pdf", nil
+}
+
+func TestConvertFile(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	dir := t.TempDir()
+	pdf := filepath.Join(dir, "essay.pdf")
+	notes := filepath.Join(dir, "notes.md")
+	ioutil.WriteFile(pdf, []byte(testPDF), 0644)
+	ioutil.WriteFile(notes, []byte("# Notes\n"), 0644)
+
+	registry := NewConverterRegistry()
+	if path, err := registry.ConvertFile(context.Background(), pdf); err != nil || path != pdf {
+		t.Errorf("ConvertFile(essay.pdf) = %s, %v; want it untouched", path, err)
+	}
+
+	registry.Register(MarkdownConverter{BaseDir: dir})
+	path, err := registry.ConvertFile(context.Background(), notes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(path) != "notes.pdf" || !strings.HasPrefix(path, tmp) {
+		t.Errorf("ConvertFile(notes.md) = %s, want notes.pdf in %s", path, tmp)
+	}
+	if n, err := CountPages(path); err != nil || n != 1 {
+		t.Errorf("converted document has %d pages, %v; want 1", n, err)
+	}
+	os.RemoveAll(filepath.Dir(path))
+
+	registry = NewConverterRegistry()
+	registry.Register(readerConverter{&failingReader{}})
+	if _, err := registry.ConvertFile(context.Background(), notes); err == nil {
+		t.Fatal("ConvertFile succeeded although the converted document could not be read")
+	}
+	if left, _ := ioutil.ReadDir(tmp); len(left) != 0 {
+		t.Errorf("ConvertFile left %s behind", left[0].Name())
+	}
+}
+
+func TestExternalConverter(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh to run converters with")
+	}
+
+	tests := []struct {
+		name    string
+		command string
+		want    string
+		wantErr string
+	}{
+		{name: "stdin and stdout", command: "tr a-z A-Z", want: "HELLO"},
+		{name: "input and output", command: `sh -c 'tr a-z A-Z < "$0" > "$1"' {input} {output}`, want: "HELLO"},
+		{name: "output inside an argument", command: `sh -c 'tr a-z A-Z > "${0#--out=}"' --out={output}`, want: "HELLO"},
+		{name: "outdir", command: `sh -c 'tr a-z A-Z < "$0" > "$1/chosen name.pdf"' {input} {outdir}`, want: "HELLO"},
+		{name: "input extension", command: `sh -c 'case "$0" in *.txt) echo ok ;; esac' {input}`, want: "ok\n"},
+		{name: "no output file", command: `sh -c 'true' {outdir}`, wantErr: "produced 0 files"},
+		{name: "failure", command: `sh -c 'echo broken >&2; exit 3'`, wantErr: "broken"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := NewExternalConverter(ExternalConverterConfig{
+				Name:     "test",
+				From:     []string{"text/plain"},
+				To:       "application/pdf",
+				Command:  test.command,
+				InputExt: ".txt",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out, outType, err := c.Convert(context.Background(), strings.NewReader("hello"))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("err = %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := ioutil.ReadAll(out)
+			if string(data) != test.want || outType != "application/pdf" {
+				t.Errorf("got %q as %s, want %q as application/pdf", data, outType, test.want)
+			}
+		})
+	}
+}
+
+func TestNewExternalConverter(t *testing.T) {
+	for _, config := range []ExternalConverterConfig{
+		{Name: "no from", To: "application/pdf", Command: "cat"},
+		{Name: "no to", From: []string{"text/plain"}, Command: "cat"},
+		{Name: "no command", From: []string{"text/plain"}, To: "application/pdf"},
+		{Name: "blank command", From: []string{"text/plain"}, To: "application/pdf", Command: "  "},
+	} {
+		if _, err := NewExternalConverter(config); err == nil {
+			t.Errorf("%s: NewExternalConverter succeeded", config.Name)
+		}
+	}
+}
+
+func TestSplitCommandLine(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{"pandoc -o {output} {input}", []string{"pandoc", "-o", "{output}", "{input}"}},
+		{"  spaced\tout\n ", []string{"spaced", "out"}},
+		{`sh -c 'echo "a b"'`, []string{"sh", "-c", `echo "a b"`}},
+		{`say "it's here"`, []string{"say", "it's here"}},
+		{`--title="My Notes" x`, []string{"--title=My Notes", "x"}},
+		{`empty '' ""`, []string{"empty", "", ""}},
+		{`unterminated "quote here`, []string{"unterminated", "quote here"}},
+		{"", nil},
+	}
+
+	for _, test := range tests {
+		if got := splitCommandLine(test.command); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitCommandLine(%q) = %q, want %q", test.command, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventType says what happened to a print job.
+type EventType string
+
+// The steps of a print job, in the order they happen. A job that is sent
+// again after a failure goes through the wizard steps again.
+const (
+	// EventLoggedIn is sent once the session was found to be logged in.
+	EventLoggedIn EventType = "logged-in"
+	// EventPrinterSelected is sent when the wizard accepted the printer.
+	EventPrinterSelected EventType = "printer-selected"
+	// EventOptionsSubmitted is sent when the wizard accepted the copies.
+	EventOptionsSubmitted EventType = "options-submitted"
+	// EventUploading is sent as the document is uploaded, with Bytes of
+	// Total sent so far. Counts that come faster than the sink takes them
+	// are skipped.
+	EventUploading EventType = "uploading"
+	// EventUploaded is sent when PaperCut has received the document.
+	EventUploaded EventType = "uploaded"
+
+	// The job statuses PaperCut shows in the job list. EventStatus is sent
+	// for statuses gu does not know.
+	EventRendering EventType = "rendering"
+	EventHeld      EventType = "held"
+	EventPrinted   EventType = "printed"
+	EventCancelled EventType = "cancelled"
+	EventStatus    EventType = "status"
+
+	// EventFailed is sent when the job could not be printed. Err is set
+	// when gu gave up, Status when PaperCut reported an error.
+	EventFailed EventType = "failed"
+)
+
+// Event is a step of a print job.
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// Printer and Document name the job, JobID once PaperCut listed it.
+	Printer  string
+	Document string
+	Copies   int
+	JobID    string
+
+	// Status is the status in the job list, for job status events.
+	Status string
+
+	// Bytes and Total count the upload, for EventUploading and
+	// EventUploaded.
+	Bytes int64
+	Total int64
+
+	Err error
+}
+
+// String describes the event in a line for logs and progress displays.
+func (e Event) String() string {
+	switch e.Type {
+	case EventLoggedIn:
+		return "logged in"
+	case EventPrinterSelected:
+		return "selected printer " + e.Printer
+	case EventOptionsSubmitted:
+		if e.Copies == 1 {
+			return "asked for 1 copy"
+		}
+		return fmt.Sprintf("asked for %d copies", e.Copies)
+	case EventUploading:
+		if e.Total > 0 {
+			return fmt.Sprintf("uploading %s: %d%%", e.Document, e.Bytes*100/e.Total)
+		}
+		return "uploading " + e.Document
+	case EventUploaded:
+		if e.Total > 0 {
+			return fmt.Sprintf("uploaded %s (%d bytes)", e.Document, e.Total)
+		}
+		return "uploaded " + e.Document
+	case EventFailed:
+		if e.Err != nil {
+			return "failed: " + e.Err.Error()
+		}
+		return "job " + e.JobID + " failed: " + e.Status
+	}
+	return "job " + e.JobID + " on " + e.Printer + " is " + e.Status
+}
+
+// EventSink receives the events of a print job. It is called on the
+// goroutine printing the job, which waits for it to return.
+type EventSink func(Event)
+
+// PrintOption configures CreatePrintJob and the calls like it.
+type PrintOption func(*printOptions)
+
+type printOptions struct {
+	events EventSink
+}
+
+// WithEvents sends the events of the job to sink. Several sinks get each
+// event in the order they were given.
+func WithEvents(sink EventSink) PrintOption {
+	return func(o *printOptions) {
+		if previous := o.events; previous != nil {
+			o.events = func(e Event) {
+				previous(e)
+				sink(e)
+			}
+			return
+		}
+		o.events = sink
+	}
+}
+
+/*
+LogEvents writes the events of the job to logger, each after prefix. Upload
+progress is left out, and so are failures: the caller reports those along
+with what becomes of the document.
+*/
+func LogEvents(logger *log.Logger, prefix string) PrintOption {
+	return WithEvents(func(e Event) {
+		if e.Type != EventUploading && e.Type != EventFailed {
+			logger.Printf("%s: %s", prefix, e)
+		}
+	})
+}
+
+func newPrintOptions(opts []PrintOption) printOptions {
+	var o printOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// emit stamps e with the time and sends it to the sink, if there is one.
+func (o printOptions) emit(e Event) {
+	if o.events != nil {
+		e.Time = time.Now()
+		o.events(e)
+	}
+}
+
+/*
+StatusEvent returns the event for job having its current status, so that
+code watching the job list can feed the same sinks as CreatePrintJob.
+*/
+func StatusEvent(job PaperCutJob) Event {
+	e := Event{
+		Type:     EventStatus,
+		Time:     time.Now(),
+		Printer:  job.printer,
+		Document: job.document,
+		JobID:    job.jobID,
+		Status:   job.status,
+	}
+
+	status := strings.ToLower(job.status)
+	for prefix, t := range map[string]EventType{
+		JobStatusRendering: EventRendering,
+		JobStatusHeld:      EventHeld,
+		JobStatusPrinted:   EventPrinted,
+		JobStatusCancelled: EventCancelled,
+		JobStatusError:     EventFailed,
+	} {
+		if strings.HasPrefix(status, strings.ToLower(prefix)) {
+			e.Type = t
+		}
+	}
+	return e
+}
+
+/*
+WatchPrintJob fetches the job list every interval until job, as returned by
+SubmitPrintJob, has reached a final status, and returns it then. Every
+status it sees after the one job has is sent as an event.
+*/
+func WatchPrintJob(ctx context.Context, credentials *PaperCutCredentials, job PaperCutJob, interval time.Duration, opts ...PrintOption) (PaperCutJob, error) {
+	return watchJob(ctx, func() ([]PaperCutJob, error) {
+		return GetPaperCutPrintJobs(ctx, credentials)
+	}, job, interval, newPrintOptions(opts))
+}
+
+func watchJob(ctx context.Context, list func() ([]PaperCutJob, error), watched PaperCutJob, interval time.Duration, o printOptions) (PaperCutJob, error) {
+	jobID, status := watched.jobID, watched.status
+	if watched.IsFinished() {
+		return watched, nil
+	}
+	for {
+		jobs, err := list()
+		if err != nil {
+			return PaperCutJob{}, err
+		}
+
+		found := false
+		for _, job := range jobs {
+			if job.jobID != jobID {
+				continue
+			}
+			found = true
+			if job.status != status {
+				status = job.status
+				o.emit(StatusEvent(job))
+			}
+			if job.IsFinished() {
+				return job, nil
+			}
+		}
+		if !found {
+			return PaperCutJob{}, fmt.Errorf("job %s is not in the job list", jobID)
+		}
+
+		if err := sleep(ctx, interval); err != nil {
+			return PaperCutJob{}, err
+		}
+	}
+}
+
+// event returns an event of type t about p.
+func (p *PaperCutPrintJob) event(t EventType) Event {
+	return Event{
+		Type:     t,
+		Printer:  strings.TrimSpace(p.printer.name),
+		Document: filepath.Base(p.fileLocationPath),
+		Copies:   p.copies,
+	}
+}
+
+// failed sends an EventFailed for err, if it is not nil, and returns it.
+func (p *PaperCutPrintJob) failed(err error) error {
+	if err != nil {
+		e := p.event(EventFailed)
+		e.Err = err
+		p.options.emit(e)
+	}
+	return err
+}
+
+/*
+progressReader counts the bytes read from an upload and reports them about
+every percent.
+*/
+type progressReader struct {
+	r      io.Reader
+	read   int64
+	total  int64
+	next   int64
+	report func(read int64, total int64)
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.read += int64(n)
+	if n > 0 && (r.read >= r.next || r.read == r.total) {
+		r.report(r.read, r.total)
+		r.next = r.read + r.total/100 + 1
+	}
+	return n, err
+}
+
+/*
+uploadProgress hands the progress of an upload from the goroutine reading
+its body to the one printing the job. Only the latest count is kept.
+*/
+type uploadProgress struct {
+	mu      sync.Mutex
+	read    int64
+	total   int64
+	updated chan struct{}
+}
+
+func newUploadProgress() *uploadProgress {
+	return &uploadProgress{updated: make(chan struct{}, 1)}
+}
+
+// report records the count and signals updated without waiting.
+func (u *uploadProgress) report(read int64, total int64) {
+	u.mu.Lock()
+	u.read, u.total = read, total
+	u.mu.Unlock()
+
+	select {
+	case u.updated <- struct{}{}:
+	default:
+	}
+}
+
+// get returns the latest count.
+func (u *uploadProgress) get() (int64, int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.read, u.total
+}
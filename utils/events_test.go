@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/quantamhd/gu/papercuttest"
+)
+
+// writeLargeDocument writes a PDF of about size bytes, so that its upload
+// takes several reads.
+func writeLargeDocument(t *testing.T, name string, size int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	padding := "%" + strings.Repeat("x", 78) + "\n"
+	contents := "%PDF-1.4\n" + strings.Repeat(padding, size/len(padding)) + "1 0 obj << /Type /Page >> endobj\n%%EOF\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// recordEvents returns a sink that keeps the events it gets, and fails t
+// if it is called while it is still running.
+func recordEvents(t *testing.T, events *[]Event) PrintOption {
+	var running int32
+	return WithEvents(func(e Event) {
+		if !atomic.CompareAndSwapInt32(&running, 0, 1) {
+			t.Errorf("%s event sent while the sink was running", e.Type)
+			return
+		}
+		defer atomic.StoreInt32(&running, 0)
+		*events = append(*events, e)
+	})
+}
+
+// checkUploadProgress checks that the uploading events in events count up
+// to their total, and returns the events without them.
+func checkUploadProgress(t *testing.T, events []Event) []EventType {
+	t.Helper()
+	var types []EventType
+	var last, total int64
+	uploading := false
+	for _, e := range events {
+		if e.Type != EventUploading {
+			if uploading && e.Type != EventUploaded && e.Type != EventFailed {
+				t.Errorf("%s event during the upload", e.Type)
+			}
+			uploading = false
+			types = append(types, e.Type)
+			continue
+		}
+		if !uploading && (len(types) == 0 || types[len(types)-1] != EventOptionsSubmitted) {
+			t.Errorf("uploading event after %v", types)
+		}
+		if e.Bytes <= last || e.Bytes > e.Total {
+			t.Errorf("uploaded %d of %d bytes after %d", e.Bytes, e.Total, last)
+		}
+		last, total = e.Bytes, e.Total
+		uploading = true
+	}
+	if total == 0 || last != total {
+		t.Errorf("the upload ended at %d of %d bytes", last, total)
+	}
+	return types
+}
+
+func TestEventOrder(t *testing.T) {
+	_, ctx := newTestServer(t)
+	credentials := logIn(t, ctx)
+	printer := testPrinter(t, ctx, credentials, "library-bw")
+
+	var events []Event
+	if _, err := SubmitPrintJob(ctx, credentials, printer, 1, writeLargeDocument(t, "thesis.pdf", 1<<20), recordEvents(t, &events)); err != nil {
+		t.Fatal(err)
+	}
+
+	types := checkUploadProgress(t, events)
+	want := []EventType{EventLoggedIn, EventPrinterSelected, EventOptionsSubmitted, EventUploaded, EventRendering}
+	if strings.Join(eventTypes(types), " ") != strings.Join(eventTypes(want), " ") {
+		t.Errorf("events = %v, want %v", types, want)
+	}
+
+	for _, e := range events {
+		if e.Type == EventUploaded && (e.Bytes != e.Total || e.Total < 1<<20) {
+			t.Errorf("uploaded %d of %d bytes", e.Bytes, e.Total)
+		}
+		if e.Time.IsZero() {
+			t.Errorf("%s event has no time", e.Type)
+		}
+	}
+}
+
+func TestEventOrderRejected(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	credentials := logIn(t, ctx)
+	printer := testPrinter(t, ctx, credentials, "library-bw")
+
+	srv.Fail(papercuttest.RejectUpload)
+	var events []Event
+	if _, err := SubmitPrintJob(ctx, credentials, printer, 1, writeLargeDocument(t, "thesis.pdf", 1<<20), recordEvents(t, &events)); err == nil {
+		t.Fatal("the rejected upload succeeded")
+	}
+
+	types := checkUploadProgress(t, events)
+	if len(types) == 0 || types[len(types)-1] != EventFailed {
+		t.Errorf("events = %v, want failed last", types)
+	}
+	for _, e := range types {
+		if e == EventUploaded {
+			t.Error("uploaded event for a rejected upload")
+		}
+	}
+}
+
+func eventTypes(types []EventType) []string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = string(t)
+	}
+	return names
+}
@@ -0,0 +1,207 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Hooks that can be set in HookConfig.
+const (
+	HookSubmit  = "on_submit"
+	HookPrinted = "on_printed"
+	HookFailed  = "on_failed"
+)
+
+// hookTimeout is how long a hook may run before it is killed.
+const hookTimeout = time.Minute
+
+/*
+HookConfig holds the commands run when a print job reaches a step, split
+into arguments like converter commands. Empty ones are not run.
+*/
+type HookConfig struct {
+	OnSubmit  string `mapstructure:"on_submit"`
+	OnPrinted string `mapstructure:"on_printed"`
+	OnFailed  string `mapstructure:"on_failed"`
+}
+
+// HookJob is what a hook is told about the job, as JSON on its stdin and
+// in GU_ environment variables.
+type HookJob struct {
+	Hook     string    `json:"hook"`
+	Time     time.Time `json:"time"`
+	JobID    string    `json:"job_id,omitempty"`
+	File     string    `json:"file"`
+	Document string    `json:"document"`
+	Printer  string    `json:"printer"`
+	Copies   int       `json:"copies"`
+	Status   string    `json:"status,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Server   string    `json:"server"`
+	Username string    `json:"username"`
+}
+
+// Validate checks that the commands that are set can be run.
+func (c HookConfig) Validate() error {
+	for hook, command := range map[string]string{HookSubmit: c.OnSubmit, HookPrinted: c.OnPrinted, HookFailed: c.OnFailed} {
+		args := splitCommandLine(command)
+		if len(args) == 0 {
+			continue
+		}
+		if _, err := exec.LookPath(args[0]); err != nil {
+			return fmt.Errorf("hook %s: %v", hook, err)
+		}
+	}
+	return nil
+}
+
+// IsEmpty reports whether no hook is set.
+func (c HookConfig) IsEmpty() bool {
+	return c.OnSubmit == "" && c.OnPrinted == "" && c.OnFailed == ""
+}
+
+func (c HookConfig) command(hook string) string {
+	switch hook {
+	case HookSubmit:
+		return c.OnSubmit
+	case HookPrinted:
+		return c.OnPrinted
+	case HookFailed:
+		return c.OnFailed
+	}
+	return ""
+}
+
+/*
+RunHook runs the command of hook, if it is set, with job as JSON on its
+stdin and in the environment variables GU_HOOK, GU_JOB_ID, GU_FILE,
+GU_DOCUMENT, GU_PRINTER, GU_COPIES, GU_STATUS, GU_ERROR, GU_SERVER and
+GU_USERNAME. Its output goes to gu's. A hook still running after a minute
+is killed.
+*/
+func RunHook(ctx context.Context, config HookConfig, hook string, job HookJob) error {
+	command := config.command(hook)
+	if command == "" {
+		return nil
+	}
+	args := splitCommandLine(command)
+	if len(args) == 0 {
+		return nil
+	}
+
+	job.Hook = hook
+	if job.Time.IsZero() {
+		job.Time = time.Now()
+	}
+	input, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(append(input, '\n'))
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(),
+		"GU_HOOK="+hook,
+		"GU_JOB_ID="+job.JobID,
+		"GU_FILE="+job.File,
+		"GU_DOCUMENT="+job.Document,
+		"GU_PRINTER="+job.Printer,
+		"GU_COPIES="+strconv.Itoa(job.Copies),
+		"GU_STATUS="+job.Status,
+		"GU_ERROR="+job.Error,
+		"GU_SERVER="+job.Server,
+		"GU_USERNAME="+job.Username,
+	)
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("hook %s: %v", hook, err)
+	}
+	return nil
+}
+
+/*
+HookQueue collects the hooks the events of a print job call for: on_submit
+once the job is in the job list, on_printed when it has printed, and
+on_failed when it could not be sent, failed or was cancelled. Being
+interrupted is not a failure. The hooks are not run from the events, where
+they would hold up the job, but by Run once the call that emitted them has
+returned.
+*/
+type HookQueue struct {
+	config HookConfig
+	job    HookJob
+	report func(error)
+
+	mu        sync.Mutex
+	submitted bool
+	pending   []HookJob
+}
+
+// NewHookQueue returns a queue for the hooks of config. job fills in what
+// the events do not say, and errors of the hooks are passed to report.
+func NewHookQueue(config HookConfig, job HookJob, report func(error)) *HookQueue {
+	return &HookQueue{config: config, job: job, report: report}
+}
+
+// Events returns the option that queues hooks from the events of a job.
+func (q *HookQueue) Events() PrintOption {
+	return WithEvents(func(e Event) {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		if e.JobID != "" && !q.submitted {
+			q.submitted = true
+			q.add(HookSubmit, e)
+		}
+
+		switch e.Type {
+		case EventPrinted:
+			q.add(HookPrinted, e)
+		case EventCancelled:
+			q.add(HookFailed, e)
+		case EventFailed:
+			if !errors.Is(e.Err, context.Canceled) {
+				q.add(HookFailed, e)
+			}
+		}
+	})
+}
+
+func (q *HookQueue) add(hook string, e Event) {
+	q.job.Hook = hook
+	q.job.Time = e.Time
+	if e.JobID != "" {
+		q.job.JobID = e.JobID
+	}
+	q.job.Status = e.Status
+	if e.Err != nil {
+		q.job.Error = e.Err.Error()
+	}
+	q.pending = append(q.pending, q.job)
+}
+
+// Run runs the queued hooks one after another and empties the queue.
+func (q *HookQueue) Run() {
+	q.mu.Lock()
+	pending := q.pending
+	q.pending = nil
+	q.mu.Unlock()
+
+	for _, job := range pending {
+		if err := RunHook(context.Background(), q.config, job.Hook, job); err != nil {
+			q.report(err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/quantamhd/gu/papercuttest"
+)
+
+// recordingHooks returns hooks that append a line per run to a file, and a
+// function that returns the lines so far.
+func recordingHooks(t *testing.T) (HookConfig, func() []string) {
+	t.Helper()
+	log := filepath.Join(t.TempDir(), "hooks.log")
+	command := `sh -c 'echo "$GU_HOOK $GU_DOCUMENT $GU_STATUS" >> ` + log + `'`
+	runs := func() []string {
+		data, _ := ioutil.ReadFile(log)
+		return strings.Fields(strings.ReplaceAll(string(data), " ", "|"))
+	}
+	return HookConfig{OnSubmit: command, OnPrinted: command, OnFailed: command}, runs
+}
+
+func TestHookQueue(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	credentials := logIn(t, ctx)
+	printer := testPrinter(t, ctx, credentials, "library-bw")
+	config, runs := recordingHooks(t)
+
+	var reported []error
+	hooks := NewHookQueue(config, HookJob{Document: "essay.pdf"}, func(err error) { reported = append(reported, err) })
+	job, err := SubmitPrintJob(ctx, credentials, printer, 1, writeDocument(t, "essay.pdf"), hooks.Events())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := runs(); len(got) != 0 {
+		t.Fatalf("hooks ran while the job was sent: %v", got)
+	}
+
+	hooks.Run()
+	if got := runs(); strings.Join(got, " ") != "on_submit|essay.pdf|Rendering" {
+		t.Fatalf("hooks run = %v, want on_submit", got)
+	}
+
+	srv.SetJobStatus(srv.Jobs()[0].ID, papercuttest.StatusPrinted)
+	if _, err := WatchPrintJob(ctx, credentials, job, 0, hooks.Events()); err != nil {
+		t.Fatal(err)
+	}
+	hooks.Run()
+	hooks.Run()
+	if got := runs(); len(got) != 2 || got[1] != "on_printed|essay.pdf|Printed" {
+		t.Errorf("hooks run = %v, want on_submit and then on_printed once", got)
+	}
+	if len(reported) != 0 {
+		t.Errorf("hooks failed: %v", reported)
+	}
+}
+
+func TestHookQueueFailed(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	credentials := logIn(t, ctx)
+	printer := testPrinter(t, ctx, credentials, "library-bw")
+	config, runs := recordingHooks(t)
+
+	srv.Fail(papercuttest.RejectUpload)
+	hooks := NewHookQueue(config, HookJob{Document: "essay.pdf"}, func(err error) { t.Error(err) })
+	if _, err := SubmitPrintJob(ctx, credentials, printer, 1, writeDocument(t, "essay.pdf"), hooks.Events()); err == nil {
+		t.Fatal("the rejected upload succeeded")
+	}
+	hooks.Run()
+	if got := runs(); len(got) != 1 || !strings.HasPrefix(got[0], "on_failed|essay.pdf") {
+		t.Errorf("hooks run = %v, want on_failed", got)
+	}
+}
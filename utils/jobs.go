@@ -0,0 +1,253 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// Job statuses as PaperCut shows them in the web print job list.
+const (
+	JobStatusRendering = "Rendering"
+	JobStatusHeld      = "Held in a queue"
+	JobStatusPrinted   = "Printed"
+	JobStatusCancelled = "Cancelled"
+	JobStatusError     = "Error"
+)
+
+// PaperCutJob is an entry in the web print job list.
+type PaperCutJob struct {
+	jobID     string
+	submitted string
+	printer   string
+	document  string
+	pages     int
+	cost      float64
+	status    string
+}
+
+func (j PaperCutJob) GetJobID() string {
+	return j.jobID
+}
+
+func (j PaperCutJob) GetSubmitted() string {
+	return j.submitted
+}
+
+func (j PaperCutJob) GetPrinterName() string {
+	return j.printer
+}
+
+func (j PaperCutJob) GetDocumentName() string {
+	return j.document
+}
+
+func (j PaperCutJob) GetPages() int {
+	return j.pages
+}
+
+func (j PaperCutJob) GetCost() float64 {
+	return j.cost
+}
+
+func (j PaperCutJob) GetStatus() string {
+	return j.status
+}
+
+// IsFinished reports whether the job has reached a final status.
+func (j PaperCutJob) IsFinished() bool {
+	return IsFinishedStatus(j.status)
+}
+
+// IsFinishedStatus reports whether a job with status has been printed,
+// cancelled or failed.
+func IsFinishedStatus(status string) bool {
+	status = strings.ToLower(status)
+	return strings.HasPrefix(status, strings.ToLower(JobStatusPrinted)) ||
+		strings.HasPrefix(status, strings.ToLower(JobStatusCancelled)) ||
+		strings.HasPrefix(status, strings.ToLower(JobStatusError))
+}
+
+/**
+ * Converts to an array of strings for utility purposes
+ */
+func (j PaperCutJob) ToListStrings() []string {
+	return []string{j.jobID, j.submitted, j.printer, j.document, strconv.Itoa(j.pages), j.status}
+}
+
+// GetPaperCutPrintJobs fetches the user's recent web print jobs, newest first.
+func GetPaperCutPrintJobs(ctx context.Context, credentials *PaperCutCredentials) ([]PaperCutJob, error) {
+	doc, err := getJobListPage(ctx, credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	return getJobList(doc), nil
+}
+
+/*
+SubmitPrintJob sends the document at filePath to printer like
+CreatePrintJob and returns the job PaperCut created for it, so that its
+status can be followed. PaperCut may take a moment to list a new job, so
+the job list is checked a few times. The job's first status is sent as an
+event.
+*/
+func SubmitPrintJob(ctx context.Context, credentials *PaperCutCredentials, printer *PaperCutPrinter, copies int, filePath string, opts ...PrintOption) (PaperCutJob, error) {
+	printJob := newPrintJob(printer, copies, filePath, opts)
+	job, err := printJob.submitAndFind(ctx, credentials)
+	return job, printJob.failed(err)
+}
+
+// submitAndFind sends the document and looks for its job in the job list.
+func (p *PaperCutPrintJob) submitAndFind(ctx context.Context, credentials *PaperCutCredentials) (PaperCutJob, error) {
+	if err := p.submit(ctx, credentials); err != nil {
+		return PaperCutJob{}, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		jobs, err := GetPaperCutPrintJobs(ctx, credentials)
+		if err != nil {
+			return PaperCutJob{}, err
+		}
+		if job, ok := p.findNewJob(jobs); ok {
+			p.options.emit(StatusEvent(job))
+			return job, nil
+		}
+		if attempt >= Retry.MaxAttempts {
+			return PaperCutJob{}, fmt.Errorf("%s was uploaded but is not in the job list", filepath.Base(p.fileLocationPath))
+		}
+		wait, _ := Retry.delay(attempt, nil)
+		if err := sleep(ctx, wait); err != nil {
+			return PaperCutJob{}, err
+		}
+	}
+}
+
+/*
+CancelPrintJob cancels a job that has not printed yet by following the
+cancel link of its row in the job list.
+*/
+func CancelPrintJob(ctx context.Context, credentials *PaperCutCredentials, jobID string) error {
+	doc, err := getJobListPage(ctx, credentials)
+	if err != nil {
+		return err
+	}
+
+	var row *goquery.Selection
+	jobs, rows := getJobRows(doc)
+	for i, job := range jobs {
+		if job.jobID == jobID {
+			row = rows[i]
+		}
+	}
+	if row == nil {
+		return fmt.Errorf("job %s is not in the job list", jobID)
+	}
+
+	link := row.Find("a.cancel").First()
+	if link.Length() == 0 {
+		link = row.Find("a").FilterFunction(func(i int, s *goquery.Selection) bool {
+			return strings.EqualFold(strings.TrimSpace(s.Text()), "cancel")
+		}).First()
+	}
+	href, ok := link.Attr("href")
+	if !ok {
+		return fmt.Errorf("job %s can no longer be cancelled", jobID)
+	}
+
+	base, err := url.Parse(baseURL(ctx) + "/app")
+	if err != nil {
+		return err
+	}
+	ref, err := url.Parse(href)
+	if err != nil {
+		return err
+	}
+	cancelURL := base.ResolveReference(ref).String()
+
+	resp, err := Retry.do(ctx, "cancelling job "+jobID, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", cancelURL, nil)
+		if err == nil {
+			addGetHeaders(req, credentials.sessionID)
+		}
+		return req, err
+	})
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	return nil
+}
+
+func getJobListPage(ctx context.Context, credentials *PaperCutCredentials) (*goquery.Document, error) {
+	return getAppPage(ctx, credentials, "page/UserWebPrint", "fetching the job list")
+}
+
+func getJobList(doc *goquery.Document) []PaperCutJob {
+	jobs, _ := getJobRows(doc)
+	return jobs
+}
+
+/*
+getJobRows parses the job list along with the table row of each job.
+
+The page has no job numbers that last: the cancel link names the job only
+while it can be cancelled. A job is therefore known by its submission time,
+printer and document, which do not change while it moves through the list.
+Jobs that share all three are numbered from the oldest, so their IDs do not
+change as newer jobs are added above them.
+*/
+func getJobRows(doc *goquery.Document) ([]PaperCutJob, []*goquery.Selection) {
+	var jobs []PaperCutJob
+	var rows []*goquery.Selection
+
+	doc.Find("table.results .odd, table.results .even").Each(func(i int, s *goquery.Selection) {
+		cell := func(class string) string {
+			return strings.TrimSpace(strings.Replace(s.Find("td."+class).Text(), "\n", "", -1))
+		}
+
+		pages, _ := strconv.Atoi(cell("pagesColumnValue"))
+		cost, _ := parseMoney(cell("costColumnValue"))
+
+		jobs = append(jobs, PaperCutJob{
+			submitted: cell("dateColumnValue"),
+			printer:   cell("printerColumnValue"),
+			document:  cell("documentNameColumnValue"),
+			pages:     pages,
+			cost:      cost,
+			status:    cell("statusColumnValue"),
+		})
+		rows = append(rows, s)
+	})
+
+	seen := map[string]int{}
+	for i := len(jobs) - 1; i >= 0; i-- {
+		id := jobKey(jobs[i])
+		seen[id]++
+		if n := seen[id]; n > 1 {
+			id += "-" + strconv.Itoa(n)
+		}
+		jobs[i].jobID = id
+	}
+
+	return jobs, rows
+}
+
+// jobKey hashes what identifies a job in the job list into a short ID.
+func jobKey(job PaperCutJob) string {
+	h := fnv.New32a()
+	io.WriteString(h, job.submitted+"\x00"+job.printer+"\x00"+job.document)
+	return fmt.Sprintf("%08x", h.Sum32())
+}
@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/quantamhd/gu/papercuttest"
+)
+
+// findJob returns the job called id from the job list.
+func findJob(t *testing.T, jobs []PaperCutJob, id string) PaperCutJob {
+	t.Helper()
+	for _, job := range jobs {
+		if job.GetJobID() == id {
+			return job
+		}
+	}
+	t.Fatalf("job %s is not in the job list", id)
+	return PaperCutJob{}
+}
+
+func TestJobIDsAreStable(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	credentials := logIn(t, ctx)
+	printer := testPrinter(t, ctx, credentials, "library-bw")
+
+	first, err := SubmitPrintJob(ctx, credentials, printer, 1, writeDocument(t, "essay.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := SubmitPrintJob(ctx, credentials, printer, 1, writeDocument(t, "notes.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.GetJobID() == second.GetJobID() {
+		t.Fatalf("both jobs are called %s", first.GetJobID())
+	}
+
+	// The newer job is listed above the first one and the first one
+	// finishes, losing its cancel link; neither changes its ID.
+	for _, upload := range srv.Jobs() {
+		if upload.Document == "essay.pdf" {
+			srv.SetJobStatus(upload.ID, papercuttest.StatusPrinted)
+		}
+	}
+	jobs, err := GetPaperCutPrintJobs(ctx, credentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 {
+		t.Fatalf("job list has %d jobs, want 2", len(jobs))
+	}
+	if job := findJob(t, jobs, first.GetJobID()); job.GetDocumentName() != "essay.pdf" || !job.IsFinished() {
+		t.Errorf("job %s is %s, %s; want essay.pdf, printed", first.GetJobID(), job.GetDocumentName(), job.GetStatus())
+	}
+	if job := findJob(t, jobs, second.GetJobID()); job.GetDocumentName() != "notes.pdf" {
+		t.Errorf("job %s is %s, want notes.pdf", second.GetJobID(), job.GetDocumentName())
+	}
+}
+
+func TestSubmitSameDocumentTwice(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	credentials := logIn(t, ctx)
+	printer := testPrinter(t, ctx, credentials, "library-bw")
+	path := writeDocument(t, "essay.pdf")
+
+	first, err := SubmitPrintJob(ctx, credentials, printer, 1, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := SubmitPrintJob(ctx, credentials, printer, 1, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.GetJobID() == second.GetJobID() {
+		t.Fatalf("the second upload was taken for the first job, %s", first.GetJobID())
+	}
+	if jobs := srv.Jobs(); len(jobs) != 2 {
+		t.Fatalf("server has %d jobs, want 2", len(jobs))
+	}
+
+	// Cancelling the second job leaves the first one alone.
+	if err := CancelPrintJob(ctx, credentials, second.GetJobID()); err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := GetPaperCutPrintJobs(ctx, credentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := findJob(t, jobs, second.GetJobID()).GetStatus(); status != JobStatusCancelled {
+		t.Errorf("second job is %s, want cancelled", status)
+	}
+	if status := findJob(t, jobs, first.GetJobID()).GetStatus(); status != JobStatusRendering {
+		t.Errorf("first job is %s, want still rendering", status)
+	}
+}
+
+func TestCancelPrintJob(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	credentials := logIn(t, ctx)
+	printer := testPrinter(t, ctx, credentials, "library-bw")
+
+	job, err := SubmitPrintJob(ctx, credentials, printer, 1, writeDocument(t, "essay.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CancelPrintJob(ctx, credentials, job.GetJobID()); err != nil {
+		t.Fatal(err)
+	}
+
+	if uploads := srv.Jobs(); len(uploads) != 1 || uploads[0].Status != papercuttest.StatusCancelled {
+		t.Fatalf("server jobs = %v, want one cancelled job", uploads)
+	}
+	if balance := srv.Balance("student"); balance != 10 {
+		t.Errorf("balance = %v, want 10 after the refund", balance)
+	}
+
+	if err := CancelPrintJob(ctx, credentials, job.GetJobID()); err == nil {
+		t.Error("cancelling a cancelled job succeeded")
+	}
+	if err := CancelPrintJob(ctx, credentials, "nonsense"); err == nil {
+		t.Error("cancelling an unknown job succeeded")
+	}
+}
@@ -0,0 +1,577 @@
+package utils
+
+import (
+	"bytes"
+	"image"
+	_ "image/gif"  // register GIF decoding for embedded images
+	_ "image/jpeg" // register JPEG decoding for embedded images
+	_ "image/png"  // register PNG decoding for embedded images
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jung-kurt/gofpdf"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	extast "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/text"
+)
+
+const (
+	mdMargin       = 20.0
+	mdBodySize     = 11.0
+	mdCodeSize     = 9.0
+	mdIndent       = 6.0
+	mdParagraphGap = 2.5
+)
+
+var mdHeadingSizes = []float64{20, 16, 14, 12, 11, 10}
+
+// markdownRenderer walks a goldmark AST and typesets it onto a gofpdf
+// document. Inline text flows with Write so that bold, italic and code
+// spans can be mixed on the same line.
+type markdownRenderer struct {
+	pdf     *gofpdf.Fpdf
+	source  []byte
+	baseDir string
+	tr      func(string) string
+
+	size   float64
+	bold   bool
+	italic bool
+	strike bool
+	mono   bool
+
+	// keepLine is set after a list marker so that the first block of the
+	// list item starts on the same line as its bullet.
+	keepLine bool
+}
+
+/*
+MarkdownToPDF renders Markdown source into a PDF written to w.
+Relative image paths are resolved against baseDir.
+*/
+func MarkdownToPDF(source []byte, baseDir string, w io.Writer) error {
+	md := goldmark.New(goldmark.WithExtensions(extension.GFM))
+	doc := md.Parser().Parse(text.NewReader(source))
+
+	pdf := gofpdf.New("P", "mm", "Letter", "")
+	pdf.SetMargins(mdMargin, mdMargin, mdMargin)
+	pdf.SetAutoPageBreak(true, mdMargin)
+	pdf.AliasNbPages("")
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-mdMargin + 5)
+		pdf.SetFont("Helvetica", "", 8)
+		pdf.SetTextColor(128, 128, 128)
+		pdf.CellFormat(0, 5, strconv.Itoa(pdf.PageNo())+" / {nb}", "", 0, "C", false, 0, "")
+		pdf.SetTextColor(0, 0, 0)
+	})
+	pdf.AddPage()
+
+	r := &markdownRenderer{
+		pdf:     pdf,
+		source:  source,
+		baseDir: baseDir,
+		tr:      pdf.UnicodeTranslatorFromDescriptor(""),
+		size:    mdBodySize,
+	}
+	r.setFont()
+
+	for n := doc.FirstChild(); n != nil; n = n.NextSibling() {
+		r.renderBlock(n)
+	}
+
+	return pdf.Output(w)
+}
+
+func (r *markdownRenderer) lineHeight() float64 {
+	return r.size * 0.5
+}
+
+func (r *markdownRenderer) setFont() {
+	family := "Helvetica"
+	if r.mono {
+		family = "Courier"
+	}
+
+	style := ""
+	if r.bold {
+		style += "B"
+	}
+	if r.italic {
+		style += "I"
+	}
+	if r.strike {
+		style += "S"
+	}
+
+	r.pdf.SetFont(family, style, r.size)
+}
+
+func (r *markdownRenderer) leftMargin() float64 {
+	left, _, _, _ := r.pdf.GetMargins()
+	return left
+}
+
+func (r *markdownRenderer) contentWidth() float64 {
+	width, _ := r.pdf.GetPageSize()
+	left, _, right, _ := r.pdf.GetMargins()
+	return width - left - right
+}
+
+// startBlock moves the cursor to the left margin of a fresh line unless a
+// list marker has just been written.
+func (r *markdownRenderer) startBlock() {
+	if r.keepLine {
+		r.keepLine = false
+		return
+	}
+	if r.pdf.GetX() > r.leftMargin()+0.1 {
+		r.pdf.Ln(r.lineHeight())
+	}
+	r.pdf.SetX(r.leftMargin())
+}
+
+// endBlock finishes the current line and leaves gap millimetres of space.
+func (r *markdownRenderer) endBlock(gap float64) {
+	if r.pdf.GetX() > r.leftMargin()+0.1 {
+		r.pdf.Ln(r.lineHeight())
+	}
+	r.pdf.Ln(gap)
+}
+
+func (r *markdownRenderer) renderBlock(n ast.Node) {
+	switch node := n.(type) {
+	case *ast.Heading:
+		r.renderHeading(node)
+	case *ast.Paragraph:
+		r.startBlock()
+		r.renderInlines(node)
+		r.endBlock(mdParagraphGap)
+	case *ast.TextBlock:
+		r.startBlock()
+		r.renderInlines(node)
+		r.endBlock(0)
+	case *ast.List:
+		r.renderList(node)
+	case *ast.Blockquote:
+		r.renderBlockquote(node)
+	case *ast.FencedCodeBlock, *ast.CodeBlock:
+		r.renderCode(n)
+	case *ast.HTMLBlock:
+		// Raw HTML has no sensible rendering in a PDF.
+	case *ast.ThematicBreak:
+		r.startBlock()
+		y := r.pdf.GetY() + 2
+		r.pdf.SetDrawColor(180, 180, 180)
+		r.pdf.Line(r.leftMargin(), y, r.leftMargin()+r.contentWidth(), y)
+		r.pdf.SetDrawColor(0, 0, 0)
+		r.pdf.Ln(5)
+	case *extast.Table:
+		r.renderTable(node)
+	default:
+		for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+			r.renderBlock(c)
+		}
+	}
+}
+
+func (r *markdownRenderer) renderHeading(h *ast.Heading) {
+	level := h.Level
+	if level < 1 {
+		level = 1
+	} else if level > len(mdHeadingSizes) {
+		level = len(mdHeadingSizes)
+	}
+
+	r.startBlock()
+	r.pdf.Ln(2)
+
+	oldSize, oldBold := r.size, r.bold
+	r.size, r.bold = mdHeadingSizes[level-1], true
+	r.setFont()
+	r.renderInlines(h)
+	r.pdf.Ln(r.lineHeight())
+
+	if level <= 2 {
+		y := r.pdf.GetY() + 0.5
+		r.pdf.SetDrawColor(200, 200, 200)
+		r.pdf.Line(r.leftMargin(), y, r.leftMargin()+r.contentWidth(), y)
+		r.pdf.SetDrawColor(0, 0, 0)
+		r.pdf.Ln(2)
+	}
+
+	r.size, r.bold = oldSize, oldBold
+	r.setFont()
+	r.pdf.Ln(mdParagraphGap)
+}
+
+func (r *markdownRenderer) renderList(list *ast.List) {
+	number := list.Start
+	if number == 0 {
+		number = 1
+	}
+
+	left := r.leftMargin()
+
+	for item := list.FirstChild(); item != nil; item = item.NextSibling() {
+		r.startBlock()
+
+		marker := "\x95" // bullet in cp1252
+		if list.IsOrdered() {
+			marker = strconv.Itoa(number) + "."
+			number++
+		}
+
+		r.pdf.SetX(left)
+		r.pdf.CellFormat(mdIndent, r.lineHeight(), marker, "", 0, "L", false, 0, "")
+		r.pdf.SetLeftMargin(left + mdIndent)
+		r.keepLine = true
+
+		for c := item.FirstChild(); c != nil; c = c.NextSibling() {
+			r.renderBlock(c)
+		}
+
+		r.keepLine = false
+		r.pdf.SetLeftMargin(left)
+		r.pdf.SetX(left)
+	}
+
+	if _, nested := list.Parent().(*ast.ListItem); !nested {
+		r.pdf.Ln(mdParagraphGap)
+	}
+}
+
+func (r *markdownRenderer) renderBlockquote(q *ast.Blockquote) {
+	r.startBlock()
+
+	left := r.leftMargin()
+	page, top := r.pdf.PageNo(), r.pdf.GetY()
+
+	r.pdf.SetLeftMargin(left + mdIndent)
+	r.pdf.SetX(left + mdIndent)
+	r.pdf.SetTextColor(90, 90, 90)
+	r.italic = true
+	r.setFont()
+
+	for c := q.FirstChild(); c != nil; c = c.NextSibling() {
+		r.renderBlock(c)
+	}
+
+	r.italic = false
+	r.setFont()
+	r.pdf.SetTextColor(0, 0, 0)
+	r.pdf.SetLeftMargin(left)
+	r.pdf.SetX(left)
+
+	// Only draw the bar when the quote did not cross a page boundary.
+	if r.pdf.PageNo() == page {
+		r.pdf.SetDrawColor(200, 200, 200)
+		r.pdf.SetLineWidth(1)
+		r.pdf.Line(left+1.5, top, left+1.5, r.pdf.GetY()-mdParagraphGap)
+		r.pdf.SetLineWidth(0.2)
+		r.pdf.SetDrawColor(0, 0, 0)
+	}
+}
+
+func (r *markdownRenderer) renderCode(n ast.Node) {
+	r.startBlock()
+
+	oldSize, oldMono := r.size, r.mono
+	r.size, r.mono = mdCodeSize, true
+	r.setFont()
+
+	width := r.contentWidth() - (r.leftMargin() - mdMargin)
+	lh := r.lineHeight()
+
+	r.pdf.SetFillColor(244, 244, 244)
+	r.pdf.CellFormat(width, 2, "", "", 1, "L", true, 0, "")
+
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		segment := lines.At(i)
+		line := strings.TrimRight(string(segment.Value(r.source)), "\r\n")
+		line = strings.Replace(line, "\t", "    ", -1)
+
+		wrapped := r.pdf.SplitLines([]byte(r.tr(line)), width-4)
+		if len(wrapped) == 0 {
+			wrapped = [][]byte{nil}
+		}
+		for _, w := range wrapped {
+			r.pdf.SetX(r.leftMargin())
+			r.pdf.CellFormat(width, lh, "  "+string(w), "", 1, "L", true, 0, "")
+		}
+	}
+
+	r.pdf.SetX(r.leftMargin())
+	r.pdf.CellFormat(width, 2, "", "", 1, "L", true, 0, "")
+	r.pdf.SetFillColor(255, 255, 255)
+
+	r.size, r.mono = oldSize, oldMono
+	r.setFont()
+	r.pdf.SetX(r.leftMargin())
+	r.pdf.Ln(mdParagraphGap)
+}
+
+func (r *markdownRenderer) renderTable(table *extast.Table) {
+	r.startBlock()
+
+	var rows [][]*extast.TableCell
+	var header []bool
+	for row := table.FirstChild(); row != nil; row = row.NextSibling() {
+		var cells []*extast.TableCell
+		for c := row.FirstChild(); c != nil; c = c.NextSibling() {
+			if cell, ok := c.(*extast.TableCell); ok {
+				cells = append(cells, cell)
+			}
+		}
+		_, isHeader := row.(*extast.TableHeader)
+		rows = append(rows, cells)
+		header = append(header, isHeader)
+	}
+
+	columns := 0
+	for _, cells := range rows {
+		if len(cells) > columns {
+			columns = len(cells)
+		}
+	}
+	if columns == 0 {
+		return
+	}
+
+	colWidth := r.contentWidth() / float64(columns)
+	lh := r.lineHeight()
+	_, pageHeight := r.pdf.GetPageSize()
+	r.pdf.SetDrawColor(180, 180, 180)
+
+	for i, cells := range rows {
+		r.bold = header[i]
+		r.setFont()
+
+		texts := make([]string, len(cells))
+		rowLines := 1
+		for j, cell := range cells {
+			texts[j] = r.tr(r.plainText(cell))
+			if n := len(r.pdf.SplitLines([]byte(texts[j]), colWidth)); n > rowLines {
+				rowLines = n
+			}
+		}
+		rowHeight := float64(rowLines)*lh + 2
+
+		if r.pdf.GetY()+rowHeight > pageHeight-mdMargin {
+			r.pdf.AddPage()
+		}
+
+		x, y := r.leftMargin(), r.pdf.GetY()
+		for j := 0; j < columns; j++ {
+			if header[i] {
+				r.pdf.SetFillColor(235, 235, 235)
+				r.pdf.Rect(x, y, colWidth, rowHeight, "FD")
+			} else {
+				r.pdf.Rect(x, y, colWidth, rowHeight, "D")
+			}
+			if j < len(cells) {
+				r.pdf.SetXY(x, y+1)
+				r.pdf.MultiCell(colWidth, lh, texts[j], "", cellAlign(cells[j].Alignment), false)
+			}
+			x += colWidth
+		}
+		r.pdf.SetXY(r.leftMargin(), y+rowHeight)
+	}
+
+	r.bold = false
+	r.setFont()
+	r.pdf.SetDrawColor(0, 0, 0)
+	r.pdf.SetFillColor(255, 255, 255)
+	r.pdf.Ln(mdParagraphGap + 1)
+}
+
+func cellAlign(a extast.Alignment) string {
+	switch a {
+	case extast.AlignRight:
+		return "R"
+	case extast.AlignCenter:
+		return "C"
+	}
+	return "L"
+}
+
+func (r *markdownRenderer) renderInlines(n ast.Node) {
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		r.renderInline(c)
+	}
+}
+
+func (r *markdownRenderer) renderInline(n ast.Node) {
+	lh := r.lineHeight()
+
+	switch node := n.(type) {
+	case *ast.Text:
+		r.pdf.Write(lh, r.tr(string(node.Segment.Value(r.source))))
+		if node.HardLineBreak() {
+			r.pdf.Ln(lh)
+		} else if node.SoftLineBreak() {
+			r.pdf.Write(lh, " ")
+		}
+	case *ast.String:
+		r.pdf.Write(lh, r.tr(string(node.Value)))
+	case *ast.Emphasis:
+		oldBold, oldItalic := r.bold, r.italic
+		if node.Level >= 2 {
+			r.bold = true
+		} else {
+			r.italic = true
+		}
+		r.setFont()
+		r.renderInlines(node)
+		r.bold, r.italic = oldBold, oldItalic
+		r.setFont()
+	case *extast.Strikethrough:
+		r.strike = true
+		r.setFont()
+		r.renderInlines(node)
+		r.strike = false
+		r.setFont()
+	case *ast.CodeSpan:
+		oldSize, oldMono := r.size, r.mono
+		r.mono, r.size = true, r.size-1
+		r.setFont()
+		r.pdf.Write(lh, r.tr(r.plainText(node)))
+		r.size, r.mono = oldSize, oldMono
+		r.setFont()
+	case *ast.Link:
+		r.writeLink(r.plainText(node), string(node.Destination))
+	case *ast.AutoLink:
+		url := string(node.URL(r.source))
+		r.writeLink(string(node.Label(r.source)), url)
+	case *ast.Image:
+		r.renderImage(node)
+	case *extast.TaskCheckBox:
+		if node.IsChecked {
+			r.pdf.Write(lh, "[x] ")
+		} else {
+			r.pdf.Write(lh, "[ ] ")
+		}
+	case *ast.RawHTML:
+		// Inline HTML tags are dropped.
+	default:
+		r.renderInlines(n)
+	}
+}
+
+func (r *markdownRenderer) writeLink(label string, url string) {
+	r.pdf.SetTextColor(20, 80, 180)
+	r.pdf.WriteLinkString(r.lineHeight(), r.tr(label), url)
+	r.pdf.SetTextColor(0, 0, 0)
+}
+
+/*
+renderImage draws a local image on its own line, scaled down to fit the
+column. Remote or unreadable images fall back to their alt text.
+*/
+func (r *markdownRenderer) renderImage(img *ast.Image) {
+	alt := r.plainText(img)
+	dest := string(img.Destination)
+
+	imageType, ok := r.localImage(dest)
+	if !ok {
+		r.pdf.Write(r.lineHeight(), r.tr("["+alt+"]"))
+		return
+	}
+
+	path := dest
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(r.baseDir, path)
+	}
+
+	options := gofpdf.ImageOptions{ImageType: imageType, ReadDpi: true}
+	info := r.pdf.RegisterImageOptions(path, options)
+	if info == nil || !r.pdf.Ok() {
+		r.pdf.ClearError()
+		r.pdf.Write(r.lineHeight(), r.tr("["+alt+"]"))
+		return
+	}
+
+	width, height := info.Extent()
+	maxWidth := r.contentWidth() - (r.leftMargin() - mdMargin)
+	if width > maxWidth {
+		height = height * maxWidth / width
+		width = maxWidth
+	}
+
+	_, pageHeight := r.pdf.GetPageSize()
+	maxHeight := pageHeight - 2*mdMargin
+	if height > maxHeight {
+		width = width * maxHeight / height
+		height = maxHeight
+	}
+
+	if r.pdf.GetX() > r.leftMargin()+0.1 {
+		r.pdf.Ln(r.lineHeight())
+	}
+	if r.pdf.GetY()+height > pageHeight-mdMargin {
+		r.pdf.AddPage()
+	}
+
+	r.pdf.ImageOptions(path, r.leftMargin(), r.pdf.GetY(), width, height, true, options, 0, "")
+	r.pdf.SetX(r.leftMargin())
+}
+
+// localImage checks that dest names a readable local image in a format
+// gofpdf can embed and returns the gofpdf image type.
+func (r *markdownRenderer) localImage(dest string) (string, bool) {
+	if strings.Contains(dest, "://") || strings.HasPrefix(dest, "data:") {
+		return "", false
+	}
+
+	path := dest
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(r.baseDir, path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer file.Close()
+
+	_, format, err := image.DecodeConfig(file)
+	if err != nil {
+		return "", false
+	}
+
+	switch format {
+	case "png":
+		return "PNG", true
+	case "jpeg":
+		return "JPG", true
+	case "gif":
+		return "GIF", true
+	}
+	return "", false
+}
+
+// plainText flattens the inline children of n into a single string.
+func (r *markdownRenderer) plainText(n ast.Node) string {
+	var buf bytes.Buffer
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		switch node := c.(type) {
+		case *ast.Text:
+			buf.Write(node.Segment.Value(r.source))
+			if node.SoftLineBreak() || node.HardLineBreak() {
+				buf.WriteByte(' ')
+			}
+		case *ast.String:
+			buf.Write(node.Value)
+		case *ast.AutoLink:
+			buf.Write(node.Label(r.source))
+		default:
+			buf.WriteString(r.plainText(c))
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// renderMarkdown converts source and checks that the result is a PDF whose
+// pages can be counted.
+func renderMarkdown(t *testing.T, source string, baseDir string) ([]byte, int) {
+	t.Helper()
+	var out bytes.Buffer
+	if err := MarkdownToPDF([]byte(source), baseDir, &out); err != nil {
+		t.Fatalf("MarkdownToPDF: %v", err)
+	}
+	pages, err := countPDFPages(out.Bytes())
+	if err != nil {
+		t.Fatalf("output is not a readable PDF: %v", err)
+	}
+	return out.Bytes(), pages
+}
+
+func TestMarkdownToPDF(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+	}{
+		{"headings", "# One\n## Two\n### Three\n#### Four\n##### Five\n###### Six\n\nBody text.\n"},
+		{"inline styles", "Some **bold**, *italic*, ~~struck~~ and `code` with a [link](https://example.com).\n"},
+		{"nested lists", "- one\n  - one.one\n    - one.one.one\n- two\n\n1. first\n   1. inner\n   2. inner\n2. second\n"},
+		{"task list", "- [x] done\n- [ ] to do\n"},
+		{"table", "| Left | Centre | Right |\n|:-----|:------:|------:|\n| a | b | c |\n| a much longer cell that has to wrap | **bold** | `code` |\n"},
+		{"code blocks", "```go\nfunc main() {\n\tfmt.Println(\"hello\")\n}\n```\n\n    indented code\n"},
+		{"blockquote", "> quoted\n>\n> > nested quote\n"},
+		{"rule and break", "above\n\n---\n\nline  \nbreak\n"},
+		{"unicode", "Café, naïve, “quotes” — and ✓\n"},
+		{"empty", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, pages := renderMarkdown(t, test.source, t.TempDir()); pages != 1 {
+				t.Errorf("got %d pages, want 1", pages)
+			}
+		})
+	}
+}
+
+func TestMarkdownToPDFPageBreaks(t *testing.T) {
+	var source strings.Builder
+	for i := 1; i <= 200; i++ {
+		fmt.Fprintf(&source, "Paragraph %d.\n\n", i)
+	}
+
+	if _, pages := renderMarkdown(t, source.String(), t.TempDir()); pages < 2 {
+		t.Errorf("got %d pages for 200 paragraphs, want several", pages)
+	}
+}
+
+func TestMarkdownToPDFImages(t *testing.T) {
+	dir := t.TempDir()
+	picture := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for x := 0; x < 40; x++ {
+		picture.Set(x, 10, color.Black)
+	}
+	file, err := os.Create(filepath.Join(dir, "diagram.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(file, picture); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	data, pages := renderMarkdown(t, "Before\n\n![diagram](diagram.png)\n\nAfter\n", dir)
+	if pages != 1 {
+		t.Errorf("got %d pages, want 1", pages)
+	}
+	if !bytes.Contains(data, []byte("/Subtype /Image")) {
+		t.Error("the local image is not embedded")
+	}
+
+	for _, source := range []string{
+		"![missing](missing.png)\n",
+		"![remote](https://example.com/picture.png)\n",
+		"![not an image](notes.txt)\n",
+	} {
+		data, pages := renderMarkdown(t, source, dir)
+		if pages != 1 {
+			t.Errorf("%q: got %d pages, want 1", source, pages)
+		}
+		if bytes.Contains(data, []byte("/Subtype /Image")) {
+			t.Errorf("%q: an image was embedded", source)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package utils
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrUnknownPageCount is returned by CountPages for document types whose
+// page count can only be known after PaperCut renders them.
+var ErrUnknownPageCount = errors.New("page count is unknown for this document type")
+
+var (
+	pdfObjectRe    = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+	pdfRootRe      = regexp.MustCompile(`/Root\s+(\d+)\s+\d+\s+R`)
+	pdfPagesRe     = regexp.MustCompile(`/Pages\s+(\d+)\s+\d+\s+R`)
+	pdfCountRe     = regexp.MustCompile(`/Count\s+(\d+)`)
+	pdfPageRe      = regexp.MustCompile(`/Type\s*/Page\b`)
+	pdfObjStmRe    = regexp.MustCompile(`/Type\s*/ObjStm\b`)
+	pdfFirstRe     = regexp.MustCompile(`/First\s+(\d+)`)
+	pdfFlateRe     = regexp.MustCompile(`/Filter\s*\[?\s*/FlateDecode\s*\]?`)
+	pdfIntegerPair = regexp.MustCompile(`(\d+)\s+(\d+)`)
+)
+
+/*
+CountPages counts the pages of the document at path without contacting
+PaperCut. PDFs are counted from their page tree and images count as a
+single page. Other types return ErrUnknownPageCount.
+*/
+func CountPages(path string) (int, error) {
+	mimeType := DetectType(path)
+
+	switch {
+	case mimeType == "application/pdf":
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return 0, err
+		}
+		return countPDFPages(data)
+	case strings.HasPrefix(mimeType, "image/"):
+		return 1, nil
+	}
+
+	return 0, ErrUnknownPageCount
+}
+
+/*
+countPDFPages reads /Count from the root of the page tree. Objects packed in
+compressed object streams are unpacked first, and later definitions of an
+object win so that incrementally updated files are read correctly. If the
+page tree cannot be followed the individual /Type /Page objects are counted.
+*/
+func countPDFPages(data []byte) (int, error) {
+	if !bytes.HasPrefix(bytes.TrimLeft(data, "\r\n\t "), []byte("%PDF")) {
+		return 0, errors.New("not a PDF document")
+	}
+
+	objects := pdfObjects(data)
+
+	if count, ok := pdfPageTreeCount(data, objects); ok {
+		return count, nil
+	}
+
+	count := 0
+	for _, body := range objects {
+		count += len(pdfPageRe.FindAll(pdfDictionary(body), -1))
+	}
+	if count == 0 {
+		return 0, errors.New("could not find any pages in PDF")
+	}
+
+	return count, nil
+}
+
+func pdfPageTreeCount(data []byte, objects map[int][]byte) (int, bool) {
+	roots := pdfRootRe.FindAllSubmatch(data, -1)
+	if len(roots) == 0 {
+		return 0, false
+	}
+	root, _ := strconv.Atoi(string(roots[len(roots)-1][1]))
+
+	pagesRef := pdfPagesRe.FindSubmatch(pdfDictionary(objects[root]))
+	if pagesRef == nil {
+		return 0, false
+	}
+	pages, _ := strconv.Atoi(string(pagesRef[1]))
+
+	count := pdfCountRe.FindSubmatch(pdfDictionary(objects[pages]))
+	if count == nil {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(string(count[1]))
+	return n, err == nil && n > 0
+}
+
+/*
+pdfObjects indexes every top level indirect object by number, including
+those stored inside object streams. Objects are taken in file order, with
+the contents of an object stream counting from where the stream is, so the
+definition from the latest incremental update wins.
+*/
+func pdfObjects(data []byte) map[int][]byte {
+	objects := map[int][]byte{}
+
+	for pos := 0; pos < len(data); {
+		loc := pdfObjectRe.FindSubmatchIndex(data[pos:])
+		if loc == nil {
+			break
+		}
+
+		number, _ := strconv.Atoi(string(data[pos+loc[2] : pos+loc[3]]))
+		start := pos + loc[1]
+		end := pdfObjectEnd(data, start)
+
+		objects[number] = data[start:end]
+		if pdfObjStmRe.Match(pdfDictionary(data[start:end])) {
+			for packed, body := range pdfObjectStream(data[start:end]) {
+				objects[packed] = body
+			}
+		}
+
+		pos = end
+	}
+
+	return objects
+}
+
+// pdfObjectEnd returns the offset of the endobj that closes the object
+// starting at start, skipping over any stream data.
+func pdfObjectEnd(data []byte, start int) int {
+	rest := data[start:]
+	end := bytes.Index(rest, []byte("endobj"))
+	if end < 0 {
+		return len(data)
+	}
+
+	if s := bytes.Index(rest, []byte("stream")); s >= 0 && s < end {
+		if es := bytes.Index(rest[s:], []byte("endstream")); es >= 0 {
+			if e := bytes.Index(rest[s+es:], []byte("endobj")); e >= 0 {
+				end = s + es + e
+			}
+		}
+	}
+
+	return start + end
+}
+
+// pdfDictionary strips the stream data from an object body.
+func pdfDictionary(body []byte) []byte {
+	if s := bytes.Index(body, []byte("stream")); s >= 0 {
+		return body[:s]
+	}
+	return body
+}
+
+// pdfStreamData returns the raw bytes between stream and endstream.
+func pdfStreamData(body []byte) []byte {
+	s := bytes.Index(body, []byte("stream"))
+	if s < 0 {
+		return nil
+	}
+	data := body[s+len("stream"):]
+	data = bytes.TrimPrefix(data, []byte("\r"))
+	data = bytes.TrimPrefix(data, []byte("\n"))
+
+	if e := bytes.LastIndex(data, []byte("endstream")); e >= 0 {
+		data = data[:e]
+	}
+	return data
+}
+
+// pdfObjectStream unpacks a Flate compressed /Type /ObjStm object.
+func pdfObjectStream(body []byte) map[int][]byte {
+	dict := pdfDictionary(body)
+	if !pdfFlateRe.Match(dict) {
+		return nil
+	}
+
+	first := pdfFirstRe.FindSubmatch(dict)
+	if first == nil {
+		return nil
+	}
+	offset, _ := strconv.Atoi(string(first[1]))
+
+	reader, err := zlib.NewReader(bytes.NewReader(pdfStreamData(body)))
+	if err != nil {
+		return nil
+	}
+	content, err := ioutil.ReadAll(reader)
+	if err != nil && len(content) == 0 {
+		return nil
+	}
+	if offset > len(content) {
+		return nil
+	}
+
+	pairs := pdfIntegerPair.FindAllSubmatch(content[:offset], -1)
+	objects := map[int][]byte{}
+
+	for i, pair := range pairs {
+		number, _ := strconv.Atoi(string(pair[1]))
+		start, _ := strconv.Atoi(string(pair[2]))
+		start += offset
+
+		end := len(content)
+		if i+1 < len(pairs) {
+			next, _ := strconv.Atoi(string(pairs[i+1][2]))
+			end = next + offset
+		}
+		if start > end || end > len(content) {
+			continue
+		}
+
+		objects[number] = content[start:end]
+	}
+
+	return objects
+}
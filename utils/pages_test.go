@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// pdfPageTree is a catalog and page tree of count pages, numbered from 1.
+func pdfPageTree(count int) string {
+	var kids []string
+	var pages strings.Builder
+	for i := 0; i < count; i++ {
+		kids = append(kids, fmt.Sprintf("%d 0 R", 3+i))
+		fmt.Fprintf(&pages, "%d 0 obj\n<< /Type /Page /Parent 2 0 R >>\nendobj\n", 3+i)
+	}
+	return "%PDF-1.4\n" +
+		"1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n" +
+		fmt.Sprintf("2 0 obj\n<< /Type /Pages /Kids [%s] /Count %d >>\nendobj\n", strings.Join(kids, " "), count) +
+		pages.String() +
+		"trailer\n<< /Root 1 0 R >>\n%%EOF\n"
+}
+
+// pdfObjectStreamObject packs bodies, keyed by object number, into a Flate
+// compressed object stream numbered number.
+func pdfObjectStreamObject(t *testing.T, number int, bodies map[int]string) string {
+	t.Helper()
+	var header, content strings.Builder
+	for n := 1; n < 100; n++ {
+		body, ok := bodies[n]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&header, "%d %d ", n, content.Len())
+		content.WriteString(body + "\n")
+	}
+
+	var packed bytes.Buffer
+	w := zlib.NewWriter(&packed)
+	w.Write([]byte(header.String() + content.String()))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return fmt.Sprintf("%d 0 obj\n<< /Type /ObjStm /N %d /First %d /Filter /FlateDecode /Length %d >>\nstream\n%s\nendstream\nendobj\n",
+		number, len(bodies), header.Len(), packed.Len(), packed.String())
+}
+
+func TestCountPDFPages(t *testing.T) {
+	objectStream := "%PDF-1.5\n" +
+		pdfObjectStreamObject(t, 10, map[int]string{
+			1: "<< /Type /Catalog /Pages 2 0 R >>",
+			2: "<< /Type /Pages /Kids [3 0 R 4 0 R] /Count 2 >>",
+		}) +
+		"3 0 obj\n<< /Type /Page /Parent 2 0 R >>\nendobj\n" +
+		"4 0 obj\n<< /Type /Page /Parent 2 0 R >>\nendobj\n" +
+		"trailer\n<< /Root 1 0 R >>\n%%EOF\n"
+
+	tests := []struct {
+		name string
+		pdf  string
+		want int
+	}{
+		{"plain", pdfPageTree(3), 3},
+		{"incremental update", pdfPageTree(2) +
+			"5 0 obj\n<< /Type /Page /Parent 2 0 R >>\nendobj\n" +
+			"2 0 obj\n<< /Type /Pages /Kids [3 0 R 4 0 R 5 0 R] /Count 3 >>\nendobj\n" +
+			"trailer\n<< /Root 1 0 R /Prev 9 >>\n%%EOF\n", 3},
+		{"object stream", objectStream, 2},
+		{"update in an object stream", pdfPageTree(2) +
+			"5 0 obj\n<< /Type /Page /Parent 2 0 R >>\nendobj\n" +
+			pdfObjectStreamObject(t, 11, map[int]string{
+				2: "<< /Type /Pages /Kids [3 0 R 4 0 R 5 0 R] /Count 3 >>",
+			}) +
+			"trailer\n<< /Root 1 0 R /Prev 9 >>\n%%EOF\n", 3},
+		{"update after an object stream", objectStream +
+			"2 0 obj\n<< /Type /Pages /Kids [3 0 R] /Count 1 >>\nendobj\n" +
+			"trailer\n<< /Root 1 0 R /Prev 9 >>\n%%EOF\n", 1},
+		{"no page tree", "%PDF-1.4\n" +
+			"1 0 obj\n<< /Type /Page >>\nendobj\n" +
+			"2 0 obj\n<< /Type /Page >>\nendobj\n%%EOF\n", 2},
+		{"pages object is not a page", "%PDF-1.4\n" +
+			"1 0 obj\n<< /Type /Pages /Kids [2 0 R] >>\nendobj\n" +
+			"2 0 obj\n<< /Type /Page >>\nendobj\n%%EOF\n", 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := countPDFPages([]byte(test.pdf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("countPDFPages = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCountPDFPagesErrors(t *testing.T) {
+	for name, data := range map[string]string{
+		"not a PDF": "hello",
+		"no pages":  "%PDF-1.4\n1 0 obj\n<< /Type /Catalog >>\nendobj\n%%EOF\n",
+	} {
+		if n, err := countPDFPages([]byte(data)); err == nil {
+			t.Errorf("%s: countPDFPages = %d, want an error", name, n)
+		}
+	}
+}
+
+func TestCountPages(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	if n, err := CountPages(write("essay.pdf", pdfPageTree(4))); err != nil || n != 4 {
+		t.Errorf("CountPages(essay.pdf) = %d, %v; want 4", n, err)
+	}
+	if n, err := CountPages(write("photo.png", "\x89PNG\r\n\x1a\n")); err != nil || n != 1 {
+		t.Errorf("CountPages(photo.png) = %d, %v; want 1", n, err)
+	}
+	if _, err := CountPages(write("notes.txt", "hello\n")); err != ErrUnknownPageCount {
+		t.Errorf("CountPages(notes.txt) error = %v, want ErrUnknownPageCount", err)
+	}
+}
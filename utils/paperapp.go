@@ -2,14 +2,18 @@ package utils
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"time"
 
@@ -21,7 +25,16 @@ import (
 	"github.com/PuerkitoBio/goquery"
 )
 
-const baseURL string = "https://paper-app.gonzaga.edu:9192"
+// BaseURL is the address of the PaperCut server, without a trailing slash.
+// The Host, Origin and Referer headers are derived from it. It can be
+// pointed at a papercuttest server to run the print flow offline. See
+// Server for using another server for some calls only.
+var BaseURL = "https://paper-app.gonzaga.edu:9192"
+
+// Transport carries every request made to the PaperCut server. NewTransport
+// builds one with custom certificates and proxies. Wrap it with
+// TraceTransport or HARRecorder to inspect a session.
+var Transport http.RoundTripper = http.DefaultTransport
 
 /*PaperCutCredentials ...
 parameters
@@ -33,12 +46,16 @@ type PaperCutCredentials struct {
 	password   string
 	sessionID  string
 	isLoggedIn bool
+	balance    float64
+	hasBalance bool
 }
 
 type PaperCutPrinter struct {
-	value    int
-	name     string
-	location string
+	value       int
+	name        string
+	location    string
+	costPerPage float64
+	hasCost     bool
 }
 
 type PaperCutPrintJob struct {
@@ -47,6 +64,9 @@ type PaperCutPrintJob struct {
 	fileLocationPath string
 	uploadID         int
 	jobID            string
+	uploadAttempted  bool
+	before           map[string]bool
+	options          printOptions
 }
 
 func (p PaperCutPrinter) GetName() string {
@@ -61,10 +81,20 @@ func (p PaperCutPrinter) ToListStrings() []string {
 	return data
 }
 
+func (p PaperCutPrinter) GetLocation() string {
+	return p.location
+}
+
 func (p PaperCutPrinter) GetID() int {
 	return p.value
 }
 
+// GetCostPerPage returns the cost per page PaperCut lists for the printer
+// and whether it was shown at all.
+func (p PaperCutPrinter) GetCostPerPage() (float64, bool) {
+	return p.costPerPage, p.hasCost
+}
+
 func (p PaperCutCredentials) GetSessionID() string {
 	return p.sessionID
 }
@@ -73,28 +103,48 @@ func (p PaperCutCredentials) IsLoggedIn() bool {
 	return p.isLoggedIn
 }
 
-func CreatePaperCutCredentials(username string, password string) *PaperCutCredentials {
-	credentials := PaperCutCredentials{username, password, "", false}
-	login(&credentials)
-	return &credentials
+// GetBalance returns the account balance from the summary page shown after
+// login and whether it could be read.
+func (p PaperCutCredentials) GetBalance() (float64, bool) {
+	return p.balance, p.hasBalance
 }
 
-func GetPaperCutPrinters(credentials *PaperCutCredentials) map[int]PaperCutPrinter {
-	netClient := &http.Client{
-		Timeout: time.Second * 10,
+// FindPrinter looks up a printer by its name or ID.
+func FindPrinter(printers map[int]PaperCutPrinter, nameOrID string) (int, bool) {
+	if nameOrID == "" {
+		return 0, false
 	}
 
-	printerListURL := baseURL + "/app?service=action/1/UserWebPrint/0/$ActionLink"
+	for id, p := range printers {
+		if strings.EqualFold(strings.TrimSpace(p.GetName()), nameOrID) ||
+			strconv.Itoa(id) == nameOrID {
+			return id, true
+		}
+	}
 
-	req, _ := http.NewRequest("GET", printerListURL, nil)
+	return 0, false
+}
 
-	addGetHeaders(req, credentials.sessionID)
+func CreatePaperCutCredentials(ctx context.Context, username string, password string) (*PaperCutCredentials, error) {
+	credentials := PaperCutCredentials{username: username, password: password}
+	if err := login(ctx, &credentials); err != nil {
+		return nil, err
+	}
+	return &credentials, nil
+}
 
-	resp, err := netClient.Do(req)
+func GetPaperCutPrinters(ctx context.Context, credentials *PaperCutCredentials) (map[int]PaperCutPrinter, error) {
+	printerListURL := baseURL(ctx) + "/app?service=action/1/UserWebPrint/0/$ActionLink"
 
+	resp, err := Retry.do(ctx, "fetching the printer list", func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", printerListURL, nil)
+		if err == nil {
+			addGetHeaders(req, credentials.sessionID)
+		}
+		return req, err
+	})
 	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+		return nil, err
 	}
 
 	defer resp.Body.Close()
@@ -102,36 +152,329 @@ func GetPaperCutPrinters(credentials *PaperCutCredentials) map[int]PaperCutPrint
 	return getPrinterList(resp)
 }
 
-func CreatePrintJob(credentials *PaperCutCredentials, printer *PaperCutPrinter, copies int, filePath string) {
-	printJob := PaperCutPrintJob{printer, copies, filePath, -1, ""}
-	submitPrinterSelection(credentials, &printJob)
-	submitCopyAmount(credentials, &printJob)
-	submitDocument(credentials, &printJob)
+/*
+CreatePrintJob sends the document at filePath to printer. Steps that fail
+with a transient error restart the wizard from printer selection, see
+submit. WithEvents follows the job as it goes through the wizard.
+*/
+func CreatePrintJob(ctx context.Context, credentials *PaperCutCredentials, printer *PaperCutPrinter, copies int, filePath string, opts ...PrintOption) error {
+	printJob := newPrintJob(printer, copies, filePath, opts)
+	return printJob.failed(printJob.submit(ctx, credentials))
+}
+
+func newPrintJob(printer *PaperCutPrinter, copies int, filePath string, opts []PrintOption) *PaperCutPrintJob {
+	return &PaperCutPrintJob{printer: printer, copies: copies, fileLocationPath: filePath, uploadID: -1, options: newPrintOptions(opts)}
+}
+
+/*
+DryRunPrintJob writes the requests CreatePrintJob would send to out, with
+secrets redacted, from logging in to the upload. None of them is sent. The
+upload ID PaperCut hands out with the print options is shown as 0.
+*/
+func DryRunPrintJob(ctx context.Context, credentials *PaperCutCredentials, printer *PaperCutPrinter, copies int, filePath string, out io.Writer) error {
+	printJob := newPrintJob(printer, copies, filePath, nil)
+	printJob.uploadID = 0
+
+	steps := []func() (*http.Request, error){
+		func() (*http.Request, error) { return newWizardRequest(ctx, credentials) },
+		func() (*http.Request, error) { return newPrinterSelectionRequest(ctx, credentials, printJob) },
+		func() (*http.Request, error) { return newCopiesRequest(ctx, credentials, printJob) },
+		func() (*http.Request, error) { return newUploadRequest(ctx, credentials, printJob) },
+	}
+	if _, ok := currentServer(ctx).Auth.(FormAuthenticator); ok {
+		steps = append([]func() (*http.Request, error){func() (*http.Request, error) {
+			return newLoginRequest(ctx, credentials.username, credentials.password, credentials.sessionID)
+		}}, steps...)
+	}
+
+	for _, step := range steps {
+		req, err := step()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, formatRequest(req))
+		fmt.Fprintln(out)
+	}
+	return nil
+}
+
+/*
+submit runs the print wizard, starting again from printer selection when a
+step fails with a transient error, up to Retry.MaxAttempts times. An upload
+is never repeated when its outcome is unknown, such as when the connection
+dropped after the document was sent: the job list is watched for the
+document instead, see confirmUpload.
+*/
+func (p *PaperCutPrintJob) submit(ctx context.Context, credentials *PaperCutCredentials) error {
+	p.uploadAttempted = false
+	jobs, err := GetPaperCutPrintJobs(ctx, credentials)
+	if err != nil {
+		return err
+	}
+	p.before = map[string]bool{}
+	for _, job := range jobs {
+		p.before[job.jobID] = true
+	}
+	p.options.emit(p.event(EventLoggedIn))
+
+	for attempt := 1; ; attempt++ {
+		err := p.runWizard(ctx, credentials)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return p.abandon(ctx, credentials)
+		}
+		if errors.Is(err, ErrUploadOutcomeUnknown) {
+			return p.confirmUpload(ctx, credentials, err)
+		}
+		if !isRetryable(err) {
+			return err
+		}
+
+		wait, ok := Retry.delay(attempt, err)
+		if !ok {
+			err = fmt.Errorf("PaperCut asked to wait before trying again: %w", err)
+		}
+		last := !ok || attempt >= Retry.MaxAttempts
+		if ok && (!last || p.uploadAttempted) {
+			if sleep(ctx, wait) != nil {
+				return p.abandon(ctx, credentials)
+			}
+		}
+
+		if p.uploadAttempted {
+			jobs, listErr := GetPaperCutPrintJobs(ctx, credentials)
+			if listErr != nil {
+				return fmt.Errorf("%v; could not check whether the document arrived: %v", err, listErr)
+			}
+			if job, ok := p.findNewJob(jobs); ok {
+				p.jobID = job.jobID
+				p.options.emit(p.event(EventUploaded))
+				return nil
+			}
+		}
+
+		if !ok {
+			return err
+		}
+		if last {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+	}
+}
+
+// runWizard goes through the web print wizard once, from the printer list
+// to the upload.
+func (p *PaperCutPrintJob) runWizard(ctx context.Context, credentials *PaperCutCredentials) error {
+	p.uploadID = -1
+
+	if err := startWizard(ctx, credentials); err != nil {
+		return err
+	}
+	if err := submitPrinterSelection(ctx, credentials, p); err != nil {
+		return err
+	}
+	p.options.emit(p.event(EventPrinterSelected))
+	if err := submitCopyAmount(ctx, credentials, p); err != nil {
+		return err
+	}
+	p.options.emit(p.event(EventOptionsSubmitted))
+	return submitDocument(ctx, credentials, p)
+}
+
+/*
+abandon cleans up after the wizard was interrupted by the end of
+interrupted, whose error it returns. It leaves the wizard by going back to
+the job list and, if the upload reached PaperCut, cancels the job so that
+it is never printed. The cleanup talks to the same server but gets its own
+short deadline, since interrupted is already done.
+*/
+func (p *PaperCutPrintJob) abandon(interrupted context.Context, credentials *PaperCutCredentials) error {
+	cause := interrupted.Err()
+	ctx, cancel := context.WithTimeout(WithServer(context.Background(), currentServer(interrupted)), 10*time.Second)
+	defer cancel()
+
+	jobs, err := GetPaperCutPrintJobs(ctx, credentials)
+	if err != nil {
+		return fmt.Errorf("%w; could not check whether the document arrived: %v", cause, err)
+	}
+
+	if !p.uploadAttempted {
+		return cause
+	}
+
+	if job, ok := p.findNewJob(jobs); ok {
+		if err := CancelPrintJob(ctx, credentials, job.jobID); err != nil {
+			return fmt.Errorf("%w; job %s may still print: %v", cause, job.jobID, err)
+		}
+	}
+
+	return cause
+}
+
+/*
+confirmUpload looks for the document in the job list after its upload
+failed with err in a way that leaves open whether PaperCut received it.
+The list is checked up to Retry.MaxAttempts times, as PaperCut may take a
+moment to list a new job; if the document never shows up err is returned,
+as sending it again could print it twice.
+*/
+func (p *PaperCutPrintJob) confirmUpload(ctx context.Context, credentials *PaperCutCredentials, err error) error {
+	document := filepath.Base(p.fileLocationPath)
+	for attempt := 1; ; attempt++ {
+		wait, _ := Retry.delay(attempt, nil)
+		if sleep(ctx, wait) != nil {
+			return p.abandon(ctx, credentials)
+		}
+
+		jobs, listErr := GetPaperCutPrintJobs(ctx, credentials)
+		if ctx.Err() != nil {
+			return p.abandon(ctx, credentials)
+		}
+		if listErr == nil {
+			if job, ok := p.findNewJob(jobs); ok {
+				p.jobID = job.jobID
+				p.options.emit(p.event(EventUploaded))
+				return nil
+			}
+		}
+
+		if attempt >= Retry.MaxAttempts {
+			if listErr != nil {
+				return fmt.Errorf("%w, and the job list could not be checked: %v", err, listErr)
+			}
+			return fmt.Errorf("%w, and %s is not in the job list", err, document)
+		}
+	}
+}
+
+/*
+uploadMayHaveArrived reports whether an upload that failed with err may
+still have reached PaperCut: the connection dropped or timed out, or a
+gateway answered in its place. Servers that are busy or asking to slow
+down turn the upload away without reading it.
+*/
+func uploadMayHaveArrived(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusServiceUnavailable ||
+		statusErr.StatusCode == http.StatusTooManyRequests) {
+		return false
+	}
+	return isRetryable(err)
 }
 
-func intitalConnection() (string, *http.Client) {
-	netClient := &http.Client{
-		Timeout: time.Second * 10,
+// findNewJob looks for the document among the jobs that were not in the
+// list before the first upload.
+func (p *PaperCutPrintJob) findNewJob(jobs []PaperCutJob) (PaperCutJob, bool) {
+	document := filepath.Base(p.fileLocationPath)
+	for _, job := range jobs {
+		if !p.before[job.jobID] && job.document == document {
+			return job, true
+		}
 	}
+	return PaperCutJob{}, false
+}
+
+/*
+ErrUploadOutcomeUnknown is returned when an upload failed after the
+document was sent and it did not show up in the job list. It may still
+print, so it must not be sent again without checking.
+*/
+var ErrUploadOutcomeUnknown = errors.New("the outcome of the upload is unknown")
+
+// MaxDocumentSize is the largest document web print accepts.
+var MaxDocumentSize int64 = 100 << 20
 
-	resp, err := netClient.Get(baseURL + "/user")
+/*
+CheckDocument runs the local pre-flight checks for a document: its type
+must be accepted by PaperCut and it must not exceed MaxDocumentSize.
+*/
+func CheckDocument(filePath string) error {
+	fi, err := os.Stat(filePath)
 	if err != nil {
-		fmt.Println("Could not contact PaperCutServer")
-		os.Exit(1)
+		return err
+	}
+
+	if mimeType := DetectType(filePath); !IsAcceptedType(mimeType) {
+		return fmt.Errorf("%s is not a printable document type", mimeType)
+	}
+
+	if fi.Size() > MaxDocumentSize {
+		return fmt.Errorf("document is %d bytes, the limit is %d", fi.Size(), MaxDocumentSize)
+	}
+
+	return nil
+}
+
+// newClient returns an http.Client for talking to the PaperCut server of ctx.
+func newClient(ctx context.Context) *http.Client {
+	return &http.Client{
+		Timeout:   time.Second * 10,
+		Transport: currentServer(ctx).Transport,
+	}
+}
+
+func intitalConnection(ctx context.Context) (string, error) {
+	resp, err := Retry.do(ctx, "contacting PaperCut", func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", baseURL(ctx)+"/user", nil)
+	})
+	if err != nil {
+		return "", err
 	}
 
 	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
 	jsessionID := getCookieByName(resp.Cookies(), "JSESSIONID")
 
-	//io.Copy(os.Stdout, resp.Body)
+	return jsessionID, nil
+}
 
-	return jsessionID, netClient
+/*
+Authenticator starts a PaperCut session. It returns the JSESSIONID of the
+session and the page PaperCut showed once the login was done, which is the
+summary page when it succeeded.
+*/
+type Authenticator interface {
+	Authenticate(ctx context.Context, username string, password string) (string, *goquery.Document, error)
 }
 
-func login(credentials *PaperCutCredentials) {
-	jessionid, netClient := intitalConnection()
+// Auth logs in every new PaperCutCredentials. Set it to a CASAuthenticator
+// for servers behind single sign-on.
+var Auth Authenticator = FormAuthenticator{}
+
+// FormAuthenticator logs in with PaperCut's own username and password form.
+type FormAuthenticator struct{}
+
+// Authenticate posts the PaperCut login form.
+func (FormAuthenticator) Authenticate(ctx context.Context, username string, password string) (string, *goquery.Document, error) {
+	jessionid, err := intitalConnection(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Logging in twice is harmless, so the login form is retried on its own.
+	resp, err := Retry.do(ctx, "logging in", func() (*http.Request, error) {
+		return newLoginRequest(ctx, username, password, jessionid)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	defer resp.Body.Close()
+
+	doc, err := goquery.NewDocumentFromResponse(resp)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return jessionid, doc, nil
+}
 
-	loginURL := baseURL + "/app"
+// newLoginRequest builds the post of PaperCut's login form.
+func newLoginRequest(ctx context.Context, username string, password string, jessionid string) (*http.Request, error) {
+	loginURL := baseURL(ctx) + "/app"
 
 	form := url.Values{
 		"service":              {"direct/1/Home/$Form$0"},
@@ -139,37 +482,43 @@ func login(credentials *PaperCutCredentials) {
 		"Form0":                {"$Hidden$0,$Hidden$1,inputUsername,inputPassword,$PropertySelection$0,$Submit$0"},
 		"$Hidden$0":            {"true"},
 		"$Hidden$1":            {"X"},
-		"inputUsername":        {credentials.username},
-		"inputPassword":        {credentials.password},
+		"inputUsername":        {username},
+		"inputPassword":        {password},
 		"$PropertySelection$0": {"en"},
 		"$Submit$0":            {"Log in"},
 	}
 
-	req, _ := http.NewRequest("POST", loginURL, bytes.NewBufferString(form.Encode()))
-
-	addPostHeaders(req, form, jessionid)
-	resp, err := netClient.Do(req)
+	req, err := http.NewRequestWithContext(ctx, "POST", loginURL, bytes.NewBufferString(form.Encode()))
+	if err == nil {
+		addPostHeaders(req, form, jessionid)
+	}
+	return req, err
+}
 
+func login(ctx context.Context, credentials *PaperCutCredentials) error {
+	jessionid, doc, err := currentServer(ctx).Auth.Authenticate(ctx, credentials.username, credentials.password)
 	if err != nil {
-		fmt.Println("Could not contact PaperCutServer")
-		os.Exit(1)
+		return err
 	}
 
-	defer resp.Body.Close()
-
-	//io.Copy(os.Stdout, resp.Body)
-	if isLoggedIn(resp) {
+	if doc != nil && isLoggedIn(doc) {
 		credentials.isLoggedIn = true
 		credentials.sessionID = jessionid
+		credentials.balance, credentials.hasBalance = parseBalance(doc)
 	}
+
+	return nil
 }
 
-func getPrinterList(httpResponse *http.Response) map[int]PaperCutPrinter {
+func getPrinterList(httpResponse *http.Response) (map[int]PaperCutPrinter, error) {
 	var printers = map[int]PaperCutPrinter{}
 
 	doc, err := goquery.NewDocumentFromResponse(httpResponse)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	if isLoginPage(doc) {
+		return nil, ErrSessionExpired
 	}
 
 	doc.Find(".odd, .even").Each(func(i int, s *goquery.Selection) {
@@ -178,21 +527,58 @@ func getPrinterList(httpResponse *http.Response) map[int]PaperCutPrinter {
 		locationName := strings.Replace(s.Find("td.locationColumnValue").Text(), "\n", "", -1)
 		valueString, _ := s.Find("input").Attr("value")
 		valueInt, _ := strconv.Atoi(valueString)
+		cost, hasCost := parseMoney(s.Find("td[class*=cost]").Text())
 
-		structPrinter := PaperCutPrinter{valueInt, printerName, locationName}
+		structPrinter := PaperCutPrinter{valueInt, printerName, locationName, cost, hasCost}
 
 		printers[valueInt] = structPrinter
 	})
 
-	return printers
+	return printers, nil
+}
+
+// startWizard opens the first page of the web print wizard, the printer
+// list, so that it can be gone through again after a failure.
+func startWizard(ctx context.Context, credentials *PaperCutCredentials) error {
+	resp, err := sendOnce.do(ctx, "starting the print wizard", func() (*http.Request, error) {
+		return newWizardRequest(ctx, credentials)
+	})
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	return nil
+}
+
+func newWizardRequest(ctx context.Context, credentials *PaperCutCredentials) (*http.Request, error) {
+	wizardURL := baseURL(ctx) + "/app?service=action/1/UserWebPrint/0/$ActionLink"
+
+	req, err := http.NewRequestWithContext(ctx, "GET", wizardURL, nil)
+	if err == nil {
+		addGetHeaders(req, credentials.sessionID)
+	}
+	return req, err
 }
 
-func submitPrinterSelection(credentials *PaperCutCredentials, printJob *PaperCutPrintJob) {
-	netClient := &http.Client{
-		Timeout: time.Second * 10,
+func submitPrinterSelection(ctx context.Context, credentials *PaperCutCredentials, printJob *PaperCutPrintJob) error {
+	resp, err := sendOnce.do(ctx, "selecting the printer", func() (*http.Request, error) {
+		return newPrinterSelectionRequest(ctx, credentials, printJob)
+	})
+	if err != nil {
+		return err
 	}
 
-	submitPrinterURL := baseURL + "/app"
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	return nil
+}
+
+func newPrinterSelectionRequest(ctx context.Context, credentials *PaperCutCredentials, printJob *PaperCutPrintJob) (*http.Request, error) {
+	submitPrinterURL := baseURL(ctx) + "/app"
 
 	form := url.Values{
 		"service":     {"direct/1/UserWebPrintSelectPrinter/$Form"},
@@ -205,28 +591,49 @@ func submitPrinterSelection(credentials *PaperCutCredentials, printJob *PaperCut
 		"$Submit$1":   {"2. Print Options and Account Selection »"},
 	}
 
-	req, _ := http.NewRequest("POST", submitPrinterURL, bytes.NewBufferString(form.Encode()))
-	addPostHeaders(req, form, credentials.sessionID)
-
-	addPostHeaders(req, form, credentials.sessionID)
+	req, err := http.NewRequestWithContext(ctx, "POST", submitPrinterURL, bytes.NewBufferString(form.Encode()))
+	if err == nil {
+		addPostHeaders(req, form, credentials.sessionID)
+	}
+	return req, err
+}
 
-	resp, err := netClient.Do(req)
+// uploadUIDRe finds the upload ID in the script of the upload page.
+var uploadUIDRe = regexp.MustCompile(`var uploadUID = '([0-9]*)'`)
 
+func submitCopyAmount(ctx context.Context, credentials *PaperCutCredentials, printJob *PaperCutPrintJob) error {
+	resp, err := sendOnce.do(ctx, "setting the print options", func() (*http.Request, error) {
+		return newCopiesRequest(ctx, credentials, printJob)
+	})
 	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+		return err
 	}
 
 	defer resp.Body.Close()
 
-}
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(resp.Body); err != nil {
+		return fmt.Errorf("setting the print options: %w", err)
+	}
+	html := buf.String()
 
-func submitCopyAmount(credentials *PaperCutCredentials, printJob *PaperCutPrintJob) {
-	netClient := &http.Client{
-		Timeout: time.Second * 10,
+	res := uploadUIDRe.FindAllStringSubmatch(html, -1)
+	if len(res) == 0 {
+		return ErrSessionExpired
+	}
+	uploadID, err := strconv.Atoi(res[0][1])
+
+	if err != nil {
+		return err
 	}
 
-	submitPrinterURL := baseURL + "/app"
+	printJob.uploadID = uploadID
+
+	return nil
+}
+
+func newCopiesRequest(ctx context.Context, credentials *PaperCutCredentials, printJob *PaperCutPrintJob) (*http.Request, error) {
+	submitPrinterURL := baseURL(ctx) + "/app"
 
 	form := url.Values{
 		"service": {"direct/1/UserWebPrintOptionsAndAccountSelection/$Form"},
@@ -236,53 +643,106 @@ func submitCopyAmount(credentials *PaperCutCredentials, printJob *PaperCutPrintJ
 		"$Submit": {"3. Upload Documents »"},
 	}
 
-	req, _ := http.NewRequest("POST", submitPrinterURL, bytes.NewBufferString(form.Encode()))
-	addPostHeadersReferer(req, form, credentials.sessionID, "app")
-
-	resp, err := netClient.Do(req)
+	req, err := http.NewRequestWithContext(ctx, "POST", submitPrinterURL, bytes.NewBufferString(form.Encode()))
+	if err == nil {
+		addPostHeadersReferer(req, form, credentials.sessionID, "app")
+	}
+	return req, err
+}
 
+func submitDocument(ctx context.Context, credentials *PaperCutCredentials, printJob *PaperCutPrintJob) error {
+	req, err := newUploadRequest(ctx, credentials, printJob)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	defer resp.Body.Close()
+	// From here on the document may reach PaperCut even if no answer comes
+	// back, so submit checks the job list before uploading it again.
+	printJob.uploadAttempted = true
 
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(resp.Body)
-	html := buf.String()
+	// The body is read on a goroutine of the transport, so the progress is
+	// handed back to be sent to the sink from this one.
+	progress := newUploadProgress()
+	req.Body = ioutil.NopCloser(&progressReader{r: req.Body, total: req.ContentLength, report: progress.report})
 
-	re, err := regexp.Compile(`var uploadUID = '([0-9]*)'`) // want to know what is in front of 'at'
-	res := re.FindAllStringSubmatch(html, -1)
-	uploadID, err := strconv.Atoi(res[0][1])
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := sendOnce.do(ctx, "uploading the document", func() (*http.Request, error) {
+			return req, nil
+		})
+		done <- result{resp, err}
+	}()
+
+	var reported int64
+	emitProgress := func() {
+		read, total := progress.get()
+		if read > reported {
+			reported = read
+			e := printJob.event(EventUploading)
+			e.Bytes, e.Total = read, total
+			printJob.options.emit(e)
+		}
+	}
+	var r result
+	for waiting := true; waiting; {
+		select {
+		case <-progress.updated:
+			emitProgress()
+		case r = <-done:
+			waiting = false
+		}
+	}
+	emitProgress()
 
+	resp, err := r.resp, r.err
 	if err != nil {
-		log.Fatal(err)
+		sent, _ := progress.get()
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusUnauthorized {
+			return ErrSessionExpired
+		}
+		if sent > 0 && uploadMayHaveArrived(err) {
+			return fmt.Errorf("%v: %w", err, ErrUploadOutcomeUnknown)
+		}
+		return err
 	}
 
-	printJob.uploadID = uploadID
-}
+	defer resp.Body.Close()
+
+	io.Copy(ioutil.Discard, resp.Body)
 
-func submitDocument(credentials *PaperCutCredentials, printJob *PaperCutPrintJob) {
-	netClient := &http.Client{
-		Timeout: time.Second * 10,
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{Step: "uploading the document", StatusCode: resp.StatusCode, Status: resp.Status}
 	}
 
+	e := printJob.event(EventUploaded)
+	e.Bytes, e.Total = req.ContentLength, req.ContentLength
+	printJob.options.emit(e)
+
+	return nil
+}
+
+// newUploadRequest builds the upload of the document as a multipart form.
+func newUploadRequest(ctx context.Context, credentials *PaperCutCredentials, printJob *PaperCutPrintJob) (*http.Request, error) {
 	file, err := os.Open(printJob.fileLocationPath)
 	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+		return nil, err
 	}
 
 	fileContents, err := ioutil.ReadAll(file)
 	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+		file.Close()
+		return nil, err
 	}
 
 	fi, err := file.Stat()
 	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+		file.Close()
+		return nil, err
 	}
 
 	file.Close()
@@ -292,80 +752,126 @@ func submitDocument(credentials *PaperCutCredentials, printJob *PaperCutPrintJob
 	writer.SetBoundary("----WebKitFormBoundaryTy4GAUTgQRtwjfOn")
 	h := make(textproto.MIMEHeader)
 	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, "file[]", fi.Name()))
-	h.Set("Content-Type", "application/pdf")
+	h.Set("Content-Type", DetectType(printJob.fileLocationPath))
 	part, err := writer.CreatePart(h)
 
 	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+		return nil, err
 	}
 
 	part.Write(fileContents)
 
 	err = writer.Close()
 
-	//io.Copy(os.Stdout, body)
-
 	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+		return nil, err
 	}
 
-	uploadURL := baseURL + "/upload/" + strconv.Itoa(printJob.uploadID)
+	uploadURL := baseURL(ctx) + "/upload/" + strconv.Itoa(printJob.uploadID)
 
-	req, err := http.NewRequest("POST", uploadURL, body)
-
-	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req, err := http.NewRequestWithContext(ctx, "POST", uploadURL, body)
 
 	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+		return nil, err
 	}
-	addUploadHeaders(req, body, credentials.sessionID)
 
-	println(strconv.Itoa(printJob.uploadID))
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	addUploadHeaders(req, credentials.sessionID)
+
+	return req, nil
+}
+
+// formatRequest generates an ascii representation of a request with cookies
+// and passwords redacted. Uploaded files are summarised rather than dumped.
+func formatRequest(r *http.Request) string {
+	var request []string
+	request = append(request, fmt.Sprintf("%v %v %v", r.Method, redactURL(r.URL), r.Proto))
+	request = append(request, fmt.Sprintf("Host: %v", r.Host))
 
-	fmt.Println(formatRequest(req))
+	headers := redactHeaders(r.Header)
+	if r.ContentLength > 0 && headers.Get("Content-Length") == "" {
+		headers.Set("Content-Length", strconv.FormatInt(r.ContentLength, 10))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, h := range headers[name] {
+			request = append(request, fmt.Sprintf("%v: %v", strings.ToLower(name), h))
+		}
+	}
 
-	resp, err := netClient.Do(req)
+	if r.GetBody == nil {
+		return strings.Join(request, "\n")
+	}
 
+	body, err := r.GetBody()
 	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+		return strings.Join(request, "\n")
 	}
+	defer body.Close()
 
-	io.Copy(os.Stdout, resp.Body)
+	request = append(request, "")
+	request = append(request, formatBody(r.Header.Get("Content-Type"), body))
 
-	println("Test")
+	return strings.Join(request, "\n")
+}
 
-	defer resp.Body.Close()
+// formatBody renders a request body for formatRequest.
+func formatBody(contentType string, body io.Reader) string {
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		data, _ := ioutil.ReadAll(body)
+		form, err := url.ParseQuery(string(data))
+		if err != nil {
+			return fmt.Sprintf("[%d bytes of unparseable form data]", len(data))
+		}
+		encoded := redactForm(form).Encode()
+		if decoded, err := url.QueryUnescape(encoded); err == nil {
+			return decoded
+		}
+		return encoded
+
+	case strings.HasPrefix(mediaType, "multipart/"):
+		var parts []string
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				break
+			}
+			size, _ := io.Copy(ioutil.Discard, part)
+			parts = append(parts, fmt.Sprintf("[part %q filename=%q content-type=%q: %d bytes]",
+				part.FormName(), part.FileName(), part.Header.Get("Content-Type"), size))
+		}
+		return strings.Join(parts, "\n")
+	}
+
+	size, _ := io.Copy(ioutil.Discard, body)
+	return fmt.Sprintf("[%d bytes of %s]", size, mediaType)
 }
 
-// formatRequest generates ascii representation of a request
-func formatRequest(r *http.Request) string {
- // Create return string
- var request []string
- // Add the request string
- url := fmt.Sprintf("%v %v %v", r.Method, r.URL, r.Proto)
- request = append(request, url)
- // Add the host
- request = append(request, fmt.Sprintf("Host: %v", r.Host))
- // Loop through headers
- for name, headers := range r.Header {
-   name = strings.ToLower(name)
-   for _, h := range headers {
-     request = append(request, fmt.Sprintf("%v: %v", name, h))
-   }
- }
-
- // If this is a POST, add post data
- if r.Method == "POST" {
-    r.ParseForm()
-    request = append(request, "\n")
-    request = append(request, r.Form.Encode())
- }
-  // Return the request as a string
-  return strings.Join(request, "\n")
+// serverHost returns the host and port of the server of ctx.
+func serverHost(ctx context.Context) string {
+	if u, err := url.Parse(baseURL(ctx)); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return baseURL(ctx)
+}
+
+// serverOrigin returns the scheme and host of the server of ctx the way
+// browsers send it in the Origin header, without any path the server is
+// mounted under.
+func serverOrigin(ctx context.Context) string {
+	if u, err := url.Parse(baseURL(ctx)); err == nil && u.Host != "" {
+		return u.Scheme + "://" + u.Host
+	}
+	return baseURL(ctx)
 }
 
 func addGetHeaders(req *http.Request, jsessionid string) {
@@ -374,8 +880,8 @@ func addGetHeaders(req *http.Request, jsessionid string) {
 	req.Header.Add("Accept-Language", "en-US,en;q=0.8")
 	req.Header.Add("Connection", "keep-alive")
 	req.Header.Add("Cookie", "org.apache.tapestry.locale=en; JSESSIONID="+jsessionid)
-	req.Header.Add("Host", "paper-app.gonzaga.edu:9192")
-	req.Header.Add("Referer", "https://paper-app.gonzaga.edu:9192/app?service=page/UserWebPrint")
+	req.Header.Add("Host", serverHost(req.Context()))
+	req.Header.Add("Referer", baseURL(req.Context())+"/app?service=page/UserWebPrint")
 	req.Header.Add("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/57.0.2987.133 Safari/537.36")
 }
 
@@ -388,24 +894,23 @@ func addPostHeaders(req *http.Request, form url.Values, jessionid string) {
 	req.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 	req.Header.Add("Cookie", "org.apache.tapestry.locale=en;JSESSIONID="+jessionid)
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Add("Host", "paper-app.gonzaga.edu:9192")
-	req.Header.Add("Origin", "https://paper-app.gonzaga.edu:9192")
-	req.Header.Add("Referer", "https://paper-app.gonzaga.edu:9192/user")
+	req.Header.Add("Host", serverHost(req.Context()))
+	req.Header.Add("Origin", serverOrigin(req.Context()))
+	req.Header.Add("Referer", baseURL(req.Context())+"/user")
 	req.Header.Add("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/57.0.2987.133 Safari/537.36")
 
 }
 
-func addUploadHeaders(req *http.Request, body *bytes.Buffer, jessionid string) {
+func addUploadHeaders(req *http.Request, jessionid string) {
 	req.Header.Add("Accept", "application/json")
 	req.Header.Add("Accept-Encoding", "")
 	req.Header.Add("Accept-Language", "en-US,en;q=0.8")
 	req.Header.Add("Cache-Control", "no-cache")
 	req.Header.Add("Connection", "keep-alive")
 	req.Header.Add("Cookie", "JSESSIONID="+jessionid)
-	req.Header.Add("Content-Length", "18913")
-	req.Header.Add("Host", "paper-app.gonzaga.edu:9192")
-	req.Header.Add("Origin", "https://paper-app.gonzaga.edu:9192")
-	req.Header.Add("Referer", "https://paper-app.gonzaga.edu:9192/app")
+	req.Header.Add("Host", serverHost(req.Context()))
+	req.Header.Add("Origin", serverOrigin(req.Context()))
+	req.Header.Add("Referer", baseURL(req.Context())+"/app")
 	req.Header.Add("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/57.0.2987.133 Safari/537.36")
 	req.Header.Add("X-Requested-With", "XMLHttpRequest")
 
@@ -420,20 +925,21 @@ func addPostHeadersReferer(req *http.Request, form url.Values, jessionid string,
 	req.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 	req.Header.Add("Cookie", "org.apache.tapestry.locale=en;JSESSIONID="+jessionid)
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Add("Host", "paper-app.gonzaga.edu:9192")
-	req.Header.Add("Origin", "https://paper-app.gonzaga.edu:9192")
-	req.Header.Add("Referer", "https://paper-app.gonzaga.edu:9192/"+referer)
+	req.Header.Add("Host", serverHost(req.Context()))
+	req.Header.Add("Origin", serverOrigin(req.Context()))
+	req.Header.Add("Referer", baseURL(req.Context())+"/"+referer)
 	req.Header.Add("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/57.0.2987.133 Safari/537.36")
 
 }
 
-func isLoggedIn(loginResponse *http.Response) bool {
-	loggedIn := false
+// isLoginPage reports whether PaperCut, or the single sign-on page it
+// redirected to, answered with a login form.
+func isLoginPage(doc *goquery.Document) bool {
+	return doc.Find("input[type=password]").Length() > 0
+}
 
-	doc, err := goquery.NewDocumentFromResponse(loginResponse)
-	if err != nil {
-		log.Fatal(err)
-	}
+func isLoggedIn(doc *goquery.Document) bool {
+	loggedIn := false
 
 	doc.Find("title").Each(func(i int, s *goquery.Selection) {
 		title := s.Text()
@@ -445,6 +951,39 @@ func isLoggedIn(loginResponse *http.Response) bool {
 	return loggedIn
 }
 
+// parseBalance reads the account balance from the PaperCut summary page.
+func parseBalance(doc *goquery.Document) (float64, bool) {
+	var balance float64
+	found := false
+
+	doc.Find("#balance, .balance, .stat-bal .val").EachWithBreak(func(i int, s *goquery.Selection) bool {
+		balance, found = parseMoney(s.Text())
+		return !found
+	})
+
+	return balance, found
+}
+
+var moneyRe = regexp.MustCompile(`(-|\()?\s*[^0-9\s-]{0,3}\s*(-)?([0-9][0-9,]*(\.[0-9]+)?)`)
+
+// parseMoney extracts an amount such as "$1.25", "-$0.50" or "($0.50)".
+func parseMoney(text string) (float64, bool) {
+	m := moneyRe.FindStringSubmatch(strings.TrimSpace(text))
+	if m == nil {
+		return 0, false
+	}
+
+	amount, err := strconv.ParseFloat(strings.Replace(m[3], ",", "", -1), 64)
+	if err != nil {
+		return 0, false
+	}
+	if m[1] != "" || m[2] != "" {
+		amount = -amount
+	}
+
+	return amount, true
+}
+
 func getCookieByName(cookie []*http.Cookie, name string) string {
 	cookieLen := len(cookie)
 	result := ""
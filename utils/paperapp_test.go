@@ -0,0 +1,478 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quantamhd/gu/papercuttest"
+)
+
+const testPDF = "%PDF-1.4\n1 0 obj << /Type /Page >> endobj\n%%EOF\n"
+
+// newTestServer starts a fake PaperCut server and returns a context whose
+// calls go to it. Retries wait only a few milliseconds.
+func newTestServer(t *testing.T) (*papercuttest.Server, context.Context) {
+	t.Helper()
+	srv := papercuttest.NewServer()
+	t.Cleanup(srv.Close)
+
+	retry := Retry
+	Retry = RetryPolicy{MaxAttempts: 4, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	t.Cleanup(func() { Retry = retry })
+
+	return srv, WithServer(context.Background(), Server{URL: srv.URL})
+}
+
+// logIn logs in as the fake server's default user.
+func logIn(t *testing.T, ctx context.Context) *PaperCutCredentials {
+	t.Helper()
+	credentials, err := CreatePaperCutCredentials(ctx, "student", "password")
+	if err != nil {
+		t.Fatalf("logging in: %v", err)
+	}
+	if !credentials.IsLoggedIn() {
+		t.Fatal("logging in: not logged in")
+	}
+	return credentials
+}
+
+// testPrinter returns the printer called name from the fake server.
+func testPrinter(t *testing.T, ctx context.Context, credentials *PaperCutCredentials, name string) *PaperCutPrinter {
+	t.Helper()
+	printers, err := GetPaperCutPrinters(ctx, credentials)
+	if err != nil {
+		t.Fatalf("fetching printers: %v", err)
+	}
+	id, ok := FindPrinter(printers, name)
+	if !ok {
+		t.Fatalf("no printer %q in %v", name, printers)
+	}
+	printer := printers[id]
+	return &printer
+}
+
+// writeDocument writes a one page PDF called name to a temporary directory.
+func writeDocument(t *testing.T, name string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(testPDF), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoginAndPrinters(t *testing.T) {
+	_, ctx := newTestServer(t)
+	credentials := logIn(t, ctx)
+
+	if balance, ok := credentials.GetBalance(); !ok || balance != 10 {
+		t.Errorf("balance = %v, %v; want 10, true", balance, ok)
+	}
+
+	printers, err := GetPaperCutPrinters(ctx, credentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(printers) != 2 {
+		t.Fatalf("got %d printers, want 2: %v", len(printers), printers)
+	}
+	for id, want := range map[int]string{1: "library-bw", 2: "library-color"} {
+		if got := printers[id]; got.GetName() != want || got.GetID() != id {
+			t.Errorf("printer %d = %q (ID %d), want %q", id, got.GetName(), got.GetID(), want)
+		}
+	}
+	if cost, ok := printers[1].GetCostPerPage(); !ok || cost != 0.05 {
+		t.Errorf("cost per page = %v, %v; want 0.05, true", cost, ok)
+	}
+}
+
+func TestBadLogin(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	srv.Fail(papercuttest.BadLogin)
+
+	credentials, err := CreatePaperCutCredentials(ctx, "student", "password")
+	if err == nil && credentials.IsLoggedIn() {
+		t.Fatal("logged in although the server rejects every login")
+	}
+
+	if _, err := NewSession(ctx, "student", "password"); err == nil {
+		t.Fatal("NewSession succeeded although the server rejects every login")
+	}
+}
+
+func TestSubmitPrintJob(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	credentials := logIn(t, ctx)
+	printer := testPrinter(t, ctx, credentials, "library-color")
+
+	var events []EventType
+	job, err := SubmitPrintJob(ctx, credentials, printer, 2, writeDocument(t, "essay.pdf"),
+		WithEvents(func(e Event) {
+			if e.Type != EventUploading {
+				events = append(events, e.Type)
+			}
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploads := srv.Jobs()
+	if len(uploads) != 1 {
+		t.Fatalf("server has %d jobs, want 1", len(uploads))
+	}
+	upload := uploads[0]
+	if upload.Document != "essay.pdf" || upload.Printer != "library-color" || upload.Copies != 2 {
+		t.Errorf("server job = %s on %s, %d copies; want essay.pdf on library-color, 2 copies",
+			upload.Document, upload.Printer, upload.Copies)
+	}
+	if !bytes.Equal(upload.Data, []byte(testPDF)) {
+		t.Errorf("server got %q, want the document", upload.Data)
+	}
+
+	if job.GetDocumentName() != "essay.pdf" || job.GetPrinterName() != "library-color" ||
+		job.GetStatus() != JobStatusRendering || job.GetPages() != 2 || job.GetCost() != 0.5 {
+		t.Errorf("job = %v, cost %v", job.ToListStrings(), job.GetCost())
+	}
+
+	want := []EventType{EventLoggedIn, EventPrinterSelected, EventOptionsSubmitted, EventUploaded, EventRendering}
+	if len(events) != len(want) {
+		t.Fatalf("events = %v, want %v", events, want)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Fatalf("events = %v, want %v", events, want)
+		}
+	}
+}
+
+func TestExpiredSession(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	credentials := logIn(t, ctx)
+
+	srv.Fail(papercuttest.ExpiredSession)
+	if _, err := GetPaperCutPrintJobs(ctx, credentials); !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("job list on an expired session: err = %v, want ErrSessionExpired", err)
+	}
+	srv.Recover()
+
+	session, err := NewSession(ctx, "student", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.FailNext(papercuttest.ExpiredSession, 1)
+	if _, err := session.Jobs(ctx); err != nil {
+		t.Fatalf("Session.Jobs did not log in again: %v", err)
+	}
+}
+
+func TestRejectUpload(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	credentials := logIn(t, ctx)
+	printer := testPrinter(t, ctx, credentials, "library-bw")
+
+	srv.Fail(papercuttest.RejectUpload)
+	if err := CreatePrintJob(ctx, credentials, printer, 1, writeDocument(t, "essay.pdf")); err == nil {
+		t.Fatal("CreatePrintJob succeeded although the upload was rejected")
+	}
+	if jobs := srv.Jobs(); len(jobs) != 0 {
+		t.Fatalf("server has %d jobs, want none", len(jobs))
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	credentials := logIn(t, ctx)
+	printer := testPrinter(t, ctx, credentials, "library-bw")
+
+	// The fake asks for a one second pause, which MaxDelay has to allow.
+	Retry.MaxDelay = 2 * time.Second
+	srv.FailNext(papercuttest.Unavailable, 1)
+	if err := CreatePrintJob(ctx, credentials, printer, 1, writeDocument(t, "essay.pdf")); err != nil {
+		t.Fatalf("CreatePrintJob did not retry: %v", err)
+	}
+	if jobs := srv.Jobs(); len(jobs) != 1 {
+		t.Fatalf("server has %d jobs, want 1", len(jobs))
+	}
+
+	Retry.MaxDelay = 10 * time.Millisecond
+	srv.Fail(papercuttest.Unavailable)
+	start := time.Now()
+	err := CreatePrintJob(ctx, credentials, printer, 1, writeDocument(t, "notes.pdf"))
+	if err == nil || !IsTemporary(err) {
+		t.Fatalf("err = %v, want a temporary error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("CreatePrintJob took %v; a pause above MaxDelay should end it at once", elapsed)
+	}
+}
+
+func TestLostUploadResponse(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	credentials := logIn(t, ctx)
+	printer := testPrinter(t, ctx, credentials, "library-bw")
+
+	srv.FailNext(papercuttest.LostUploadResponse, 1)
+	job, err := SubmitPrintJob(ctx, credentials, printer, 1, writeDocument(t, "essay.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if jobs := srv.Jobs(); len(jobs) != 1 {
+		t.Fatalf("server has %d jobs, want 1: the document was sent again", len(jobs))
+	}
+	if job.GetDocumentName() != "essay.pdf" {
+		t.Errorf("job is %s, want essay.pdf", job.GetDocumentName())
+	}
+}
+
+// dropUploads reads every upload to the end and then drops the connection
+// before it reaches the server, as if the answer was lost.
+type dropUploads struct {
+	uploads int
+}
+
+func (d *dropUploads) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasPrefix(req.URL.Path, "/upload/") {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+	d.uploads++
+	ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	return nil, &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+}
+
+func TestUploadOutcomeUnknown(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	credentials := logIn(t, ctx)
+	printer := testPrinter(t, ctx, credentials, "library-bw")
+
+	transport := &dropUploads{}
+	ctx = WithServer(ctx, Server{URL: srv.URL, Transport: transport})
+	err := CreatePrintJob(ctx, credentials, printer, 1, writeDocument(t, "essay.pdf"))
+	if !errors.Is(err, ErrUploadOutcomeUnknown) {
+		t.Fatalf("err = %v, want ErrUploadOutcomeUnknown", err)
+	}
+	if IsTemporary(err) {
+		t.Errorf("%v is temporary, so callers would send the document again", err)
+	}
+	if transport.uploads != 1 {
+		t.Errorf("the document was uploaded %d times, want once", transport.uploads)
+	}
+}
+
+func TestBusyUploadIsRetried(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	credentials := logIn(t, ctx)
+	printer := testPrinter(t, ctx, credentials, "library-bw")
+	path := writeDocument(t, "essay.pdf")
+
+	ctx = WithServer(ctx, Server{URL: srv.URL, Transport: &busyUploads{}})
+	if err := CreatePrintJob(ctx, credentials, printer, 1, path); err != nil {
+		t.Fatal(err)
+	}
+	if jobs := srv.Jobs(); len(jobs) != 1 {
+		t.Fatalf("server has %d jobs, want 1", len(jobs))
+	}
+}
+
+// busyUploads answers the first upload with 503 Service Unavailable without
+// passing it on.
+type busyUploads struct {
+	answered bool
+}
+
+func (b *busyUploads) RoundTrip(req *http.Request) (*http.Response, error) {
+	if b.answered || !strings.HasPrefix(req.URL.Path, "/upload/") {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+	b.answered = true
+	ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	return &http.Response{
+		Status:     "503 Service Unavailable",
+		StatusCode: http.StatusServiceUnavailable,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+func TestInterruptBeforeUpload(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	credentials := logIn(t, ctx)
+	printer := testPrinter(t, ctx, credentials, "library-bw")
+	srv.OnUpload = func(papercuttest.Job) { t.Error("the interrupted job was uploaded") }
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	_, err := SubmitPrintJob(ctx, credentials, printer, 1, writeDocument(t, "essay.pdf"),
+		WithEvents(func(e Event) {
+			if e.Type == EventPrinterSelected {
+				cancel()
+			}
+		}))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if jobs := srv.Jobs(); len(jobs) != 0 {
+		t.Fatalf("server has %d jobs, want none", len(jobs))
+	}
+}
+
+func TestInterruptDuringUpload(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	credentials := logIn(t, ctx)
+	printer := testPrinter(t, ctx, credentials, "library-bw")
+
+	// The document reaches PaperCut, but the interrupt comes before the
+	// answer does.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ctx = WithServer(ctx, Server{URL: srv.URL, Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if !strings.HasPrefix(req.URL.Path, "/upload/") {
+			return http.DefaultTransport.RoundTrip(req)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		cancel()
+		return nil, context.Canceled
+	})})
+
+	_, err := SubmitPrintJob(ctx, credentials, printer, 1, writeDocument(t, "essay.pdf"))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if jobs := srv.Jobs(); len(jobs) != 1 || jobs[0].Status != papercuttest.StatusCancelled {
+		t.Fatalf("server jobs = %v, want the uploaded job cancelled", jobs)
+	}
+	if balance := srv.Balance("student"); balance != 10 {
+		t.Errorf("balance = %v, want 10 after the refund", balance)
+	}
+}
+
+func TestServerHostAndOrigin(t *testing.T) {
+	tests := []struct {
+		url    string
+		host   string
+		origin string
+	}{
+		{"https://paper-app.gonzaga.edu:9192", "paper-app.gonzaga.edu:9192", "https://paper-app.gonzaga.edu:9192"},
+		{"https://print.example.edu/papercut/", "print.example.edu", "https://print.example.edu"},
+		{"http://10.0.0.5:9191/a/b", "10.0.0.5:9191", "http://10.0.0.5:9191"},
+		{"paper-app", "paper-app", "paper-app"},
+	}
+
+	for _, test := range tests {
+		ctx := WithServer(context.Background(), Server{URL: test.url})
+		if got := serverHost(ctx); got != test.host {
+			t.Errorf("serverHost(%s) = %q, want %q", test.url, got, test.host)
+		}
+		if got := serverOrigin(ctx); got != test.origin {
+			t.Errorf("serverOrigin(%s) = %q, want %q", test.url, got, test.origin)
+		}
+	}
+}
+
+func TestHeadersFollowServer(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	mounted := srv.URL + "/papercut"
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	// The fake serves from the root, so the mount point is taken off on
+	// the way to it.
+	var headers []http.Header
+	ctx = WithServer(ctx, Server{URL: mounted + "/", Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		headers = append(headers, req.Header.Clone())
+		req = req.Clone(req.Context())
+		req.URL.Path = strings.TrimPrefix(req.URL.Path, "/papercut")
+		return http.DefaultTransport.RoundTrip(req)
+	})})
+
+	credentials := logIn(t, ctx)
+	printer := testPrinter(t, ctx, credentials, "library-bw")
+	if err := CreatePrintJob(ctx, credentials, printer, 1, writeDocument(t, "essay.pdf")); err != nil {
+		t.Fatal(err)
+	}
+
+	origins := 0
+	for _, h := range headers {
+		if got := h.Get("Host"); got != "" && got != host {
+			t.Errorf("Host = %q, want %q", got, host)
+		}
+		if got := h.Get("Origin"); got != "" {
+			origins++
+			if got != srv.URL {
+				t.Errorf("Origin = %q, want %q without the mount point", got, srv.URL)
+			}
+		}
+		if got := h.Get("Referer"); got != "" && !strings.HasPrefix(got, mounted+"/") {
+			t.Errorf("Referer = %q, want a page under %s", got, mounted)
+		}
+	}
+	if origins == 0 {
+		t.Errorf("none of %d requests had an Origin header", len(headers))
+	}
+}
+
+func TestDryRunPrintJob(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	credentials := logIn(t, ctx)
+	printer := testPrinter(t, ctx, credentials, "library-bw")
+
+	requests := 0
+	srv.OnUpload = func(papercuttest.Job) { t.Error("the dry run uploaded the document") }
+	ctx = WithServer(ctx, Server{URL: srv.URL, Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		requests++
+		return http.DefaultTransport.RoundTrip(req)
+	})})
+
+	out := new(bytes.Buffer)
+	if err := DryRunPrintJob(ctx, credentials, printer, 2, writeDocument(t, "essay.pdf"), out); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 0 {
+		t.Errorf("the dry run sent %d requests", requests)
+	}
+
+	shown := out.String()
+	for _, want := range []string{
+		"inputPassword=" + redacted,
+		"$ActionLink",
+		"$RadioGroup=1",
+		"copies=2",
+		"/upload/0 HTTP/1.1",
+		`filename="essay.pdf"`,
+	} {
+		if !strings.Contains(shown, want) {
+			t.Errorf("the dry run does not show %q:\n%s", want, shown)
+		}
+	}
+	upload := shown[strings.Index(shown, "/upload/0"):]
+	if m := regexp.MustCompile(`content-length: (\d+)`).FindStringSubmatch(upload); m == nil {
+		t.Error("the upload has no content-length")
+	} else if n, _ := strconv.Atoi(m[1]); n <= len(testPDF) || n > len(testPDF)+512 {
+		t.Errorf("the upload has content-length %d for a %d byte document", n, len(testPDF))
+	}
+	if strings.Contains(shown, "password&") || strings.Contains(shown, credentials.GetSessionID()) {
+		t.Errorf("the dry run shows a secret:\n%s", shown)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// secretFormFields are form fields whose values never leave the process
+// in dumps or logs.
+var secretFormFields = map[string]bool{
+	"inputpassword": true,
+	"password":      true,
+	"passwd":        true,
+}
+
+// secretQueryParams are URL parameters that carry sessions or single sign-on
+// tickets, which can be replayed to log in as the user.
+var secretQueryParams = map[string]bool{
+	"jsessionid":   true,
+	"ticket":       true,
+	"samlresponse": true,
+}
+
+// secretHeaders are headers whose whole value is replaced when redacting.
+var secretHeaders = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+}
+
+// redactHeader hides credentials carried in a header value. Cookie values
+// are replaced one by one so the cookie names stay visible.
+func redactHeader(name string, value string) string {
+	switch strings.ToLower(name) {
+	case "cookie":
+		return redactCookies(value)
+	case "location":
+		if u, err := url.Parse(value); err == nil {
+			return redactURL(u)
+		}
+		return value
+	case "set-cookie":
+		if i := strings.Index(value, "="); i >= 0 {
+			end := strings.Index(value, ";")
+			if end < 0 {
+				return value[:i+1] + redacted
+			}
+			return value[:i+1] + redacted + value[end:]
+		}
+		return value
+	}
+	if secretHeaders[strings.ToLower(name)] {
+		return redacted
+	}
+	return value
+}
+
+func redactCookies(value string) string {
+	cookies := strings.Split(value, ";")
+	for i, cookie := range cookies {
+		if eq := strings.Index(cookie, "="); eq >= 0 {
+			cookies[i] = cookie[:eq+1] + redacted
+		}
+	}
+	return strings.Join(cookies, ";")
+}
+
+// redactHeaders returns a copy of h with credentials hidden.
+func redactHeaders(h http.Header) http.Header {
+	clean := http.Header{}
+	for name, values := range h {
+		for _, v := range values {
+			clean[name] = append(clean[name], redactHeader(name, v))
+		}
+	}
+	return clean
+}
+
+// redactForm returns a copy of form with password, session and ticket
+// fields hidden. It is used for query strings too.
+func redactForm(form url.Values) url.Values {
+	clean := url.Values{}
+	for name, values := range form {
+		for _, v := range values {
+			if lower := strings.ToLower(name); secretFormFields[lower] || secretQueryParams[lower] {
+				v = redacted
+			}
+			clean.Add(name, v)
+		}
+	}
+	return clean
+}
+
+// redactURL hides session identifiers and tickets passed in the URL, such
+// as ;jsessionid= path parameters or CAS service tickets.
+func redactURL(u *url.URL) string {
+	clean := *u
+	if i := strings.Index(strings.ToLower(clean.Path), ";jsessionid="); i >= 0 {
+		clean.Path = clean.Path[:i] + ";jsessionid=" + redacted
+		clean.RawPath = ""
+	}
+
+	query := clean.Query()
+	changed := false
+	for name := range query {
+		lower := strings.ToLower(name)
+		if secretFormFields[lower] || secretQueryParams[lower] {
+			query.Set(name, redacted)
+			changed = true
+		}
+	}
+	if changed {
+		clean.RawQuery = query.Encode()
+	}
+
+	return clean.String()
+}
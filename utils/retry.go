@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ErrSessionExpired is returned when PaperCut answers a logged in page with
+// the login form, so the wizard cannot continue without logging in again.
+var ErrSessionExpired = errors.New("the PaperCut session has expired")
+
+/*
+RetryPolicy decides how often a failed request to PaperCut is sent again.
+Attempt n waits about BaseDelay * 2^(n-1), capped at MaxDelay and jittered
+so that many clients do not retry in step. A Retry-After header from the
+server is used instead when it is present; when it asks for a longer wait
+than MaxDelay the request is not retried.
+*/
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// Retry is the policy used for every step of the print wizard.
+var Retry = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+}
+
+// sendOnce is used for requests that must not be repeated on their own.
+var sendOnce = RetryPolicy{MaxAttempts: 1}
+
+// StatusError is a response PaperCut answered with an unexpected status.
+type StatusError struct {
+	Step       string
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return e.Step + ": PaperCut answered " + e.Status
+}
+
+// Temporary reports whether the request may succeed if sent again.
+func (e *StatusError) Temporary() bool {
+	return retryableStatus(e.StatusCode)
+}
+
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// IsTemporary reports whether err is a transient failure that may go away
+// if the same thing is tried again later.
+func IsTemporary(err error) bool {
+	return isRetryable(err)
+}
+
+/*
+isRetryable reports whether err is a transient failure: a timeout, a
+dropped or refused connection, or a status such as 503 that asks the
+client to come back later. Certificate errors and cancellations are final.
+*/
+func isRetryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Temporary()
+	}
+
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+
+	var certErr x509.CertificateInvalidError
+	var authorityErr x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	if errors.As(err, &certErr) || errors.As(err, &authorityErr) || errors.As(err, &hostErr) {
+		return false
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+/*
+delay returns how long to wait before attempt+1, honouring the Retry-After
+carried by err. It reports false when the server asked for a longer wait
+than MaxDelay.
+*/
+func (p RetryPolicy) delay(attempt int, err error) (time.Duration, bool) {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+		if p.MaxDelay > 0 && statusErr.RetryAfter > p.MaxDelay {
+			return 0, false
+		}
+		return statusErr.RetryAfter, true
+	}
+
+	backoff := p.BaseDelay << uint(attempt-1)
+	if backoff <= 0 || (p.MaxDelay > 0 && backoff > p.MaxDelay) {
+		backoff = p.MaxDelay
+	}
+	if backoff <= 0 {
+		return 0, true
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)), true
+}
+
+/*
+do sends the request built by newRequest, building it again for every
+attempt, until it gets an answer that is not a transient failure,
+MaxAttempts is reached or ctx is done. Responses with a 2xx or 3xx status
+are returned, any other status is turned into a *StatusError.
+*/
+func (p RetryPolicy) do(ctx context.Context, step string, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	return p.doWith(ctx, newClient(ctx), step, newRequest)
+}
+
+// doWith is do with a client of the caller's, such as one with a cookie jar.
+func (p RetryPolicy) doWith(ctx context.Context, netClient *http.Client, step string, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := netClient.Do(req)
+		if err == nil {
+			if resp.StatusCode < 400 {
+				return resp, nil
+			}
+			err = &StatusError{
+				Step:       step,
+				StatusCode: resp.StatusCode,
+				Status:     resp.Status,
+				RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		if _, ok := err.(*StatusError); !ok {
+			err = fmt.Errorf("%s: %w", step, err)
+		}
+		if !isRetryable(err) || p.MaxAttempts <= 1 || ctx.Err() != nil {
+			return nil, err
+		}
+		if attempt >= p.MaxAttempts {
+			return nil, fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+
+		wait, ok := p.delay(attempt, err)
+		if !ok {
+			return nil, fmt.Errorf("PaperCut asked to wait before trying again: %w", err)
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sleep waits for d or until ctx is done, whichever comes first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as a date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(when); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
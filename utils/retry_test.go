@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDelay(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 4, BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+	busy := func(wait time.Duration) error {
+		return &StatusError{StatusCode: http.StatusServiceUnavailable, RetryAfter: wait}
+	}
+
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		err    error
+		want   time.Duration
+		wantOK bool
+	}{
+		{"within MaxDelay", policy, busy(5 * time.Second), 5 * time.Second, true},
+		{"at MaxDelay", policy, busy(10 * time.Second), 10 * time.Second, true},
+		{"above MaxDelay", policy, busy(2 * time.Minute), 0, false},
+		{"no MaxDelay", RetryPolicy{BaseDelay: time.Second}, busy(2 * time.Minute), 2 * time.Minute, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := test.policy.delay(1, test.err)
+			if got != test.want || ok != test.wantOK {
+				t.Errorf("delay = %v, %t, want %v, %t", got, ok, test.want, test.wantOK)
+			}
+		})
+	}
+
+	for attempt := 1; attempt <= 6; attempt++ {
+		got, ok := policy.delay(attempt, nil)
+		backoff := policy.BaseDelay << uint(attempt-1)
+		if backoff > policy.MaxDelay {
+			backoff = policy.MaxDelay
+		}
+		if !ok || got < backoff/2 || got > backoff {
+			t.Errorf("attempt %d: delay = %v, %t, want between %v and %v", attempt, got, ok, backoff/2, backoff)
+		}
+	}
+}
+
+// busyServer answers every request with 503 and the given Retry-After
+// until it has seen fail of them.
+func busyServer(t *testing.T, retryAfter string, fail int32) (*httptest.Server, *int32) {
+	t.Helper()
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= fail {
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestLongRetryAfterIsNotRetried(t *testing.T) {
+	srv, requests := busyServer(t, "120", 100)
+	policy := RetryPolicy{MaxAttempts: 4, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+
+	start := time.Now()
+	_, err := policy.do(context.Background(), "test", func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, srv.URL, nil)
+	})
+	if err == nil {
+		t.Fatal("do succeeded against a busy server")
+	}
+	if !IsTemporary(err) {
+		t.Errorf("%v is not temporary", err)
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Errorf("server got %d requests, want 1", n)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("do took %v, it should give up at once", elapsed)
+	}
+}
+
+func TestShortRetryAfterIsRetried(t *testing.T) {
+	srv, requests := busyServer(t, "1", 1)
+	policy := RetryPolicy{MaxAttempts: 4, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Second}
+
+	resp, err := policy.do(context.Background(), "test", func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, srv.URL, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if n := atomic.LoadInt32(requests); n != 2 {
+		t.Errorf("server got %d requests, want 2", n)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if got := parseRetryAfter("30"); got != 30*time.Second {
+		t.Errorf("parseRetryAfter(30) = %v, want 30s", got)
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(date); got < 55*time.Second || got > time.Minute {
+		t.Errorf("parseRetryAfter(%q) = %v, want about a minute", date, got)
+	}
+	past := time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)
+	for _, value := range []string{"", "0", "-5", "soon", past} {
+		if got := parseRetryAfter(value); got != 0 {
+			t.Errorf("parseRetryAfter(%q) = %v, want 0", value, got)
+		}
+	}
+}
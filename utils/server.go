@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+/*
+Server is a PaperCut server and how to reach it. BaseURL, Transport and Auth
+set the server for the whole program; a Server attached to a context with
+WithServer takes their place for the calls made with that context, so that
+one program can use several servers at once. Empty fields fall back to the
+package variables.
+*/
+type Server struct {
+	URL       string
+	Transport http.RoundTripper
+	Auth      Authenticator
+}
+
+type serverKey struct{}
+
+// WithServer returns a context whose calls go to server.
+func WithServer(ctx context.Context, server Server) context.Context {
+	return context.WithValue(ctx, serverKey{}, server)
+}
+
+// currentServer returns the server for calls made with ctx.
+func currentServer(ctx context.Context) Server {
+	server, _ := ctx.Value(serverKey{}).(Server)
+	server.URL = strings.TrimSuffix(server.URL, "/")
+	if server.URL == "" {
+		server.URL = BaseURL
+	}
+	if server.Transport == nil {
+		server.Transport = Transport
+	}
+	if server.Auth == nil {
+		server.Auth = Auth
+	}
+	return server
+}
+
+// baseURL returns the address of the server for calls made with ctx.
+func baseURL(ctx context.Context) string {
+	return currentServer(ctx).URL
+}
@@ -0,0 +1,218 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+/*
+Session keeps a PaperCut login alive for commands that run for a long time,
+such as servers. When PaperCut expires the session, the call is made again
+after logging in with the same username and password.
+*/
+type Session struct {
+	username string
+	password string
+
+	mu          sync.Mutex
+	credentials *PaperCutCredentials
+
+	// wizard lets one document at a time through the print wizard, whose
+	// state PaperCut keeps per session.
+	wizard chan struct{}
+}
+
+// NewSession logs in and returns a session for username.
+func NewSession(ctx context.Context, username string, password string) (*Session, error) {
+	s := &Session{username: username, password: password, wizard: make(chan struct{}, 1)}
+	if _, err := s.login(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+/*
+ResumeSession carries on with a PaperCut session started earlier, given its
+ID, such as one saved by another gu process. When it has expired, it logs
+in again with password, or returns ErrSessionExpired if there is none.
+*/
+func ResumeSession(ctx context.Context, username string, password string, sessionID string) (*Session, error) {
+	s := &Session{username: username, password: password, wizard: make(chan struct{}, 1)}
+
+	if sessionID != "" {
+		s.credentials = &PaperCutCredentials{username: username, password: password, sessionID: sessionID, isLoggedIn: true}
+		_, err := GetPaperCutPrintJobs(ctx, s.credentials)
+		if err == nil {
+			return s, nil
+		}
+		if !errors.Is(err, ErrSessionExpired) {
+			return nil, err
+		}
+	}
+
+	if password == "" {
+		return nil, ErrSessionExpired
+	}
+	if _, err := s.login(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Session) GetUsername() string {
+	return s.username
+}
+
+// GetCredentials returns the credentials of the current login.
+func (s *Session) GetCredentials() *PaperCutCredentials {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.credentials
+}
+
+func (s *Session) login(ctx context.Context) (*PaperCutCredentials, error) {
+	credentials, err := CreatePaperCutCredentials(ctx, s.username, s.password)
+	if err != nil {
+		return nil, err
+	}
+	if !credentials.IsLoggedIn() {
+		return nil, errors.New("the username or password was not accepted")
+	}
+
+	s.mu.Lock()
+	s.credentials = credentials
+	s.mu.Unlock()
+	return credentials, nil
+}
+
+// do runs call with the current credentials, logging in again once if the
+// session has expired.
+func (s *Session) do(ctx context.Context, call func(*PaperCutCredentials) error) error {
+	err := call(s.GetCredentials())
+	if !errors.Is(err, ErrSessionExpired) {
+		return err
+	}
+
+	credentials, err := s.login(ctx)
+	if err != nil {
+		return err
+	}
+	return call(credentials)
+}
+
+// Printers returns the printers offered for web print.
+func (s *Session) Printers(ctx context.Context) (map[int]PaperCutPrinter, error) {
+	var printers map[int]PaperCutPrinter
+	err := s.do(ctx, func(credentials *PaperCutCredentials) error {
+		var err error
+		printers, err = GetPaperCutPrinters(ctx, credentials)
+		return err
+	})
+	return printers, err
+}
+
+/*
+Submit sends a document to printer, see SubmitPrintJob. Documents are sent
+one after the other; Submit waits for its turn until ctx is done. A job
+whose session expired on the way is sent again after logging in, so its
+events may repeat the wizard steps.
+*/
+func (s *Session) Submit(ctx context.Context, printer *PaperCutPrinter, copies int, filePath string, opts ...PrintOption) (PaperCutJob, error) {
+	printJob := newPrintJob(printer, copies, filePath, opts)
+
+	select {
+	case s.wizard <- struct{}{}:
+		defer func() { <-s.wizard }()
+	case <-ctx.Done():
+		return PaperCutJob{}, printJob.failed(ctx.Err())
+	}
+
+	var job PaperCutJob
+	err := s.do(ctx, func(credentials *PaperCutCredentials) error {
+		var err error
+		job, err = printJob.submitAndFind(ctx, credentials)
+		return err
+	})
+	return job, printJob.failed(err)
+}
+
+/*
+Watch follows job until it has reached a final status, see
+WatchPrintJob.
+*/
+func (s *Session) Watch(ctx context.Context, job PaperCutJob, interval time.Duration, opts ...PrintOption) (PaperCutJob, error) {
+	return watchJob(ctx, func() ([]PaperCutJob, error) {
+		return s.Jobs(ctx)
+	}, job, interval, newPrintOptions(opts))
+}
+
+// Jobs returns the recent web print jobs, see GetPaperCutPrintJobs.
+func (s *Session) Jobs(ctx context.Context) ([]PaperCutJob, error) {
+	var jobs []PaperCutJob
+	err := s.do(ctx, func(credentials *PaperCutCredentials) error {
+		var err error
+		jobs, err = GetPaperCutPrintJobs(ctx, credentials)
+		return err
+	})
+	return jobs, err
+}
+
+// Cancel cancels a job that has not printed yet, see CancelPrintJob.
+func (s *Session) Cancel(ctx context.Context, jobID string) error {
+	return s.do(ctx, func(credentials *PaperCutCredentials) error {
+		return CancelPrintJob(ctx, credentials, jobID)
+	})
+}
+
+// Balance returns the current account balance, see GetPaperCutBalance.
+func (s *Session) Balance(ctx context.Context) (float64, error) {
+	var balance float64
+	err := s.do(ctx, func(credentials *PaperCutCredentials) error {
+		var err error
+		balance, err = GetPaperCutBalance(ctx, credentials)
+		return err
+	})
+	return balance, err
+}
+
+// Transactions returns the recent transactions, see GetPaperCutTransactions.
+func (s *Session) Transactions(ctx context.Context) ([]PaperCutTransaction, error) {
+	var transactions []PaperCutTransaction
+	err := s.do(ctx, func(credentials *PaperCutCredentials) error {
+		var err error
+		transactions, err = GetPaperCutTransactions(ctx, credentials)
+		return err
+	})
+	return transactions, err
+}
+
+/*
+Logout ends the PaperCut session, see Logout. The session must not be used
+afterwards.
+*/
+func (s *Session) Logout(ctx context.Context) error {
+	return Logout(ctx, s.GetCredentials())
+}
+
+/*
+KeepAlive fetches the job list every interval until ctx is done, so that
+PaperCut does not end an idle session. A session that expired anyway is
+logged in again. Failures are passed to report.
+*/
+func (s *Session) KeepAlive(ctx context.Context, interval time.Duration, report func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.Jobs(ctx); err != nil && ctx.Err() == nil {
+				report(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionInBodyRe finds session identifiers PaperCut embeds in links when a
+// page is served before the session cookie is set.
+var sessionInBodyRe = regexp.MustCompile(`(?i)(jsessionid=)[^&;?#"'\s<>]+`)
+
+// TraceTransport logs every request and response to Out with credentials
+// redacted.
+type TraceTransport struct {
+	Next http.RoundTripper
+	Out  io.Writer
+}
+
+// RoundTrip logs req, forwards it and logs the response.
+func (t *TraceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	fmt.Fprintf(t.Out, "> %s %s\n", req.Method, redactURL(req.URL))
+	writeTraceHeaders(t.Out, "> ", req.Header)
+
+	resp, err := t.Next.RoundTrip(req)
+	elapsed := time.Since(start)
+
+	if err != nil {
+		fmt.Fprintf(t.Out, "< error after %v: %v\n\n", elapsed, err)
+		return resp, err
+	}
+
+	fmt.Fprintf(t.Out, "< %s (%v)\n", resp.Status, elapsed)
+	writeTraceHeaders(t.Out, "< ", resp.Header)
+	fmt.Fprintln(t.Out)
+
+	return resp, nil
+}
+
+func writeTraceHeaders(w io.Writer, prefix string, h http.Header) {
+	clean := redactHeaders(h)
+	names := make([]string, 0, len(clean))
+	for name := range clean {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, v := range clean[name] {
+			fmt.Fprintf(w, "%s%s: %s\n", prefix, name, v)
+		}
+	}
+}
+
+/*
+HARRecorder records requests and responses in HAR 1.2 format. The archive is
+rewritten to Path after every exchange, so a session that ends in a fatal
+error can still be shared. Passwords, cookies and session IDs are redacted,
+the account name is replaced, uploaded files are replaced by a summary and
+response bodies are left out.
+*/
+type HARRecorder struct {
+	Next http.RoundTripper
+	Path string
+
+	mu      sync.Mutex
+	entries []harEntry
+}
+
+type harLog struct {
+	Log harContent `json:"log"`
+}
+
+type harContent struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harBody        `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+	Comment     string         `json:"comment,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string         `json:"mimeType"`
+	Params   []harNameValue `json:"params,omitempty"`
+	Text     string         `json:"text"`
+}
+
+type harBody struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// RoundTrip forwards req and appends the exchange to the archive.
+func (h *HARRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	entry := harEntry{
+		StartedDateTime: start.Format(time.RFC3339Nano),
+		Request:         harRequestFor(req),
+	}
+
+	resp, err := h.Next.RoundTrip(req)
+	if err != nil {
+		entry.Response = harResponse{Comment: err.Error(), Cookies: []harNameValue{}, Headers: []harNameValue{}}
+		h.add(entry, start)
+		return resp, err
+	}
+
+	waited := time.Since(start)
+
+	body, readErr := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	entry.Response = harResponseFor(resp, body)
+	entry.Timings = harTimings{Wait: ms(waited), Receive: ms(time.Since(start) - waited)}
+	h.add(entry, start)
+
+	return resp, readErr
+}
+
+func (h *HARRecorder) add(entry harEntry, start time.Time) {
+	entry.Time = ms(time.Since(start))
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.entries = append(h.entries, entry)
+	if err := h.save(); err != nil {
+		fmt.Printf("Could not write HAR file %s: %v\n", h.Path, err)
+	}
+}
+
+func (h *HARRecorder) save() error {
+	data := new(bytes.Buffer)
+	encoder := json.NewEncoder(data)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+
+	err := encoder.Encode(harLog{harContent{
+		Version: "1.2",
+		Creator: harCreator{Name: "gu", Version: "dev"},
+		Entries: h.entries,
+	}})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(h.Path, data.Bytes(), 0600)
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func harRequestFor(req *http.Request) harRequest {
+	r := harRequest{
+		Method:      req.Method,
+		URL:         redactURL(req.URL),
+		HTTPVersion: req.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(req.Header),
+		QueryString: []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    req.ContentLength,
+	}
+
+	for _, c := range req.Cookies() {
+		r.Cookies = append(r.Cookies, harNameValue{c.Name, redacted})
+	}
+
+	query, _ := url.ParseQuery(req.URL.RawQuery)
+	for name, values := range redactForm(query) {
+		for _, v := range values {
+			r.QueryString = append(r.QueryString, harNameValue{name, v})
+		}
+	}
+
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			contentType := req.Header.Get("Content-Type")
+			r.PostData = &harPostData{MimeType: contentType}
+
+			if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+				data, _ := ioutil.ReadAll(body)
+				form, _ := url.ParseQuery(string(data))
+				clean := redactForm(form)
+				for name := range clean {
+					if usernameFields[name] {
+						clean.Set(name, anonymousUser)
+					}
+				}
+				for name, values := range clean {
+					for _, v := range values {
+						r.PostData.Params = append(r.PostData.Params, harNameValue{name, v})
+					}
+				}
+				r.PostData.Text = clean.Encode()
+			} else {
+				r.PostData.Text = formatBody(contentType, body)
+			}
+			body.Close()
+		}
+	}
+
+	return r
+}
+
+func harResponseFor(resp *http.Response, body []byte) harResponse {
+	r := harResponse{
+		Status:      resp.StatusCode,
+		StatusText:  http.StatusText(resp.StatusCode),
+		HTTPVersion: resp.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(resp.Header),
+		RedirectURL: redactHeader("Location", resp.Header.Get("Location")),
+		HeadersSize: -1,
+		BodySize:    int64(len(body)),
+	}
+
+	for _, c := range resp.Cookies() {
+		r.Cookies = append(r.Cookies, harNameValue{c.Name, redacted})
+	}
+
+	// Pages carry the user's name, balance and job history, so only their
+	// size is kept; --record saves them anonymised.
+	r.Content = harBody{Size: int64(len(body)), MimeType: resp.Header.Get("Content-Type")}
+	if len(body) > 0 {
+		r.Comment = "body left out"
+	}
+
+	return r
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	headers := []harNameValue{}
+	clean := redactHeaders(h)
+	for name, values := range clean {
+		for _, v := range values {
+			headers = append(headers, harNameValue{name, v})
+		}
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].Name < headers[j].Name })
+	return headers
+}
+
+func isTextual(contentType string) bool {
+	contentType = baseMIMEType(contentType)
+	return strings.HasPrefix(contentType, "text/") ||
+		strings.HasSuffix(contentType, "json") ||
+		strings.HasSuffix(contentType, "xml") ||
+		strings.HasSuffix(contentType, "javascript")
+}
@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// secretServer answers the login form with a redirect carrying the session
+// in the URL, and a page with the user's name and balance.
+func secretServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "cookie-secret", Path: "/"})
+		if r.Method == "POST" {
+			w.Header().Set("Location", "/app;jsessionid=url-secret?service=page/UserSummary&ticket=ST-secret")
+			w.WriteHeader(http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<p>Logged in as Jane Doe, balance $12.34</p>`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func sendSecrets(t *testing.T, transport http.RoundTripper, server string) {
+	t.Helper()
+	client := &http.Client{
+		Transport:     transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	form := url.Values{"inputUsername": {"jdoe"}, "inputPassword": {"hunter2"}}
+	resp, err := client.PostForm(server+"/app", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	req, _ := http.NewRequest("GET", server+"/app;jsessionid=url-secret?service=page/UserSummary", nil)
+	req.AddCookie(&http.Cookie{Name: "JSESSIONID", Value: "cookie-secret"})
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+var secrets = []string{"url-secret", "cookie-secret", "ST-secret", "hunter2", "jdoe", "Jane Doe", "12.34"}
+
+func TestTraceRedacts(t *testing.T) {
+	srv := secretServer(t)
+	out := new(bytes.Buffer)
+	sendSecrets(t, &TraceTransport{Next: http.DefaultTransport, Out: out}, srv.URL)
+
+	trace := out.String()
+	for _, secret := range secrets {
+		if strings.Contains(trace, secret) {
+			t.Errorf("the trace contains %q:\n%s", secret, trace)
+		}
+	}
+	if !strings.Contains(trace, "< Location: /app;jsessionid="+url.PathEscape(redacted)) {
+		t.Errorf("the trace does not show the redirect:\n%s", trace)
+	}
+}
+
+func TestHARRedacts(t *testing.T) {
+	srv := secretServer(t)
+	path := filepath.Join(t.TempDir(), "session.har")
+	sendSecrets(t, &HARRecorder{Next: http.DefaultTransport, Path: path}, srv.URL)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	har := string(data)
+	for _, secret := range secrets {
+		if strings.Contains(har, secret) {
+			t.Errorf("the HAR file contains %q:\n%s", secret, har)
+		}
+	}
+	if !strings.Contains(har, `"redirectURL": "/app;jsessionid=`+url.PathEscape(redacted)) {
+		t.Errorf("the HAR file does not show the redirect:\n%s", har)
+	}
+}
@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+/*
+TransportConfig describes how to connect to PaperCut. The zero value
+behaves like http.DefaultTransport, taking proxies from the environment.
+*/
+type TransportConfig struct {
+	// CAFiles are PEM bundles trusted in addition to the system roots,
+	// such as the CA of an inspecting proxy.
+	CAFiles []string
+	// InsecureSkipVerify turns off certificate verification entirely.
+	InsecureSkipVerify bool
+	// ClientCert and ClientKey are the PEM files of a client certificate.
+	// ClientKey may be left empty when ClientCert holds both.
+	ClientCert string
+	ClientKey  string
+	// Proxy is an http, https or socks5 URL. When empty HTTPS_PROXY,
+	// HTTP_PROXY and NO_PROXY are used.
+	Proxy string
+	// NoProxy lists hosts that bypass Proxy, in the NO_PROXY format. It
+	// defaults to the NO_PROXY environment variable.
+	NoProxy string
+}
+
+// NewTransport returns a transport for talking to PaperCut configured by
+// config.
+func NewTransport(config TransportConfig) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	proxy, err := config.proxy()
+	if err != nil {
+		return nil, err
+	}
+	transport.Proxy = proxy
+
+	return transport, nil
+}
+
+func (c TransportConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+
+	if len(c.CAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		for _, file := range c.CAFiles {
+			pem, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, errors.New(file + ": no PEM certificates found")
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.ClientCert != "" {
+		key := c.ClientKey
+		if key == "" {
+			key = c.ClientCert
+		}
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, key)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	} else if c.ClientKey != "" {
+		return nil, errors.New("a client key was given without a client certificate")
+	}
+
+	return tlsConfig, nil
+}
+
+func (c TransportConfig) proxy() (func(*http.Request) (*url.URL, error), error) {
+	if c.Proxy == "" {
+		if c.NoProxy == "" {
+			return http.ProxyFromEnvironment, nil
+		}
+		env := httpproxy.FromEnvironment()
+		env.NoProxy = c.NoProxy
+		return proxyFunc(env), nil
+	}
+
+	u, err := url.Parse(c.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: %v", err)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("proxy %s: scheme must be http, https or socks5", c.Proxy)
+	}
+
+	noProxy := c.NoProxy
+	if noProxy == "" {
+		noProxy = firstEnv("NO_PROXY", "no_proxy")
+	}
+
+	return proxyFunc(&httpproxy.Config{HTTPProxy: c.Proxy, HTTPSProxy: c.Proxy, NoProxy: noProxy}), nil
+}
+
+func proxyFunc(config *httpproxy.Config) func(*http.Request) (*url.URL, error) {
+	proxyURL := config.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxyURL(req.URL)
+	}
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,227 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePEM writes blocks to a new file called name in dir.
+func writePEM(t *testing.T, dir string, name string, blocks ...*pem.Block) string {
+	t.Helper()
+	var data []byte
+	for _, block := range blocks {
+		data = append(data, pem.EncodeToMemory(block)...)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// get fetches url with a transport configured by config.
+func get(config TransportConfig, url string) error {
+	transport, err := NewTransport(config)
+	if err != nil {
+		return err
+	}
+	defer transport.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: transport, Timeout: 5 * time.Second}).Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func TestTransportCAFile(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	dir := t.TempDir()
+	ca := writePEM(t, dir, "ca.pem", &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	if err := get(TransportConfig{}, srv.URL); err == nil {
+		t.Error("a server with an unknown CA was trusted")
+	}
+	if err := get(TransportConfig{CAFiles: []string{ca}}, srv.URL); err != nil {
+		t.Errorf("with the CA file: %v", err)
+	}
+	if err := get(TransportConfig{InsecureSkipVerify: true}, srv.URL); err != nil {
+		t.Errorf("without verification: %v", err)
+	}
+
+	notPEM := filepath.Join(dir, "ca.txt")
+	ioutil.WriteFile(notPEM, []byte("not a certificate\n"), 0600)
+	for _, files := range [][]string{
+		{notPEM},
+		{ca, notPEM},
+		{filepath.Join(dir, "missing.pem")},
+	} {
+		if _, err := NewTransport(TransportConfig{CAFiles: files}); err == nil {
+			t.Errorf("CA files %q were accepted", files)
+		}
+	}
+}
+
+// newClientCert returns the PEM blocks of a self-signed client certificate
+// and its key.
+func newClientCert(t *testing.T) (*pem.Block, *pem.Block) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "jdoe"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &pem.Block{Type: "CERTIFICATE", Bytes: cert}, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+}
+
+func TestTransportClientCert(t *testing.T) {
+	var user string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user = r.TLS.PeerCertificates[0].Subject.CommonName
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	certBlock, keyBlock := newClientCert(t)
+	cert := writePEM(t, dir, "cert.pem", certBlock)
+	key := writePEM(t, dir, "key.pem", keyBlock)
+	both := writePEM(t, dir, "both.pem", certBlock, keyBlock)
+
+	if err := get(TransportConfig{InsecureSkipVerify: true}, srv.URL); err == nil {
+		t.Error("the server let a client without a certificate in")
+	}
+	for _, config := range []TransportConfig{
+		{InsecureSkipVerify: true, ClientCert: cert, ClientKey: key},
+		{InsecureSkipVerify: true, ClientCert: both},
+	} {
+		user = ""
+		if err := get(config, srv.URL); err != nil {
+			t.Errorf("client certificate %s, key %q: %v", filepath.Base(config.ClientCert), config.ClientKey, err)
+		} else if user != "jdoe" {
+			t.Errorf("the server saw client %q, want jdoe", user)
+		}
+	}
+
+	for _, config := range []TransportConfig{
+		{ClientKey: key},
+		{ClientCert: cert},
+		{ClientCert: key, ClientKey: cert},
+		{ClientCert: filepath.Join(dir, "missing.pem"), ClientKey: key},
+	} {
+		if _, err := NewTransport(config); err == nil {
+			t.Errorf("client certificate %q with key %q was accepted", config.ClientCert, config.ClientKey)
+		}
+	}
+}
+
+// proxyFor returns the proxy the transport configured by config uses for
+// url, or "" for none.
+func proxyFor(t *testing.T, config TransportConfig, url string) string {
+	t.Helper()
+	transport, err := NewTransport(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", url, nil)
+	proxy, err := transport.Proxy(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxy == nil {
+		return ""
+	}
+	return proxy.String()
+}
+
+// clearProxyEnv empties the proxy variables for the test.
+func clearProxyEnv(t *testing.T) {
+	for _, name := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy", "NO_PROXY", "no_proxy"} {
+		t.Setenv(name, "")
+	}
+}
+
+func TestTransportProxy(t *testing.T) {
+	clearProxyEnv(t)
+
+	tests := []struct {
+		config TransportConfig
+		url    string
+		want   string
+	}{
+		{TransportConfig{Proxy: "http://proxy.gonzaga.edu:3128"}, "https://paper-app.gonzaga.edu:9192/app", "http://proxy.gonzaga.edu:3128"},
+		{TransportConfig{Proxy: "http://proxy.gonzaga.edu:3128"}, "http://paper-app.gonzaga.edu:9191/app", "http://proxy.gonzaga.edu:3128"},
+		{TransportConfig{Proxy: "socks5://127.0.0.1:1080"}, "https://paper-app.gonzaga.edu:9192/app", "socks5://127.0.0.1:1080"},
+		{TransportConfig{Proxy: "SOCKS5H://127.0.0.1:1080"}, "https://paper-app.gonzaga.edu:9192/app", "socks5h://127.0.0.1:1080"},
+		{TransportConfig{Proxy: "http://proxy.gonzaga.edu:3128", NoProxy: "gonzaga.edu"}, "https://paper-app.gonzaga.edu:9192/app", ""},
+		{TransportConfig{Proxy: "http://proxy.gonzaga.edu:3128", NoProxy: "gonzaga.edu"}, "https://print.partner.edu/app", "http://proxy.gonzaga.edu:3128"},
+		{TransportConfig{Proxy: "http://proxy.gonzaga.edu:3128", NoProxy: "10.0.0.0/8, .partner.edu"}, "https://10.1.2.3:9192/app", ""},
+		{TransportConfig{Proxy: "http://proxy.gonzaga.edu:3128", NoProxy: "10.0.0.0/8, .partner.edu"}, "https://print.partner.edu/app", ""},
+	}
+
+	for _, test := range tests {
+		if got := proxyFor(t, test.config, test.url); got != test.want {
+			t.Errorf("proxy %q, no proxy %q: %s goes through %q, want %q",
+				test.config.Proxy, test.config.NoProxy, test.url, got, test.want)
+		}
+	}
+
+	for _, proxy := range []string{"ftp://proxy.gonzaga.edu", "proxy.gonzaga.edu:3128", "http://proxy .gonzaga.edu"} {
+		if _, err := NewTransport(TransportConfig{Proxy: proxy}); err == nil {
+			t.Errorf("proxy %q was accepted", proxy)
+		}
+	}
+}
+
+func TestTransportProxyEnvironment(t *testing.T) {
+	clearProxyEnv(t)
+	t.Setenv("NO_PROXY", "gonzaga.edu")
+
+	// NO_PROXY also applies to a configured proxy, unless NoProxy is set.
+	config := TransportConfig{Proxy: "http://proxy.gonzaga.edu:3128"}
+	if got := proxyFor(t, config, "https://paper-app.gonzaga.edu:9192/app"); got != "" {
+		t.Errorf("NO_PROXY host goes through %q", got)
+	}
+	config.NoProxy = "partner.edu"
+	if got := proxyFor(t, config, "https://paper-app.gonzaga.edu:9192/app"); got != "http://proxy.gonzaga.edu:3128" {
+		t.Errorf("with NoProxy set, NO_PROXY host goes through %q, want the proxy", got)
+	}
+
+	// NoProxy also applies to the proxy from the environment.
+	t.Setenv("HTTPS_PROXY", "http://env-proxy.gonzaga.edu:8080")
+	config = TransportConfig{NoProxy: "partner.edu"}
+	if got := proxyFor(t, config, "https://print.partner.edu/app"); got != "" {
+		t.Errorf("NoProxy host goes through %q", got)
+	}
+	if got := proxyFor(t, config, "https://paper-app.gonzaga.edu:9192/app"); got != "http://env-proxy.gonzaga.edu:8080" {
+		t.Errorf("other hosts go through %q, want HTTPS_PROXY", got)
+	}
+}